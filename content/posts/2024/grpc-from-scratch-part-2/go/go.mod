@@ -5,7 +5,13 @@ go 1.21.7
 require (
 	connectrpc.com/connect v1.14.0
 	golang.org/x/net v0.21.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240123012728-ef4313101c80
+	google.golang.org/grpc v1.62.1
 	google.golang.org/protobuf v1.32.0
 )
 
-require golang.org/x/text v0.14.0 // indirect
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// EncodingHeader names the compression used for the messages a peer
+	// sends with their compressed flag set.
+	EncodingHeader = "Grpc-Encoding"
+	// AcceptEncodingHeader lists the compressions a peer can decompress.
+	AcceptEncodingHeader = "Grpc-Accept-Encoding"
+)
+
+// Identity is the encoding of uncompressed messages.
+const Identity = "identity"
+
+// Encoding returns the encoding set in h, or Identity if there is none.
+func Encoding(h http.Header) string {
+	if encoding := strings.TrimSpace(h.Get(EncodingHeader)); encoding != "" {
+		return encoding
+	}
+	return Identity
+}
+
+// AcceptEncodings returns the encodings listed in h's grpc-accept-encoding.
+// The header may be repeated, and each one is a comma separated list.
+func AcceptEncodings(h http.Header) []string {
+	var encodings []string
+	for _, value := range h.Values(AcceptEncodingHeader) {
+		for _, encoding := range strings.Split(value, ",") {
+			if encoding = strings.TrimSpace(encoding); encoding != "" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Metadata is the custom key-value data sent along with an RPC: request
+// headers from the client, and response headers and trailers from the
+// server. Keys are lowercase. Keys ending in "-bin" hold binary values,
+// which are base64 encoded on the wire; in Metadata they're the raw bytes.
+type Metadata map[string][]string
+
+// Append adds values to key.
+func (md Metadata) Append(key string, values ...string) {
+	key = strings.ToLower(key)
+	md[key] = append(md[key], values...)
+}
+
+// Get returns the first value of key, or "" if there is none.
+func (md Metadata) Get(key string) string {
+	if values := md[strings.ToLower(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// reserved reports whether a header belongs to the protocol rather than the
+// application, so it isn't metadata.
+func reserved(key string) bool {
+	switch key {
+	case "content-type", "te", "user-agent", "trailer", "content-length", "connection", "host",
+		"accept-encoding", "content-encoding", "x-user-agent", "x-grpc-web":
+		return true
+	}
+	return strings.HasPrefix(key, "grpc-") || strings.HasPrefix(key, "connect-")
+}
+
+// SetHeader adds md to h, base64 encoding the values of binary keys.
+// Reserved keys, like content-type or anything starting with grpc-, are
+// skipped. Use http.TrailerPrefix as prefix to send metadata as trailers
+// from a handler, or "" otherwise.
+func (md Metadata) SetHeader(h http.Header, prefix string) {
+	for key, values := range md {
+		key = strings.ToLower(key)
+		if reserved(key) {
+			continue
+		}
+		for _, value := range values {
+			if strings.HasSuffix(key, "-bin") {
+				// Padding is optional, and the spec asks for none.
+				value = base64.RawStdEncoding.EncodeToString([]byte(value))
+			}
+			h.Add(prefix+key, value)
+		}
+	}
+}
+
+// MetadataFromHeader collects the metadata in h, leaving out reserved
+// headers. Binary values are decoded; ones that aren't valid base64 are an
+// InvalidArgument error.
+func MetadataFromHeader(h http.Header) (Metadata, error) {
+	md := make(Metadata)
+	for key, values := range h {
+		key = strings.ToLower(key)
+		if reserved(key) {
+			continue
+		}
+		binary := strings.HasSuffix(key, "-bin")
+		for _, value := range values {
+			if !binary {
+				md[key] = append(md[key], value)
+				continue
+			}
+			// Several binary values may also be joined with commas
+			// into one header.
+			for _, part := range strings.Split(value, ",") {
+				raw, err := decodeBinary(strings.TrimSpace(part))
+				if err != nil {
+					return nil, Errorf(InvalidArgument, "invalid base64 in metadata %s: %v", key, err)
+				}
+				md[key] = append(md[key], string(raw))
+			}
+		}
+	}
+	return md, nil
+}
+
+// decodeBinary decodes the value of a -bin header, which may or may not be
+// padded.
+func decodeBinary(value string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+}
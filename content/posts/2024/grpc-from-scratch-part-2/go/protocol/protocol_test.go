@@ -0,0 +1,195 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	tests := []struct {
+		msg, encoded string
+	}{
+		{"plain message", "plain message"},
+		{"100% done", "100%25 done"},
+		{"line\nbreak", "line%0Abreak"},
+		{"héllo ✓", "h%C3%A9llo %E2%9C%93"},
+	}
+	for _, tt := range tests {
+		if got := EncodeMessage(tt.msg); got != tt.encoded {
+			t.Errorf("EncodeMessage(%q) = %q, want %q", tt.msg, got, tt.encoded)
+		}
+		if got := DecodeMessage(tt.encoded); got != tt.msg {
+			t.Errorf("DecodeMessage(%q) = %q, want %q", tt.encoded, got, tt.msg)
+		}
+	}
+	// Broken escapes are kept as they are.
+	if got := DecodeMessage("50%% off %zz%4"); got != "50%% off %zz%4" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestStatusTrailers(t *testing.T) {
+	detail, err := anypb.New(durationpb.New(3 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Status{Code: ResourceExhausted, Message: "slow down: 100% used", Details: []*anypb.Any{detail}}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "body")
+		// Flushing makes HTTP/1.1 use chunked encoding, which has room
+		// for trailers.
+		w.(http.Flusher).Flush()
+		want.SetTrailer(w.Header())
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if got := resp.Trailer.Get(MessageHeader); got != "slow down: 100%25 used" {
+		t.Errorf("got grpc-message %q", got)
+	}
+
+	got := StatusFromTrailer(resp.Trailer)
+	if got.Code != want.Code || got.Message != want.Message || len(got.Details) != 1 || !proto.Equal(got.Details[0], detail) {
+		t.Errorf("got status %+v, want %+v", got, want)
+	}
+}
+
+func TestStatusFromTrailerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		trailer http.Header
+		want    Code
+	}{
+		{"missing", http.Header{}, Internal},
+		{"not a number", http.Header{StatusHeader: {"ok"}}, Internal},
+		{"bad details", http.Header{StatusHeader: {"5"}, StatusDetailsHeader: {"!!"}}, Internal},
+		{"not found", http.Header{StatusHeader: {"5"}}, NotFound},
+		{"unknown code", http.Header{StatusHeader: {"42"}}, 42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StatusFromTrailer(tt.trailer); got.Code != tt.want {
+				t.Errorf("got %s, want %s", got.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	if got := FromError(ctx.Err()).Code; got != DeadlineExceeded {
+		t.Errorf("got %s for an expired context", got)
+	}
+	if got := FromError(io.ErrUnexpectedEOF).Code; got != Unknown {
+		t.Errorf("got %s for a plain error", got)
+	}
+	if FromError(nil).Err() != nil {
+		t.Error("nil error didn't turn into OK")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		d       time.Duration
+		encoded string
+	}{
+		{0, "0n"},
+		{150 * time.Millisecond, "150000u"},
+		{99 * time.Millisecond, "99000000n"},
+		{2 * time.Second, "2000000u"},
+		{2*time.Second + 1, "2000001u"}, // rounded up
+		{30 * time.Minute, "1800000m"},
+		{48 * time.Hour, "172800S"},
+	}
+	for _, tt := range tests {
+		if got := EncodeTimeout(tt.d); got != tt.encoded {
+			t.Errorf("EncodeTimeout(%v) = %q, want %q", tt.d, got, tt.encoded)
+		}
+	}
+	for _, s := range []string{"1H", "60M", "3600S", "3600000m"} {
+		if got, err := DecodeTimeout(s); err != nil || got != time.Hour {
+			t.Errorf("DecodeTimeout(%q) = %v, %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "S", "10", "10s", "123456789S", "-1S"} {
+		if _, err := DecodeTimeout(s); err == nil {
+			t.Errorf("DecodeTimeout(%q) succeeded", s)
+		}
+	}
+}
+
+func TestContextWithTimeout(t *testing.T) {
+	client, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	SetTimeout(client, r.Header)
+
+	ctx, cancel, err := ContextWithTimeout(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if left := time.Until(deadline); !ok || left > time.Minute || left < 59*time.Second {
+		t.Errorf("server deadline is %v away, want about a minute", left)
+	}
+
+	r.Header.Set(TimeoutHeader, "soon")
+	if _, _, err := ContextWithTimeout(r); FromError(err).Code != InvalidArgument {
+		t.Errorf("got error %v for a malformed timeout", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	md := Metadata{}
+	md.Append("X-Request-Id", "abc")
+	md.Append("trace-bin", "\x00\xff\x10")
+	md.Append("grpc-status", "0") // reserved, so never sent
+	h := make(http.Header)
+	md.SetHeader(h, "")
+	if got := h.Get("Trace-Bin"); got != "AP8Q" {
+		t.Errorf("binary value encoded as %q, want unpadded base64", got)
+	}
+	if h.Get(StatusHeader) != "" {
+		t.Error("reserved key was sent as metadata")
+	}
+
+	// Both padded and unpadded values, also joined with commas, are
+	// accepted.
+	h.Add("Other-Bin", "AQ==, Ag")
+	h.Set("Content-Type", "application/grpc")
+	got, err := MetadataFromHeader(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("x-request-id") != "abc" || got.Get("trace-bin") != "\x00\xff\x10" {
+		t.Errorf("got metadata %q", got)
+	}
+	if other := got["other-bin"]; len(other) != 2 || other[0] != "\x01" || other[1] != "\x02" {
+		t.Errorf("got other-bin %q", other)
+	}
+	if _, ok := got["content-type"]; ok {
+		t.Error("content-type is not metadata")
+	}
+
+	h.Set("Broken-Bin", "not base64!")
+	if _, err := MetadataFromHeader(h); FromError(err).Code != InvalidArgument {
+		t.Errorf("got error %v for invalid base64", err)
+	}
+}
@@ -0,0 +1,309 @@
+// Package protocol implements the parts of gRPC over HTTP/2 that live in
+// headers and trailers instead of the message envelope: status codes and
+// messages, error details, deadlines and custom metadata. See
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md for the
+// spec and https://github.com/grpc/grpc/blob/master/doc/statuscodes.md for
+// the status codes.
+package protocol
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const (
+	StatusHeader        = "Grpc-Status"
+	MessageHeader       = "Grpc-Message"
+	StatusDetailsHeader = "Grpc-Status-Details-Bin"
+)
+
+// Code is a gRPC status code.
+type Code uint32
+
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	DeadlineExceeded   Code = 4
+	NotFound           Code = 5
+	AlreadyExists      Code = 6
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Aborted            Code = 10
+	OutOfRange         Code = 11
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unavailable        Code = 14
+	DataLoss           Code = 15
+	Unauthenticated    Code = 16
+)
+
+var codeNames = [...]string{
+	OK:                 "OK",
+	Canceled:           "CANCELLED",
+	Unknown:            "UNKNOWN",
+	InvalidArgument:    "INVALID_ARGUMENT",
+	DeadlineExceeded:   "DEADLINE_EXCEEDED",
+	NotFound:           "NOT_FOUND",
+	AlreadyExists:      "ALREADY_EXISTS",
+	PermissionDenied:   "PERMISSION_DENIED",
+	ResourceExhausted:  "RESOURCE_EXHAUSTED",
+	FailedPrecondition: "FAILED_PRECONDITION",
+	Aborted:            "ABORTED",
+	OutOfRange:         "OUT_OF_RANGE",
+	Unimplemented:      "UNIMPLEMENTED",
+	Internal:           "INTERNAL",
+	Unavailable:        "UNAVAILABLE",
+	DataLoss:           "DATA_LOSS",
+	Unauthenticated:    "UNAUTHENTICATED",
+}
+
+func (c Code) String() string {
+	if int(c) < len(codeNames) {
+		return codeNames[c]
+	}
+	return "CODE(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// CodeFromHTTPStatus maps the HTTP status of a response that isn't a gRPC
+// response at all, like an error page from a proxy, to a gRPC code. See
+// https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func CodeFromHTTPStatus(status int) Code {
+	switch status {
+	case http.StatusBadRequest:
+		return Internal
+	case http.StatusUnauthorized:
+		return Unauthenticated
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Unavailable
+	}
+	return Unknown
+}
+
+// Status is how an RPC ended. It's also an error, so handlers can return
+// one and clients get one back.
+type Status struct {
+	Code    Code
+	Message string
+	// Details carry extra information about an error, e.g. the messages
+	// from google/rpc/error_details.proto.
+	Details []*anypb.Any
+}
+
+// Errorf returns a Status with the given code and a formatted message.
+func Errorf(code Code, format string, args ...any) *Status {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (s *Status) Error() string {
+	if s.Message == "" {
+		return "rpc error: code = " + s.Code.String()
+	}
+	return "rpc error: code = " + s.Code.String() + " desc = " + s.Message
+}
+
+// Err returns s as an error, or nil if the code is OK.
+func (s *Status) Err() error {
+	if s.Code == OK {
+		return nil
+	}
+	return s
+}
+
+// FromError turns any error into a Status. A *Status anywhere in the chain
+// is used as is, and context errors get their matching codes. Everything
+// else is Unknown.
+func FromError(err error) *Status {
+	var s *Status
+	switch {
+	case err == nil:
+		return &Status{Code: OK}
+	case errors.As(err, &s):
+		return s
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Status{Code: DeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &Status{Code: Canceled, Message: err.Error()}
+	}
+	return &Status{Code: Unknown, Message: err.Error()}
+}
+
+// SetTrailer writes the status into h as grpc-status, grpc-message and, if
+// there are details, grpc-status-details-bin. In a handler, pass
+// w.Header(); the names get http.TrailerPrefix, so they're sent as
+// trailers without having to be declared up front.
+func (s *Status) SetTrailer(h http.Header) {
+	s.SetHeader(h, http.TrailerPrefix)
+}
+
+// SetHeader is SetTrailer with the prefix of the names up to the caller. A
+// handler that fails before writing anything can send the status in the
+// headers, with no prefix, as a Trailers-Only response.
+func (s *Status) SetHeader(h http.Header, prefix string) {
+	h.Set(prefix+StatusHeader, strconv.FormatUint(uint64(s.Code), 10))
+	if s.Message != "" {
+		h.Set(prefix+MessageHeader, EncodeMessage(s.Message))
+	}
+	if len(s.Details) > 0 {
+		h.Set(prefix+StatusDetailsHeader, base64.RawStdEncoding.EncodeToString(s.marshal()))
+	}
+}
+
+// StatusFromTrailer reads the status of an RPC from its trailers. A server
+// that fails before sending any message may put the status in the headers
+// instead (a "Trailers-Only" response), so pass those when the trailers
+// have none. A missing or malformed status is reported as an Internal
+// error, since the RPC can't be assumed to have worked.
+func StatusFromTrailer(h http.Header) *Status {
+	value := h.Get(StatusHeader)
+	if value == "" {
+		return Errorf(Internal, "server sent no grpc-status")
+	}
+	code, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return Errorf(Internal, "invalid grpc-status %q", value)
+	}
+	s := &Status{Code: Code(code), Message: DecodeMessage(h.Get(MessageHeader))}
+	if details := h.Get(StatusDetailsHeader); details != "" {
+		raw, err := decodeBinary(details)
+		if err != nil {
+			return Errorf(Internal, "invalid grpc-status-details-bin: %v", err)
+		}
+		// The details header is the whole google.rpc.Status, and takes
+		// precedence over the other two.
+		if err := s.unmarshal(raw); err != nil {
+			return Errorf(Internal, "invalid grpc-status-details-bin: %v", err)
+		}
+	}
+	return s
+}
+
+// EncodeMessage percent-encodes a status message. Anything outside of
+// printable ASCII, and "%" itself, becomes %XX so that arbitrary UTF-8
+// survives as a header value.
+func EncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// DecodeMessage undoes EncodeMessage. A "%" that isn't followed by two hex
+// digits is kept as it is rather than throwing the message away, as the
+// spec asks.
+func DecodeMessage(msg string) string {
+	if !strings.Contains(msg, "%") {
+		return msg
+	}
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if v, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
+
+// marshal encodes s as a google.rpc.Status message:
+//
+//	message Status {
+//	  int32 code = 1;
+//	  string message = 2;
+//	  repeated google.protobuf.Any details = 3;
+//	}
+//
+// It's small enough to encode by hand. genproto is only a test dependency,
+// used to check that grpc-go reads what we write and the other way around.
+func (s *Status) marshal() []byte {
+	var b []byte
+	if s.Code != OK {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(s.Code))
+	}
+	if s.Message != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, s.Message)
+	}
+	for _, detail := range s.Details {
+		msg, err := proto.Marshal(detail)
+		if err != nil {
+			continue
+		}
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b
+}
+
+// unmarshal decodes a google.rpc.Status message into s. Unknown fields are
+// skipped.
+func (s *Status) unmarshal(b []byte) error {
+	*s = Status{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			s.Code = Code(int32(v))
+			b = b[n:]
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			s.Message = v
+			b = b[n:]
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			detail := &anypb.Any{}
+			if err := proto.Unmarshal(v, detail); err != nil {
+				return err
+			}
+			s.Details = append(s.Details, detail)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
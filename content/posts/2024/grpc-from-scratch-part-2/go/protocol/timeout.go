@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const TimeoutHeader = "Grpc-Timeout"
+
+// maxTimeoutValue is the largest number grpc-timeout allows: at most 8
+// digits, followed by a unit.
+const maxTimeoutValue = 99_999_999
+
+var timeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+// EncodeTimeout formats d for the grpc-timeout header, using the finest unit
+// the value fits into. It rounds up, so the server never gives up before
+// the client does.
+func EncodeTimeout(d time.Duration) string {
+	if d <= 0 {
+		// Already expired, but 0 is still a valid timeout.
+		return "0n"
+	}
+	for _, u := range timeoutUnits {
+		value := (d + u.d - 1) / u.d
+		if value <= maxTimeoutValue {
+			return strconv.FormatInt(int64(value), 10) + string(u.unit)
+		}
+	}
+	return strconv.Itoa(maxTimeoutValue) + "H"
+}
+
+// DecodeTimeout parses a grpc-timeout header value.
+func DecodeTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, errors.New("invalid grpc-timeout " + strconv.Quote(s))
+	}
+	value, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid grpc-timeout " + strconv.Quote(s))
+	}
+	for _, u := range timeoutUnits {
+		if u.unit != s[len(s)-1] {
+			continue
+		}
+		if time.Duration(value) > time.Duration(1<<63-1)/u.d {
+			// Hours of this size don't fit in a Duration, and are as
+			// good as no timeout at all.
+			return time.Duration(1<<63 - 1), nil
+		}
+		return time.Duration(value) * u.d, nil
+	}
+	return 0, errors.New("invalid grpc-timeout unit in " + strconv.Quote(s))
+}
+
+// SetTimeout sets grpc-timeout in h to the time left until ctx's deadline,
+// if it has one. Clients call it on their request headers.
+func SetTimeout(ctx context.Context, h http.Header) {
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Set(TimeoutHeader, EncodeTimeout(time.Until(deadline)))
+	}
+}
+
+// ContextWithTimeout returns a context for serving r that's cancelled once
+// the timeout the client asked for with grpc-timeout runs out. Without the
+// header, it's just r's context. A malformed header is an InvalidArgument
+// error.
+func ContextWithTimeout(r *http.Request) (context.Context, context.CancelFunc, error) {
+	value := r.Header.Get(TimeoutHeader)
+	if value == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	timeout, err := DecodeTimeout(value)
+	if err != nil {
+		return nil, nil, Errorf(InvalidArgument, "%v", err)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
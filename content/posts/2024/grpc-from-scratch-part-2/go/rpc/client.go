@@ -0,0 +1,403 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+)
+
+// Client calls procedures on a gRPC server.
+type Client struct {
+	// HTTPClient has to speak HTTP/2, e.g. with an http2.Transport. Only
+	// HTTP/2 lets the request and the response stream at the same time.
+	HTTPClient *http.Client
+	// BaseURL is where the server is, like http://127.0.0.1:9000.
+	BaseURL string
+	// Compression is the grpc-encoding of the messages we send, like
+	// "gzip". Empty sends them uncompressed. Responses can use any
+	// registered compressor either way.
+	Compression string
+}
+
+// clientStream is the client's end of one call, whatever its kind. The
+// request body is a pipe: every send writes a message into it and
+// CloseSend closes it, which is what ends our half of the stream. The
+// response body is read by recv as the messages arrive, and the status
+// comes in the trailers once it has been read to the end.
+type clientStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	pw     *io.PipeWriter
+
+	// sendComp compresses our messages and recvComp decompresses the
+	// server's, once ready is closed. Either is nil for uncompressed
+	// messages.
+	sendComp, recvComp Compressor
+
+	// ready is closed once the response headers have arrived or the call
+	// has failed without any. resp and header are set before that.
+	ready  chan struct{}
+	resp   *http.Response
+	header protocol.Metadata
+
+	// err is how the stream ended: io.EOF if it finished with status OK,
+	// the status otherwise. Only recv sets it after ready is closed.
+	err     error
+	trailer protocol.Metadata
+}
+
+// newClientStream starts a call. The request goes out right away, while the
+// caller sends the messages.
+func newClientStream(ctx context.Context, c *Client, procedure string, md protocol.Metadata) (*clientStream, error) {
+	encoding := c.Compression
+	if encoding == "" {
+		encoding = protocol.Identity
+	}
+	sendComp, ok := compressorFor(encoding)
+	if !ok {
+		return nil, protocol.Errorf(protocol.Internal, "no compressor registered for %q", encoding)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	url := strings.TrimSuffix(c.BaseURL, "/") + "/" + strings.TrimPrefix(procedure, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		cancel()
+		return nil, protocol.Errorf(protocol.Internal, "http request failure: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	if sendComp != nil {
+		req.Header.Set(protocol.EncodingHeader, encoding)
+	}
+	req.Header.Set(protocol.AcceptEncodingHeader, acceptEncoding())
+	protocol.SetTimeout(ctx, req.Header)
+	md.SetHeader(req.Header, "")
+
+	cs := &clientStream{ctx: ctx, cancel: cancel, pw: pw, sendComp: sendComp, ready: make(chan struct{})}
+	go func() {
+		defer close(cs.ready)
+		if err := cs.start(c.HTTPClient, req); err != nil {
+			cs.err = err
+			// Sends still blocked on the pipe give up with io.EOF, and
+			// Recv reports the error.
+			pr.CloseWithError(io.EOF)
+			cs.cancel()
+		}
+	}()
+	return cs, nil
+}
+
+// start sends the request and checks the response headers.
+func (cs *clientStream) start(httpClient *http.Client, req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return cs.ctxErr(protocol.Errorf(protocol.Unavailable, "http failure: %v", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Not a gRPC response, maybe an error page from a proxy.
+		resp.Body.Close()
+		return protocol.Errorf(protocol.CodeFromHTTPStatus(resp.StatusCode), "unexpected HTTP status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/grpc") {
+		resp.Body.Close()
+		return protocol.Errorf(protocol.Unknown, "unexpected content-type %q", ct)
+	}
+	md, err := protocol.MetadataFromHeader(resp.Header)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	if resp.Header.Get(protocol.StatusHeader) != "" {
+		// A Trailers-Only response: there are no messages, and the
+		// headers are the trailers.
+		resp.Body.Close()
+		cs.header, cs.trailer = protocol.Metadata{}, md
+		return statusErr(protocol.StatusFromTrailer(resp.Header))
+	}
+	encoding := protocol.Encoding(resp.Header)
+	recvComp, ok := compressorFor(encoding)
+	if !ok {
+		resp.Body.Close()
+		return protocol.Errorf(protocol.Internal, "unsupported grpc-encoding %q", encoding)
+	}
+	cs.resp, cs.header, cs.recvComp = resp, md, recvComp
+	return nil
+}
+
+// ctxErr returns the context's error as a status if the context is what
+// ended the call, and err otherwise.
+func (cs *clientStream) ctxErr(err error) error {
+	if ctxErr := cs.ctx.Err(); ctxErr != nil {
+		return protocol.FromError(ctxErr)
+	}
+	return err
+}
+
+// statusErr turns the final status of a stream into what recv returns.
+func statusErr(s *protocol.Status) error {
+	if s.Code == protocol.OK {
+		return io.EOF
+	}
+	return s
+}
+
+// send writes a message to the server. If the call is already over, it
+// returns io.EOF, and recv has the reason.
+func (cs *clientStream) send(msg any) error {
+	m, err := asMessage(msg)
+	if err != nil {
+		return err
+	}
+	err = writeMessage(cs.pw, m, cs.sendComp)
+	var status *protocol.Status
+	if err != nil && !errors.As(err, &status) {
+		return io.EOF
+	}
+	return err
+}
+
+// CloseSend tells the server we won't send any more messages. The response
+// can still be read.
+func (cs *clientStream) CloseSend() error {
+	return cs.pw.Close()
+}
+
+// recv reads the next message into msg. At the end of the stream it returns
+// io.EOF if the status is OK and the status otherwise, every time it's
+// called from then on.
+func (cs *clientStream) recv(msg any) error {
+	m, err := asMessage(msg)
+	if err != nil {
+		return err
+	}
+	<-cs.ready
+	if cs.err != nil {
+		return cs.err
+	}
+	err = readMessage(cs.resp.Body, m, cs.recvComp)
+	if err == nil {
+		return nil
+	}
+	var status *protocol.Status
+	switch {
+	case err == io.EOF:
+		cs.err = cs.finish()
+	case errors.As(err, &status):
+		cs.err = status
+	default:
+		cs.err = cs.ctxErr(protocol.Errorf(protocol.Internal, "%v", err))
+	}
+	cs.resp.Body.Close()
+	cs.pw.CloseWithError(io.EOF)
+	cs.cancel()
+	return cs.err
+}
+
+// finish reads the status and metadata from the trailers, once the body
+// has been read to the end.
+func (cs *clientStream) finish() error {
+	md, err := protocol.MetadataFromHeader(cs.resp.Trailer)
+	if err != nil {
+		return err
+	}
+	cs.trailer = md
+	return statusErr(protocol.StatusFromTrailer(cs.resp.Trailer))
+}
+
+// Header returns the metadata the server sent with its response headers,
+// waiting for them if needed.
+func (cs *clientStream) Header() (protocol.Metadata, error) {
+	<-cs.ready
+	if cs.header == nil {
+		return nil, cs.err
+	}
+	return cs.header, nil
+}
+
+// Trailer returns the metadata the server sent with its trailers. It's
+// only complete once Recv has returned an error.
+func (cs *clientStream) Trailer() protocol.Metadata {
+	return cs.trailer
+}
+
+// recvLast reads the one message of a response and makes sure nothing but
+// the status follows.
+func (cs *clientStream) recvLast(msg any) error {
+	if err := cs.recv(msg); err != nil {
+		if err == io.EOF {
+			return protocol.Errorf(protocol.Internal, "server sent no response message")
+		}
+		return err
+	}
+	if err := cs.recv(msg); err != io.EOF {
+		if err == nil {
+			return protocol.Errorf(protocol.Internal, "server sent more than one response message")
+		}
+		return err
+	}
+	return nil
+}
+
+// Unary calls a procedure that takes one message and returns one. The
+// metadata the server sent, from its headers and trailers, is returned
+// along with the response. A failed call returns a *protocol.Status.
+func Unary[Req, Res any](ctx context.Context, c *Client, procedure string, md protocol.Metadata, req *Req) (*Res, protocol.Metadata, error) {
+	cs, err := newClientStream(ctx, c, procedure, md)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cs.send(req); err != nil && err != io.EOF {
+		cs.cancel()
+		return nil, nil, err
+	}
+	cs.CloseSend()
+	res := new(Res)
+	err = cs.recvLast(res)
+	respMD := protocol.Metadata{}
+	maps.Copy(respMD, cs.header)
+	maps.Copy(respMD, cs.trailer)
+	if err != nil {
+		return nil, respMD, err
+	}
+	return res, respMD, nil
+}
+
+// ClientStreamingClient is the client's end of an RPC that sends many
+// messages and gets one response.
+type ClientStreamingClient[Req, Res any] struct {
+	cs *clientStream
+}
+
+// NewClientStream starts a client streaming call.
+func NewClientStream[Req, Res any](ctx context.Context, c *Client, procedure string, md protocol.Metadata) (*ClientStreamingClient[Req, Res], error) {
+	cs, err := newClientStream(ctx, c, procedure, md)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientStreamingClient[Req, Res]{cs: cs}, nil
+}
+
+// Send sends a message. It returns io.EOF if the call is already over;
+// CloseAndRecv tells why.
+func (s *ClientStreamingClient[Req, Res]) Send(msg *Req) error {
+	return s.cs.send(msg)
+}
+
+// CloseAndRecv closes our half of the stream and waits for the response.
+func (s *ClientStreamingClient[Req, Res]) CloseAndRecv() (*Res, error) {
+	s.cs.CloseSend()
+	res := new(Res)
+	if err := s.cs.recvLast(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Header returns the metadata from the response headers.
+func (s *ClientStreamingClient[Req, Res]) Header() (protocol.Metadata, error) {
+	return s.cs.Header()
+}
+
+// Trailer returns the metadata from the trailers, once CloseAndRecv has
+// returned.
+func (s *ClientStreamingClient[Req, Res]) Trailer() protocol.Metadata {
+	return s.cs.Trailer()
+}
+
+// ServerStreamingClient is the client's end of an RPC that sends one
+// message and gets a stream of responses. Cancel the context to stop
+// early.
+type ServerStreamingClient[Res any] struct {
+	cs *clientStream
+}
+
+// NewServerStream starts a server streaming call with req as its only
+// message.
+func NewServerStream[Req, Res any](ctx context.Context, c *Client, procedure string, md protocol.Metadata, req *Req) (*ServerStreamingClient[Res], error) {
+	cs, err := newClientStream(ctx, c, procedure, md)
+	if err != nil {
+		return nil, err
+	}
+	if err := cs.send(req); err != nil && err != io.EOF {
+		cs.cancel()
+		return nil, err
+	}
+	cs.CloseSend()
+	return &ServerStreamingClient[Res]{cs: cs}, nil
+}
+
+// Recv returns the next response. After the last one it returns io.EOF if
+// the call succeeded and a *protocol.Status if it didn't.
+func (s *ServerStreamingClient[Res]) Recv() (*Res, error) {
+	res := new(Res)
+	if err := s.cs.recv(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Header returns the metadata from the response headers.
+func (s *ServerStreamingClient[Res]) Header() (protocol.Metadata, error) {
+	return s.cs.Header()
+}
+
+// Trailer returns the metadata from the trailers, once Recv has returned an
+// error.
+func (s *ServerStreamingClient[Res]) Trailer() protocol.Metadata {
+	return s.cs.Trailer()
+}
+
+// BidiStreamingClient is the client's end of an RPC that streams both
+// ways. Send and Recv may be called from different goroutines, so the two
+// directions can go on independently.
+type BidiStreamingClient[Req, Res any] struct {
+	cs *clientStream
+}
+
+// NewBidiStream starts a bidirectional streaming call.
+func NewBidiStream[Req, Res any](ctx context.Context, c *Client, procedure string, md protocol.Metadata) (*BidiStreamingClient[Req, Res], error) {
+	cs, err := newClientStream(ctx, c, procedure, md)
+	if err != nil {
+		return nil, err
+	}
+	return &BidiStreamingClient[Req, Res]{cs: cs}, nil
+}
+
+// Send sends a message. It returns io.EOF if the call is already over;
+// Recv tells why.
+func (s *BidiStreamingClient[Req, Res]) Send(msg *Req) error {
+	return s.cs.send(msg)
+}
+
+// CloseSend closes our half of the stream. The server can keep sending.
+func (s *BidiStreamingClient[Req, Res]) CloseSend() error {
+	return s.cs.CloseSend()
+}
+
+// Recv returns the next response. After the last one it returns io.EOF if
+// the call succeeded and a *protocol.Status if it didn't.
+func (s *BidiStreamingClient[Req, Res]) Recv() (*Res, error) {
+	res := new(Res)
+	if err := s.cs.recv(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Header returns the metadata from the response headers.
+func (s *BidiStreamingClient[Req, Res]) Header() (protocol.Metadata, error) {
+	return s.cs.Header()
+}
+
+// Trailer returns the metadata from the trailers, once Recv has returned an
+// error.
+func (s *BidiStreamingClient[Req, Res]) Trailer() protocol.Metadata {
+	return s.cs.Trailer()
+}
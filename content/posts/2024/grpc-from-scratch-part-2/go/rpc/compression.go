@@ -0,0 +1,72 @@
+package rpc
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+)
+
+// Compressor compresses messages for one grpc-encoding, like gzip.
+type Compressor interface {
+	// Name is what goes in grpc-encoding and grpc-accept-encoding.
+	Name() string
+	// Compress returns a writer that compresses into w. Closing it
+	// flushes the rest of the message, without closing w.
+	Compress(w io.Writer) (io.WriteCloser, error)
+	// Decompress returns a reader of the decompressed r.
+	Decompress(r io.Reader) (io.Reader, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{"gzip": gzipCompressor{}}
+)
+
+// RegisterCompressor makes c available to clients and servers, replacing
+// any compressor with the same name. gzip is registered from the start.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+// compressorFor returns the compressor for a grpc-encoding. Identity is a
+// nil compressor, and ok is false if the encoding isn't registered.
+func compressorFor(encoding string) (c Compressor, ok bool) {
+	if encoding == protocol.Identity {
+		return nil, true
+	}
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok = compressors[encoding]
+	return c, ok
+}
+
+// acceptEncoding is the grpc-accept-encoding value listing every
+// registered compressor.
+func acceptEncoding() string {
+	compressorsMu.RLock()
+	names := make([]string, 0, len(compressors))
+	for name := range compressors {
+		names = append(names, name)
+	}
+	compressorsMu.RUnlock()
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
@@ -0,0 +1,195 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+)
+
+// A Connect unary call is a plain HTTP POST: the body is the message, with
+// no envelope, compressed as a whole with Content-Encoding. Metadata goes
+// in the headers, trailers included with a Trailer- prefix, and errors
+// are JSON with an HTTP status to match. See
+// https://connectrpc.com/docs/protocol
+
+const (
+	connectTimeoutHeader = "Connect-Timeout-Ms"
+	connectTrailerPrefix = "Trailer-"
+)
+
+// connectContextWithTimeout is protocol.ContextWithTimeout for
+// Connect-Timeout-Ms, which is at most 10 digits of milliseconds.
+func connectContextWithTimeout(r *http.Request) (context.Context, context.CancelFunc, error) {
+	value := r.Header.Get(connectTimeoutHeader)
+	if value == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	ms, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || len(value) > 10 {
+		return nil, nil, protocol.Errorf(protocol.InvalidArgument, "invalid %s %q", connectTimeoutHeader, value)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+	return ctx, cancel, nil
+}
+
+// connectEncodings returns the request's Content-Encoding and the
+// encodings listed in its Accept-Encoding, without their weights.
+func connectEncodings(h http.Header) (encoding string, accepted []string) {
+	encoding = strings.TrimSpace(h.Get("Content-Encoding"))
+	if encoding == "" {
+		encoding = protocol.Identity
+	}
+	for _, value := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(part, ";")
+			if name = strings.TrimSpace(name); name != "" {
+				accepted = append(accepted, name)
+			}
+		}
+	}
+	return encoding, accepted
+}
+
+// connectRecv reads the request of a Connect unary call, returning io.EOF
+// if it's been read already.
+func (ss *serverStream) connectRecv(m proto.Message) error {
+	if ss.connectRead {
+		return io.EOF
+	}
+	ss.connectRead = true
+	body, err := io.ReadAll(io.LimitReader(ss.body, maxMessageSize+1))
+	if err != nil {
+		return ss.ctxErr(err)
+	}
+	if len(body) > maxMessageSize {
+		return protocol.Errorf(protocol.ResourceExhausted, "message is larger than the limit of %d", maxMessageSize)
+	}
+	if ss.recvComp != nil {
+		if body, err = decompress(ss.recvComp, body); err != nil {
+			return err
+		}
+	}
+	// The body may well have been written by hand, with curl, so a bad one
+	// is the client's fault.
+	if ss.json {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, m)
+	} else {
+		err = proto.Unmarshal(body, m)
+	}
+	if err != nil {
+		return protocol.Errorf(protocol.InvalidArgument, "failed to unmarshal message: %v", err)
+	}
+	return nil
+}
+
+// connectSend keeps the response of a Connect unary call until
+// finishConnectLocked writes it, after the headers with the trailers in
+// them.
+func (ss *serverStream) connectSend(m proto.Message) error {
+	var msg []byte
+	var err error
+	if ss.json {
+		msg, err = protojson.Marshal(m)
+	} else {
+		msg, err = proto.Marshal(m)
+	}
+	if err != nil {
+		return protocol.Errorf(protocol.Internal, "failed to marshal message: %v", err)
+	}
+	if ss.sendComp != nil {
+		if msg, err = compress(ss.sendComp, msg); err != nil {
+			return protocol.Errorf(protocol.Internal, "failed to compress message with %s: %v", ss.sendComp.Name(), err)
+		}
+	}
+	ss.connectMsg = msg
+	return nil
+}
+
+// finishConnectLocked writes the whole response of a Connect unary call.
+func (ss *serverStream) finishConnectLocked(status *protocol.Status) {
+	h := ss.w.Header()
+	ss.header.SetHeader(h, "")
+	ss.trailer.SetHeader(h, connectTrailerPrefix)
+	if status.Code != protocol.OK {
+		h.Set("Content-Type", "application/json")
+		ss.w.WriteHeader(connectHTTPStatus(status.Code))
+		ss.w.Write(connectErrorJSON(status))
+		return
+	}
+	h.Set("Content-Type", ss.variant.contentType(ss.json))
+	if ss.sendComp != nil {
+		h.Set("Content-Encoding", ss.sendComp.Name())
+	}
+	ss.w.WriteHeader(http.StatusOK)
+	ss.w.Write(ss.connectMsg)
+}
+
+// connectHTTPStatus is the HTTP status of a Connect error.
+func connectHTTPStatus(code protocol.Code) int {
+	switch code {
+	case protocol.Canceled, protocol.DeadlineExceeded:
+		return http.StatusRequestTimeout
+	case protocol.InvalidArgument, protocol.OutOfRange:
+		return http.StatusBadRequest
+	case protocol.NotFound, protocol.Unimplemented:
+		return http.StatusNotFound
+	case protocol.AlreadyExists, protocol.Aborted:
+		return http.StatusConflict
+	case protocol.PermissionDenied:
+		return http.StatusForbidden
+	case protocol.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case protocol.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case protocol.Unavailable:
+		return http.StatusServiceUnavailable
+	case protocol.Unauthenticated:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// connectCodeName is the name of a code in a Connect error: the gRPC name
+// in snake case, with the American spelling of canceled.
+func connectCodeName(code protocol.Code) string {
+	if code == protocol.Canceled {
+		return "canceled"
+	}
+	return strings.ToLower(code.String())
+}
+
+type connectError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message,omitempty"`
+	Details []connectErrorDetail `json:"details,omitempty"`
+}
+
+type connectErrorDetail struct {
+	// Type is the full name of the message, without the type URL's prefix.
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// connectErrorJSON is the body of a Connect error response.
+func connectErrorJSON(status *protocol.Status) []byte {
+	e := connectError{Code: connectCodeName(status.Code), Message: status.Message}
+	for _, detail := range status.Details {
+		e.Details = append(e.Details, connectErrorDetail{
+			Type:  detail.TypeUrl[strings.LastIndex(detail.TypeUrl, "/")+1:],
+			Value: base64.RawStdEncoding.EncodeToString(detail.Value),
+		})
+	}
+	body, _ := json.Marshal(e)
+	return body
+}
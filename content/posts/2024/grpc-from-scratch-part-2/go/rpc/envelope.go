@@ -0,0 +1,143 @@
+// Package rpc makes gRPC calls and serves them, on top of the message
+// envelope from part 1 and the headers and trailers from the protocol
+// package. All four kinds of RPC are built on one stream: unary calls send
+// and receive one message, client streaming sends many and receives one,
+// server streaming the other way around, and bidirectional streaming sends
+// and receives as many as it likes, in both directions at once. Servers
+// also answer gRPC-Web calls, and Connect calls for unary procedures.
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+)
+
+// maxMessageSize is the largest message we accept, the same default as
+// grpc-go. Without a limit, the 4-byte length prefix lets a peer make us
+// allocate up to 4 GiB.
+const maxMessageSize = 4 << 20
+
+// The flags byte at the start of the envelope.
+const (
+	flagUncompressed = 0
+	flagCompressed   = 1
+)
+
+// writeMessage writes protoMsg with its 5-byte envelope: a compression flag
+// and the length of the message. With a compressor, the message is
+// compressed and flagged as such; with nil, it goes as is.
+func writeMessage(w io.Writer, protoMsg proto.Message, c Compressor) error {
+	msg, err := proto.Marshal(protoMsg)
+	if err != nil {
+		return protocol.Errorf(protocol.Internal, "failed to marshal message: %v", err)
+	}
+
+	flag := byte(flagUncompressed)
+	if c != nil {
+		flag = flagCompressed
+		if msg, err = compress(c, msg); err != nil {
+			return protocol.Errorf(protocol.Internal, "failed to compress message with %s: %v", c.Name(), err)
+		}
+	}
+
+	// One write for the envelope and the message, so a pipe or an HTTP/2
+	// stream gets the whole thing at once.
+	buf := make([]byte, 5, 5+len(msg))
+	buf[0] = flag
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(msg)))
+	_, err = w.Write(append(buf, msg...))
+	return err
+}
+
+func compress(c Compressor, msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	cw, err := c.Compress(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cw.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readMessage reads the next message from body. Compressed messages are
+// decompressed with c, the compressor of the peer's grpc-encoding, which is
+// nil if it didn't set one. It returns io.EOF if the stream ended cleanly
+// before another message started.
+func readMessage(body io.Reader, protoResp proto.Message, c Compressor) error {
+	prefixes := [5]byte{}
+	if _, err := io.ReadFull(body, prefixes[:]); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("failed to read envelope: %w", err)
+	}
+
+	// The size is checked before anything is allocated, or a bogus length
+	// would have us reserve up to 4 GiB for it.
+	msgSize := binary.BigEndian.Uint32(prefixes[1:5])
+	if msgSize > maxMessageSize {
+		return protocol.Errorf(protocol.ResourceExhausted, "message of %d bytes is larger than the limit of %d", msgSize, maxMessageSize)
+	}
+	msg := make([]byte, msgSize)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return fmt.Errorf("failed to read msg: %w", err)
+	}
+
+	switch prefixes[0] {
+	case flagUncompressed:
+	case flagCompressed:
+		if c == nil {
+			return protocol.Errorf(protocol.Internal, "compressed message without a grpc-encoding")
+		}
+		var err error
+		if msg, err = decompress(c, msg); err != nil {
+			return err
+		}
+	default:
+		return protocol.Errorf(protocol.Internal, "invalid message flags 0x%02x", prefixes[0])
+	}
+
+	if err := proto.Unmarshal(msg, protoResp); err != nil {
+		return protocol.Errorf(protocol.Internal, "failed to unmarshal message: %v", err)
+	}
+	return nil
+}
+
+// decompress decompresses msg, stopping at maxMessageSize: a small message
+// can decompress to gigabytes.
+func decompress(c Compressor, msg []byte) ([]byte, error) {
+	r, err := c.Decompress(bytes.NewReader(msg))
+	if err != nil {
+		return nil, protocol.Errorf(protocol.Internal, "failed to decompress message with %s: %v", c.Name(), err)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, protocol.Errorf(protocol.Internal, "failed to decompress message with %s: %v", c.Name(), err)
+	}
+	if len(out) > maxMessageSize {
+		return nil, protocol.Errorf(protocol.ResourceExhausted, "decompressed message is larger than the limit of %d", maxMessageSize)
+	}
+	return out, nil
+}
+
+// asMessage turns one of the typed messages of a stream into a
+// proto.Message. The stream types take *Req and *Res rather than
+// proto.Message so that Recv can allocate the message itself.
+func asMessage(msg any) (proto.Message, error) {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return nil, protocol.Errorf(protocol.Internal, "%T is not a protobuf message", msg)
+	}
+	return m, nil
+}
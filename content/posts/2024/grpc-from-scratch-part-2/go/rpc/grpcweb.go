@@ -0,0 +1,93 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+)
+
+// gRPC-Web is gRPC for clients that can't read HTTP trailers, like
+// browsers. The messages are framed the same way, but the status and the
+// trailers come at the end of the body, in a frame with this flag set and
+// formatted like HTTP/1 headers. See
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+const flagTrailers = 0x80
+
+// finishWebLocked ends a gRPC-Web call with the trailers frame.
+func (ss *serverStream) finishWebLocked(status *protocol.Status) {
+	ss.sendHeaderLocked()
+	h := http.Header{}
+	ss.trailer.SetHeader(h, "")
+	status.SetHeader(h, "")
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var block bytes.Buffer
+	for _, key := range keys {
+		for _, value := range h[key] {
+			block.WriteString(strings.ToLower(key) + ": " + value + "\r\n")
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = flagTrailers
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	ss.writer().Write(append(frame, block.Bytes()...))
+}
+
+// base64Writer is the response body of grpc-web-text, which is base64
+// encoded. writeMessage writes a whole frame at once, so each frame is
+// encoded on its own, padding and all, as the spec allows.
+type base64Writer struct {
+	w io.Writer
+}
+
+func (b base64Writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(b.w, base64.StdEncoding.EncodeToString(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// base64Reader decodes the request body of grpc-web-text. Clients may
+// encode each frame on its own too, so padding can turn up in the middle;
+// decoding four characters at a time copes with that.
+type base64Reader struct {
+	r       *bufio.Reader
+	decoded [3]byte
+	buf     []byte // decoded but not read yet
+}
+
+func newBase64Reader(r io.Reader) *base64Reader {
+	return &base64Reader{r: bufio.NewReader(r)}
+}
+
+func (b *base64Reader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		var quad [4]byte
+		if _, err := io.ReadFull(b.r, quad[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, errors.New("truncated base64 in grpc-web-text body")
+			}
+			return 0, err
+		}
+		n, err := base64.StdEncoding.Decode(b.decoded[:], quad[:])
+		if err != nil {
+			return 0, err
+		}
+		b.buf = b.decoded[:n]
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,934 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"connectrpc.com/connect"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	greetv1 "github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/gen"
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+)
+
+// The test service has one method of each kind, served once by grpc-go and
+// once by our handlers, so that each client can be tried against both:
+//
+//	Greet:     unary, "Hello, <name>!"
+//	GreetMany: client streaming, greets all the names it's sent at once
+//	GreetEach: server streaming, greets each of a comma separated list
+//	Chat:      bidirectional, greets every name as it arrives
+//
+// An empty name fails with InvalidArgument and "slow" waits for the
+// deadline. Every method echoes the x-echo request metadata in its headers
+// and sends x-trailer-bin in its trailers.
+const service = "/greet.v1.GreetService/"
+
+var trailerBin = "\x00\xffbinary"
+
+// greeting is the logic behind every method.
+func greeting(ctx context.Context, name string) (*greetv1.GreetResponse, error) {
+	switch name {
+	case "":
+		detail, err := anypb.New(&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: "name", Description: "must not be empty"}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, &protocol.Status{Code: protocol.InvalidArgument, Message: "name is required: 100% ✗", Details: []*anypb.Any{detail}}
+	case "slow":
+		<-ctx.Done()
+		return nil, protocol.FromError(ctx.Err())
+	}
+	return &greetv1.GreetResponse{Greeting: "Hello, " + name + "!"}, nil
+}
+
+// setMetadata sets the response metadata of one of our handlers.
+func setMetadata(ctx context.Context) {
+	md := protocol.Metadata{}
+	md.Append("x-echo", RequestMetadata(ctx).Get("x-echo"))
+	SetHeader(ctx, md)
+	SetTrailer(ctx, protocol.Metadata{"x-trailer-bin": {trailerBin}})
+}
+
+// startServer serves the test service with our handlers over h2c.
+func startServer(t *testing.T) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle(service+"Greet", UnaryHandler(func(ctx context.Context, req *greetv1.GreetRequest) (*greetv1.GreetResponse, error) {
+		setMetadata(ctx)
+		return greeting(ctx, req.Name)
+	}))
+	mux.Handle(service+"GreetMany", ClientStreamingHandler(func(ctx context.Context, stream *ClientStreamingServer[greetv1.GreetRequest, greetv1.GreetResponse]) (*greetv1.GreetResponse, error) {
+		setMetadata(ctx)
+		var names []string
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				return greeting(ctx, strings.Join(names, " & "))
+			}
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, req.Name)
+		}
+	}))
+	mux.Handle(service+"GreetEach", ServerStreamingHandler(func(ctx context.Context, req *greetv1.GreetRequest, stream *ServerStreamingServer[greetv1.GreetResponse]) error {
+		setMetadata(ctx)
+		for _, name := range strings.Split(req.Name, ",") {
+			res, err := greeting(ctx, name)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	mux.Handle(service+"Chat", BidiStreamingHandler(func(ctx context.Context, stream *BidiStreamingServer[greetv1.GreetRequest, greetv1.GreetResponse]) error {
+		setMetadata(ctx)
+		for {
+			req, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			res, err := greeting(ctx, req.Name)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(res); err != nil {
+				return err
+			}
+		}
+	}))
+	ts := httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+// toGRPC converts an error from greeting for grpc-go.
+func toGRPC(err error) error {
+	if err == nil {
+		return nil
+	}
+	s := protocol.FromError(err)
+	return status.ErrorProto(&spb.Status{Code: int32(s.Code), Message: s.Message, Details: s.Details})
+}
+
+// grpcMetadata returns the response metadata for one of grpc-go's
+// handlers.
+func grpcMetadata(ctx context.Context) (header, trailer metadata.MD) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return metadata.Pairs("x-echo", strings.Join(md.Get("x-echo"), "")), metadata.Pairs("x-trailer-bin", trailerBin)
+}
+
+// setGRPCMetadata sets the response metadata of one of grpc-go's streaming
+// handlers.
+func setGRPCMetadata(stream grpc.ServerStream) {
+	header, trailer := grpcMetadata(stream.Context())
+	stream.SetHeader(header)
+	stream.SetTrailer(trailer)
+}
+
+var grpcService = grpc.ServiceDesc{
+	ServiceName: "greet.v1.GreetService",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Greet",
+		Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+			req := &greetv1.GreetRequest{}
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			header, trailer := grpcMetadata(ctx)
+			grpc.SetHeader(ctx, header)
+			grpc.SetTrailer(ctx, trailer)
+			res, err := greeting(ctx, req.Name)
+			return res, toGRPC(err)
+		},
+	}},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GreetMany",
+			ClientStreams: true,
+			Handler: func(_ any, stream grpc.ServerStream) error {
+				setGRPCMetadata(stream)
+				var names []string
+				for {
+					req := &greetv1.GreetRequest{}
+					err := stream.RecvMsg(req)
+					if err == io.EOF {
+						res, err := greeting(stream.Context(), strings.Join(names, " & "))
+						if err != nil {
+							return toGRPC(err)
+						}
+						return stream.SendMsg(res)
+					}
+					if err != nil {
+						return err
+					}
+					names = append(names, req.Name)
+				}
+			},
+		},
+		{
+			StreamName:    "GreetEach",
+			ServerStreams: true,
+			Handler: func(_ any, stream grpc.ServerStream) error {
+				setGRPCMetadata(stream)
+				req := &greetv1.GreetRequest{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				for _, name := range strings.Split(req.Name, ",") {
+					res, err := greeting(stream.Context(), name)
+					if err != nil {
+						return toGRPC(err)
+					}
+					if err := stream.SendMsg(res); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			StreamName:    "Chat",
+			ClientStreams: true,
+			ServerStreams: true,
+			Handler: func(_ any, stream grpc.ServerStream) error {
+				setGRPCMetadata(stream)
+				for {
+					req := &greetv1.GreetRequest{}
+					err := stream.RecvMsg(req)
+					if err == io.EOF {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+					res, err := greeting(stream.Context(), req.Name)
+					if err != nil {
+						return toGRPC(err)
+					}
+					if err := stream.SendMsg(res); err != nil {
+						return err
+					}
+				}
+			},
+		},
+	},
+}
+
+// startGRPCServer serves the test service with grpc-go.
+func startGRPCServer(t *testing.T) string {
+	t.Helper()
+	s := grpc.NewServer()
+	s.RegisterService(&grpcService, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	return l.Addr().String()
+}
+
+// newClient returns our client for a server speaking h2c.
+func newClient(addr string) *Client {
+	return &Client{
+		HTTPClient: &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+			},
+		},
+		BaseURL: "http://" + addr,
+	}
+}
+
+func testMetadata() protocol.Metadata {
+	return protocol.Metadata{"x-echo": {"ping"}}
+}
+
+// checkStatus checks that err is the InvalidArgument error of an empty
+// name, details included.
+func checkStatus(t *testing.T, err error) {
+	t.Helper()
+	var s *protocol.Status
+	if !errors.As(err, &s) {
+		t.Fatalf("got error %v, want a *protocol.Status", err)
+	}
+	if s.Code != protocol.InvalidArgument || s.Message != "name is required: 100% ✗" {
+		t.Errorf("got status %s %q", s.Code, s.Message)
+	}
+	badRequest := &errdetails.BadRequest{}
+	if len(s.Details) != 1 || s.Details[0].UnmarshalTo(badRequest) != nil || badRequest.FieldViolations[0].Field != "name" {
+		t.Errorf("got details %v", s.Details)
+	}
+}
+
+func checkTrailer(t *testing.T, trailer protocol.Metadata) {
+	t.Helper()
+	if got := trailer.Get("x-trailer-bin"); got != trailerBin {
+		t.Errorf("got trailer x-trailer-bin %q, want %q", got, trailerBin)
+	}
+}
+
+func TestClient(t *testing.T) {
+	servers := map[string]func(t *testing.T) string{
+		"grpc-go": startGRPCServer,
+		"ours":    startServer,
+	}
+	for name, start := range servers {
+		t.Run(name, func(t *testing.T) {
+			client := newClient(start(t))
+			ctx := context.Background()
+
+			t.Run("unary", func(t *testing.T) {
+				res, md, err := Unary[greetv1.GreetRequest, greetv1.GreetResponse](ctx, client, service+"Greet", testMetadata(), &greetv1.GreetRequest{Name: "World"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Greeting != "Hello, World!" {
+					t.Errorf("got %q", res.Greeting)
+				}
+				if md.Get("x-echo") != "ping" {
+					t.Errorf("got response metadata %q", md)
+				}
+				checkTrailer(t, md)
+			})
+
+			t.Run("unary error", func(t *testing.T) {
+				_, md, err := Unary[greetv1.GreetRequest, greetv1.GreetResponse](ctx, client, service+"Greet", nil, &greetv1.GreetRequest{})
+				checkStatus(t, err)
+				checkTrailer(t, md)
+			})
+
+			t.Run("deadline", func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+				defer cancel()
+				_, _, err := Unary[greetv1.GreetRequest, greetv1.GreetResponse](ctx, client, service+"Greet", nil, &greetv1.GreetRequest{Name: "slow"})
+				if s := protocol.FromError(err); s.Code != protocol.DeadlineExceeded {
+					t.Errorf("got %v, want DEADLINE_EXCEEDED", err)
+				}
+			})
+
+			t.Run("client streaming", func(t *testing.T) {
+				stream, err := NewClientStream[greetv1.GreetRequest, greetv1.GreetResponse](ctx, client, service+"GreetMany", testMetadata())
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range []string{"Ada", "Grace", "Linus"} {
+					if err := stream.Send(&greetv1.GreetRequest{Name: name}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				res, err := stream.CloseAndRecv()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Greeting != "Hello, Ada & Grace & Linus!" {
+					t.Errorf("got %q", res.Greeting)
+				}
+				if md, err := stream.Header(); err != nil || md.Get("x-echo") != "ping" {
+					t.Errorf("got header %q and error %v", md, err)
+				}
+				checkTrailer(t, stream.Trailer())
+			})
+
+			t.Run("server streaming", func(t *testing.T) {
+				// The third name fails after two messages, so the status
+				// arrives in the trailers.
+				stream, err := NewServerStream[greetv1.GreetRequest, greetv1.GreetResponse](ctx, client, service+"GreetEach", nil, &greetv1.GreetRequest{Name: "Ada,Grace,"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for {
+					res, err := stream.Recv()
+					if err != nil {
+						checkStatus(t, err)
+						break
+					}
+					got = append(got, res.Greeting)
+				}
+				if strings.Join(got, " ") != "Hello, Ada! Hello, Grace!" {
+					t.Errorf("got %q", got)
+				}
+				checkTrailer(t, stream.Trailer())
+			})
+
+			t.Run("bidi streaming", func(t *testing.T) {
+				stream, err := NewBidiStream[greetv1.GreetRequest, greetv1.GreetResponse](ctx, client, service+"Chat", testMetadata())
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Each answer arrives before the next name is sent, so both
+				// directions really are open at once.
+				for _, name := range []string{"Ada", "Grace"} {
+					if err := stream.Send(&greetv1.GreetRequest{Name: name}); err != nil {
+						t.Fatal(err)
+					}
+					res, err := stream.Recv()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if res.Greeting != "Hello, "+name+"!" {
+						t.Errorf("got %q", res.Greeting)
+					}
+				}
+				stream.CloseSend()
+				if _, err := stream.Recv(); err != io.EOF {
+					t.Errorf("got %v after CloseSend, want io.EOF", err)
+				}
+				checkTrailer(t, stream.Trailer())
+			})
+		})
+	}
+}
+
+// newGRPCClient returns a grpc-go client for our server.
+func newGRPCClient(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	conn, err := grpc.Dial(startServer(t), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// checkGRPCStatus is checkStatus for an error from grpc-go.
+func checkGRPCStatus(t *testing.T, err error) {
+	t.Helper()
+	s := status.Convert(err)
+	if s.Code() != codes.InvalidArgument || s.Message() != "name is required: 100% ✗" {
+		t.Errorf("got status %s %q", s.Code(), s.Message())
+	}
+	details := s.Details()
+	if len(details) != 1 {
+		t.Fatalf("got details %v", details)
+	}
+	if badRequest, ok := details[0].(*errdetails.BadRequest); !ok || badRequest.FieldViolations[0].Field != "name" {
+		t.Errorf("got details %v", details)
+	}
+}
+
+func checkGRPCTrailer(t *testing.T, trailer metadata.MD) {
+	t.Helper()
+	if got := strings.Join(trailer.Get("x-trailer-bin"), ""); got != trailerBin {
+		t.Errorf("got trailer x-trailer-bin %q, want %q", got, trailerBin)
+	}
+}
+
+func TestServer(t *testing.T) {
+	conn := newGRPCClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-echo", "ping")
+
+	t.Run("unary", func(t *testing.T) {
+		var header, trailer metadata.MD
+		res := &greetv1.GreetResponse{}
+		err := conn.Invoke(ctx, service+"Greet", &greetv1.GreetRequest{Name: "World"}, res, grpc.Header(&header), grpc.Trailer(&trailer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Greeting != "Hello, World!" {
+			t.Errorf("got %q", res.Greeting)
+		}
+		if got := header.Get("x-echo"); len(got) != 1 || got[0] != "ping" {
+			t.Errorf("got header %v", header)
+		}
+		checkGRPCTrailer(t, trailer)
+	})
+
+	t.Run("unary error", func(t *testing.T) {
+		var trailer metadata.MD
+		err := conn.Invoke(ctx, service+"Greet", &greetv1.GreetRequest{}, &greetv1.GreetResponse{}, grpc.Trailer(&trailer))
+		checkGRPCStatus(t, err)
+		checkGRPCTrailer(t, trailer)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		err := conn.Invoke(ctx, service+"Greet", &greetv1.GreetRequest{Name: "slow"}, &greetv1.GreetResponse{})
+		if status.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("got %v, want DeadlineExceeded", err)
+		}
+	})
+
+	t.Run("client streaming", func(t *testing.T) {
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true}, service+"GreetMany")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"Ada", "Grace", "Linus"} {
+			if err := stream.SendMsg(&greetv1.GreetRequest{Name: name}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stream.CloseSend()
+		res := &greetv1.GreetResponse{}
+		if err := stream.RecvMsg(res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Greeting != "Hello, Ada & Grace & Linus!" {
+			t.Errorf("got %q", res.Greeting)
+		}
+		if err := stream.RecvMsg(res); err != io.EOF {
+			t.Errorf("got %v after the response, want io.EOF", err)
+		}
+		checkGRPCTrailer(t, stream.Trailer())
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, service+"GreetEach")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.SendMsg(&greetv1.GreetRequest{Name: "Ada,Grace,"}); err != nil {
+			t.Fatal(err)
+		}
+		stream.CloseSend()
+		var got []string
+		for {
+			res := &greetv1.GreetResponse{}
+			if err := stream.RecvMsg(res); err != nil {
+				checkGRPCStatus(t, err)
+				break
+			}
+			got = append(got, res.Greeting)
+		}
+		if strings.Join(got, " ") != "Hello, Ada! Hello, Grace!" {
+			t.Errorf("got %q", got)
+		}
+		checkGRPCTrailer(t, stream.Trailer())
+	})
+
+	t.Run("trailers only", func(t *testing.T) {
+		// Failing before any message puts the status in the headers.
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, service+"GreetEach")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SendMsg(&greetv1.GreetRequest{})
+		stream.CloseSend()
+		checkGRPCStatus(t, stream.RecvMsg(&greetv1.GreetResponse{}))
+		checkGRPCTrailer(t, stream.Trailer())
+	})
+
+	t.Run("bidi streaming", func(t *testing.T) {
+		stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, service+"Chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"Ada", "Grace"} {
+			if err := stream.SendMsg(&greetv1.GreetRequest{Name: name}); err != nil {
+				t.Fatal(err)
+			}
+			res := &greetv1.GreetResponse{}
+			if err := stream.RecvMsg(res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Greeting != "Hello, "+name+"!" {
+				t.Errorf("got %q", res.Greeting)
+			}
+		}
+		stream.CloseSend()
+		if err := stream.RecvMsg(&greetv1.GreetResponse{}); err != io.EOF {
+			t.Errorf("got %v after CloseSend, want io.EOF", err)
+		}
+		checkGRPCTrailer(t, stream.Trailer())
+	})
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	client := newClient(startGRPCServer(t))
+	name := strings.Repeat("x", maxMessageSize)
+	_, _, err := Unary[greetv1.GreetRequest, greetv1.GreetResponse](context.Background(), client, service+"Greet", nil, &greetv1.GreetRequest{Name: name})
+	// grpc-go has the same limit, so it's the server that refuses it.
+	if s := protocol.FromError(err); s.Code != protocol.ResourceExhausted {
+		t.Errorf("got %v, want RESOURCE_EXHAUSTED", err)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	gzip, _ := compressorFor("gzip")
+	for _, c := range []Compressor{nil, gzip} {
+		var buf bytes.Buffer
+		req := &greetv1.GreetRequest{Name: strings.Repeat("World", 100)}
+		if err := writeMessage(&buf, req, c); err != nil {
+			t.Fatal(err)
+		}
+		if compressed := buf.Bytes()[0] == flagCompressed; compressed != (c != nil) {
+			t.Errorf("compressor %v: got compressed flag %v", c, compressed)
+		}
+		if c != nil && buf.Len() >= 500 {
+			t.Errorf("got %d bytes for a gzipped repetitive message", buf.Len())
+		}
+		got := &greetv1.GreetRequest{}
+		if err := readMessage(&buf, got, c); err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != req.Name {
+			t.Errorf("compressor %v: got %q", c, got.Name)
+		}
+		if err := readMessage(&buf, got, c); err != io.EOF {
+			t.Errorf("got %v at the end, want io.EOF", err)
+		}
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	gzip, _ := compressorFor("gzip")
+	var bomb bytes.Buffer
+	if err := writeMessage(&bomb, &greetv1.GreetRequest{Name: strings.Repeat("x", maxMessageSize)}, gzip); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		c     Compressor
+		code  protocol.Code
+	}{
+		// Only the envelope is there, so reading the message would fail
+		// with something else.
+		{"hostile length", []byte{0, 0xff, 0xff, 0xff, 0xff}, nil, protocol.ResourceExhausted},
+		{"compressed without encoding", []byte{1, 0, 0, 0, 0}, nil, protocol.Internal},
+		{"invalid flags", []byte{2, 0, 0, 0, 0}, nil, protocol.Internal},
+		{"invalid gzip", []byte{1, 0, 0, 0, 3, 'b', 'a', 'd'}, gzip, protocol.Internal},
+		{"decompression bomb", bomb.Bytes(), gzip, protocol.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		err := readMessage(bytes.NewReader(tt.input), &greetv1.GreetRequest{}, tt.c)
+		var s *protocol.Status
+		if !errors.As(err, &s) || s.Code != tt.code {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.code)
+		}
+	}
+}
+
+// encodingRecorder remembers the grpc-encoding of the last response.
+type encodingRecorder struct {
+	http.RoundTripper
+	encoding string
+}
+
+func (r *encodingRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.RoundTripper.RoundTrip(req)
+	if err == nil {
+		r.encoding = resp.Header.Get(protocol.EncodingHeader)
+	}
+	return resp, err
+}
+
+func TestCompression(t *testing.T) {
+	servers := map[string]func(t *testing.T) string{
+		"grpc-go": startGRPCServer,
+		"ours":    startServer,
+	}
+	for name, start := range servers {
+		t.Run(name, func(t *testing.T) {
+			client := newClient(start(t))
+			client.Compression = "gzip"
+			recorder := &encodingRecorder{RoundTripper: client.HTTPClient.Transport}
+			client.HTTPClient.Transport = recorder
+			res, _, err := Unary[greetv1.GreetRequest, greetv1.GreetResponse](context.Background(), client, service+"Greet", nil, &greetv1.GreetRequest{Name: "World"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Greeting != "Hello, World!" {
+				t.Errorf("got %q", res.Greeting)
+			}
+			if recorder.encoding != "gzip" {
+				t.Errorf("got response grpc-encoding %q, want gzip", recorder.encoding)
+			}
+
+			stream, err := NewBidiStream[greetv1.GreetRequest, greetv1.GreetResponse](context.Background(), client, service+"Chat", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.Send(&greetv1.GreetRequest{Name: "Ada"})
+			if res, err := stream.Recv(); err != nil || res.Greeting != "Hello, Ada!" {
+				t.Errorf("got %v and error %v", res, err)
+			}
+			stream.CloseSend()
+			if _, err := stream.Recv(); err != io.EOF {
+				t.Errorf("got %v after CloseSend, want io.EOF", err)
+			}
+		})
+	}
+
+	t.Run("grpc-go client", func(t *testing.T) {
+		conn := newGRPCClient(t)
+		res := &greetv1.GreetResponse{}
+		err := conn.Invoke(context.Background(), service+"Greet", &greetv1.GreetRequest{Name: "World"}, res, grpc.UseCompressor(grpcgzip.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Greeting != "Hello, World!" {
+			t.Errorf("got %q", res.Greeting)
+		}
+	})
+
+	t.Run("unregistered", func(t *testing.T) {
+		client := newClient(startServer(t))
+		client.Compression = "snappy"
+		if _, err := NewBidiStream[greetv1.GreetRequest, greetv1.GreetResponse](context.Background(), client, service+"Chat", nil); protocol.FromError(err).Code != protocol.Internal {
+			t.Errorf("got %v, want INTERNAL", err)
+		}
+	})
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	client := newClient(startServer(t))
+	req, err := http.NewRequest(http.MethodPost, client.BaseURL+service+"Greet", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set(protocol.EncodingHeader, "br")
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := protocol.StatusFromTrailer(resp.Header); s.Code != protocol.Unimplemented {
+		t.Errorf("got %s, want UNIMPLEMENTED", s)
+	}
+	if got := protocol.AcceptEncodings(resp.Header); !slices.Contains(got, "gzip") {
+		t.Errorf("got grpc-accept-encoding %q, want gzip in it", got)
+	}
+}
+
+// connectClients are connect-go clients for every variant our server
+// speaks. Connect and gRPC-Web go over HTTP/1.1, like from a browser.
+func connectClients(addr string) map[string]struct {
+	httpClient *http.Client
+	opts       []connect.ClientOption
+} {
+	type client = struct {
+		httpClient *http.Client
+		opts       []connect.ClientOption
+	}
+	h1, h2 := &http.Client{}, newClient(addr).HTTPClient
+	return map[string]client{
+		"connect":       {h1, nil},
+		"connect json":  {h1, []connect.ClientOption{connect.WithProtoJSON()}},
+		"connect gzip":  {h1, []connect.ClientOption{connect.WithSendGzip()}},
+		"grpc-web":      {h1, []connect.ClientOption{connect.WithGRPCWeb()}},
+		"grpc-web gzip": {h1, []connect.ClientOption{connect.WithGRPCWeb(), connect.WithSendGzip()}},
+		"grpc":          {h2, []connect.ClientOption{connect.WithGRPC()}},
+	}
+}
+
+func TestConnectClients(t *testing.T) {
+	addr := startServer(t)
+	for name, c := range connectClients(addr) {
+		t.Run(name, func(t *testing.T) {
+			greet := connect.NewClient[greetv1.GreetRequest, greetv1.GreetResponse](c.httpClient, "http://"+addr+service+"Greet", c.opts...)
+
+			req := connect.NewRequest(&greetv1.GreetRequest{Name: "World"})
+			req.Header().Set("X-Echo", "ping")
+			res, err := greet.CallUnary(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Msg.Greeting != "Hello, World!" {
+				t.Errorf("got %q", res.Msg.Greeting)
+			}
+			if got := res.Header().Get("X-Echo"); got != "ping" {
+				t.Errorf("got header x-echo %q", got)
+			}
+			if got, err := connect.DecodeBinaryHeader(res.Trailer().Get("X-Trailer-Bin")); err != nil || string(got) != trailerBin {
+				t.Errorf("got trailer x-trailer-bin %q and error %v", got, err)
+			}
+
+			_, err = greet.CallUnary(context.Background(), connect.NewRequest(&greetv1.GreetRequest{}))
+			var connectErr *connect.Error
+			if !errors.As(err, &connectErr) {
+				t.Fatalf("got %v, want a *connect.Error", err)
+			}
+			if connectErr.Code() != connect.CodeInvalidArgument || connectErr.Message() != "name is required: 100% ✗" {
+				t.Errorf("got error %s %q", connectErr.Code(), connectErr.Message())
+			}
+			if details := connectErr.Details(); len(details) != 1 {
+				t.Errorf("got details %v", details)
+			} else if detail, err := details[0].Value(); err != nil || detail.(*errdetails.BadRequest).FieldViolations[0].Field != "name" {
+				t.Errorf("got detail %v and error %v", detail, err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err = greet.CallUnary(ctx, connect.NewRequest(&greetv1.GreetRequest{Name: "slow"}))
+			if connect.CodeOf(err) != connect.CodeDeadlineExceeded {
+				t.Errorf("got %v, want deadline_exceeded", err)
+			}
+		})
+	}
+}
+
+func TestGRPCWebServerStream(t *testing.T) {
+	addr := startServer(t)
+	greetEach := connect.NewClient[greetv1.GreetRequest, greetv1.GreetResponse](&http.Client{}, "http://"+addr+service+"GreetEach", connect.WithGRPCWeb())
+	stream, err := greetEach.CallServerStream(context.Background(), connect.NewRequest(&greetv1.GreetRequest{Name: "Ada,Grace,"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for stream.Receive() {
+		got = append(got, stream.Msg().Greeting)
+	}
+	if strings.Join(got, " ") != "Hello, Ada! Hello, Grace!" {
+		t.Errorf("got %q", got)
+	}
+	if connect.CodeOf(stream.Err()) != connect.CodeInvalidArgument {
+		t.Errorf("got %v, want invalid_argument", stream.Err())
+	}
+	if got, err := connect.DecodeBinaryHeader(stream.ResponseTrailer().Get("X-Trailer-Bin")); err != nil || string(got) != trailerBin {
+		t.Errorf("got trailer x-trailer-bin %q and error %v", got, err)
+	}
+}
+
+func TestGRPCWebText(t *testing.T) {
+	addr := startServer(t)
+	// Each frame is encoded on its own, so the padding of the first one
+	// ends up in the middle of the body.
+	var body strings.Builder
+	for _, name := range []string{"Ada", "Grace"} {
+		var frame bytes.Buffer
+		if err := writeMessage(&frame, &greetv1.GreetRequest{Name: name}, nil); err != nil {
+			t.Fatal(err)
+		}
+		body.WriteString(base64.StdEncoding.EncodeToString(frame.Bytes()))
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+service+"Chat", strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc-web-text")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/grpc-web-text+proto" {
+		t.Errorf("got content-type %q", ct)
+	}
+
+	r := newBase64Reader(resp.Body)
+	for _, name := range []string{"Ada", "Grace"} {
+		res := &greetv1.GreetResponse{}
+		if err := readMessage(r, res, nil); err != nil {
+			t.Fatal(err)
+		}
+		if res.Greeting != "Hello, "+name+"!" {
+			t.Errorf("got %q", res.Greeting)
+		}
+	}
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		t.Fatal(err)
+	}
+	if prefix[0] != flagTrailers {
+		t.Fatalf("got flags 0x%02x, want the trailers frame", prefix[0])
+	}
+	block, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"grpc-status: 0\r\n", "x-trailer-bin: " + base64.RawStdEncoding.EncodeToString([]byte(trailerBin)) + "\r\n"} {
+		if !strings.Contains(string(block), want) {
+			t.Errorf("got trailers %q, want %q in them", block, want)
+		}
+	}
+}
+
+func TestConnectJSON(t *testing.T) {
+	addr := startServer(t)
+	post := func(procedure, contentType, body string) (*http.Response, string) {
+		t.Helper()
+		resp, err := http.Post("http://"+addr+service+procedure, contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, string(b)
+	}
+
+	resp, body := post("Greet", "application/json", `{"name": "World"}`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s with content-type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	res := &greetv1.GreetResponse{}
+	if err := protojson.Unmarshal([]byte(body), res); err != nil || res.Greeting != "Hello, World!" {
+		t.Errorf("got body %s and error %v", body, err)
+	}
+	if resp.Header.Get("Trailer-X-Trailer-Bin") == "" {
+		t.Errorf("got headers %v, want the trailers in them", resp.Header)
+	}
+
+	resp, body = post("Greet", "application/json", `{}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %s, want 400", resp.Status)
+	}
+	var connectErr connectError
+	if err := json.Unmarshal([]byte(body), &connectErr); err != nil {
+		t.Fatal(err)
+	}
+	if connectErr.Code != "invalid_argument" || len(connectErr.Details) != 1 || connectErr.Details[0].Type != "google.rpc.BadRequest" {
+		t.Errorf("got error %s", body)
+	}
+
+	resp, _ = post("Greet", "application/json", `{"name": `)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %s for invalid JSON, want 400", resp.Status)
+	}
+
+	// Connect streaming isn't supported, and neither are unknown types.
+	for _, tt := range []struct{ procedure, contentType string }{
+		{"GreetEach", "application/json"},
+		{"Greet", "application/connect+proto"},
+		{"Greet", "text/plain"},
+	} {
+		if resp, _ := post(tt.procedure, tt.contentType, ""); resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("%s as %s: got %s, want 415", tt.procedure, tt.contentType, resp.Status)
+		}
+	}
+}
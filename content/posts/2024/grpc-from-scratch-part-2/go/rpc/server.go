@@ -0,0 +1,441 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+)
+
+// variant is the protocol a call came in with. They all share the same
+// handlers: gRPC-Web only changes where the status goes, and Connect unary
+// calls drop the envelope.
+type variant int
+
+const (
+	variantGRPC variant = iota
+	variantGRPCWeb
+	variantGRPCWebText // gRPC-Web with base64 bodies
+	variantConnect     // Connect unary
+)
+
+// variantFor picks the variant from the request's Content-Type. json is
+// true for Connect calls with JSON messages instead of binary protobuf.
+func variantFor(contentType string) (v variant, json bool, ok bool) {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case "application/grpc", "application/grpc+proto":
+		return variantGRPC, false, true
+	case "application/grpc-web", "application/grpc-web+proto":
+		return variantGRPCWeb, false, true
+	case "application/grpc-web-text", "application/grpc-web-text+proto":
+		return variantGRPCWebText, false, true
+	case "application/proto":
+		return variantConnect, false, true
+	case "application/json":
+		return variantConnect, true, true
+	}
+	return 0, false, false
+}
+
+// contentType is the Content-Type of a successful response.
+func (v variant) contentType(json bool) string {
+	switch v {
+	case variantGRPCWeb:
+		return "application/grpc-web+proto"
+	case variantGRPCWebText:
+		return "application/grpc-web-text+proto"
+	case variantConnect:
+		if json {
+			return "application/json"
+		}
+		return "application/proto"
+	}
+	return "application/grpc+proto"
+}
+
+// serverStream is the server's end of one call, whatever its kind. It's
+// kept in the handler's context, so RequestMetadata, SetHeader and
+// SetTrailer can find it.
+type serverStream struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	r       *http.Request
+	body    io.Reader         // the request body, decoded for grpc-web-text
+	md      protocol.Metadata // sent by the client
+	variant variant
+	json    bool
+
+	// recvComp decompresses the client's messages and sendComp compresses
+	// ours. Either is nil for uncompressed messages.
+	recvComp, sendComp Compressor
+
+	// A Connect unary call is read in one go, and its response is kept
+	// until the call ends.
+	connectRead bool
+	connectMsg  []byte
+
+	// mu guards the response metadata. A bidirectional handler may be
+	// sending from one goroutine while another sets the trailers.
+	mu          sync.Mutex
+	header      protocol.Metadata
+	trailer     protocol.Metadata
+	wroteHeader bool
+}
+
+type streamKey struct{}
+
+// serve runs a handler for one call. It checks the request, applies the
+// client's deadline to the context and, once the handler is done, ends the
+// call with the status of the error it returned. Connect calls are only
+// accepted by unary handlers.
+func serve(w http.ResponseWriter, r *http.Request, unary bool, handler func(ss *serverStream) error) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	v, json, ok := variantFor(r.Header.Get("Content-Type"))
+	if !ok || v == variantConnect && !unary {
+		// Not a request we can answer, so the error has to be one any
+		// HTTP client understands.
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	defer r.Body.Close()
+
+	ss := &serverStream{w: w, r: r, body: r.Body, variant: v, json: json, header: protocol.Metadata{}, trailer: protocol.Metadata{}}
+	if v == variantGRPCWebText {
+		ss.body = newBase64Reader(r.Body)
+	}
+	if err := ss.negotiateCompression(); err != nil {
+		ss.finish(err)
+		return
+	}
+	contextWithTimeout := protocol.ContextWithTimeout
+	if v == variantConnect {
+		contextWithTimeout = connectContextWithTimeout
+	}
+	ctx, cancel, err := contextWithTimeout(r)
+	if err != nil {
+		ss.finish(err)
+		return
+	}
+	defer cancel()
+	ss.ctx = context.WithValue(ctx, streamKey{}, ss)
+	if ss.md, err = protocol.MetadataFromHeader(r.Header); err != nil {
+		ss.finish(err)
+		return
+	}
+	ss.finish(handler(ss))
+}
+
+// negotiateCompression picks the compressors for the call: the client's
+// messages are compressed with the encoding it says, and ours with the
+// same one if the client accepts it. Connect uses the standard HTTP
+// headers for this, and gRPC its own.
+func (ss *serverStream) negotiateCompression() error {
+	encoding, accepted := protocol.Encoding(ss.r.Header), protocol.AcceptEncodings(ss.r.Header)
+	acceptHeader := protocol.AcceptEncodingHeader
+	if ss.variant == variantConnect {
+		encoding, accepted = connectEncodings(ss.r.Header)
+		acceptHeader = "Accept-Encoding"
+	}
+	// This tells the client what it could use instead, if its encoding
+	// isn't supported.
+	ss.w.Header().Set(acceptHeader, acceptEncoding())
+
+	comp, ok := compressorFor(encoding)
+	if !ok {
+		return protocol.Errorf(protocol.Unimplemented, "unsupported encoding %q", encoding)
+	}
+	ss.recvComp = comp
+	if comp != nil && slices.Contains(accepted, encoding) {
+		ss.sendComp = comp
+	}
+	return nil
+}
+
+// sendHeaderLocked writes the response headers if they haven't been yet.
+func (ss *serverStream) sendHeaderLocked() {
+	if ss.wroteHeader {
+		return
+	}
+	ss.wroteHeader = true
+	ss.header.SetHeader(ss.w.Header(), "")
+	ss.w.Header().Set("Content-Type", ss.variant.contentType(ss.json))
+	if ss.sendComp != nil {
+		ss.w.Header().Set(protocol.EncodingHeader, ss.sendComp.Name())
+	}
+	ss.w.WriteHeader(http.StatusOK)
+}
+
+// writer is what messages are written to: the response body, encoded for
+// grpc-web-text.
+func (ss *serverStream) writer() io.Writer {
+	if ss.variant == variantGRPCWebText {
+		return base64Writer{ss.w}
+	}
+	return ss.w
+}
+
+// send writes a message and flushes it, so the client gets it right away
+// instead of whenever the buffer fills up.
+func (ss *serverStream) send(msg any) error {
+	m, err := asMessage(msg)
+	if err != nil {
+		return err
+	}
+	if err := ss.ctx.Err(); err != nil {
+		return protocol.FromError(err)
+	}
+	if ss.variant == variantConnect {
+		return ss.connectSend(m)
+	}
+	ss.mu.Lock()
+	ss.sendHeaderLocked()
+	ss.mu.Unlock()
+	if err := writeMessage(ss.writer(), m, ss.sendComp); err != nil {
+		return ss.ctxErr(err)
+	}
+	if err := http.NewResponseController(ss.w).Flush(); err != nil {
+		return ss.ctxErr(err)
+	}
+	return nil
+}
+
+// recv reads the next message from the client. It returns io.EOF once the
+// client has closed its half of the stream.
+func (ss *serverStream) recv(msg any) error {
+	m, err := asMessage(msg)
+	if err != nil {
+		return err
+	}
+	if ss.variant == variantConnect {
+		return ss.connectRecv(m)
+	}
+	if err := readMessage(ss.body, m, ss.recvComp); err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return ss.ctxErr(err)
+	}
+	return nil
+}
+
+// recvOnly reads the one message of a unary or server streaming call.
+func (ss *serverStream) recvOnly(msg any) error {
+	if err := ss.recv(msg); err != nil {
+		if err == io.EOF {
+			return protocol.Errorf(protocol.Internal, "client sent no request message")
+		}
+		return err
+	}
+	if err := ss.recv(msg); err != io.EOF {
+		if err == nil {
+			return protocol.Errorf(protocol.Internal, "client sent more than one request message")
+		}
+		return err
+	}
+	return nil
+}
+
+// ctxErr turns a failed read or write into a status. If the client went
+// away or the deadline passed, that's what the status says.
+func (ss *serverStream) ctxErr(err error) error {
+	if ctxErr := ss.ctx.Err(); ctxErr != nil {
+		return protocol.FromError(ctxErr)
+	}
+	var status *protocol.Status
+	if errors.As(err, &status) {
+		return status
+	}
+	return protocol.Errorf(protocol.Internal, "%v", err)
+}
+
+// finish ends the call with the status of err. For gRPC, if no message was
+// sent, the status and all the metadata go in the headers, as a
+// Trailers-Only response.
+func (ss *serverStream) finish(err error) {
+	status := protocol.FromError(err)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	switch ss.variant {
+	case variantGRPCWeb, variantGRPCWebText:
+		ss.finishWebLocked(status)
+		return
+	case variantConnect:
+		ss.finishConnectLocked(status)
+		return
+	}
+	h := ss.w.Header()
+	if !ss.wroteHeader {
+		ss.wroteHeader = true
+		ss.header.SetHeader(h, "")
+		ss.trailer.SetHeader(h, "")
+		status.SetHeader(h, "")
+		h.Set("Content-Type", ss.variant.contentType(ss.json))
+		ss.w.WriteHeader(http.StatusOK)
+		return
+	}
+	ss.trailer.SetHeader(h, http.TrailerPrefix)
+	status.SetTrailer(h)
+}
+
+func streamFromContext(ctx context.Context) *serverStream {
+	ss, _ := ctx.Value(streamKey{}).(*serverStream)
+	return ss
+}
+
+// RequestMetadata returns the metadata the client sent with the call being
+// served with ctx.
+func RequestMetadata(ctx context.Context) protocol.Metadata {
+	if ss := streamFromContext(ctx); ss != nil {
+		return ss.md
+	}
+	return nil
+}
+
+// SetHeader adds md to the response headers of the call being served with
+// ctx. It fails once the headers have been sent with the first message.
+func SetHeader(ctx context.Context, md protocol.Metadata) error {
+	ss := streamFromContext(ctx)
+	if ss == nil {
+		return errors.New("rpc: SetHeader called outside of a handler")
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.wroteHeader {
+		return errors.New("rpc: SetHeader called after the headers were sent")
+	}
+	for key, values := range md {
+		ss.header.Append(key, values...)
+	}
+	return nil
+}
+
+// SetTrailer adds md to the trailers of the call being served with ctx.
+func SetTrailer(ctx context.Context, md protocol.Metadata) error {
+	ss := streamFromContext(ctx)
+	if ss == nil {
+		return errors.New("rpc: SetTrailer called outside of a handler")
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for key, values := range md {
+		ss.trailer.Append(key, values...)
+	}
+	return nil
+}
+
+// UnaryHandler serves a procedure that takes one message and returns one,
+// over gRPC, gRPC-Web or Connect, depending on the request's Content-Type.
+// The streaming handlers take gRPC and gRPC-Web. Returning a
+// *protocol.Status sets the status of the call; any other error is
+// Unknown.
+func UnaryHandler[Req, Res any](fn func(ctx context.Context, req *Req) (*Res, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, true, func(ss *serverStream) error {
+			req := new(Req)
+			if err := ss.recvOnly(req); err != nil {
+				return err
+			}
+			res, err := fn(ss.ctx, req)
+			if err != nil {
+				return err
+			}
+			return ss.send(res)
+		})
+	})
+}
+
+// ClientStreamingServer is the server's end of an RPC that receives many
+// messages and answers with one.
+type ClientStreamingServer[Req, Res any] struct {
+	ss *serverStream
+}
+
+// Recv returns the next message. It returns io.EOF once the client is done
+// sending.
+func (s *ClientStreamingServer[Req, Res]) Recv() (*Req, error) {
+	req := new(Req)
+	if err := s.ss.recv(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ClientStreamingHandler serves a client streaming procedure.
+func ClientStreamingHandler[Req, Res any](fn func(ctx context.Context, stream *ClientStreamingServer[Req, Res]) (*Res, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, false, func(ss *serverStream) error {
+			res, err := fn(ss.ctx, &ClientStreamingServer[Req, Res]{ss: ss})
+			if err != nil {
+				return err
+			}
+			return ss.send(res)
+		})
+	})
+}
+
+// ServerStreamingServer is the server's end of an RPC that answers one
+// message with a stream of them.
+type ServerStreamingServer[Res any] struct {
+	ss *serverStream
+}
+
+// Send sends a message to the client.
+func (s *ServerStreamingServer[Res]) Send(msg *Res) error {
+	return s.ss.send(msg)
+}
+
+// ServerStreamingHandler serves a server streaming procedure. The call ends
+// when fn returns.
+func ServerStreamingHandler[Req, Res any](fn func(ctx context.Context, req *Req, stream *ServerStreamingServer[Res]) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, false, func(ss *serverStream) error {
+			req := new(Req)
+			if err := ss.recvOnly(req); err != nil {
+				return err
+			}
+			return fn(ss.ctx, req, &ServerStreamingServer[Res]{ss: ss})
+		})
+	})
+}
+
+// BidiStreamingServer is the server's end of an RPC that streams both
+// ways. Send and Recv may be called from different goroutines.
+type BidiStreamingServer[Req, Res any] struct {
+	ss *serverStream
+}
+
+// Recv returns the next message. It returns io.EOF once the client has
+// closed its half of the stream, which doesn't stop the server from
+// sending.
+func (s *BidiStreamingServer[Req, Res]) Recv() (*Req, error) {
+	req := new(Req)
+	if err := s.ss.recv(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Send sends a message to the client.
+func (s *BidiStreamingServer[Req, Res]) Send(msg *Res) error {
+	return s.ss.send(msg)
+}
+
+// BidiStreamingHandler serves a bidirectional streaming procedure. The
+// call ends when fn returns. Over HTTP/1.1 the request and response can't
+// both stream, so serve it over HTTP/2, e.g. with h2c.
+func BidiStreamingHandler[Req, Res any](fn func(ctx context.Context, stream *BidiStreamingServer[Req, Res]) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, false, func(ss *serverStream) error {
+			return fn(ss.ctx, &BidiStreamingServer[Req, Res]{ss: ss})
+		})
+	})
+}
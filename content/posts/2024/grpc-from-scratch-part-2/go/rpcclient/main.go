@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	greetv1 "github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/gen"
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/rpc"
+)
+
+// This is the from-scratch client from part 1, taught to respect the
+// status, deadline and metadata of an RPC.
+func main() {
+	client := &rpc.Client{
+		HTTPClient: &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			},
+		},
+		BaseURL: "http://127.0.0.1:9000",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	md := protocol.Metadata{}
+	md.Append("x-request-id", "1234")
+	md.Append("trace-bin", "\x00\x01\x02")
+
+	req := &greetv1.GreetRequest{Name: "World"}
+	fmt.Println("send->", req)
+	resp, respMD, err := rpc.Unary[greetv1.GreetRequest, greetv1.GreetResponse](ctx, client, "greet.v1.GreetService/Greet", md, req)
+	if err != nil {
+		status := protocol.FromError(err)
+		log.Fatalf("err: code=%s message=%q", status.Code, status.Message)
+	}
+	fmt.Println("recv<-", resp)
+	fmt.Println("response metadata:", respMD)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	greetv1 "github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/gen"
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/protocol"
+	"github.com/sudorandom/kmcd.dev/grpc-from-scratch-part-2/rpc"
+)
+
+// This is the server from this post rebuilt on the rpc package, so it
+// answers with a real status, honors deadlines and echoes metadata.
+func main() {
+	mux := http.NewServeMux()
+	mux.Handle("/greet.v1.GreetService/Greet", rpc.UnaryHandler(greet))
+	log.Fatal(http.ListenAndServe(
+		"localhost:9000",
+		h2c.NewHandler(mux, &http2.Server{}),
+	))
+}
+
+func greet(ctx context.Context, req *greetv1.GreetRequest) (*greetv1.GreetResponse, error) {
+	fmt.Println("recv<-", req)
+	if req.Name == "" {
+		return nil, protocol.Errorf(protocol.InvalidArgument, "name is required")
+	}
+	// Echo the request metadata back in the response headers.
+	if err := rpc.SetHeader(ctx, rpc.RequestMetadata(ctx)); err != nil {
+		return nil, err
+	}
+	resp := &greetv1.GreetResponse{
+		Greeting: fmt.Sprintf("Hello, %s!", req.Name),
+	}
+	fmt.Println("send->", resp)
+	return resp, nil
+}
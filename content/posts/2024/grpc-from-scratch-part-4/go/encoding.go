@@ -2,6 +2,7 @@ package grpcfromscratchpart3
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
 	"math"
@@ -10,11 +11,29 @@ import (
 
 const (
 	MaxVarintLen64 = 10
+	// MaxFieldNumber is the largest field number a tag can have.
+	MaxFieldNumber = 1<<29 - 1
+)
+
+// Wire types, the low 3 bits of a field tag. They say how the value after
+// the tag is encoded, which is all a reader needs to skip a field it
+// doesn't know.
+const (
+	WireVarint     = 0 // int32, int64, uint32, uint64, sint32, sint64, bool, enum
+	WireFixed64    = 1 // fixed64, sfixed64, double
+	WireBytes      = 2 // string, bytes, embedded messages, packed repeated fields
+	WireStartGroup = 3 // deprecated groups, up to the matching end tag
+	WireEndGroup   = 4
+	WireFixed32    = 5 // fixed32, sfixed32, float
 )
 
 var (
-	ErrOverflow  = errors.New("overflow")
-	ErrTruncated = errors.New("truncated")
+	ErrOverflow           = errors.New("overflow")
+	ErrTruncated          = errors.New("truncated")
+	ErrInvalidFieldNumber = errors.New("invalid field number")
+	ErrInvalidWireType    = errors.New("invalid wire type")
+	ErrEndGroup           = errors.New("mismatched end group")
+	ErrGroupDepth         = errors.New("groups nested too deeply")
 )
 
 func WriteUvarint(buf *bytes.Buffer, x uint64) {
@@ -26,7 +45,7 @@ func WriteUvarint(buf *bytes.Buffer, x uint64) {
 }
 
 func WriteFieldTag(buf *bytes.Buffer, field int32, protoType uint8) {
-	WriteUvarint(buf, uint64(field<<3)|uint64(protoType))
+	WriteUvarint(buf, uint64(field)<<3|uint64(protoType))
 }
 
 func ReadFieldTag(buf *bytes.Buffer) (int32, int8, error) {
@@ -34,12 +53,14 @@ func ReadFieldTag(buf *bytes.Buffer) (int32, int8, error) {
 	if err != nil {
 		return 0, 0, err
 	}
-	if field>>3 > uint64(math.MaxInt32) {
-		return 0, 0, ErrOverflow
+	if field>>3 < 1 || field>>3 > MaxFieldNumber {
+		return 0, 0, ErrInvalidFieldNumber
 	}
 	return int32(field >> 3), int8(field & 7), nil
 }
 
+// ReadUvarint reads a varint. It returns io.EOF if buf is empty, and
+// ErrTruncated if it ends in the middle of one.
 func ReadUvarint(buf *bytes.Buffer) (uint64, error) {
 	var x uint64
 	var s uint
@@ -47,6 +68,9 @@ func ReadUvarint(buf *bytes.Buffer) (uint64, error) {
 	for {
 		b, err := buf.ReadByte()
 		if err != nil {
+			if i > 0 {
+				return 0, ErrTruncated
+			}
 			return 0, err
 		}
 		if i == MaxVarintLen64 {
@@ -64,6 +88,177 @@ func ReadUvarint(buf *bytes.Buffer) (uint64, error) {
 	}
 }
 
+// int32 and int64 are plain varints of the two's complement, so negative
+// numbers always take 10 bytes, even for int32. sint32 and sint64 zigzag
+// encode them first, to keep small negative numbers small.
+
+func WriteInt32(buf *bytes.Buffer, v int32) {
+	WriteUvarint(buf, uint64(int64(v)))
+}
+
+func WriteInt64(buf *bytes.Buffer, v int64) {
+	WriteUvarint(buf, uint64(v))
+}
+
+func WriteUint32(buf *bytes.Buffer, v uint32) {
+	WriteUvarint(buf, uint64(v))
+}
+
+func WriteSint32(buf *bytes.Buffer, v int32) {
+	WriteUvarint(buf, EncodeZigZag(int64(v)))
+}
+
+func WriteSint64(buf *bytes.Buffer, v int64) {
+	WriteUvarint(buf, EncodeZigZag(v))
+}
+
+func WriteBool(buf *bytes.Buffer, v bool) {
+	if v {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+// EncodeZigZag maps signed integers to unsigned ones so that numbers close
+// to zero stay small: 0, -1, 1, -2 become 0, 1, 2, 3.
+func EncodeZigZag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func DecodeZigZag(x uint64) int64 {
+	return int64(x>>1) ^ -int64(x&1)
+}
+
+// ReadInt32 reads an int32. Unlike casting the varint, it's an ErrOverflow
+// if the value doesn't fit, which no encoder produces.
+func ReadInt32(buf *bytes.Buffer) (int32, error) {
+	x, err := ReadUvarint(buf)
+	if err != nil {
+		return 0, err
+	}
+	if int64(x) < math.MinInt32 || int64(x) > math.MaxInt32 {
+		return 0, ErrOverflow
+	}
+	return int32(x), nil
+}
+
+func ReadInt64(buf *bytes.Buffer) (int64, error) {
+	x, err := ReadUvarint(buf)
+	return int64(x), err
+}
+
+// ReadUint32 reads a uint32, returning ErrOverflow if it doesn't fit.
+func ReadUint32(buf *bytes.Buffer) (uint32, error) {
+	x, err := ReadUvarint(buf)
+	if err != nil {
+		return 0, err
+	}
+	if x > math.MaxUint32 {
+		return 0, ErrOverflow
+	}
+	return uint32(x), nil
+}
+
+// ReadSint32 reads a zigzag encoded sint32, returning ErrOverflow if it
+// doesn't fit.
+func ReadSint32(buf *bytes.Buffer) (int32, error) {
+	x, err := ReadUvarint(buf)
+	if err != nil {
+		return 0, err
+	}
+	if x > math.MaxUint32 {
+		return 0, ErrOverflow
+	}
+	return int32(DecodeZigZag(x)), nil
+}
+
+func ReadSint64(buf *bytes.Buffer) (int64, error) {
+	x, err := ReadUvarint(buf)
+	return DecodeZigZag(x), err
+}
+
+// ReadBool reads a bool. Any non-zero varint is true.
+func ReadBool(buf *bytes.Buffer) (bool, error) {
+	x, err := ReadUvarint(buf)
+	return x != 0, err
+}
+
+// Fixed-size values are little-endian, whatever their type.
+
+func WriteFixed32(buf *bytes.Buffer, v uint32) {
+	buf.Write(binary.LittleEndian.AppendUint32(nil, v))
+}
+
+func WriteFixed64(buf *bytes.Buffer, v uint64) {
+	buf.Write(binary.LittleEndian.AppendUint64(nil, v))
+}
+
+func WriteSfixed32(buf *bytes.Buffer, v int32) {
+	WriteFixed32(buf, uint32(v))
+}
+
+func WriteSfixed64(buf *bytes.Buffer, v int64) {
+	WriteFixed64(buf, uint64(v))
+}
+
+func WriteFloat(buf *bytes.Buffer, v float32) {
+	WriteFixed32(buf, math.Float32bits(v))
+}
+
+func WriteDouble(buf *bytes.Buffer, v float64) {
+	WriteFixed64(buf, math.Float64bits(v))
+}
+
+func ReadFixed32(buf *bytes.Buffer) (uint32, error) {
+	b := buf.Next(4)
+	if len(b) < 4 {
+		return 0, ErrTruncated
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func ReadFixed64(buf *bytes.Buffer) (uint64, error) {
+	b := buf.Next(8)
+	if len(b) < 8 {
+		return 0, ErrTruncated
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func ReadSfixed32(buf *bytes.Buffer) (int32, error) {
+	v, err := ReadFixed32(buf)
+	return int32(v), err
+}
+
+func ReadSfixed64(buf *bytes.Buffer) (int64, error) {
+	v, err := ReadFixed64(buf)
+	return int64(v), err
+}
+
+func ReadFloat(buf *bytes.Buffer) (float32, error) {
+	v, err := ReadFixed32(buf)
+	return math.Float32frombits(v), err
+}
+
+func ReadDouble(buf *bytes.Buffer) (float64, error) {
+	v, err := ReadFixed64(buf)
+	return math.Float64frombits(v), err
+}
+
+// WriteBytes writes b with its length in front. Strings and embedded
+// messages are written the same way; an embedded message is just the
+// bytes of the message.
+func WriteBytes(buf *bytes.Buffer, b []byte) {
+	WriteUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func WriteString(buf *bytes.Buffer, s string) {
+	WriteUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
 func ReadBytes(buf *bytes.Buffer) ([]byte, error) {
 	size, err := ReadUvarint(buf)
 	if err != nil {
@@ -92,16 +287,131 @@ func ReadString(buf *bytes.Buffer) (string, error) {
 	return string(b), err
 }
 
+// WritePacked writes a repeated scalar field in its packed form: one tag
+// and the length of all the values, then the values with no tags. The
+// values are written with write, like WriteSint64 or WriteDouble.
+// Strings, bytes and messages can't be packed; they get a tag each.
+func WritePacked[T any](buf *bytes.Buffer, field int32, values []T, write func(*bytes.Buffer, T)) {
+	if len(values) == 0 {
+		return
+	}
+	packed := &bytes.Buffer{}
+	for _, v := range values {
+		write(packed, v)
+	}
+	WriteFieldTag(buf, field, WireBytes)
+	WriteBytes(buf, packed.Bytes())
+}
+
+// ReadPacked reads the values of a packed repeated field, after its tag,
+// using read for each of them. Readers have to accept the unpacked form
+// too, one tag per value, which is just as many calls to read.
+func ReadPacked[T any](buf *bytes.Buffer, read func(*bytes.Buffer) (T, error)) ([]T, error) {
+	packed, err := ReadBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	return readAll(bytes.NewBuffer(packed), read)
+}
+
+// readAll reads values until buf is empty.
+func readAll[T any](buf *bytes.Buffer, read func(*bytes.Buffer) (T, error)) ([]T, error) {
+	result := []T{}
+	for buf.Len() > 0 {
+		v, err := read(buf)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrTruncated
+			}
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// ReadRepeatedInt32 reads the int32s of a packed field that has already
+// been read with ReadBytes.
 func ReadRepeatedInt32(buf *bytes.Buffer) ([]int32, error) {
-	result := []int32{}
+	return readAll(buf, ReadInt32)
+}
+
+// maxGroupDepth is how deeply groups can nest, the same limit as the Go
+// protobuf module's. Past that it's more likely an attack than a message.
+const maxGroupDepth = 10000
+
+// ReadGroup reads the fields of a group started by field's start tag, up
+// to its end tag, and returns them. Groups are the deprecated proto2 way of
+// nesting messages: delimited by tags instead of a length.
+func ReadGroup(buf *bytes.Buffer, field int32) ([]byte, error) {
+	start := buf.Bytes()
+	n, err := skipGroup(buf, field, maxGroupDepth)
+	if err != nil {
+		return nil, err
+	}
+	return start[:n:n], nil
+}
+
+// SkipField skips the value of a field whose tag has just been read, as
+// returned by ReadFieldTag. Readers use it for fields they don't know, so
+// that messages from a newer version of the schema still parse. A group
+// needs the field number too, to find its matching end tag.
+func SkipField(buf *bytes.Buffer, field int32, wireType int8) error {
+	return skipField(buf, field, wireType, maxGroupDepth)
+}
+
+func skipField(buf *bytes.Buffer, field int32, wireType int8, depth int) error {
+	switch wireType {
+	case WireVarint:
+		_, err := ReadUvarint(buf)
+		if err == io.EOF {
+			return ErrTruncated
+		}
+		return err
+	case WireFixed64:
+		_, err := ReadFixed64(buf)
+		return err
+	case WireBytes:
+		_, err := ReadBytes(buf)
+		return err
+	case WireStartGroup:
+		_, err := skipGroup(buf, field, depth)
+		return err
+	case WireEndGroup:
+		// Only a group can end, and skipGroup looks for its end itself.
+		return ErrEndGroup
+	case WireFixed32:
+		_, err := ReadFixed32(buf)
+		return err
+	}
+	return ErrInvalidWireType
+}
+
+// skipGroup skips the fields of a group, including nested ones, and its
+// end tag. It returns the size of the fields, without the end tag.
+func skipGroup(buf *bytes.Buffer, field int32, depth int) (int, error) {
+	if depth == 0 {
+		return 0, ErrGroupDepth
+	}
+	n := buf.Len()
 	for {
-		res, err := ReadUvarint(buf)
+		size := n - buf.Len()
+		f, wireType, err := ReadFieldTag(buf)
 		if err == io.EOF {
-			return result, nil
-		} else if err != nil {
-			return nil, err
+			return 0, ErrTruncated
+		}
+		if err != nil {
+			return 0, err
+		}
+		if wireType == WireEndGroup {
+			if f != field {
+				return 0, ErrEndGroup
+			}
+			return size, nil
+		}
+		if err := skipField(buf, f, wireType, depth-1); err != nil {
+			return 0, err
 		}
-		result = append(result, int32(res))
 	}
 }
 
@@ -2,11 +2,14 @@ package grpcfromscratchpart3
 
 import (
 	"bytes"
+	"math"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/sudorandom/kmcd.dev/grpc-from-scratch/gen"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -107,3 +110,603 @@ func TestDecodeInt32Array(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []int32{1, 2, 3, 400}, result)
 }
+
+// The tests below check the codec against protowire, the wire format
+// package of the Go protobuf module, and against proto itself for whole
+// messages.
+
+// checkScalar checks that write matches protowire's encoding of each value,
+// and that read decodes protowire's encoding back to the same value.
+// Values are compared by their encoding, so NaN works.
+func checkScalar[T any](t *testing.T, values []T, write func(*bytes.Buffer, T), read func(*bytes.Buffer) (T, error), appendWire func([]byte, T) []byte) {
+	t.Helper()
+	for _, v := range values {
+		want := appendWire(nil, v)
+		buf := &bytes.Buffer{}
+		write(buf, v)
+		assert.Equal(t, want, buf.Bytes(), "encoding %v", v)
+
+		got, err := read(bytes.NewBuffer(want))
+		require.NoError(t, err, "decoding %v", v)
+		assert.Equal(t, want, appendWire(nil, got), "decoding %v", v)
+	}
+}
+
+func TestScalarsMatchProtowire(t *testing.T) {
+	appendVarint := protowire.AppendVarint
+	t.Run("uint64", func(t *testing.T) {
+		checkScalar(t, []uint64{0, 1, 127, 128, 300, math.MaxUint32, math.MaxUint64}, WriteUvarint, ReadUvarint, appendVarint)
+	})
+	t.Run("int32", func(t *testing.T) {
+		checkScalar(t, []int32{0, 1, -1, 1234, math.MinInt32, math.MaxInt32}, WriteInt32, ReadInt32, func(b []byte, v int32) []byte {
+			return appendVarint(b, uint64(v))
+		})
+	})
+	t.Run("int64", func(t *testing.T) {
+		checkScalar(t, []int64{0, 1, -1, math.MinInt64, math.MaxInt64}, WriteInt64, ReadInt64, func(b []byte, v int64) []byte {
+			return appendVarint(b, uint64(v))
+		})
+	})
+	t.Run("uint32", func(t *testing.T) {
+		checkScalar(t, []uint32{0, 1, 128, math.MaxUint32}, WriteUint32, ReadUint32, func(b []byte, v uint32) []byte {
+			return appendVarint(b, uint64(v))
+		})
+	})
+	t.Run("sint32", func(t *testing.T) {
+		checkScalar(t, []int32{0, 1, -1, 63, -64, 64, math.MinInt32, math.MaxInt32}, WriteSint32, ReadSint32, func(b []byte, v int32) []byte {
+			return appendVarint(b, protowire.EncodeZigZag(int64(v)))
+		})
+	})
+	t.Run("sint64", func(t *testing.T) {
+		checkScalar(t, []int64{0, 1, -1, math.MinInt64, math.MaxInt64}, WriteSint64, ReadSint64, func(b []byte, v int64) []byte {
+			return appendVarint(b, protowire.EncodeZigZag(v))
+		})
+	})
+	t.Run("bool", func(t *testing.T) {
+		checkScalar(t, []bool{false, true}, WriteBool, ReadBool, func(b []byte, v bool) []byte {
+			return appendVarint(b, protowire.EncodeBool(v))
+		})
+	})
+	t.Run("fixed32", func(t *testing.T) {
+		checkScalar(t, []uint32{0, 1, math.MaxUint32}, WriteFixed32, ReadFixed32, protowire.AppendFixed32)
+	})
+	t.Run("fixed64", func(t *testing.T) {
+		checkScalar(t, []uint64{0, 1, math.MaxUint64}, WriteFixed64, ReadFixed64, protowire.AppendFixed64)
+	})
+	t.Run("sfixed32", func(t *testing.T) {
+		checkScalar(t, []int32{0, -1, math.MinInt32, math.MaxInt32}, WriteSfixed32, ReadSfixed32, func(b []byte, v int32) []byte {
+			return protowire.AppendFixed32(b, uint32(v))
+		})
+	})
+	t.Run("sfixed64", func(t *testing.T) {
+		checkScalar(t, []int64{0, -1, math.MinInt64, math.MaxInt64}, WriteSfixed64, ReadSfixed64, func(b []byte, v int64) []byte {
+			return protowire.AppendFixed64(b, uint64(v))
+		})
+	})
+	t.Run("float", func(t *testing.T) {
+		values := []float32{0, float32(math.Copysign(0, -1)), 1.5, -3.25, math.MaxFloat32, math.SmallestNonzeroFloat32, float32(math.Inf(1)), float32(math.NaN())}
+		checkScalar(t, values, WriteFloat, ReadFloat, func(b []byte, v float32) []byte {
+			return protowire.AppendFixed32(b, math.Float32bits(v))
+		})
+	})
+	t.Run("double", func(t *testing.T) {
+		values := []float64{0, math.Copysign(0, -1), 1.5, -3.25, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(-1), math.NaN()}
+		checkScalar(t, values, WriteDouble, ReadDouble, func(b []byte, v float64) []byte {
+			return protowire.AppendFixed64(b, math.Float64bits(v))
+		})
+	})
+	t.Run("bytes", func(t *testing.T) {
+		checkScalar(t, [][]byte{{}, {0}, bytes.Repeat([]byte{0xff}, 300)}, WriteBytes, ReadBytes, protowire.AppendBytes)
+	})
+	t.Run("string", func(t *testing.T) {
+		checkScalar(t, []string{"", "hello world", "héllo", strings.Repeat("x", 200)}, WriteString, ReadString, protowire.AppendString)
+	})
+}
+
+func TestZigZagMatchesProtowire(t *testing.T) {
+	for _, v := range []int64{0, 1, -1, 2, -2, math.MinInt32, math.MaxInt32, math.MinInt64, math.MaxInt64} {
+		assert.Equal(t, protowire.EncodeZigZag(v), EncodeZigZag(v), "encoding %d", v)
+		assert.Equal(t, v, DecodeZigZag(protowire.EncodeZigZag(v)), "decoding %d", v)
+	}
+}
+
+func TestFieldTagMatchesProtowire(t *testing.T) {
+	for _, field := range []int32{1, 15, 16, 2047, 2048, 1 << 28, MaxFieldNumber} {
+		for wireType := int8(0); wireType < 8; wireType++ {
+			want := protowire.AppendTag(nil, protowire.Number(field), protowire.Type(wireType))
+			buf := &bytes.Buffer{}
+			WriteFieldTag(buf, field, uint8(wireType))
+			assert.Equal(t, want, buf.Bytes(), "field %d wire type %d", field, wireType)
+
+			gotField, gotType, err := ReadFieldTag(bytes.NewBuffer(want))
+			require.NoError(t, err)
+			assert.Equal(t, field, gotField)
+			assert.Equal(t, wireType, gotType)
+		}
+	}
+
+	for _, tag := range []uint64{0, 2, uint64(MaxFieldNumber+1) << 3} {
+		_, _, err := ReadFieldTag(bytes.NewBuffer(protowire.AppendVarint(nil, tag)))
+		assert.ErrorIs(t, err, ErrInvalidFieldNumber, "tag %d", tag)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	varint := func(x uint64) *bytes.Buffer {
+		return bytes.NewBuffer(protowire.AppendVarint(nil, x))
+	}
+	_, err := ReadInt32(varint(1 << 31))
+	assert.ErrorIs(t, err, ErrOverflow)
+	belowInt32 := int64(math.MinInt32) - 1
+	_, err = ReadInt32(varint(uint64(belowInt32)))
+	assert.ErrorIs(t, err, ErrOverflow)
+	_, err = ReadUint32(varint(1 << 32))
+	assert.ErrorIs(t, err, ErrOverflow)
+	_, err = ReadSint32(varint(1 << 32))
+	assert.ErrorIs(t, err, ErrOverflow)
+
+	// This used to be truncated to 0 without a word.
+	_, err = ReadRepeatedInt32(bytes.NewBuffer(protowire.AppendVarint([]byte{1}, 1<<32)))
+	assert.ErrorIs(t, err, ErrOverflow)
+	// A varint cut short is truncated, not the end of the values.
+	_, err = ReadRepeatedInt32(bytes.NewBuffer([]byte{1, 0x80}))
+	assert.ErrorIs(t, err, ErrTruncated)
+
+	_, err = ReadUvarint(bytes.NewBuffer(bytes.Repeat([]byte{0xff}, 11)))
+	assert.ErrorIs(t, err, ErrOverflow)
+	_, err = ReadFixed32(bytes.NewBuffer([]byte{1, 2, 3}))
+	assert.ErrorIs(t, err, ErrTruncated)
+	_, err = ReadFixed64(bytes.NewBuffer([]byte{1, 2, 3, 4, 5, 6, 7}))
+	assert.ErrorIs(t, err, ErrTruncated)
+	_, err = ReadBytes(bytes.NewBuffer([]byte{5, 'a'}))
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestPackedMatchesProtowire(t *testing.T) {
+	values := []int64{1, -1, 300, math.MinInt64}
+	var packed []byte
+	for _, v := range values {
+		packed = protowire.AppendVarint(packed, protowire.EncodeZigZag(v))
+	}
+	want := protowire.AppendBytes(protowire.AppendTag(nil, 18, protowire.BytesType), packed)
+
+	buf := &bytes.Buffer{}
+	WritePacked(buf, 18, values, WriteSint64)
+	assert.Equal(t, want, buf.Bytes())
+
+	field, wireType, err := ReadFieldTag(buf)
+	require.NoError(t, err)
+	assert.Equal(t, int32(18), field)
+	assert.Equal(t, int8(WireBytes), wireType)
+	got, err := ReadPacked(buf, ReadSint64)
+	require.NoError(t, err)
+	assert.Equal(t, values, got)
+
+	// Empty repeated fields aren't written at all.
+	buf.Reset()
+	WritePacked(buf, 18, nil, WriteSint64)
+	assert.Zero(t, buf.Len())
+}
+
+// unknownFields has a field of every wire type, including nested groups,
+// written by protowire. None of them are in TestMessage.
+func unknownFields() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 100, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1<<40)
+	b = protowire.AppendTag(b, 101, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, 42)
+	b = protowire.AppendTag(b, 102, protowire.BytesType)
+	b = protowire.AppendString(b, "unknown")
+	b = protowire.AppendTag(b, 103, protowire.StartGroupType)
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	b = protowire.AppendTag(b, 2, protowire.StartGroupType)
+	b = protowire.AppendTag(b, 1, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 7)
+	b = protowire.AppendTag(b, 2, protowire.EndGroupType)
+	b = protowire.AppendTag(b, 103, protowire.EndGroupType)
+	b = protowire.AppendTag(b, 104, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 42)
+	return b
+}
+
+func TestSkipFieldMatchesProtowire(t *testing.T) {
+	b := unknownFields()
+	buf := bytes.NewBuffer(b)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+
+		field, wireType, err := ReadFieldTag(buf)
+		require.NoError(t, err)
+		require.NoError(t, SkipField(buf, field, wireType))
+		assert.Equal(t, len(b), buf.Len(), "after field %d", field)
+	}
+
+	tests := map[string][]byte{
+		"end group":            protowire.AppendTag(nil, 1, protowire.EndGroupType),
+		"mismatched end group": protowire.AppendTag(protowire.AppendTag(nil, 1, protowire.StartGroupType), 2, protowire.EndGroupType),
+		"unterminated group":   protowire.AppendTag(nil, 1, protowire.StartGroupType),
+		"reserved wire type":   protowire.AppendTag(nil, 1, 6),
+		"truncated fixed64":    append(protowire.AppendTag(nil, 1, protowire.Fixed64Type), 1, 2, 3),
+		"truncated bytes":      append(protowire.AppendTag(nil, 1, protowire.BytesType), 10, 1),
+		"truncated varint":     append(protowire.AppendTag(nil, 1, protowire.VarintType), 0x80),
+		"deep groups":          bytes.Repeat(protowire.AppendTag(nil, 1, protowire.StartGroupType), maxGroupDepth+2),
+	}
+	for name, b := range tests {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0, name)
+		assert.Less(t, protowire.ConsumeFieldValue(num, typ, b[n:]), 0, "protowire: %s", name)
+
+		buf := bytes.NewBuffer(b)
+		field, wireType, err := ReadFieldTag(buf)
+		require.NoError(t, err, name)
+		assert.Error(t, SkipField(buf, field, wireType), name)
+	}
+}
+
+func TestReadGroupMatchesProtowire(t *testing.T) {
+	b := unknownFields()
+	// Skip ahead to the group, field 103.
+	for {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		if num == 103 {
+			want, n := protowire.ConsumeGroup(num, b)
+			require.GreaterOrEqual(t, n, 0)
+
+			buf := bytes.NewBuffer(b)
+			got, err := ReadGroup(buf, 103)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+			assert.Equal(t, len(b)-n, buf.Len())
+			return
+		}
+		b = b[protowire.ConsumeFieldValue(num, typ, b):]
+	}
+}
+
+// allTypes is a full AllTypes message. Field order and zero values are the
+// ones proto.Marshal writes, so encodings can be compared byte for byte.
+func allTypes() *gen.AllTypes {
+	return &gen.AllTypes{
+		IntValue:             -1234,
+		UintValue:            math.MaxUint64,
+		BoolValue:            true,
+		StringValue:          "hello world",
+		RepeatedIntValue:     []int32{100002130, -2, 3},
+		NestedMessage:        &gen.AllTypes_NestedMessage{NestedString: "nested"},
+		Int64Value:           math.MinInt64,
+		Uint32Value:          math.MaxUint32,
+		Sint32Value:          -64,
+		Sint64Value:          -1 << 40,
+		BytesValue:           []byte{0, 1, 2},
+		Fixed32Value:         0xdeadbeef,
+		Fixed64Value:         math.MaxUint64,
+		Sfixed32Value:        -2,
+		Sfixed64Value:        -3,
+		FloatValue:           1.5,
+		DoubleValue:          math.Copysign(0, -1),
+		RepeatedSint64Value:  []int64{-1, 0, 1},
+		RepeatedFixed32Value: []uint32{1, 2},
+		RepeatedDoubleValue:  []float64{math.Inf(1), -0.5},
+		UnpackedInt64Value:   []int64{-1, 2},
+		RepeatedStringValue:  []string{"a", "", "c"},
+		RepeatedNestedMessage: []*gen.AllTypes_NestedMessage{
+			{NestedString: "first"},
+			{},
+		},
+	}
+}
+
+// marshalAllTypes is a hand-written proto.Marshal for AllTypes. With
+// packed false, the packed fields are written one tag per value.
+func marshalAllTypes(m *gen.AllTypes, packed bool) []byte {
+	buf := &bytes.Buffer{}
+	repeated := func(field int32, wireType uint8, n int, write func(*bytes.Buffer, int)) {
+		if packed && wireType != WireBytes {
+			indexes := make([]int, n)
+			for i := range indexes {
+				indexes[i] = i
+			}
+			WritePacked(buf, field, indexes, write)
+			return
+		}
+		for i := 0; i < n; i++ {
+			WriteFieldTag(buf, field, wireType)
+			write(buf, i)
+		}
+	}
+	nested := func(buf *bytes.Buffer, m *gen.AllTypes_NestedMessage) {
+		msg := &bytes.Buffer{}
+		if m.NestedString != "" {
+			WriteFieldTag(msg, 1, WireBytes)
+			WriteString(msg, m.NestedString)
+		}
+		WriteBytes(buf, msg.Bytes())
+	}
+
+	if m.IntValue != 0 {
+		WriteFieldTag(buf, 1, WireVarint)
+		WriteInt32(buf, m.IntValue)
+	}
+	if m.UintValue != 0 {
+		WriteFieldTag(buf, 2, WireVarint)
+		WriteUvarint(buf, m.UintValue)
+	}
+	if m.BoolValue {
+		WriteFieldTag(buf, 3, WireVarint)
+		WriteBool(buf, m.BoolValue)
+	}
+	if m.StringValue != "" {
+		WriteFieldTag(buf, 4, WireBytes)
+		WriteString(buf, m.StringValue)
+	}
+	if m.Int64Value != 0 {
+		WriteFieldTag(buf, 5, WireVarint)
+		WriteInt64(buf, m.Int64Value)
+	}
+	if m.Uint32Value != 0 {
+		WriteFieldTag(buf, 6, WireVarint)
+		WriteUint32(buf, m.Uint32Value)
+	}
+	if m.Sint32Value != 0 {
+		WriteFieldTag(buf, 7, WireVarint)
+		WriteSint32(buf, m.Sint32Value)
+	}
+	if m.Sint64Value != 0 {
+		WriteFieldTag(buf, 8, WireVarint)
+		WriteSint64(buf, m.Sint64Value)
+	}
+	if len(m.BytesValue) > 0 {
+		WriteFieldTag(buf, 9, WireBytes)
+		WriteBytes(buf, m.BytesValue)
+	}
+	repeated(10, WireVarint, len(m.RepeatedIntValue), func(buf *bytes.Buffer, i int) { WriteInt32(buf, m.RepeatedIntValue[i]) })
+	if m.NestedMessage != nil {
+		WriteFieldTag(buf, 11, WireBytes)
+		nested(buf, m.NestedMessage)
+	}
+	if m.Fixed32Value != 0 {
+		WriteFieldTag(buf, 12, WireFixed32)
+		WriteFixed32(buf, m.Fixed32Value)
+	}
+	if m.Fixed64Value != 0 {
+		WriteFieldTag(buf, 13, WireFixed64)
+		WriteFixed64(buf, m.Fixed64Value)
+	}
+	if m.Sfixed32Value != 0 {
+		WriteFieldTag(buf, 14, WireFixed32)
+		WriteSfixed32(buf, m.Sfixed32Value)
+	}
+	if m.Sfixed64Value != 0 {
+		WriteFieldTag(buf, 15, WireFixed64)
+		WriteSfixed64(buf, m.Sfixed64Value)
+	}
+	// -0 is written: only all zero bits are the default.
+	if math.Float32bits(m.FloatValue) != 0 {
+		WriteFieldTag(buf, 16, WireFixed32)
+		WriteFloat(buf, m.FloatValue)
+	}
+	if math.Float64bits(m.DoubleValue) != 0 {
+		WriteFieldTag(buf, 17, WireFixed64)
+		WriteDouble(buf, m.DoubleValue)
+	}
+	repeated(18, WireVarint, len(m.RepeatedSint64Value), func(buf *bytes.Buffer, i int) { WriteSint64(buf, m.RepeatedSint64Value[i]) })
+	repeated(19, WireFixed32, len(m.RepeatedFixed32Value), func(buf *bytes.Buffer, i int) { WriteFixed32(buf, m.RepeatedFixed32Value[i]) })
+	repeated(20, WireFixed64, len(m.RepeatedDoubleValue), func(buf *bytes.Buffer, i int) { WriteDouble(buf, m.RepeatedDoubleValue[i]) })
+	// Declared with packed = false, so never packed.
+	for _, v := range m.UnpackedInt64Value {
+		WriteFieldTag(buf, 21, WireVarint)
+		WriteInt64(buf, v)
+	}
+	repeated(22, WireBytes, len(m.RepeatedStringValue), func(buf *bytes.Buffer, i int) { WriteString(buf, m.RepeatedStringValue[i]) })
+	repeated(23, WireBytes, len(m.RepeatedNestedMessage), func(buf *bytes.Buffer, i int) { nested(buf, m.RepeatedNestedMessage[i]) })
+	return buf.Bytes()
+}
+
+// readRepeated reads a repeated scalar field in either form: packed, or a
+// single value with its own tag.
+func readRepeated[T any](buf *bytes.Buffer, wireType int8, values *[]T, read func(*bytes.Buffer) (T, error)) error {
+	if wireType == WireBytes {
+		packed, err := ReadPacked(buf, read)
+		*values = append(*values, packed...)
+		return err
+	}
+	v, err := read(buf)
+	*values = append(*values, v)
+	return err
+}
+
+// readInto reads one value into *v.
+func readInto[T any](buf *bytes.Buffer, v *T, read func(*bytes.Buffer) (T, error)) error {
+	var err error
+	*v, err = read(buf)
+	return err
+}
+
+func unmarshalNested(buf *bytes.Buffer) (*gen.AllTypes_NestedMessage, error) {
+	b, err := ReadBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = bytes.NewBuffer(b)
+	m := &gen.AllTypes_NestedMessage{}
+	for buf.Len() > 0 {
+		field, wireType, err := ReadFieldTag(buf)
+		if err != nil {
+			return nil, err
+		}
+		if field == 1 && wireType == WireBytes {
+			err = readInto(buf, &m.NestedString, ReadString)
+		} else {
+			err = SkipField(buf, field, wireType)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// unmarshalAllTypes is a hand-written proto.Unmarshal for AllTypes.
+// Unknown fields, or known ones with the wrong wire type, are skipped.
+func unmarshalAllTypes(b []byte) (*gen.AllTypes, error) {
+	m := &gen.AllTypes{}
+	buf := bytes.NewBuffer(b)
+	for buf.Len() > 0 {
+		field, wireType, err := ReadFieldTag(buf)
+		if err != nil {
+			return nil, err
+		}
+		// The wire type each field has when it isn't packed.
+		wireTypes := map[int32]int8{
+			1: WireVarint, 2: WireVarint, 3: WireVarint, 4: WireBytes, 5: WireVarint,
+			6: WireVarint, 7: WireVarint, 8: WireVarint, 9: WireBytes, 10: WireVarint,
+			11: WireBytes, 12: WireFixed32, 13: WireFixed64, 14: WireFixed32, 15: WireFixed64,
+			16: WireFixed32, 17: WireFixed64, 18: WireVarint, 19: WireFixed32, 20: WireFixed64,
+			21: WireVarint, 22: WireBytes, 23: WireBytes,
+		}
+		want, known := wireTypes[field]
+		packable := field == 10 || (field >= 18 && field <= 21)
+		if !known || wireType != want && !(packable && wireType == WireBytes) {
+			if err := SkipField(buf, field, wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		switch field {
+		case 1:
+			err = readInto(buf, &m.IntValue, ReadInt32)
+		case 2:
+			err = readInto(buf, &m.UintValue, ReadUvarint)
+		case 3:
+			err = readInto(buf, &m.BoolValue, ReadBool)
+		case 4:
+			err = readInto(buf, &m.StringValue, ReadString)
+		case 5:
+			err = readInto(buf, &m.Int64Value, ReadInt64)
+		case 6:
+			err = readInto(buf, &m.Uint32Value, ReadUint32)
+		case 7:
+			err = readInto(buf, &m.Sint32Value, ReadSint32)
+		case 8:
+			err = readInto(buf, &m.Sint64Value, ReadSint64)
+		case 9:
+			err = readInto(buf, &m.BytesValue, ReadBytes)
+		case 10:
+			err = readRepeated(buf, wireType, &m.RepeatedIntValue, ReadInt32)
+		case 11:
+			// Repeats of a message field are merged; one is enough here.
+			err = readInto(buf, &m.NestedMessage, unmarshalNested)
+		case 12:
+			err = readInto(buf, &m.Fixed32Value, ReadFixed32)
+		case 13:
+			err = readInto(buf, &m.Fixed64Value, ReadFixed64)
+		case 14:
+			err = readInto(buf, &m.Sfixed32Value, ReadSfixed32)
+		case 15:
+			err = readInto(buf, &m.Sfixed64Value, ReadSfixed64)
+		case 16:
+			err = readInto(buf, &m.FloatValue, ReadFloat)
+		case 17:
+			err = readInto(buf, &m.DoubleValue, ReadDouble)
+		case 18:
+			err = readRepeated(buf, wireType, &m.RepeatedSint64Value, ReadSint64)
+		case 19:
+			err = readRepeated(buf, wireType, &m.RepeatedFixed32Value, ReadFixed32)
+		case 20:
+			err = readRepeated(buf, wireType, &m.RepeatedDoubleValue, ReadDouble)
+		case 21:
+			err = readRepeated(buf, wireType, &m.UnpackedInt64Value, ReadInt64)
+		case 22:
+			var s string
+			err = readInto(buf, &s, ReadString)
+			m.RepeatedStringValue = append(m.RepeatedStringValue, s)
+		case 23:
+			var nested *gen.AllTypes_NestedMessage
+			err = readInto(buf, &nested, unmarshalNested)
+			m.RepeatedNestedMessage = append(m.RepeatedNestedMessage, nested)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func TestAllTypesMatchesProto(t *testing.T) {
+	m := allTypes()
+	want, err := proto.Marshal(m)
+	require.NoError(t, err)
+	assert.Equal(t, want, marshalAllTypes(m, true))
+
+	got, err := unmarshalAllTypes(want)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(m, got), "got %v", got)
+
+	// Readers have to take repeated scalars unpacked too.
+	unpacked := marshalAllTypes(m, false)
+	assert.NotEqual(t, want, unpacked)
+	res := &gen.AllTypes{}
+	require.NoError(t, proto.Unmarshal(unpacked, res))
+	assert.True(t, proto.Equal(m, res), "proto got %v", res)
+	got, err = unmarshalAllTypes(unpacked)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(m, got), "got %v", got)
+
+	// Fields from a newer schema, or with an unexpected wire type, are
+	// skipped. proto keeps them as unknown fields, so compare without them.
+	withUnknown := append(unknownFields(), want...)
+	withUnknown = append(withUnknown, protowire.AppendFixed32(protowire.AppendTag(nil, 1, protowire.Fixed32Type), 7)...)
+	got, err = unmarshalAllTypes(withUnknown)
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(m, got), "got %v", got)
+
+	assert.Empty(t, marshalAllTypes(&gen.AllTypes{}, true))
+}
+
+// FuzzSkipField walks arbitrary input field by field with ReadFieldTag and
+// SkipField, and with protowire, and checks they agree on where each field
+// ends and on whether the input is valid.
+func FuzzSkipField(f *testing.F) {
+	f.Add(unknownFields())
+	b, _ := proto.Marshal(allTypes())
+	f.Add(b)
+	f.Add([]byte{0x0b, 0x14})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		buf := bytes.NewBuffer(b)
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n >= 0 && num > MaxFieldNumber {
+				// protowire leaves this to proto, which rejects it.
+				n = -1
+			}
+			if n >= 0 {
+				b = b[n:]
+				n = protowire.ConsumeFieldValue(num, typ, b)
+			}
+
+			field, wireType, err := ReadFieldTag(buf)
+			if err == nil {
+				err = SkipField(buf, field, wireType)
+			}
+			if n < 0 || err != nil {
+				if (n < 0) != (err != nil) {
+					t.Fatalf("protowire error %v, our error %v", protowire.ParseError(n), err)
+				}
+				return
+			}
+			b = b[n:]
+			if len(b) != buf.Len() {
+				t.Fatalf("protowire has %d bytes left, we have %d", len(b), buf.Len())
+			}
+		}
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sudorandom/kmcd.dev/http1.1-from-scratch/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: conformance.Mux()}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	conformance.Run(t, l.Addr().String(), conformance.HTTP09Corpus, conformance.Options{
+		SimpleResponse: true,
+	})
+}
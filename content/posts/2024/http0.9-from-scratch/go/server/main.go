@@ -2,46 +2,220 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// shutdownPollInterval is how often Shutdown checks for connections that
+// have gone idle and can be closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
 type Server struct {
 	Addr    string
 	Handler http.Handler
+
+	// ReadHeaderTimeout is the amount of time allowed to read the request
+	// line. Zero means no timeout.
+	ReadHeaderTimeout time.Duration
+	// WriteTimeout is the maximum duration before timing out writes of the
+	// response. Zero means no timeout.
+	WriteTimeout time.Duration
+	// MaxConns limits the number of simultaneously open connections. Zero
+	// means no limit.
+	MaxConns int
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]bool // value is true when the connection is idle
+	doneChan   chan struct{}
+	inShutdown atomic.Bool
 }
 
 func (s *Server) ListenAndServe() error {
 	if s.Handler == nil {
 		panic("http server started without a handler")
 	}
+	if s.shuttingDown() {
+		return http.ErrServerClosed
+	}
 	l, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and handles each one in a new goroutine.
+// After Shutdown, it returns http.ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return http.ErrServerClosed
+	}
+	defer s.trackListener(l, false)
 	defer l.Close()
 
+	var sem chan struct{}
+	if s.MaxConns > 0 {
+		sem = make(chan struct{}, s.MaxConns)
+	}
+
 	for {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-s.getDoneChan():
+				return http.ErrServerClosed
+			}
+		}
+
 		conn, err := l.Accept()
 		if err != nil {
-			log.Fatal(err)
+			if s.shuttingDown() {
+				return http.ErrServerClosed
+			}
+			return err
 		}
 
-		go s.handleConnection(conn)
+		// Track the connection before its goroutine starts, so a Shutdown
+		// that runs in between still waits for it or closes it.
+		s.setConnState(conn, true)
+		go func() {
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			s.handleConnection(conn)
+		}()
 	}
 }
 
+// Shutdown stops accepting new connections, closes connections that haven't
+// started sending a request and waits for the rest to finish. If ctx expires
+// first, the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if s.doneChan == nil {
+		s.doneChan = make(chan struct{})
+	}
+	select {
+	case <-s.doneChan:
+	default:
+		close(s.doneChan)
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+func (s *Server) getDoneChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.doneChan == nil {
+		s.doneChan = make(chan struct{})
+	}
+	return s.doneChan
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) setConnState(conn net.Conn, idle bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.conns[conn] = idle
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeIdleConns closes all idle connections and reports whether there are
+// no connections left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
+	defer s.forgetConn(conn)
+
+	// The connection is idle until the client sends the first byte.
+	if s.ReadHeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.ReadHeaderTimeout))
+	}
 
 	reader := bufio.NewReader(conn)
-	line, _, err := reader.ReadLine()
+	if _, err := reader.Peek(1); err != nil {
+		return
+	}
+	s.setConnState(conn, false)
+
+	// ReadLine would hand back a line cut short by ReadHeaderTimeout as if
+	// it were complete, so look for the newline ourselves.
+	line, err := reader.ReadSlice('\n')
 	if err != nil {
 		return
 	}
+	conn.SetReadDeadline(time.Time{})
+	if s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
 
 	fields := strings.Fields(string(line))
 	if len(fields) < 2 {
@@ -53,6 +227,8 @@ func (s *Server) handleConnection(conn net.Conn) {
 		Proto:      "HTTP/0.9",
 		ProtoMajor: 0,
 		ProtoMinor: 9,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
 		RemoteAddr: conn.RemoteAddr().String(),
 	}
 
@@ -60,12 +236,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 }
 
 type responseBodyWriter struct {
-	conn net.Conn
+	conn    net.Conn
+	headers http.Header
 }
 
 func (r *responseBodyWriter) Header() http.Header {
-	// unsupported with HTTP/0.9
-	return nil
+	// unsupported with HTTP/0.9, so anything set here is never sent
+	return r.headers
 }
 
 func (r *responseBodyWriter) Write(b []byte) (int, error) {
@@ -78,7 +255,8 @@ func (r *responseBodyWriter) WriteHeader(statusCode int) {
 
 func newWriter(c net.Conn) http.ResponseWriter {
 	return &responseBodyWriter{
-		conn: c,
+		conn:    c,
+		headers: make(http.Header),
 	}
 }
 
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer runs s on a random local port and returns its address. The
+// server is shut down when the test finishes.
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return l.Addr().String()
+}
+
+func hello(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("Hello World!"))
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler:           http.HandlerFunc(hello),
+		ReadHeaderTimeout: 100 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send half a request line and stall.
+	if _, err := io.WriteString(conn, "GET /ind"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected server to close the connection, got %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	writeErr := make(chan error, 1)
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Far more than the socket buffers hold, for a client that
+			// never reads.
+			chunk := []byte(strings.Repeat("a", 64<<10))
+			for range 1024 {
+				if _, err := w.Write(chunk); err != nil {
+					writeErr <- err
+					return
+				}
+			}
+			writeErr <- nil
+		}),
+		WriteTimeout: 100 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET /\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-writeErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("got write error %v, want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("write didn't time out")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler:           http.HandlerFunc(hello),
+		ReadHeaderTimeout: 5 * time.Second,
+		MaxConns:          1,
+	})
+
+	// The first connection takes the only slot by sending nothing.
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := io.WriteString(first, "GET"); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, err := io.WriteString(second, "GET /\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected second connection to wait, got %v", err)
+	}
+
+	// Finishing the first request frees up the slot.
+	if _, err := io.WriteString(first, " /\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	body, err := io.ReadAll(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Hello World!" {
+		t.Errorf("got body %q", body)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			hello(w, r)
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.WriteString(conn, "GET /\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	body := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(conn)
+		body <- string(b)
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("Serve returned %v, want %v", err, http.ErrServerClosed)
+	}
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if got := <-body; got != "Hello World!" {
+		t.Errorf("got body %q", got)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("server still accepts connections after Shutdown")
+	}
+}
+
+func TestShutdownClosesNewConnections(t *testing.T) {
+	// A connection that was just accepted counts as idle, so Shutdown
+	// closes it instead of returning while it's still about to be served.
+	s := &Server{Handler: http.HandlerFunc(hello)}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// It's a reset rather than EOF if Shutdown closed the listener before
+	// the connection was accepted.
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected Shutdown to close the connection, got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+module github.com/sudorandom/kmcd.dev/http1.0-from-scratch
+
+go 1.22.4
+
+require github.com/sudorandom/kmcd.dev/http1.1-from-scratch v0.0.0
+
+replace github.com/sudorandom/kmcd.dev/http1.1-from-scratch => ../../../2026/http1.1-from-scratch/go
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sudorandom/kmcd.dev/http1.1-from-scratch/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: conformance.Mux()}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	conformance.Run(t, l.Addr().String(), conformance.HTTP10Corpus, conformance.Options{
+		Allow: append(
+			conformance.AllowCases("Content-Length", "the body is delimited by closing the connection",
+				"echo empty", "echo", "echo html", "status", "not found status", "bad status", "headers", "nothing", "not found"),
+			conformance.AllowCases("Content-Type", "the HTTP/1.0 server doesn't sniff Content-Type",
+				"echo", "echo html", "bad status")...),
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaders(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Look up the headers by hand, which only works for canonical keys.
+			json.NewEncoder(w).Encode(map[string][]string{
+				"X-Custom-Header": r.Header["X-Custom-Header"],
+			})
+		}),
+		MaxHeaderBytes:      1024,
+		MaxHeaderFieldBytes: 256,
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	testCases := []struct {
+		name       string
+		request    string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "canonical keys and trimmed values",
+			request:    "GET / HTTP/1.0\r\nx-custom-header:\t one \t\r\nX-CUSTOM-HEADER: two\r\n\r\n",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"X-Custom-Header":["one","two"]}` + "\n",
+		},
+		{
+			name:       "obsolete line folding",
+			request:    "GET / HTTP/1.0\r\nX-Folded: first\r\n  second\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "folded Content-Length",
+			request:    "POST / HTTP/1.0\r\nContent-Length:\r\n 5\r\n\r\nhello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid header name",
+			request:    "GET / HTTP/1.0\r\nX Custom: one\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "field too large",
+			request:    "GET / HTTP/1.0\r\nX-Big: " + strings.Repeat("a", 300) + "\r\n\r\n",
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "headers too large",
+			request:    "GET / HTTP/1.0\r\n" + strings.Repeat("X-Field: "+strings.Repeat("a", 100)+"\r\n", 10) + "\r\n",
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "more than fits in the read limit",
+			request:    "GET / HTTP/1.0\r\nX-Big: " + strings.Repeat("a", 2000) + "\r\n\r\n",
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			if _, err := io.WriteString(conn, tc.request); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if tc.wantBody != "" && string(body) != tc.wantBody {
+				t.Errorf("got body %q, want %q", body, tc.wantBody)
+			}
+		})
+	}
+}
@@ -17,31 +17,91 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// shutdownPollInterval is how often Shutdown checks for connections that
+// have gone idle and can be closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
 type Server struct {
 	Addr    string
 	Handler http.Handler
+
+	// ReadHeaderTimeout is the amount of time allowed to read the request
+	// line and headers. Zero means no timeout.
+	ReadHeaderTimeout time.Duration
+	// WriteTimeout is the maximum duration before timing out writes of the
+	// response. Zero means no timeout.
+	WriteTimeout time.Duration
+	// MaxConns limits the number of simultaneously open connections. Zero
+	// means no limit.
+	MaxConns int
+	// MaxHeaderBytes limits the size of the request line and headers
+	// together. Zero means 1MB.
+	MaxHeaderBytes int
+	// MaxHeaderFieldBytes limits the size of a single header field. Zero
+	// means 8KB.
+	MaxHeaderFieldBytes int
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]bool // value is true when the connection is idle
+	doneChan   chan struct{}
+	inShutdown atomic.Bool
 }
 
 func (s *Server) ListenAndServe() error {
-	handler := s.Handler
-	if handler == nil {
-		handler = http.DefaultServeMux
+	if s.shuttingDown() {
+		return http.ErrServerClosed
 	}
 	l, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and handles each one in a new goroutine.
+// After Shutdown, it returns http.ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return http.ErrServerClosed
+	}
+	defer s.trackListener(l, false)
 	defer l.Close()
 
+	var sem chan struct{}
+	if s.MaxConns > 0 {
+		sem = make(chan struct{}, s.MaxConns)
+	}
+
 	for {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-s.getDoneChan():
+				return http.ErrServerClosed
+			}
+		}
+
 		conn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return http.ErrServerClosed
+			}
 			return err
 		}
 
+		// Track the connection before its goroutine starts, so a Shutdown
+		// that runs in between still waits for it or closes it.
+		s.setConnState(conn, true)
 		go func() {
+			if sem != nil {
+				defer func() { <-sem }()
+			}
 			if err := s.handleConnection(conn); err != nil {
 				slog.Error(fmt.Sprintf("http error: %s", err))
 			}
@@ -49,13 +109,143 @@ func (s *Server) ListenAndServe() error {
 	}
 }
 
+// Shutdown stops accepting new connections, closes connections that haven't
+// started sending a request and waits for the rest to finish. If ctx expires
+// first, the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if s.doneChan == nil {
+		s.doneChan = make(chan struct{})
+	}
+	select {
+	case <-s.doneChan:
+	default:
+		close(s.doneChan)
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+func (s *Server) handler() http.Handler {
+	if s.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return s.Handler
+}
+
+func (s *Server) maxHeaderBytes() int {
+	if s.MaxHeaderBytes > 0 {
+		return s.MaxHeaderBytes
+	}
+	return 1 << 20
+}
+
+func (s *Server) maxHeaderFieldBytes() int {
+	if s.MaxHeaderFieldBytes > 0 {
+		return s.MaxHeaderFieldBytes
+	}
+	return 8 << 10
+}
+
+func (s *Server) getDoneChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.doneChan == nil {
+		s.doneChan = make(chan struct{})
+	}
+	return s.doneChan
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) setConnState(conn net.Conn, idle bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.conns[conn] = idle
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeIdleConns closes all idle connections and reports whether there are
+// no connections left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
 func (s *Server) handleConnection(conn net.Conn) error {
 	defer conn.Close()
+	defer s.forgetConn(conn)
 
-	// Limit headers to 1MB
-	limitReader := io.LimitReader(conn, 1*1024*1024).(*io.LimitedReader)
+	// The connection is idle until the client sends the first byte.
+	if s.ReadHeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.ReadHeaderTimeout))
+	}
+
+	// Limit the request line and headers to MaxHeaderBytes
+	limitReader := io.LimitReader(conn, int64(s.maxHeaderBytes())).(*io.LimitedReader)
 	reader := bufio.NewReader(limitReader)
-	headerReader := textproto.NewReader(bufio.NewReader(reader))
+	if _, err := reader.Peek(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return fmt.Errorf("read request line error: %w", err)
+	}
+	s.setConnState(conn, false)
+	headerReader := textproto.NewReader(reader)
 
 	// Read the request line: GET /path/to/index.html HTTP/1.0
 	reqLine, err := headerReader.ReadLine()
@@ -93,8 +283,13 @@ func (s *Server) handleConnection(conn net.Conn) error {
 
 	// Parse headers
 	req.Header = make(http.Header)
+	headerBytes := len(reqLine) + 2
 	for {
 		line, err := headerReader.ReadLineBytes()
+		if err != nil && limitReader.N == 0 {
+			writeError(conn, http.StatusRequestHeaderFieldsTooLarge)
+			return errors.New("request headers too large")
+		}
 		if err != nil && err != io.EOF {
 			return err
 		} else if err != nil {
@@ -104,15 +299,35 @@ func (s *Server) handleConnection(conn net.Conn) error {
 			break
 		}
 
+		headerBytes += len(line) + 2
+		if len(line) > s.maxHeaderFieldBytes() || headerBytes > s.maxHeaderBytes() {
+			writeError(conn, http.StatusRequestHeaderFieldsTooLarge)
+			return errors.New("request headers too large")
+		}
+
+		// HTTP/1.0 let a field continue on the next line if that line
+		// started with whitespace. RFC 9112 section 5.2 lets a server reject
+		// that, and we do: a proxy in front of us might have read the
+		// folded line differently, for a Content-Length as well.
+		if line[0] == ' ' || line[0] == '\t' {
+			writeError(conn, http.StatusBadRequest)
+			return errors.New("obsolete line folding")
+		}
 		k, v, ok := bytes.Cut(line, []byte{':'})
-		if !ok {
+		if !ok || !validHeaderName(k) {
+			writeError(conn, http.StatusBadRequest)
 			return errors.New("invalid header")
 		}
-		req.Header.Add(strings.ToLower(string(k)), strings.TrimLeft(string(v), " "))
+		key := textproto.CanonicalMIMEHeaderKey(string(k))
+		req.Header[key] = append(req.Header[key], string(bytes.Trim(v, " \t")))
 	}
 
 	// Unbound the limit after we've read the headers since the body can be any size
 	limitReader.N = math.MaxInt64
+	conn.SetReadDeadline(time.Time{})
+	if s.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
 
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, http.LocalAddrContextKey, conn.LocalAddr())
@@ -142,13 +357,42 @@ func (s *Server) handleConnection(conn net.Conn) error {
 	}
 
 	// Finally, call our http.Handler!
-	s.Handler.ServeHTTP(w, req.WithContext(ctx))
+	s.handler().ServeHTTP(w, req.WithContext(ctx))
 	if !w.sentHeaders {
 		w.sendHeaders(http.StatusOK)
 	}
 	return nil
 }
 
+// writeError sends a bare status line for a request that never made it to
+// the handler. The rest of the request is left unread, so the connection is
+// shut down for writing and drained before it's closed. Closing a socket
+// with unread data makes the kernel send a RST, which can destroy the
+// response before the client gets to read it.
+func writeError(conn net.Conn, statusCode int) {
+	fmt.Fprintf(conn, "HTTP/1.0 %d %s\r\n\r\n", statusCode, http.StatusText(statusCode))
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	io.Copy(io.Discard, io.LimitReader(conn, 256<<10))
+}
+
+// validHeaderName reports whether name is a token, which rules out empty
+// names and whitespace or separators like "@" and "/".
+func validHeaderName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		isAlnum := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+		if !isAlnum && !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
 type noBody struct{}
 
 func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
@@ -0,0 +1,244 @@
+// Package conformance replays raw HTTP requests against one of the
+// from-scratch servers and against net/http, then reports every place where
+// the two responses disagree. Differences that are known and intentional can
+// be listed in an allowlist.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mux returns the routes shared by the from-scratch server demos. The same
+// mux is mounted on both servers under test.
+func Mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write(b)
+	})
+	mux.HandleFunc("/echo/chunked", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		io.Copy(w, r.Body)
+	})
+	mux.HandleFunc("/status/{status}", func(w http.ResponseWriter, r *http.Request) {
+		status, err := strconv.ParseInt(r.PathValue("status"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, fmt.Sprintf("error: %s", err))
+			return
+		}
+		w.WriteHeader(int(status))
+	})
+	mux.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(r.Header)
+	})
+	mux.HandleFunc("/nothing", func(w http.ResponseWriter, r *http.Request) {})
+	return mux
+}
+
+// Case is a single request in the corpus.
+type Case struct {
+	Name string
+	// Request holds the raw bytes sent to the from-scratch server.
+	Request string
+	// Reference holds the raw bytes sent to net/http. If empty, Request is
+	// used. HTTP/0.9 cases need this since net/http doesn't speak HTTP/0.9.
+	Reference string
+}
+
+// Allow is a known, intentional difference between the from-scratch server
+// and net/http.
+type Allow struct {
+	// Case is the name of the case this applies to.
+	Case string
+	// Field is "status", "body" or a canonical header name.
+	Field  string
+	Reason string
+}
+
+// AllowCases allows the same difference in field for each of the named
+// cases.
+func AllowCases(field, reason string, cases ...string) []Allow {
+	allow := make([]Allow, len(cases))
+	for i, name := range cases {
+		allow[i] = Allow{Case: name, Field: field, Reason: reason}
+	}
+	return allow
+}
+
+// Options changes how responses are read and compared.
+type Options struct {
+	// SimpleResponse means the from-scratch server answers with a bare body
+	// and no status line or headers, as in HTTP/0.9. Only bodies are compared.
+	SimpleResponse bool
+	// Allow lists the differences that shouldn't fail the test.
+	Allow []Allow
+}
+
+// ignoredHeaders differ on every response for reasons that have nothing to
+// do with the servers under test.
+var ignoredHeaders = []string{"Date"}
+
+// response is the part of an HTTP response that gets compared.
+type response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// TB is the part of testing.TB that Run reports to. It's spelled out here
+// so that the package doesn't pull the testing package into its importers.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Logf(format string, args ...any)
+}
+
+// Run sends every case to the from-scratch server listening on addr and to
+// a net/http server using Mux, and fails t for each unexpected difference.
+func Run(t TB, addr string, cases []Case, opts Options) {
+	t.Helper()
+	// httptest would be simpler, but it imports testing too.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("net/http: %s", err)
+		return
+	}
+	ref := &http.Server{Handler: Mux()}
+	go ref.Serve(l)
+	defer ref.Close()
+	refAddr := l.Addr().String()
+
+	used := make([]bool, len(opts.Allow))
+	for _, tc := range cases {
+		got, err := roundTrip(addr, tc.Request, opts.SimpleResponse)
+		if err != nil {
+			t.Errorf("%s: from-scratch server: %s", tc.Name, err)
+			continue
+		}
+		refReq := tc.Reference
+		if refReq == "" {
+			refReq = tc.Request
+		}
+		want, err := roundTrip(refAddr, refReq, false)
+		if err != nil {
+			t.Errorf("%s: net/http: %s", tc.Name, err)
+			continue
+		}
+
+		for _, d := range diff(got, want, opts.SimpleResponse) {
+			if i, ok := allowed(opts.Allow, tc.Name, d.field); ok {
+				used[i] = true
+				t.Logf("%s: allowed difference in %s (%s): got %q, net/http %q", tc.Name, d.field, opts.Allow[i].Reason, d.got, d.want)
+				continue
+			}
+			t.Errorf("%s: %s differs: got %q, net/http %q", tc.Name, d.field, d.got, d.want)
+		}
+	}
+
+	// An entry nothing needs any more would hide the difference coming back.
+	for i, a := range opts.Allow {
+		if !used[i] {
+			t.Errorf("allowed difference in %s for case %q never happened", a.Field, a.Case)
+		}
+	}
+}
+
+func roundTrip(addr, raw string, simple bool) (*response, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		return nil, err
+	}
+
+	if simple {
+		body, err := io.ReadAll(conn)
+		if err != nil {
+			return nil, err
+		}
+		return &response{Body: body}, nil
+	}
+
+	method, _, _ := strings.Cut(raw, " ")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	header := resp.Header.Clone()
+	for _, k := range ignoredHeaders {
+		header.Del(k)
+	}
+	return &response{Status: resp.StatusCode, Header: header, Body: body}, nil
+}
+
+type difference struct {
+	field     string
+	got, want string
+}
+
+func diff(got, want *response, bodyOnly bool) []difference {
+	var diffs []difference
+	if !bytes.Equal(got.Body, want.Body) {
+		diffs = append(diffs, difference{"body", string(got.Body), string(want.Body)})
+	}
+	if bodyOnly {
+		return diffs
+	}
+	if got.Status != want.Status {
+		diffs = append(diffs, difference{"status", strconv.Itoa(got.Status), strconv.Itoa(want.Status)})
+	}
+
+	var names []string
+	for k := range got.Header {
+		names = append(names, k)
+	}
+	for k := range want.Header {
+		if _, ok := got.Header[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	slices.Sort(names)
+	for _, k := range names {
+		g, w := strings.Join(got.Header[k], ", "), strings.Join(want.Header[k], ", ")
+		if g != w {
+			diffs = append(diffs, difference{k, g, w})
+		}
+	}
+	return diffs
+}
+
+// allowed returns the index of the entry in allow for field in case name.
+func allowed(allow []Allow, name, field string) (int, bool) {
+	for i, a := range allow {
+		if a.Case == name && a.Field == field {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,132 @@
+package conformance
+
+// HTTP09Corpus holds simple requests: just a method and a path with no
+// version, headers or body. net/http gets the equivalent HTTP/1.0 request.
+var HTTP09Corpus = []Case{
+	{
+		Name:      "echo",
+		Request:   "GET /echo\r\n",
+		Reference: "GET /echo HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:      "status",
+		Request:   "GET /status/404\r\n",
+		Reference: "GET /status/404 HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:      "bad status",
+		Request:   "GET /status/abc\r\n",
+		Reference: "GET /status/abc HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:      "headers",
+		Request:   "GET /headers\r\n",
+		Reference: "GET /headers HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:      "nothing",
+		Request:   "GET /nothing\r\n",
+		Reference: "GET /nothing HTTP/1.0\r\n\r\n",
+	},
+}
+
+// HTTP10Corpus holds HTTP/1.0 requests.
+var HTTP10Corpus = []Case{
+	{
+		Name:    "echo empty",
+		Request: "GET /echo HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:    "echo",
+		Request: "POST /echo HTTP/1.0\r\nContent-Length: 11\r\n\r\nhello world",
+	},
+	{
+		Name:    "echo html",
+		Request: "POST /echo HTTP/1.0\r\nContent-Length: 22\r\n\r\n<html><p>hi</p></html>",
+	},
+	{
+		Name:    "status",
+		Request: "GET /status/201 HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:    "not found status",
+		Request: "GET /status/404 HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:    "bad status",
+		Request: "GET /status/abc HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:    "headers",
+		Request: "GET /headers HTTP/1.0\r\nUser-Agent: conformance\r\nX-Custom: one\r\nX-Custom: two\r\n\r\n",
+	},
+	{
+		Name:    "nothing",
+		Request: "GET /nothing HTTP/1.0\r\n\r\n",
+	},
+	{
+		Name:    "not found",
+		Request: "GET /does/not/exist HTTP/1.0\r\n\r\n",
+	},
+}
+
+// HTTP11Corpus holds HTTP/1.1 requests. Every request asks for the
+// connection to be closed so that both servers end the response the same way.
+var HTTP11Corpus = []Case{
+	{
+		Name:    "echo empty",
+		Request: "GET /echo HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+	},
+	{
+		Name:    "echo",
+		Request: "POST /echo HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nContent-Length: 11\r\n\r\nhello world",
+	},
+	{
+		Name:    "echo chunked request",
+		Request: "POST /echo HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+	},
+	{
+		Name:    "echo chunked response",
+		Request: "POST /echo/chunked HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nContent-Length: 11\r\n\r\nhello world",
+	},
+	{
+		Name:    "echo chunked both ways",
+		Request: "POST /echo/chunked HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+	},
+	{
+		Name:    "status",
+		Request: "GET /status/201 HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+	},
+	{
+		Name:    "not found status",
+		Request: "GET /status/404 HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+	},
+	{
+		Name:    "bad status",
+		Request: "GET /status/abc HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+	},
+	{
+		Name:    "headers",
+		Request: "GET /headers HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nUser-Agent: conformance\r\nX-Custom: one\r\nX-Custom: two\r\n\r\n",
+	},
+	{
+		Name:    "nothing",
+		Request: "GET /nothing HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+	},
+	{
+		Name:    "not found",
+		Request: "GET /does/not/exist HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+	},
+	{
+		Name:    "missing host",
+		Request: "GET /echo HTTP/1.1\r\nConnection: close\r\n\r\n",
+	},
+	{
+		Name:    "content-length and transfer-encoding",
+		Request: "POST /echo HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+	},
+	{
+		Name:    "invalid content-length",
+		Request: "POST /echo HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\nContent-Length: -1\r\n\r\n",
+	},
+}
@@ -1,3 +1,7 @@
 module github.com/sudorandom/kmcd.dev/http1.1-from-scratch
 
 go 1.22.4
+
+require golang.org/x/net v0.21.0
+
+require golang.org/x/text v0.14.0 // indirect
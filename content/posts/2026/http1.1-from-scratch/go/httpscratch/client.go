@@ -0,0 +1,798 @@
+package httpscratch
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxIdleConnsPerHost is the number of idle connections the client
+// keeps per host when Client.MaxIdleConnsPerHost is zero.
+const DefaultMaxIdleConnsPerHost = 2
+
+// maxRedirects is how many redirects Do follows by default.
+const maxRedirects = 10
+
+// maxDrainBytes is how much of an unread response body Close will read to
+// be able to reuse the connection. Past that it's cheaper to hang up.
+const maxDrainBytes = 64 << 10
+
+var errBodyClosed = errors.New("httpscratch: read on closed response body")
+
+// Client is an HTTP/1.1 client that keeps connections alive and reuses them.
+// It implements http.RoundTripper, so it can also sit underneath an
+// http.Client.
+type Client struct {
+	// DialContext opens the TCP connections. If nil, a net.Dialer is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// TLSConfig is used for https requests. ServerName is filled in from
+	// the request if it's empty.
+	TLSConfig *tls.Config
+	// Proxy returns the proxy to use for a request, or nil for none. Only
+	// http proxies are supported: plain requests are sent to the proxy in
+	// absolute form and https requests are tunnelled through CONNECT.
+	Proxy func(*http.Request) (*url.URL, error)
+	// CheckRedirect decides whether Do follows a redirect, with the same
+	// contract as http.Client.CheckRedirect. If nil, Do stops after 10
+	// redirects.
+	CheckRedirect func(req *http.Request, via []*http.Request) error
+	// MaxIdleConnsPerHost limits the idle connections kept per host. If
+	// zero, DefaultMaxIdleConnsPerHost is used.
+	MaxIdleConnsPerHost int
+
+	mu   sync.Mutex
+	idle map[connKey][]*clientConn
+}
+
+// connKey identifies the connections that can carry a request.
+type connKey struct {
+	scheme string
+	addr   string
+	proxy  string
+}
+
+type clientConn struct {
+	key    connKey
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	// reused is set once the connection has carried a response, after which
+	// the server may close it at any moment.
+	reused bool
+}
+
+// Do sends req and follows any redirects, much like http.Client.Do.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	var via []*http.Request
+	for {
+		resp, err := c.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		next, err := redirectRequest(req, resp)
+		if err != nil || next == nil {
+			// A redirect we can't follow is just a response.
+			return resp, nil
+		}
+
+		via = append(via, req)
+		if err := c.checkRedirect(next, via); err != nil {
+			if errors.Is(err, http.ErrUseLastResponse) {
+				return resp, nil
+			}
+			resp.Body.Close()
+			return resp, err
+		}
+		// Finish the body so the connection goes back to the pool.
+		resp.Body.Close()
+		req = next
+	}
+}
+
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if c.CheckRedirect != nil {
+		return c.CheckRedirect(req, via)
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return nil
+}
+
+// redirectRequest builds the request that follows the redirect in resp, or
+// returns nil if resp isn't a redirect that can be followed.
+func redirectRequest(req *http.Request, resp *http.Response) (*http.Request, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, nil
+	}
+	method := req.Method
+	keepBody := false
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		// Browsers turn these into a GET, and RFC 9110 section 15.4
+		// blesses that for 303 and tolerates it for the others.
+		if method != http.MethodGet && method != http.MethodHead {
+			method = http.MethodGet
+		}
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		// The request must be repeated as-is, body included.
+		keepBody = req.Body != nil && req.Body != http.NoBody
+		if keepBody && req.GetBody == nil {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+
+	u, err := req.URL.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	next, err := http.NewRequestWithContext(req.Context(), method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	next.Header = req.Header.Clone()
+	if u.Host != req.URL.Host {
+		// Don't hand credentials to a different host.
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	if keepBody {
+		if next.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		next.GetBody = req.GetBody
+		next.ContentLength = req.ContentLength
+	} else {
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+	return next, nil
+}
+
+// RoundTrip sends a single request and returns the response. Redirects are
+// returned as they are. The response body must be read to the end or closed
+// for the connection to be reused.
+func (c *Client) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL == nil || req.URL.Host == "" {
+		closeRequestBody(req)
+		return nil, errors.New("httpscratch: request has no host")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		closeRequestBody(req)
+		return nil, fmt.Errorf("httpscratch: unsupported scheme %q", req.URL.Scheme)
+	}
+	if err := validateRequest(req); err != nil {
+		closeRequestBody(req)
+		return nil, err
+	}
+
+	var proxy *url.URL
+	if c.Proxy != nil {
+		var err error
+		if proxy, err = c.Proxy(req); err != nil {
+			closeRequestBody(req)
+			return nil, err
+		}
+		if proxy != nil && proxy.Scheme != "http" {
+			closeRequestBody(req)
+			return nil, fmt.Errorf("httpscratch: unsupported proxy scheme %q", proxy.Scheme)
+		}
+	}
+	key := connKey{scheme: req.URL.Scheme, addr: canonicalAddr(req.URL)}
+	if proxy != nil {
+		key.proxy = proxy.String()
+	}
+
+	for {
+		cc, err := c.getConn(req.Context(), key, proxy)
+		if err != nil {
+			closeRequestBody(req)
+			return nil, err
+		}
+		resp, retry, err := c.roundTrip(cc, req, proxy)
+		if err == nil {
+			return resp, nil
+		}
+		if !retry {
+			return nil, err
+		}
+		// The server closed a pooled connection before it got our
+		// request. That's normal for keep-alive, so try again with
+		// another connection.
+		if req, err = rewindRequest(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// roundTrip sends req on cc and reads the response headers. retry reports
+// whether the request can safely be sent again on another connection.
+func (c *Client) roundTrip(cc *clientConn, req *http.Request, proxy *url.URL) (resp *http.Response, retry bool, err error) {
+	// Closing the connection is the only way to interrupt a blocked read or
+	// write, so that's what cancelling the request does.
+	ctx := req.Context()
+	stop := context.AfterFunc(ctx, func() { cc.conn.Close() })
+	fail := func(err error) (*http.Response, bool, error) {
+		stop()
+		cc.conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, false, ctxErr
+		}
+		return nil, false, err
+	}
+
+	absoluteForm := proxy != nil && req.URL.Scheme == "http"
+	if err := writeClientRequest(cc.writer, req, absoluteForm, proxy); err != nil {
+		resp, _, err := fail(err)
+		return resp, cc.reused && ctx.Err() == nil && isReplayable(req), err
+	}
+
+	// If a pooled connection fails before the first byte of the response,
+	// the server most likely closed it while it sat idle. Requests that are
+	// safe to repeat can be sent again.
+	if _, err := cc.reader.Peek(1); err != nil {
+		resp, _, err := fail(err)
+		return resp, cc.reused && ctx.Err() == nil && isReplayable(req), err
+	}
+
+	resp, err = readResponse(cc.reader, req)
+	if err != nil {
+		return fail(err)
+	}
+	if state, ok := cc.conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		tlsState := state.ConnectionState()
+		resp.TLS = &tlsState
+	}
+
+	reusable := !resp.Close && !req.Close
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The connection now belongs to whoever asked for the upgrade.
+		stop()
+		resp.Body = &switchedBody{reader: cc.reader, conn: cc.conn}
+		return resp, false, nil
+	}
+	if resp.Body == http.NoBody {
+		if !stop() {
+			return fail(ctx.Err())
+		}
+		cc.reused = true
+		c.release(cc, reusable)
+		return resp, false, nil
+	}
+	if resp.ContentLength == -1 && resp.TransferEncoding == nil {
+		// The body ends when the server closes the connection.
+		reusable = false
+	}
+	resp.Body = &clientBody{
+		body:     resp.Body,
+		client:   c,
+		cc:       cc,
+		reusable: reusable,
+		stop:     stop,
+	}
+	return resp, false, nil
+}
+
+// validateRequest checks the parts of req that writeClientRequest copies
+// onto the wire as they are. A CR or LF in any of them would end the line
+// early and let whoever chose the value add headers, or a whole second
+// request. Trailer values are checked when they're written, since the
+// caller may set them while the body is sent.
+func validateRequest(req *http.Request) error {
+	// A method is a token, just like a field name.
+	if req.Method != "" && !validHeaderName([]byte(req.Method)) {
+		return fmt.Errorf("httpscratch: invalid method %q", req.Method)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if !validHeaderValue([]byte(host)) || strings.ContainsAny(host, " \t") {
+		return fmt.Errorf("httpscratch: invalid host %q", host)
+	}
+	if target := req.URL.RequestURI(); !validHeaderValue([]byte(target)) || strings.ContainsAny(target, " \t") {
+		return fmt.Errorf("httpscratch: invalid request target %q", target)
+	}
+	for k, vals := range req.Header {
+		if !validHeaderName([]byte(k)) {
+			return fmt.Errorf("httpscratch: invalid header name %q", k)
+		}
+		for _, v := range vals {
+			if !validHeaderValue([]byte(v)) {
+				return fmt.Errorf("httpscratch: invalid value for header %q", k)
+			}
+		}
+	}
+	for k := range req.Trailer {
+		if !validHeaderName([]byte(k)) {
+			return fmt.Errorf("httpscratch: invalid trailer name %q", k)
+		}
+	}
+	return nil
+}
+
+// writeClientRequest writes the request line, headers and body. Bodies of
+// unknown length are sent chunked, followed by req.Trailer.
+func writeClientRequest(w *bufio.Writer, req *http.Request, absoluteForm bool, proxy *url.URL) error {
+	target := req.URL.RequestURI()
+	if absoluteForm {
+		// Proxies need the whole URL (RFC 9112 section 3.2.2), minus
+		// anything that isn't meant to leave the client.
+		u := *req.URL
+		u.User = nil
+		u.Fragment = ""
+		target = u.String()
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	chunked := hasBody && req.ContentLength <= 0
+
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\nHost: %s\r\n", method, target, host)
+	for k, vals := range req.Header {
+		switch k {
+		case "Host", "Content-Length", "Transfer-Encoding", "Trailer", "Connection":
+			// These are set from the request fields below.
+			continue
+		}
+		for _, v := range vals {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	if absoluteForm && proxy.User != nil {
+		fmt.Fprintf(w, "Proxy-Authorization: %s\r\n", proxyAuth(proxy))
+	}
+	if req.Close {
+		w.WriteString("Connection: close\r\n")
+	}
+	switch {
+	case chunked:
+		w.WriteString("Transfer-Encoding: chunked\r\n")
+		if len(req.Trailer) > 0 {
+			names := make([]string, 0, len(req.Trailer))
+			for k := range req.Trailer {
+				names = append(names, k)
+			}
+			fmt.Fprintf(w, "Trailer: %s\r\n", strings.Join(names, ", "))
+		}
+	case hasBody:
+		fmt.Fprintf(w, "Content-Length: %d\r\n", req.ContentLength)
+	case method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch:
+		// Servers expect these methods to have a body, even an empty one.
+		w.WriteString("Content-Length: 0\r\n")
+	}
+	w.Write(nlcf)
+
+	if !hasBody {
+		return w.Flush()
+	}
+	defer req.Body.Close()
+	if !chunked {
+		n, err := io.Copy(w, io.LimitReader(req.Body, req.ContentLength))
+		if err != nil {
+			return err
+		}
+		if n != req.ContentLength {
+			return fmt.Errorf("httpscratch: request body was %d bytes, but ContentLength is %d", n, req.ContentLength)
+		}
+		return w.Flush()
+	}
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := req.Body.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			if _, err := w.Write(nlcf); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// The trailer values are read now, after the body, since the caller
+	// may fill them in while the body is being read.
+	w.WriteString("0\r\n")
+	for k, vals := range req.Trailer {
+		for _, v := range vals {
+			if !validHeaderValue([]byte(v)) {
+				return fmt.Errorf("httpscratch: invalid value for trailer %q", k)
+			}
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+	w.Write(nlcf)
+	return w.Flush()
+}
+
+// readResponse reads a response to req, skipping any interim 1xx responses.
+// The body is left on reader: resp.Body reads it, but nothing more.
+func readResponse(reader *bufio.Reader, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := readResponseHeader(reader)
+		if err != nil {
+			return nil, err
+		}
+		resp.Request = req
+		if resp.StatusCode >= 100 && resp.StatusCode <= 199 && resp.StatusCode != http.StatusSwitchingProtocols {
+			continue
+		}
+
+		if resp.ProtoAtLeast(1, 1) {
+			resp.Close = headerHasToken(resp.Header, "Connection", "close")
+		} else {
+			resp.Close = !headerHasToken(resp.Header, "Connection", "keep-alive")
+		}
+
+		chunked, contentLength, err := messageFraming(resp.Header, resp.ProtoAtLeast(1, 1))
+		if err != nil {
+			return nil, malformedResponse(err)
+		}
+		resp.ContentLength = contentLength
+
+		switch {
+		case req.Method == http.MethodHead || !bodyAllowedForStatus(resp.StatusCode):
+			// The headers may describe a body, but there isn't one.
+			resp.Body = http.NoBody
+		case req.Method == http.MethodConnect && resp.StatusCode/100 == 2:
+			// What follows a successful CONNECT is the tunnel.
+			resp.Body = http.NoBody
+			resp.ContentLength = 0
+		case chunked:
+			resp.TransferEncoding = []string{"chunked"}
+			// Declare the announced trailer fields up front, like
+			// net/http does. Their values arrive after the body.
+			resp.Trailer = make(http.Header)
+			for _, name := range resp.Header["Trailer"] {
+				for _, k := range strings.Split(name, ",") {
+					if k = strings.TrimSpace(k); k != "" {
+						resp.Trailer[textproto.CanonicalMIMEHeaderKey(k)] = nil
+					}
+				}
+			}
+			resp.Body = &chunkedBodyReader{reader: reader, trailer: resp.Trailer}
+		case contentLength == 0:
+			resp.Body = http.NoBody
+		case contentLength > 0:
+			resp.Body = &bodyReader{reader: &io.LimitedReader{R: reader, N: contentLength}}
+		default:
+			resp.Body = io.NopCloser(reader)
+		}
+		return resp, nil
+	}
+}
+
+// readResponseHeader reads the status line and header fields.
+func readResponseHeader(reader *bufio.Reader) (*http.Response, error) {
+	line, err := readLine(reader, DefaultMaxHeaderBytes)
+	if err != nil {
+		return nil, malformedResponse(err)
+	}
+	proto, rest, ok := strings.Cut(string(line), " ")
+	if !ok {
+		return nil, fmt.Errorf("httpscratch: malformed status line %q", line)
+	}
+	major, minor, ok := parseProtocol(proto)
+	if !ok {
+		return nil, fmt.Errorf("httpscratch: malformed HTTP version %q", proto)
+	}
+	code, reason, _ := strings.Cut(rest, " ")
+	statusCode, err := strconv.Atoi(code)
+	if len(code) != 3 || err != nil || statusCode < 100 {
+		return nil, fmt.Errorf("httpscratch: malformed status code %q", code)
+	}
+
+	resp := &http.Response{
+		Status:     code + " " + reason,
+		StatusCode: statusCode,
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		Header:     make(http.Header),
+	}
+	budget := DefaultMaxHeaderBytes - len(line) - 2
+	if err := readHeader(reader, resp.Header, budget, DefaultMaxHeaderFieldBytes); err != nil {
+		return nil, malformedResponse(err)
+	}
+	return resp, nil
+}
+
+// malformedResponse rewords the parsing errors shared with the server, which
+// are phrased as the response the server would send back.
+func malformedResponse(err error) error {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return fmt.Errorf("httpscratch: malformed response: %s", reqErr.Reason)
+	}
+	if errors.Is(err, errLineTooLong) {
+		return errors.New("httpscratch: response headers too large")
+	}
+	return err
+}
+
+// getConn returns an idle connection for key, or dials a new one.
+func (c *Client) getConn(ctx context.Context, key connKey, proxy *url.URL) (*clientConn, error) {
+	c.mu.Lock()
+	if conns := c.idle[key]; len(conns) > 0 {
+		// Take the most recently used connection: it's the least likely
+		// to have been closed by the server.
+		cc := conns[len(conns)-1]
+		c.idle[key] = conns[:len(conns)-1]
+		c.mu.Unlock()
+		return cc, nil
+	}
+	c.mu.Unlock()
+
+	conn, err := c.dial(ctx, key, proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &clientConn{
+		key:    key,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}, nil
+}
+
+func (c *Client) dial(ctx context.Context, key connKey, proxy *url.URL) (net.Conn, error) {
+	dial := c.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	addr := key.addr
+	if proxy != nil {
+		addr = canonicalAddr(proxy)
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if key.scheme == "http" {
+		return conn, nil
+	}
+
+	if proxy != nil {
+		if err := connectTunnel(ctx, conn, key.addr, proxy); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(key.addr)
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connectTunnel asks the proxy on conn for a tunnel to addr (RFC 9110
+// section 9.3.6). Once it says yes, conn talks to addr directly.
+func connectTunnel(ctx context.Context, conn net.Conn, addr string, proxy *url.URL) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxy.User != nil {
+		fmt.Fprintf(&b, "Proxy-Authorization: %s\r\n", proxyAuth(proxy))
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return err
+	}
+
+	// Reading byte by byte would be slow, but a buffered reader could
+	// swallow the start of the TLS handshake. The proxy shouldn't send
+	// anything after its response, so check that it didn't.
+	reader := bufio.NewReader(conn)
+	resp, err := readResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("httpscratch: proxy refused CONNECT: %s", resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return errors.New("httpscratch: proxy sent data after its CONNECT response")
+	}
+	return nil
+}
+
+func proxyAuth(proxy *url.URL) string {
+	password, _ := proxy.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+password))
+}
+
+// release returns cc to the pool if it can carry another request, and
+// closes it otherwise.
+func (c *Client) release(cc *clientConn, reusable bool) {
+	if !reusable {
+		cc.conn.Close()
+		return
+	}
+	max := c.MaxIdleConnsPerHost
+	if max <= 0 {
+		max = DefaultMaxIdleConnsPerHost
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle[cc.key]) >= max {
+		cc.conn.Close()
+		return
+	}
+	if c.idle == nil {
+		c.idle = make(map[connKey][]*clientConn)
+	}
+	c.idle[cc.key] = append(c.idle[cc.key], cc)
+}
+
+// CloseIdleConnections closes the connections sitting in the pool.
+// Connections carrying a response are closed once it's done.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conns := range c.idle {
+		for _, cc := range conns {
+			cc.conn.Close()
+		}
+	}
+	c.idle = nil
+}
+
+// clientBody is a response body. Once it's been read to the end, its
+// connection goes back to the pool.
+type clientBody struct {
+	body     io.ReadCloser
+	client   *Client
+	cc       *clientConn
+	reusable bool
+	stop     func() bool
+
+	mu   sync.Mutex
+	done bool
+	err  error
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return 0, b.err
+	}
+	n, err := b.body.Read(p)
+	if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+// Close drains a little of what's left of the body in the hope of reusing
+// the connection, and closes the connection if that isn't enough.
+func (b *clientBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return nil
+	}
+	if b.reusable {
+		_, err := io.CopyN(io.Discard, b.body, maxDrainBytes)
+		if err != nil {
+			b.finish(err)
+			b.err = errBodyClosed
+			return nil
+		}
+	}
+	b.reusable = false
+	b.finish(errBodyClosed)
+	return nil
+}
+
+// finish hands the connection back once the body ended with err.
+func (b *clientBody) finish(err error) {
+	b.done = true
+	b.err = err
+	// If the request was cancelled, the connection has already been
+	// closed underneath us.
+	reusable := b.reusable && err == io.EOF && b.stop()
+	b.cc.reused = true
+	b.client.release(b.cc, reusable)
+}
+
+// switchedBody is the body of a 101 Switching Protocols response: the
+// connection itself, now speaking whatever protocol was asked for.
+type switchedBody struct {
+	reader *bufio.Reader
+	conn   net.Conn
+}
+
+func (b *switchedBody) Read(p []byte) (int, error)  { return b.reader.Read(p) }
+func (b *switchedBody) Write(p []byte) (int, error) { return b.conn.Write(p) }
+func (b *switchedBody) Close() error                { return b.conn.Close() }
+
+// canonicalAddr returns u's host and port, filling in the scheme's default
+// port.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// isReplayable reports whether req may be sent again after a failure on a
+// pooled connection. The server may already have acted on it, so like
+// net/http only safe methods qualify, or requests that carry an
+// Idempotency-Key for the server to spot the repeat by. The body must be
+// possible to send again too.
+func isReplayable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
+
+// rewindRequest returns a copy of req with a fresh body.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	next := req.Clone(req.Context())
+	next.Body = body
+	return next, nil
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
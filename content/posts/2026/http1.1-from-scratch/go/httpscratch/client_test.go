@@ -0,0 +1,589 @@
+package httpscratch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countConns counts the connections ts accepts.
+func countConns(ts *httptest.Server) *atomic.Int32 {
+	var n atomic.Int32
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			n.Add(1)
+		}
+	}
+	return &n
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestClientRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %v %q trailer=%q", r.Method, r.URL, r.TransferEncoding, body, r.Trailer.Get("Checksum"))
+	}))
+	defer ts.Close()
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	testCases := []struct {
+		name string
+		req  func() *http.Request
+		want string
+	}{
+		{
+			name: "get",
+			req: func() *http.Request {
+				req, _ := http.NewRequest(http.MethodGet, ts.URL+"/path?q=1", nil)
+				return req
+			},
+			want: `GET /path?q=1 [] "" trailer=""`,
+		},
+		{
+			name: "post with length",
+			req: func() *http.Request {
+				req, _ := http.NewRequest(http.MethodPost, ts.URL+"/", strings.NewReader("hello"))
+				return req
+			},
+			want: `POST / [] "hello" trailer=""`,
+		},
+		{
+			name: "chunked post with trailer",
+			req: func() *http.Request {
+				// A body of unknown length has to be sent chunked.
+				req, _ := http.NewRequest(http.MethodPost, ts.URL+"/", io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo")))
+				req.Trailer = http.Header{"Checksum": {"abc"}}
+				return req
+			},
+			want: `POST / [chunked] "hello" trailer="abc"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := c.Do(tc.req())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readBody(t, resp); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientPooling(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, "ok")
+	}))
+	conns := countConns(ts)
+	ts.Start()
+	defer ts.Close()
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	// Content-Length, chunked and bodiless responses all leave the
+	// connection ready for the next request.
+	for _, path := range []string{"/", "/chunked", "/", "/chunked"} {
+		resp, err := c.Do(mustRequest(t, http.MethodGet, ts.URL+path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBody(t, resp); got != "ok" {
+			t.Errorf("got body %q", got)
+		}
+	}
+	resp, err := c.Do(mustRequest(t, http.MethodHead, ts.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := conns.Load(); n != 1 {
+		t.Errorf("used %d connections, want 1", n)
+	}
+}
+
+func mustRequest(t *testing.T, method, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestClientStaleConnection(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	conns := countConns(ts)
+	ts.Start()
+	defer ts.Close()
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	resp, err := c.Do(mustRequest(t, http.MethodGet, ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, resp)
+
+	// The server hangs up on the pooled connection, which the client only
+	// notices when it tries to use it.
+	ts.CloseClientConnections()
+	resp, err = c.Do(mustRequest(t, http.MethodGet, ts.URL))
+	if err != nil {
+		t.Fatalf("request on a stale connection wasn't retried: %v", err)
+	}
+	if got := readBody(t, resp); got != "ok" {
+		t.Errorf("got body %q", got)
+	}
+	if n := conns.Load(); n != 2 {
+		t.Errorf("used %d connections, want 2", n)
+	}
+}
+
+func TestClientStaleConnectionReplay(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+
+	// The server may have acted on a request before the connection broke,
+	// so only requests that are safe to repeat are sent again.
+	testCases := []struct {
+		name      string
+		method    string
+		header    http.Header
+		wantRetry bool
+	}{
+		{name: "GET", method: http.MethodGet, wantRetry: true},
+		{name: "POST", method: http.MethodPost},
+		{name: "PUT", method: http.MethodPut},
+		{name: "POST with Idempotency-Key", method: http.MethodPost, header: http.Header{"Idempotency-Key": {"abc"}}, wantRetry: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Client{}
+			defer c.CloseIdleConnections()
+			resp, err := c.Do(mustRequest(t, http.MethodGet, ts.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			readBody(t, resp)
+
+			ts.CloseClientConnections()
+			req, err := http.NewRequest(tc.method, ts.URL, strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			resp, err = c.Do(req)
+			if tc.wantRetry {
+				if err != nil {
+					t.Fatalf("request wasn't retried: %v", err)
+				}
+				readBody(t, resp)
+			} else if err == nil {
+				resp.Body.Close()
+				t.Fatal("request was retried on a new connection")
+			}
+		})
+	}
+}
+
+func TestClientTrailers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Checksum")
+		io.WriteString(w, "body")
+		w.Header().Set("Checksum", "1234")
+	}))
+	defer ts.Close()
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	resp, err := c.Do(mustRequest(t, http.MethodGet, ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.Trailer["Checksum"]; !ok {
+		t.Errorf("trailer wasn't declared before the body: %v", resp.Trailer)
+	}
+	if got := readBody(t, resp); got != "body" {
+		t.Errorf("got body %q", got)
+	}
+	if got := resp.Trailer.Get("Checksum"); got != "1234" {
+		t.Errorf("got Checksum trailer %q, want %q", got, "1234")
+	}
+}
+
+func TestClientTrailerLimits(t *testing.T) {
+	testCases := []struct {
+		name    string
+		trailer string
+	}{
+		{name: "too many fields", trailer: strings.Repeat("X-Field: a\r\n", maxTrailerFields+1)},
+		{name: "too many bytes", trailer: strings.Repeat("X-Field: "+strings.Repeat("a", 1000)+"\r\n", maxTrailerBytes/1000)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n"+tc.trailer+"\r\n")
+			}()
+
+			c := &Client{}
+			resp, err := c.Do(mustRequest(t, http.MethodGet, "http://"+l.Addr().String()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if _, err := io.ReadAll(resp.Body); !errors.Is(err, errTrailerTooLarge) {
+				t.Errorf("got %v, want %v", err, errTrailerTooLarge)
+			}
+		})
+	}
+}
+
+func TestClientInvalidRequests(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer ts.Close()
+	c := &Client{}
+	defer c.CloseIdleConnections()
+
+	testCases := []struct {
+		name   string
+		modify func(req *http.Request)
+	}{
+		{name: "CRLF in header value", modify: func(req *http.Request) {
+			req.Header.Set("X-Injected", "a\r\nX-Evil: b")
+		}},
+		{name: "request in header value", modify: func(req *http.Request) {
+			req.Header.Set("X-Injected", "a\r\n\r\nGET /evil HTTP/1.1\r\nHost: example")
+		}},
+		{name: "invalid header name", modify: func(req *http.Request) {
+			req.Header["X Injected"] = []string{"a"}
+		}},
+		{name: "CRLF in header name", modify: func(req *http.Request) {
+			req.Header["X-Evil: b\r\nX-Injected"] = []string{"a"}
+		}},
+		{name: "CRLF in Host", modify: func(req *http.Request) {
+			req.Host = "example\r\nX-Evil: b"
+		}},
+		{name: "space in method", modify: func(req *http.Request) {
+			req.Method = "GET / HTTP/1.1\r\n\r\nGET"
+		}},
+		{name: "invalid trailer name", modify: func(req *http.Request) {
+			req.Trailer = http.Header{"X Injected": {"a"}}
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := mustRequest(t, http.MethodGet, ts.URL)
+			tc.modify(req)
+			resp, err := c.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				t.Fatal("expected an error")
+			}
+		})
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("server got %d requests, want none", n)
+	}
+}
+
+func TestClientRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/c", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %q", r.Method, r.URL.Path, body)
+	})
+	mux.HandleFunc("/see-other", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/b", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	t.Run("follow", func(t *testing.T) {
+		c := &Client{}
+		defer c.CloseIdleConnections()
+		resp, err := c.Do(mustRequest(t, http.MethodGet, ts.URL+"/a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := readBody(t, resp), `GET /c ""`; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("307 keeps the body", func(t *testing.T) {
+		c := &Client{}
+		defer c.CloseIdleConnections()
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/b", strings.NewReader("data"))
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := readBody(t, resp), `PUT /c "data"`; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("303 switches to GET", func(t *testing.T) {
+		c := &Client{}
+		defer c.CloseIdleConnections()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/see-other", strings.NewReader("data"))
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := readBody(t, resp), `GET /c ""`; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("use last response", func(t *testing.T) {
+		var via []string
+		c := &Client{CheckRedirect: func(req *http.Request, v []*http.Request) error {
+			via = append(via, req.URL.Path)
+			return http.ErrUseLastResponse
+		}}
+		defer c.CloseIdleConnections()
+		resp, err := c.Do(mustRequest(t, http.MethodGet, ts.URL+"/a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMovedPermanently || len(via) != 1 || via[0] != "/b" {
+			t.Errorf("got %s after asking about %v", resp.Status, via)
+		}
+	})
+
+	t.Run("too many", func(t *testing.T) {
+		c := &Client{}
+		defer c.CloseIdleConnections()
+		_, err := c.Do(mustRequest(t, http.MethodGet, ts.URL+"/loop"))
+		if err == nil || !strings.Contains(err.Error(), "stopped after 10 redirects") {
+			t.Errorf("got error %v", err)
+		}
+	})
+}
+
+func TestClientHTTPProxy(t *testing.T) {
+	var gotTarget, gotAuth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTarget = r.RequestURI
+		gotAuth = r.Header.Get("Proxy-Authorization")
+		io.WriteString(w, "from the proxy")
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "pass")
+
+	c := &Client{Proxy: http.ProxyURL(proxyURL)}
+	defer c.CloseIdleConnections()
+	resp, err := c.Do(mustRequest(t, http.MethodGet, "http://example.com/page?x=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(t, resp); got != "from the proxy" {
+		t.Errorf("got body %q", got)
+	}
+	if gotTarget != "http://example.com/page?x=1" {
+		t.Errorf("proxy got request target %q, want the absolute URL", gotTarget)
+	}
+	if want := "Basic dXNlcjpwYXNz"; gotAuth != want {
+		t.Errorf("proxy got Proxy-Authorization %q, want %q", gotAuth, want)
+	}
+}
+
+func TestClientConnectProxy(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secret")
+	}))
+	defer ts.Close()
+
+	var tunnels atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		tunnels.Add(1)
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	c := &Client{
+		Proxy:     http.ProxyURL(proxyURL),
+		TLSConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	defer c.CloseIdleConnections()
+	for range 2 {
+		resp, err := c.Do(mustRequest(t, http.MethodGet, ts.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TLS == nil {
+			t.Error("response didn't come over TLS")
+		}
+		if got := readBody(t, resp); got != "secret" {
+			t.Errorf("got body %q", got)
+		}
+	}
+	if n := tunnels.Load(); n != 1 {
+		t.Errorf("opened %d tunnels, want 1", n)
+	}
+}
+
+func TestClientAsTransport(t *testing.T) {
+	// Pair the client with the server from this package.
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "seen", Value: "yes"})
+			io.WriteString(w, r.Proto)
+		}),
+	})
+	c := &Client{}
+	defer c.CloseIdleConnections()
+	hc := &http.Client{Transport: c}
+	resp, err := hc.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readBody(t, resp); got != "HTTP/1.1" {
+		t.Errorf("got body %q", got)
+	}
+	if cookies := resp.Cookies(); len(cookies) != 1 || cookies[0].Value != "yes" {
+		t.Errorf("got cookies %v", cookies)
+	}
+}
+
+func TestClientMalformedResponses(t *testing.T) {
+	testCases := []struct {
+		name     string
+		response string
+	}{
+		{name: "bad status line", response: "HTTP/1.1 OK\r\n\r\n"},
+		{name: "bare LF", response: "HTTP/1.1 200 OK\nContent-Length: 0\n\n"},
+		{name: "conflicting framing", response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nTransfer-Encoding: chunked\r\n\r\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				io.WriteString(conn, tc.response)
+			}()
+
+			c := &Client{}
+			_, err = c.Do(mustRequest(t, http.MethodGet, "http://"+l.Addr().String()))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if errors.Is(err, io.EOF) {
+				t.Errorf("got %v, want a parse error", err)
+			}
+		})
+	}
+}
+
+func BenchmarkClient(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello, world")
+	}))
+	defer ts.Close()
+
+	for _, bc := range []struct {
+		name      string
+		transport http.RoundTripper
+	}{
+		{"httpscratch", &Client{}},
+		{"net/http", &http.Transport{}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			b.ResetTimer()
+			for range b.N {
+				resp, err := bc.transport.RoundTrip(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
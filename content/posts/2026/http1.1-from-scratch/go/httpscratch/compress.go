@@ -0,0 +1,185 @@
+package httpscratch
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressMinSize is the smallest response body that gets compressed
+// when Server.CompressMinSize isn't set. Below this, the gzip header and
+// trailer eat most of the savings.
+const defaultCompressMinSize = 1024
+
+// supportedEncodings are the content codings the server can produce, in
+// order of preference when the client likes them equally.
+var supportedEncodings = []string{"gzip", "deflate"}
+
+// compressor is a streaming encoder for one content coding.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newCompressor(encoding string, w io.Writer) compressor {
+	switch encoding {
+	case "gzip":
+		return gzip.NewWriter(w)
+	case "deflate":
+		// "deflate" in HTTP means the zlib format (RFC 9110 section 8.4.1.2),
+		// not a raw deflate stream.
+		return zlib.NewWriter(w)
+	}
+	return nil
+}
+
+// negotiateEncoding picks the best supported content coding from the
+// request's Accept-Encoding header, or "" if the client didn't ask for one
+// or only accepts identity.
+func negotiateEncoding(h http.Header) string {
+	qvalues := make(map[string]float64)
+	wildcard := -1.0
+	for _, v := range h["Accept-Encoding"] {
+		for _, part := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			}
+			q, ok := parseQValue(params)
+			if !ok {
+				continue
+			}
+			if coding == "*" {
+				wildcard = q
+			} else {
+				qvalues[coding] = q
+			}
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supportedEncodings {
+		q, ok := qvalues[encoding]
+		if !ok && encoding == "gzip" {
+			q, ok = qvalues["x-gzip"]
+		}
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// parseQValue finds the weight in the parameters following a coding, like
+// "q=0.5". Codings without a weight have a weight of 1. Malformed weights
+// make the whole element invalid.
+func parseQValue(params string) (float64, bool) {
+	for _, param := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(param, "=")
+		if !strings.EqualFold(strings.TrimSpace(k), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || q < 0 || q > 1 {
+			return 0, false
+		}
+		return q, true
+	}
+	return 1, true
+}
+
+// isCompressedType reports whether content of the given type is already
+// compressed, in which case compressing it again only burns CPU.
+func isCompressedType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "image/svg+xml" {
+		return false
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+		"application/vnd.rar", "font/woff", "font/woff2":
+		return true
+	}
+	return false
+}
+
+// decodeRequestBody undoes a gzip or deflate Content-Encoding on the request
+// body. Framing still comes from the original Content-Length or chunked
+// encoding, and closing the body drains the encoded bytes so the next
+// request on the connection is read from the right place.
+func decodeRequestBody(req *http.Request) error {
+	encodings := req.Header["Content-Encoding"]
+	if len(encodings) == 0 {
+		return nil
+	}
+	if len(encodings) > 1 || strings.Contains(encodings[0], ",") {
+		return &requestError{StatusCode: http.StatusUnsupportedMediaType, Reason: "multiple content codings"}
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(encodings[0]))
+	switch encoding {
+	case "identity":
+		return nil
+	case "gzip", "x-gzip", "deflate":
+	default:
+		return &requestError{
+			StatusCode: http.StatusUnsupportedMediaType,
+			Reason:     fmt.Sprintf("unsupported content coding %q", encoding),
+		}
+	}
+
+	req.Body = &decodedBody{encoding: encoding, body: req.Body}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	return nil
+}
+
+// decodedBody decompresses a request body. The decoder is created on the
+// first Read because creating it reads the gzip header, and the handler
+// might never look at the body.
+type decodedBody struct {
+	encoding string
+	body     io.ReadCloser
+	decoder  io.ReadCloser
+	err      error
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.decoder == nil {
+		if d.encoding == "deflate" {
+			d.decoder, d.err = zlib.NewReader(d.body)
+		} else {
+			d.decoder, d.err = gzip.NewReader(d.body)
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+	}
+	return d.decoder.Read(p)
+}
+
+func (d *decodedBody) Close() error {
+	if d.decoder != nil {
+		d.decoder.Close()
+	}
+	return d.body.Close()
+}
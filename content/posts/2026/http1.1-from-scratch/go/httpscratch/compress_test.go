@@ -0,0 +1,290 @@
+package httpscratch
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"GZIP;Q=0.8", "gzip"},
+		{"x-gzip", "gzip"},
+		{"br", ""},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+		{"gzip;q=0", ""},
+		{"identity", ""},
+		{"gzip;q=2, deflate", "deflate"},
+		{"gzip;q=nope, deflate;q=0.1", "deflate"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			h := http.Header{}
+			if tc.acceptEncoding != "" {
+				h.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			if got := negotiateEncoding(h); got != tc.want {
+				t.Errorf("negotiateEncoding(%q) = %q, want %q", tc.acceptEncoding, got, tc.want)
+			}
+		})
+	}
+}
+
+// roundTrip sends a raw request and returns the parsed response along with
+// its body, which is not decompressed.
+func roundTrip(t *testing.T, addr, request string) (*http.Response, []byte) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompressResponse(t *testing.T) {
+	large := strings.Repeat("hello compression ", 200)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, large)
+	})
+	mux.HandleFunc("/small", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tiny")
+	})
+	mux.HandleFunc("/png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		io.WriteString(w, large)
+	})
+	mux.HandleFunc("/content-length", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "3600")
+		io.WriteString(w, large)
+	})
+	mux.HandleFunc("/no-transform", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-transform")
+		io.WriteString(w, large)
+	})
+	addr := startServer(t, &Server{Handler: mux, Compress: true})
+
+	testCases := []struct {
+		name         string
+		request      string
+		wantEncoding string
+		wantBody     string
+		wantVary     bool
+	}{
+		{
+			name:         "gzip",
+			request:      "GET /large HTTP/1.1\r\nHost: example\r\nAccept-Encoding: gzip\r\n\r\n",
+			wantEncoding: "gzip",
+			wantBody:     large,
+			wantVary:     true,
+		},
+		{
+			name:         "deflate",
+			request:      "GET /large HTTP/1.1\r\nHost: example\r\nAccept-Encoding: gzip;q=0.2, deflate\r\n\r\n",
+			wantEncoding: "deflate",
+			wantBody:     large,
+			wantVary:     true,
+		},
+		{
+			name:     "no accept-encoding",
+			request:  "GET /large HTTP/1.1\r\nHost: example\r\n\r\n",
+			wantBody: large,
+			wantVary: true,
+		},
+		{
+			name:     "refused with q=0",
+			request:  "GET /large HTTP/1.1\r\nHost: example\r\nAccept-Encoding: gzip;q=0, deflate;q=0\r\n\r\n",
+			wantBody: large,
+			wantVary: true,
+		},
+		{
+			name:     "small body",
+			request:  "GET /small HTTP/1.1\r\nHost: example\r\nAccept-Encoding: gzip\r\n\r\n",
+			wantBody: "tiny",
+			wantVary: true,
+		},
+		{
+			name:     "already compressed type",
+			request:  "GET /png HTTP/1.1\r\nHost: example\r\nAccept-Encoding: gzip\r\n\r\n",
+			wantBody: large,
+		},
+		{
+			name:     "no-transform",
+			request:  "GET /no-transform HTTP/1.1\r\nHost: example\r\nAccept-Encoding: gzip\r\n\r\n",
+			wantBody: large,
+		},
+		{
+			name:         "handler content-length",
+			request:      "GET /content-length HTTP/1.1\r\nHost: example\r\nAccept-Encoding: gzip\r\n\r\n",
+			wantEncoding: "gzip",
+			wantBody:     large,
+			wantVary:     true,
+		},
+		{
+			name:         "HTTP/1.0",
+			request:      "GET /large HTTP/1.0\r\nAccept-Encoding: gzip\r\n\r\n",
+			wantEncoding: "gzip",
+			wantBody:     large,
+			wantVary:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := roundTrip(t, addr, tc.request)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d", resp.StatusCode)
+			}
+			encoding := resp.Header.Get("Content-Encoding")
+			if encoding != tc.wantEncoding {
+				t.Errorf("got Content-Encoding %q, want %q", encoding, tc.wantEncoding)
+			}
+			if got := decompress(t, encoding, body); got != tc.wantBody {
+				t.Errorf("got body of length %d, want %d", len(got), len(tc.wantBody))
+			}
+			if gotVary := resp.Header.Get("Vary") == "Accept-Encoding"; gotVary != tc.wantVary {
+				t.Errorf("got Vary %q, want Accept-Encoding: %v", resp.Header.Get("Vary"), tc.wantVary)
+			}
+			if encoding != "" && resp.ContentLength >= 0 {
+				t.Errorf("compressed response kept Content-Length %d", resp.ContentLength)
+			}
+			if encoding == "" && resp.ContentLength >= 0 && resp.ContentLength != int64(len(body)) {
+				t.Errorf("got Content-Length %d for a %d byte body", resp.ContentLength, len(body))
+			}
+		})
+	}
+}
+
+func TestCompressFlushedResponse(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "first part, ")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, strings.Repeat("then the rest ", 100))
+		}),
+		Compress: true,
+	})
+
+	resp, body := roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: example\r\nAccept-Encoding: gzip\r\n\r\n")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", resp.Header.Get("Content-Encoding"))
+	}
+	want := "first part, " + strings.Repeat("then the rest ", 100)
+	if got := decompress(t, "gzip", body); got != want {
+		t.Errorf("got body %q", got)
+	}
+}
+
+func TestDecodeRequestBody(t *testing.T) {
+	addr := startServer(t, &Server{Handler: http.HandlerFunc(echoBody), Compress: true})
+
+	var gzipped, deflated bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	io.WriteString(gw, "hello gzip")
+	gw.Close()
+	zw := zlib.NewWriter(&deflated)
+	io.WriteString(zw, "hello deflate")
+	zw.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// A Content-Length gzip body, a chunked deflate body, then a plain one,
+	// all pipelined to check that decoding doesn't upset the framing.
+	var req bytes.Buffer
+	req.WriteString("POST / HTTP/1.1\r\nHost: example\r\nContent-Encoding: gzip\r\n")
+	req.WriteString("Content-Length: " + strconv.Itoa(gzipped.Len()) + "\r\n\r\n")
+	req.Write(gzipped.Bytes())
+	req.WriteString("POST / HTTP/1.1\r\nHost: example\r\nContent-Encoding: deflate\r\nTransfer-Encoding: chunked\r\n\r\n")
+	fmt.Fprintf(&req, "%x\r\n", deflated.Len())
+	req.Write(deflated.Bytes())
+	req.WriteString("\r\n0\r\n\r\n")
+	req.WriteString("POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 5\r\n\r\nplain")
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	for _, want := range []string{"hello gzip", "hello deflate", "plain"} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want {
+			t.Errorf("got body %q, want %q", body, want)
+		}
+	}
+}
+
+func TestDecodeRequestBodyUnsupported(t *testing.T) {
+	addr := startServer(t, &Server{Handler: http.HandlerFunc(echoBody), Compress: true})
+
+	resp, _ := roundTrip(t, addr, "POST / HTTP/1.1\r\nHost: example\r\nContent-Encoding: br\r\nContent-Length: 5\r\n\r\nhello")
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+}
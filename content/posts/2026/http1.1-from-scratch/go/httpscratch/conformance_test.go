@@ -0,0 +1,59 @@
+package httpscratch
+
+import (
+	"testing"
+
+	"github.com/sudorandom/kmcd.dev/http1.1-from-scratch/conformance"
+)
+
+// Responses are streamed instead of buffered, so unless the handler sets
+// Content-Length itself, a body gets chunked on HTTP/1.1 and delimited by
+// closing the connection on HTTP/1.0.
+var (
+	streamedCases11 = []string{
+		"echo empty", "echo", "echo chunked request", "echo chunked response", "echo chunked both ways",
+		"status", "not found status", "bad status", "headers", "not found",
+	}
+	// rejectedCases11 never reach a handler. The error responses for them
+	// have a length, unlike net/http's.
+	rejectedCases11 = []string{"missing host", "content-length and transfer-encoding", "invalid content-length"}
+	streamedCases10 = []string{
+		"echo empty", "echo", "echo html", "status", "not found status", "bad status", "headers", "not found",
+	}
+	// closedCases10 are the HTTP/1.0 cases that get "Connection: close",
+	// which the server always sends when it's going to close the connection.
+	closedCases10 = []string{
+		"echo empty", "echo", "echo html", "status", "not found status", "bad status", "headers", "nothing", "not found",
+	}
+)
+
+var conformanceAllow11 = append(append(
+	conformance.AllowCases("Content-Length", "responses are streamed instead of buffered to compute a length", streamedCases11...),
+	conformance.AllowCases("Content-Length", "error responses are written differently", rejectedCases11...)...),
+	conformance.Allow{Case: "bad status", Field: "Content-Type", Reason: "headers are written by WriteHeader, before there is a body to sniff"},
+	conformance.Allow{Case: "missing host", Field: "body", Reason: "error messages are worded differently"},
+	conformance.Allow{Case: "invalid content-length", Field: "body", Reason: "error messages are worded differently"},
+	conformance.Allow{Case: "content-length and transfer-encoding", Field: "status", Reason: "rejected as request smuggling instead of preferring Transfer-Encoding"},
+	conformance.Allow{Case: "content-length and transfer-encoding", Field: "body", Reason: "rejected as request smuggling instead of preferring Transfer-Encoding"},
+	conformance.Allow{Case: "content-length and transfer-encoding", Field: "Content-Type", Reason: "rejected as request smuggling instead of preferring Transfer-Encoding"},
+)
+
+var conformanceAllow10 = append(append(
+	conformance.AllowCases("Content-Length", "responses are streamed instead of buffered to compute a length", streamedCases10...),
+	conformance.AllowCases("Connection", "the server always says whether the connection stays open", closedCases10...)...),
+	conformance.Allow{Case: "bad status", Field: "Content-Type", Reason: "headers are written by WriteHeader, before there is a body to sniff"},
+)
+
+func TestConformance(t *testing.T) {
+	addr := startServer(t, &Server{Handler: conformance.Mux()})
+
+	t.Run("HTTP/1.1", func(t *testing.T) {
+		conformance.Run(t, addr, conformance.HTTP11Corpus, conformance.Options{Allow: conformanceAllow11})
+	})
+	t.Run("HTTP/1.0", func(t *testing.T) {
+		conformance.Run(t, addr, conformance.HTTP10Corpus, conformance.Options{Allow: conformanceAllow10})
+	})
+	t.Run("HTTP/0.9", func(t *testing.T) {
+		conformance.Run(t, addr, conformance.HTTP09Corpus, conformance.Options{SimpleResponse: true})
+	})
+}
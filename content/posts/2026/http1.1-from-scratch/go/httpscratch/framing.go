@@ -0,0 +1,255 @@
+package httpscratch
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requestError is a problem with the request itself. The server answers it
+// with StatusCode and then closes the connection since it can no longer
+// trust where the next request starts.
+type requestError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Reason)
+}
+
+func badRequest(reason string) error {
+	return &requestError{StatusCode: http.StatusBadRequest, Reason: reason}
+}
+
+// writeRequestError sends a minimal response for a request that never made
+// it to the handler.
+func writeRequestError(w io.Writer, e *requestError) error {
+	body := http.StatusText(e.StatusCode) + ": " + e.Reason
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s",
+		e.StatusCode, http.StatusText(e.StatusCode), len(body), body)
+	return err
+}
+
+var (
+	errBareLF = badRequest("line not terminated by CRLF")
+	errBareCR = badRequest("bare CR in line")
+	// errLineTooLong means a line didn't fit in the number of bytes the
+	// caller allowed. What status that deserves depends on the line.
+	errLineTooLong = errors.New("line too long")
+)
+
+// readLine reads a single CRLF-terminated line of at most max bytes and
+// returns it without the line ending. Bare LF line endings and stray CRs are
+// rejected: a proxy in front of us might disagree about where the line ends,
+// which is exactly what request smuggling relies on.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		// The limit doesn't include the CRLF.
+		if len(line)+len(frag) > max+2 {
+			return nil, errLineTooLong
+		}
+		line = append(line, frag...)
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		break
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errBareLF
+	}
+	line = line[:len(line)-2]
+	if bytes.IndexByte(line, '\r') >= 0 {
+		return nil, errBareCR
+	}
+	return line, nil
+}
+
+// parseHeaderLine splits a field line into its name and value. The name must
+// be a token and the value loses its surrounding whitespace.
+func parseHeaderLine(line []byte) (string, string, error) {
+	// Obsolete line folding (RFC 9112 section 5.2) starts a line with
+	// whitespace to continue the previous field's value.
+	if line[0] == ' ' || line[0] == '\t' {
+		return "", "", badRequest("obsolete line folding")
+	}
+	k, v, ok := bytes.Cut(line, []byte{':'})
+	if !ok {
+		return "", "", badRequest("invalid header")
+	}
+	// This also rules out whitespace between the field name and colon
+	// (RFC 9112 section 5.1).
+	if !validHeaderName(k) {
+		return "", "", badRequest(fmt.Sprintf("invalid header name %q", k))
+	}
+	v = bytes.Trim(v, " \t")
+	if !validHeaderValue(v) {
+		return "", "", badRequest(fmt.Sprintf("invalid value for header %q", k))
+	}
+	return string(k), string(v), nil
+}
+
+// validHeaderName reports whether name is a token (RFC 9110 section 5.6.2).
+func validHeaderName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if !isTokenChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// validHeaderValue reports whether value is free of control characters. Tabs
+// are the one exception since they're allowed whitespace.
+func validHeaderValue(value []byte) bool {
+	for _, c := range value {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// requestFraming determines how the request body is delimited using the
+// message length rules from RFC 9112 section 6.3. Anything ambiguous is
+// rejected rather than guessed at.
+func requestFraming(req *http.Request) (chunked bool, contentLength int64, err error) {
+	chunked, contentLength, err = messageFraming(req.Header, req.ProtoAtLeast(1, 1))
+	if contentLength == -1 && !chunked {
+		// A request without either header has no body.
+		contentLength = 0
+	}
+	return chunked, contentLength, err
+}
+
+// messageFraming reads the framing headers shared by requests and responses.
+// contentLength is -1 if the body is chunked or neither header is present.
+func messageFraming(h http.Header, http11 bool) (chunked bool, contentLength int64, err error) {
+	te, hasTE := h["Transfer-Encoding"]
+	cl, hasCL := h["Content-Length"]
+
+	if hasTE {
+		if hasCL {
+			return false, 0, badRequest("both Transfer-Encoding and Content-Length")
+		}
+		if !http11 {
+			return false, 0, badRequest("Transfer-Encoding in an HTTP/1.0 message")
+		}
+		if err := parseTransferEncoding(te); err != nil {
+			return false, 0, err
+		}
+		return true, -1, nil
+	}
+
+	if hasCL {
+		if len(cl) != 1 {
+			return false, 0, badRequest("multiple Content-Length headers")
+		}
+		n, err := parseContentLength(cl[0])
+		if err != nil {
+			return false, 0, badRequest(err.Error())
+		}
+		return false, n, nil
+	}
+
+	return false, -1, nil
+}
+
+// parseTransferEncoding checks that the list of transfer codings ends in
+// exactly one "chunked", the only coding this server can decode.
+func parseTransferEncoding(values []string) error {
+	var codings []string
+	for _, v := range values {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.ToLower(strings.Trim(coding, " \t"))
+			if coding != "" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	if len(codings) == 0 {
+		return badRequest("empty Transfer-Encoding")
+	}
+	last := len(codings) - 1
+	for i, coding := range codings {
+		if coding == "chunked" && i != last {
+			return badRequest("chunked applied before the final transfer coding")
+		}
+	}
+	if codings[last] != "chunked" {
+		return badRequest("chunked is not the final transfer coding")
+	}
+	if len(codings) > 1 {
+		return &requestError{
+			StatusCode: http.StatusNotImplemented,
+			Reason:     fmt.Sprintf("unsupported transfer coding %q", codings[0]),
+		}
+	}
+	return nil
+}
+
+// parseContentLength parses a Content-Length value, which must be a plain
+// run of digits: no signs, whitespace or lists.
+func parseContentLength(headerval string) (int64, error) {
+	if headerval == "" {
+		return 0, errors.New("empty Content-Length")
+	}
+	for i := 0; i < len(headerval); i++ {
+		if headerval[i] < '0' || headerval[i] > '9' {
+			return 0, fmt.Errorf("invalid Content-Length %q", headerval)
+		}
+	}
+	n, err := strconv.ParseInt(headerval, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Length %q", headerval)
+	}
+	return n, nil
+}
+
+// parseChunkSize parses the chunk-size at the start of a chunk line,
+// ignoring any chunk extensions.
+func parseChunkSize(line []byte) (int64, error) {
+	size, _, _ := bytes.Cut(line, []byte{';'})
+	size = bytes.TrimRight(size, " \t")
+	if len(size) == 0 || len(size) > 16 {
+		return 0, fmt.Errorf("invalid chunk size %q", line)
+	}
+	for _, c := range size {
+		if !isHexDigit(c) {
+			return 0, fmt.Errorf("invalid chunk size %q", line)
+		}
+	}
+	n, err := strconv.ParseUint(string(size), 16, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chunk size %q", line)
+	}
+	return int64(n), nil
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
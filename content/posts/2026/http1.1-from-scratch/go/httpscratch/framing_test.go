@@ -0,0 +1,479 @@
+package httpscratch
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func echoBody(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Write(b)
+}
+
+func TestRequestSmuggling(t *testing.T) {
+	addr := startServer(t, &Server{Handler: http.HandlerFunc(echoBody)})
+
+	testCases := []struct {
+		name       string
+		request    string
+		wantStatus int
+		wantBody   string
+		// wantClose is implied for error statuses.
+		wantClose bool
+	}{
+		{
+			name:       "content-length body",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 5\r\n\r\nhello",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+		},
+		{
+			name:       "chunked body",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+		},
+		{
+			name:       "chunked is case-insensitive",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: Chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+		},
+		{
+			name:       "chunk extensions are ignored",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n5;name=value\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+		},
+		{
+			name:       "content-length with surrounding whitespace",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length:\t5 \r\n\r\nhello",
+			wantStatus: http.StatusOK,
+			wantBody:   "hello",
+		},
+		{
+			name:       "CL.TE",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 13\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nSMUGGLED",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "TE.CL",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "duplicate identical content-length",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "duplicate conflicting content-length",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 5\r\nContent-Length: 13\r\n\r\nhelloSMUGGLED",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "content-length list",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 5, 5\r\n\r\nhello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "content-length with sign",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: +5\r\n\r\nhello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "negative content-length",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: -1\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "hex content-length",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 0x5\r\n\r\nhello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "overflowing content-length",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 99999999999999999999\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "whitespace before colon",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding : chunked\r\nContent-Length: 5\r\n\r\nhello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "obsolete line folding",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "obsolete line folding in HTTP/1.0",
+			request:    "POST / HTTP/1.0\r\nContent-Length:\r\n 5\r\n\r\nhello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "header name with separator",
+			request:    "GET / HTTP/1.1\r\nHost: example\r\nX-Fo@: bar\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "empty header name",
+			request:    "GET / HTTP/1.1\r\nHost: example\r\n: bar\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "NUL in header value",
+			request:    "GET / HTTP/1.1\r\nHost: example\r\nX-Foo: b\x00ar\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "bare LF in request line",
+			request:    "GET / HTTP/1.1\nHost: example\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "bare LF in headers",
+			request:    "GET / HTTP/1.1\r\nHost: example\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "bare CR in header value",
+			request:    "GET / HTTP/1.1\r\nHost: example\rTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "obfuscated transfer-encoding",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "chunked applied twice",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "chunked not final across header lines",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "empty transfer-encoding",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: \r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unsupported transfer coding",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+			wantStatus: http.StatusNotImplemented,
+		},
+		{
+			name:       "transfer-encoding in HTTP/1.0",
+			request:    "POST / HTTP/1.0\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing host",
+			request:    "GET / HTTP/1.1\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "duplicate host",
+			request:    "GET / HTTP/1.1\r\nHost: example\r\nHost: evil\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing version on a POST",
+			request:    "POST /\r\nContent-Length: 5\r\n\r\nhello",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown version",
+			request:    "GET / HTTP/1.2\r\nHost: example\r\n\r\n",
+			wantStatus: http.StatusHTTPVersionNotSupported,
+		},
+		{
+			name:       "negative chunk size",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n-1\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+			wantClose:  true,
+		},
+		{
+			name:       "chunk size with prefix",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+			wantClose:  true,
+		},
+		{
+			name:       "overlong chunk size",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000005\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+			wantClose:  true,
+		},
+		{
+			name:       "chunk size with bare LF",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n5\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+			wantClose:  true,
+		},
+		{
+			name:       "chunk longer than its size",
+			request:    "POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+			wantClose:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			if _, err := io.WriteString(conn, tc.request); err != nil {
+				t.Fatal(err)
+			}
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("got status %d, want %d (body: %q)", resp.StatusCode, tc.wantStatus, body)
+			}
+			if tc.wantBody != "" && string(body) != tc.wantBody {
+				t.Errorf("got body %q, want %q", body, tc.wantBody)
+			}
+
+			if tc.wantClose || tc.wantStatus >= 400 {
+				// Nothing after a rejected request may be treated as another
+				// request, so the server must hang up.
+				if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+					t.Errorf("expected the connection to be closed, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	addr := startServer(t, &Server{Handler: http.HandlerFunc(echoBody)})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// Both requests arrive in one write. The body of the first request must
+	// not bleed into the second one.
+	_, err = io.WriteString(conn, ""+
+		"POST / HTTP/1.1\r\nHost: example\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n0\r\n\r\n"+
+		"POST / HTTP/1.1\r\nHost: example\r\nContent-Length: 6\r\n\r\nsecond")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	for _, want := range []string{"first", "second"} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != want {
+			t.Errorf("got body %q, want %q", body, want)
+		}
+	}
+}
+
+func TestUnreadBody(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ignored")
+		}),
+	})
+
+	testCases := []struct {
+		name      string
+		size      int
+		wantReuse bool
+	}{
+		{name: "small body is drained", size: 1 << 10, wantReuse: true},
+		{name: "large body closes the connection", size: maxPostHandlerReadBytes + 1<<10, wantReuse: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			// The client keeps sending the body while the server answers
+			// without reading it.
+			go func() {
+				fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example\r\nContent-Length: %d\r\n\r\n", tc.size)
+				conn.Write(bytes.Repeat([]byte("a"), tc.size))
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\n\r\n")
+			}()
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+
+			resp, err = http.ReadResponse(br, nil)
+			if tc.wantReuse {
+				if err != nil {
+					t.Fatalf("second request on the connection: %v", err)
+				}
+				resp.Body.Close()
+			} else if err == nil {
+				t.Fatal("expected the server to close the connection, got a second response")
+			}
+		})
+	}
+}
+
+func TestHeaderCanonicalization(t *testing.T) {
+	got := make(chan http.Header, 1)
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got <- r.Header
+		}),
+	})
+
+	resp, _ := roundTrip(t, addr, "GET / HTTP/1.1\r\nhost: example\r\nx-custom-header:\t one \t\r\nX-CUSTOM-HEADER: two\r\nContent-type: text/plain\r\n\r\n")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	h := <-got
+	// Direct map lookups only work if the keys are canonical.
+	if v := h["X-Custom-Header"]; len(v) != 2 || v[0] != "one" || v[1] != "two" {
+		t.Errorf(`got h["X-Custom-Header"] = %q, want ["one" "two"]`, v)
+	}
+	if v := h["Content-Type"]; len(v) != 1 || v[0] != "text/plain" {
+		t.Errorf(`got h["Content-Type"] = %q`, v)
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	type host struct {
+		host   string
+		header []string
+	}
+	got := make(chan host, 1)
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got <- host{r.Host, r.Header["Host"]}
+		}),
+	})
+
+	testCases := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{
+			name:    "Host header",
+			request: "GET / HTTP/1.1\r\nhost: example.com:8080\r\n\r\n",
+			want:    "example.com:8080",
+		},
+		{
+			name:    "absolute-form target",
+			request: "GET http://example.org/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			want:    "example.org",
+		},
+		{
+			name:    "HTTP/1.0 without Host",
+			request: "GET / HTTP/1.0\r\n\r\n",
+			want:    "",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, _ := roundTrip(t, addr, tc.request)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d", resp.StatusCode)
+			}
+			h := <-got
+			if h.host != tc.want {
+				t.Errorf("got r.Host %q, want %q", h.host, tc.want)
+			}
+			if h.header != nil {
+				t.Errorf(`got r.Header["Host"] = %q, want it removed`, h.header)
+			}
+		})
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler:             http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		MaxHeaderBytes:      1024,
+		MaxHeaderFieldBytes: 256,
+	})
+
+	testCases := []struct {
+		name       string
+		request    string
+		wantStatus int
+	}{
+		{
+			name:       "within limits",
+			request:    "GET / HTTP/1.1\r\nHost: example\r\nX-Big: " + strings.Repeat("a", 240) + "\r\n\r\n",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "field too large",
+			request:    "GET / HTTP/1.1\r\nHost: example\r\nX-Big: " + strings.Repeat("a", 300) + "\r\n\r\n",
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "too many fields",
+			request:    "GET / HTTP/1.1\r\nHost: example\r\n" + strings.Repeat("X-Field: "+strings.Repeat("a", 100)+"\r\n", 10) + "\r\n",
+			wantStatus: http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:       "request line too long",
+			request:    "GET /" + strings.Repeat("a", 2000) + " HTTP/1.1\r\nHost: example\r\n\r\n",
+			wantStatus: http.StatusRequestURITooLong,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, _ := roundTrip(t, addr, tc.request)
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package httpscratch
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileServerRanges(t *testing.T) {
+	content := strings.Repeat("0123456789", 200)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "file.txt"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	lastModified := modTime.Format(http.TimeFormat)
+
+	testCases := []struct {
+		name          string
+		method        string
+		header        string
+		wantStatus    int
+		wantBody      string
+		wantRange     string
+		wantLength    int64
+		wantParts     []string
+		wantNoFraming bool
+	}{
+		{
+			name:       "full GET",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+			wantLength: int64(len(content)),
+		},
+		{
+			name:       "single range",
+			method:     http.MethodGet,
+			header:     "Range: bytes=10-14\r\n",
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "01234",
+			wantRange:  "bytes 10-14/2000",
+			wantLength: 5,
+		},
+		{
+			name:       "suffix range",
+			method:     http.MethodGet,
+			header:     "Range: bytes=-3\r\n",
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "789",
+			wantRange:  "bytes 1997-1999/2000",
+			wantLength: 3,
+		},
+		{
+			name:       "multiple ranges",
+			method:     http.MethodGet,
+			header:     "Range: bytes=0-1,5-7\r\n",
+			wantStatus: http.StatusPartialContent,
+			wantParts:  []string{"01", "567"},
+			wantLength: -1,
+		},
+		{
+			name:       "unsatisfiable range",
+			method:     http.MethodGet,
+			header:     "Range: bytes=5000-6000\r\n",
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+			wantRange:  "bytes */2000",
+			wantLength: -1,
+		},
+		{
+			name:       "If-Range that doesn't match",
+			method:     http.MethodGet,
+			header:     "Range: bytes=0-4\r\nIf-Range: Mon, 01 Jan 2024 00:00:00 GMT\r\n",
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+			wantLength: int64(len(content)),
+		},
+		{
+			name:          "not modified",
+			method:        http.MethodGet,
+			header:        "If-Modified-Since: " + lastModified + "\r\n",
+			wantStatus:    http.StatusNotModified,
+			wantLength:    -1,
+			wantNoFraming: true,
+		},
+		{
+			name:          "HEAD",
+			method:        http.MethodHead,
+			wantStatus:    http.StatusOK,
+			wantLength:    int64(len(content)),
+			wantNoFraming: true,
+		},
+		{
+			name:          "HEAD with range",
+			method:        http.MethodHead,
+			header:        "Range: bytes=0-4\r\n",
+			wantStatus:    http.StatusPartialContent,
+			wantRange:     "bytes 0-4/2000",
+			wantLength:    5,
+			wantNoFraming: true,
+		},
+	}
+
+	for _, compress := range []bool{false, true} {
+		name := "identity"
+		if compress {
+			name = "compress"
+		}
+		t.Run(name, func(t *testing.T) {
+			addr := startServer(t, &Server{Handler: http.FileServer(http.Dir(dir)), Compress: compress})
+
+			// All of the requests go over one connection, so a response
+			// with the wrong framing breaks every response after it.
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			br := bufio.NewReader(conn)
+
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					_, err := io.WriteString(conn, tc.method+" /file.txt HTTP/1.1\r\nHost: example\r\n"+tc.header+"\r\n")
+					if err != nil {
+						t.Fatal(err)
+					}
+					resp, err := http.ReadResponse(br, &http.Request{Method: tc.method})
+					if err != nil {
+						t.Fatal(err)
+					}
+					body, err := io.ReadAll(resp.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if resp.StatusCode != tc.wantStatus {
+						t.Fatalf("got status %d, want %d", resp.StatusCode, tc.wantStatus)
+					}
+					if resp.Close {
+						t.Error("the connection should stay open")
+					}
+					if got := resp.Header.Get("Content-Range"); got != tc.wantRange {
+						t.Errorf("got Content-Range %q, want %q", got, tc.wantRange)
+					}
+					if tc.wantLength >= 0 && resp.ContentLength != tc.wantLength {
+						t.Errorf("got Content-Length %d, want %d", resp.ContentLength, tc.wantLength)
+					}
+					if tc.wantNoFraming {
+						if len(body) != 0 {
+							t.Errorf("got a body of %d bytes, want none", len(body))
+						}
+						if len(resp.TransferEncoding) != 0 {
+							t.Errorf("got Transfer-Encoding %q on a response without a body", resp.TransferEncoding)
+						}
+					}
+					if tc.wantBody != "" && string(body) != tc.wantBody {
+						t.Errorf("got body of %d bytes, want %d", len(body), len(tc.wantBody))
+					}
+					if tc.wantParts != nil {
+						checkByteranges(t, resp.Header.Get("Content-Type"), string(body), tc.wantParts)
+					}
+				})
+			}
+		})
+	}
+}
+
+// checkByteranges checks that body is a multipart/byteranges body with
+// the given parts.
+func checkByteranges(t *testing.T, contentType, body string, want []string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("got Content-Type %q, want multipart/byteranges", contentType)
+	}
+	mr := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var got []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got parts %q, want %q", got, want)
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	writeErr := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/short", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("/long", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "3")
+		io.WriteString(w, "hel")
+		_, err := io.WriteString(w, "lo")
+		writeErr <- err
+	})
+	addr := startServer(t, &Server{Handler: mux})
+
+	t.Run("short", func(t *testing.T) {
+		// The client can't tell the body is short, so the server has to
+		// close the connection instead of starting on the next response.
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.WriteString(conn, "GET /short HTTP/1.1\r\nHost: example\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(resp.Body); err != io.ErrUnexpectedEOF {
+			t.Errorf("got %v reading the body, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+
+	t.Run("long", func(t *testing.T) {
+		resp, body := roundTrip(t, addr, "GET /long HTTP/1.1\r\nHost: example\r\n\r\n")
+		if string(body) != "hel" || resp.ContentLength != 3 {
+			t.Errorf("got Content-Length %d and body %q", resp.ContentLength, body)
+		}
+		if err := <-writeErr; err != http.ErrContentLength {
+			t.Errorf("got write error %v, want %v", err, http.ErrContentLength)
+		}
+	})
+}
@@ -0,0 +1,393 @@
+package httpscratch
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func (s *Server) handleRequest(conn net.Conn, tlsState *tls.ConnectionState, reader *bufio.Reader) (bool, error) {
+	// The request line and the header fields share one size budget.
+	headerBudget := s.maxHeaderBytes()
+	reqLineBytes, err := readLine(reader, headerBudget)
+	if errors.Is(err, errLineTooLong) {
+		return true, &requestError{StatusCode: http.StatusRequestURITooLong, Reason: "request line too long"}
+	}
+	if err != nil {
+		return true, fmt.Errorf("read request line error: %w", err)
+	}
+	headerBudget -= len(reqLineBytes) + 2
+	reqLine := string(reqLineBytes)
+
+	req := new(http.Request)
+	var found bool
+
+	req.Method, reqLine, found = strings.Cut(reqLine, " ")
+	if !found {
+		return true, badRequest("invalid method")
+	}
+	if !methodValid(req.Method) {
+		return true, &requestError{StatusCode: http.StatusNotImplemented, Reason: "invalid method"}
+	}
+
+	req.RequestURI, reqLine, found = strings.Cut(reqLine, " ")
+	if req.URL, err = url.ParseRequestURI(req.RequestURI); err != nil {
+		return true, badRequest(fmt.Sprintf("invalid path: %s", err))
+	}
+
+	req.Header = make(http.Header)
+	if !found {
+		// An HTTP/0.9 simple request is only a method and a path. There is
+		// no version, no headers and no body, and only GET existed back then.
+		if req.Method != http.MethodGet {
+			return true, badRequest("missing protocol version")
+		}
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/0.9", 0, 9
+	} else {
+		req.Proto = reqLine
+		req.ProtoMajor, req.ProtoMinor, found = parseProtocol(req.Proto)
+		if !found {
+			return true, &requestError{StatusCode: http.StatusHTTPVersionNotSupported, Reason: "invalid protocol"}
+		}
+		if err := readHeader(reader, req.Header, headerBudget, s.maxHeaderFieldBytes()); err != nil {
+			return true, err
+		}
+	}
+
+	// Host is only required from HTTP/1.1 clients, but a request may never
+	// carry more than one.
+	if hosts := req.Header["Host"]; len(hosts) > 1 {
+		return true, badRequest("multiple 'Host' headers")
+	} else if len(hosts) == 0 && req.ProtoAtLeast(1, 1) {
+		return true, badRequest("required 'Host' header not found")
+	}
+	// As in net/http, the host ends up in req.Host rather than the header.
+	// An absolute-form target like "http://example.com/" names the host
+	// itself, and RFC 9112 section 3.2.2 says it wins over Host.
+	req.Host = req.URL.Host
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	delete(req.Header, "Host")
+
+	// HTTP/1.1 connections persist unless the client says otherwise.
+	// HTTP/1.0 connections only persist if the client asks for it, and
+	// HTTP/0.9 connections never do.
+	if req.ProtoAtLeast(1, 1) {
+		req.Close = headerHasToken(req.Header, "Connection", "close")
+	} else {
+		req.Close = !headerHasToken(req.Header, "Connection", "keep-alive")
+	}
+
+	isChunked, contentLength, err := requestFraming(req)
+	if err != nil {
+		return true, err
+	}
+
+	// The headers are in, so lift the header deadline. The write deadline
+	// covers the handler and the response.
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return true, err
+	}
+	if s.WriteTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout)); err != nil {
+			return true, err
+		}
+	}
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, conn.LocalAddr())
+	ctx, cancelCtx := context.WithCancel(ctx)
+	defer cancelCtx()
+	req.ContentLength = contentLength
+	if isChunked {
+		req.TransferEncoding = []string{"chunked"}
+		req.Body = &chunkedBodyReader{
+			reader: reader,
+		}
+	} else if req.ContentLength == 0 {
+		req.Body = noBody{}
+	} else {
+		req.Body = &bodyReader{
+			reader: &io.LimitedReader{R: reader, N: req.ContentLength},
+		}
+	}
+
+	if s.Compress {
+		if err := decodeRequestBody(req); err != nil {
+			return true, err
+		}
+	}
+
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.TLS = tlsState
+
+	if s.H2C != nil && tlsState == nil && isH2CUpgrade(req) {
+		return true, s.serveH2C(conn, reader, req.WithContext(ctx))
+	}
+
+	w := &responseBodyWriter{
+		srv:     s,
+		req:     req,
+		conn:    conn,
+		reader:  reader,
+		headers: make(http.Header),
+	}
+
+	s.handler().ServeHTTP(w, req.WithContext(ctx))
+	if w.hijacked {
+		return true, http.ErrHijacked
+	}
+	if err := w.flush(); err != nil {
+		return true, nil
+	}
+	// Drain whatever the handler didn't read so the next request on this
+	// connection starts at the right place. Close gives up after
+	// maxPostHandlerReadBytes, and the deadline stops a client trickling
+	// out a body nobody reads. Either way the connection can't be reused.
+	if err := conn.SetReadDeadline(time.Now().Add(postHandlerReadTimeout)); err != nil {
+		return true, nil
+	}
+	if err := req.Body.Close(); err != nil {
+		closeWriteAndDrain(conn)
+		return true, nil
+	}
+	return req.Close, nil
+}
+
+// readHeader reads header fields up to and including the blank line that
+// ends them. Each field line may be at most maxField bytes and all of them
+// together at most budget bytes. Field names are stored in canonical form,
+// so "content-type" and "Content-Type" end up under the same key.
+func readHeader(reader *bufio.Reader, h http.Header, budget, maxField int) error {
+	for {
+		limit := min(budget, maxField)
+		line, err := readLine(reader, limit)
+		if errors.Is(err, errLineTooLong) {
+			if limit == maxField {
+				return &requestError{StatusCode: http.StatusRequestHeaderFieldsTooLarge, Reason: "header field too large"}
+			}
+			return &requestError{StatusCode: http.StatusRequestHeaderFieldsTooLarge, Reason: "request headers too large"}
+		}
+		if err != nil {
+			return err
+		}
+		budget -= len(line) + 2
+		if len(line) == 0 {
+			return nil
+		}
+
+		k, v, err := parseHeaderLine(line)
+		if err != nil {
+			return err
+		}
+		key := textproto.CanonicalMIMEHeaderKey(k)
+		h[key] = append(h[key], v)
+	}
+}
+
+// headerHasToken reports whether the comma-separated list in header name
+// contains token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) { return 0, io.EOF }
+func (noBody) Close() error             { return nil }
+
+func parseProtocol(proto string) (int, int, bool) {
+	switch proto {
+	case "HTTP/1.0":
+		return 1, 0, true
+	case "HTTP/1.1":
+		return 1, 1, true
+	}
+	return 0, 0, false
+}
+
+func methodValid(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// maxPostHandlerReadBytes is how much of an unread request body the server
+// will read and throw away to reuse the connection, the same limit as
+// net/http. postHandlerReadTimeout is how long it waits for it.
+const (
+	maxPostHandlerReadBytes = 256 << 10
+	postHandlerReadTimeout  = 5 * time.Second
+)
+
+var errBodyNotDrained = errors.New("httpscratch: too much of the request body was left unread")
+
+// drainBody reads the rest of body, up to maxPostHandlerReadBytes. An error
+// means the body didn't end within that, so the connection is unusable.
+func drainBody(body io.Reader) error {
+	_, err := io.CopyN(io.Discard, body, maxPostHandlerReadBytes+1)
+	if err == io.EOF {
+		return nil
+	}
+	if err == nil {
+		return errBodyNotDrained
+	}
+	return err
+}
+
+// bodyReader reads a body delimited by Content-Length.
+type bodyReader struct {
+	reader *io.LimitedReader
+	// closeErr is the result of the first Close, which later ones return.
+	closed   bool
+	closeErr error
+}
+
+func (r *bodyReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	if err == io.EOF && r.reader.N > 0 {
+		// The connection ended before the whole body arrived.
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *bodyReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.closeErr = drainBody(r)
+	}
+	return r.closeErr
+}
+
+// maxChunkLineBytes limits chunk size lines, including any chunk extensions,
+// and trailer fields.
+const maxChunkLineBytes = 4096
+
+// maxTrailerFields and maxTrailerBytes limit the trailer section after the
+// last chunk, which the peer could otherwise keep sending forever.
+const (
+	maxTrailerFields = 100
+	maxTrailerBytes  = 64 << 10
+)
+
+var errTrailerTooLarge = errors.New("httpscratch: trailer section too large")
+
+type chunkedBodyReader struct {
+	reader *bufio.Reader
+	n      int64 // bytes left in current chunk
+	err    error
+	// trailer, if non-nil, receives the trailer fields that follow the
+	// last chunk. Otherwise they're discarded.
+	trailer http.Header
+	// closeErr is the result of the first Close, which later ones return.
+	closed   bool
+	closeErr error
+}
+
+func (r *chunkedBodyReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.n == 0 {
+		r.n, r.err = r.readChunkSize()
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+	if r.n == 0 {
+		r.err = io.EOF
+		return 0, r.err
+	}
+	if int64(len(p)) > r.n {
+		p = p[0:r.n]
+	}
+	n, err = r.reader.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF {
+		// The connection ended in the middle of a chunk.
+		err = io.ErrUnexpectedEOF
+	}
+	if r.n == 0 && err == nil {
+		// Read trailing \r\n
+		line, err := readLine(r.reader, maxChunkLineBytes)
+		if err != nil {
+			r.err = err
+			return n, err
+		}
+		if len(line) != 0 {
+			r.err = errors.New("missing CRLF after chunk")
+			return n, r.err
+		}
+	}
+	r.err = err
+	return n, err
+}
+
+func (r *chunkedBodyReader) readChunkSize() (int64, error) {
+	line, err := readLine(r.reader, maxChunkLineBytes)
+	if err != nil {
+		return 0, err
+	}
+	n, err := parseChunkSize(line)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		// Read trailers
+		budget := maxTrailerBytes
+		for fields := 0; ; fields++ {
+			line, err := readLine(r.reader, min(budget, maxChunkLineBytes))
+			if errors.Is(err, errLineTooLong) {
+				return 0, errTrailerTooLarge
+			}
+			if err != nil {
+				return 0, err
+			}
+			if len(line) == 0 {
+				break
+			}
+			budget -= len(line) + 2
+			if fields == maxTrailerFields || budget < 0 {
+				return 0, errTrailerTooLarge
+			}
+			if r.trailer == nil {
+				continue
+			}
+			k, v, err := parseHeaderLine(line)
+			if err != nil {
+				return 0, err
+			}
+			key := textproto.CanonicalMIMEHeaderKey(k)
+			r.trailer[key] = append(r.trailer[key], v)
+		}
+	}
+	return n, nil
+}
+
+func (r *chunkedBodyReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.closeErr = drainBody(r)
+	}
+	return r.closeErr
+}
@@ -0,0 +1,372 @@
+package httpscratch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+var nlcf = []byte{0x0d, 0x0a}
+
+type responseBodyWriter struct {
+	srv             *Server
+	req             *http.Request
+	conn            net.Conn
+	reader          *bufio.Reader
+	hijacked        bool
+	status          int
+	sentHeaders     bool
+	headers         http.Header
+	chunkedEncoding bool
+	// bodyBuffer holds the start of the body while we decide whether it's
+	// big enough to be worth compressing. It's nil once that's decided.
+	bodyBuffer *bytes.Buffer
+	compressor compressor
+	// contentLength is the declared length of the body as sent, or -1 if
+	// it's delimited some other way. written counts the bytes sent so far.
+	contentLength int64
+	written       int64
+}
+
+func (r *responseBodyWriter) Header() http.Header {
+	return r.headers
+}
+
+func (r *responseBodyWriter) Write(b []byte) (int, error) {
+	if r.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if r.status == 0 {
+		if r.headers.Get("Content-Type") == "" && len(b) > 0 {
+			r.headers.Set("Content-Type", http.DetectContentType(b))
+		}
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.req.Method == http.MethodHead {
+		// The headers describe the body a GET would get, but it's never
+		// sent. Handlers like http.FileServer rely on this.
+		return len(b), nil
+	}
+	if !bodyAllowedForStatus(r.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+
+	if r.bodyBuffer != nil {
+		r.bodyBuffer.Write(b)
+		if r.bodyBuffer.Len() >= r.srv.compressMinSize() {
+			if err := r.startBody(false); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+
+	return r.writeBody(b)
+}
+
+// writeBody writes to the client through the compressor, if there is one.
+func (r *responseBodyWriter) writeBody(b []byte) (int, error) {
+	if r.compressor != nil {
+		return r.compressor.Write(b)
+	}
+	return r.writeRaw(b)
+}
+
+// writeRaw writes b to the connection, framed as a chunk if needed.
+func (r *responseBodyWriter) writeRaw(b []byte) (int, error) {
+	if len(b) == 0 {
+		// An empty chunk would end the body.
+		return 0, nil
+	}
+
+	if r.contentLength >= 0 && r.written+int64(len(b)) > r.contentLength {
+		return 0, http.ErrContentLength
+	}
+	r.written += int64(len(b))
+
+	if r.chunkedEncoding {
+		chunkSize := fmt.Sprintf("%x\r\n", len(b))
+		if _, err := r.conn.Write([]byte(chunkSize)); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.conn.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	if r.chunkedEncoding {
+		if _, err := r.conn.Write(nlcf); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (r *responseBodyWriter) Flush() {
+	if r.hijacked {
+		return
+	}
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.bodyBuffer != nil {
+		if err := r.startBody(false); err != nil {
+			return
+		}
+	}
+	if r.compressor != nil {
+		r.compressor.Flush()
+	}
+	if flusher, ok := r.conn.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseBodyWriter) flush() error {
+	if r.status == 0 {
+		// The handler never wrote anything, so the body is empty.
+		_, clSet := r.headers["Content-Length"]
+		_, teSet := r.headers["Transfer-Encoding"]
+		if !clSet && !teSet {
+			r.headers.Set("Content-Length", "0")
+		}
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.bodyBuffer != nil {
+		// The whole body fit in the buffer.
+		if err := r.startBody(true); err != nil {
+			return err
+		}
+	}
+	if r.compressor != nil {
+		if err := r.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	if r.chunkedEncoding {
+		if _, err := r.conn.Write([]byte("0\r\n\r\n")); err != nil {
+			return err
+		}
+	}
+	if r.contentLength >= 0 && r.written < r.contentLength {
+		// The handler promised more than it wrote. The client is still
+		// waiting for the rest, so the only way out is to hang up.
+		r.req.Close = true
+	}
+
+	return nil
+}
+
+// bodyAllowed reports whether the response carries a body on the wire.
+func (r *responseBodyWriter) bodyAllowed() bool {
+	return r.req.Method != http.MethodHead && bodyAllowedForStatus(r.status)
+}
+
+// bodyAllowedForStatus reports whether a response with the given status may
+// have a body (RFC 9110 section 6.4.1).
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+func (r *responseBodyWriter) WriteHeader(statusCode int) {
+	if r.hijacked {
+		slog.Warn(fmt.Sprintf("WriteHeader(%d) called on a hijacked connection", statusCode))
+		return
+	}
+	if r.status != 0 {
+		slog.Warn(fmt.Sprintf("WriteHeader called twice, second time with: %d", statusCode))
+		return
+	}
+	r.status = statusCode
+
+	if r.mayCompress() {
+		// Hold the headers back until we know whether the body gets
+		// compressed, since that changes them.
+		r.bodyBuffer = &bytes.Buffer{}
+		return
+	}
+	r.sendHeaders()
+}
+
+func (r *responseBodyWriter) sendHeaders() error {
+	r.sentHeaders = true
+	r.contentLength = -1
+	if err := r.writeHeader(r.conn, r.req.Proto, r.headers, r.status); err != nil {
+		return err
+	}
+	if r.bodyAllowed() && !r.chunkedEncoding {
+		if cl, err := strconv.ParseInt(r.headers.Get("Content-Length"), 10, 64); err == nil {
+			r.contentLength = cl
+		}
+	}
+	return nil
+}
+
+// mayCompress reports whether the response could end up compressed, based
+// on what's known when WriteHeader is called.
+func (r *responseBodyWriter) mayCompress() bool {
+	if !r.srv.Compress || r.req.Method == http.MethodHead || !r.req.ProtoAtLeast(1, 0) {
+		return false
+	}
+	if !bodyAllowedForStatus(r.status) || r.status == http.StatusPartialContent {
+		return false
+	}
+	if r.headers.Get("Content-Encoding") != "" || r.headers.Get("Content-Range") != "" {
+		return false
+	}
+	return true
+}
+
+// startBody decides on compression using the buffered start of the body,
+// sends the headers and then the buffered bytes. final means the buffer
+// holds the whole body.
+func (r *responseBodyWriter) startBody(final bool) error {
+	buf := r.bodyBuffer.Bytes()
+	r.bodyBuffer = nil
+
+	if r.headers.Get("Content-Type") == "" && len(buf) > 0 {
+		r.headers.Set("Content-Type", http.DetectContentType(buf))
+	}
+
+	if encoding := r.chooseEncoding(len(buf), final); encoding != "" {
+		r.headers.Set("Content-Encoding", encoding)
+		r.headers.Del("Content-Length")
+		r.compressor = newCompressor(encoding, writerFunc(r.writeRaw))
+	} else if final {
+		_, clSet := r.headers["Content-Length"]
+		_, teSet := r.headers["Transfer-Encoding"]
+		if !clSet && !teSet {
+			r.headers.Set("Content-Length", strconv.Itoa(len(buf)))
+		}
+	}
+
+	if err := r.sendHeaders(); err != nil {
+		return err
+	}
+	_, err := r.writeBody(buf)
+	return err
+}
+
+// chooseEncoding returns the content coding to compress the body with, or
+// "" to send it as-is. size is the number of body bytes seen so far.
+func (r *responseBodyWriter) chooseEncoding(size int, final bool) string {
+	if isCompressedType(r.headers.Get("Content-Type")) {
+		return ""
+	}
+	if headerHasToken(r.headers, "Cache-Control", "no-transform") {
+		return ""
+	}
+
+	// From here on the response depends on Accept-Encoding.
+	r.headers.Add("Vary", "Accept-Encoding")
+
+	minSize := r.srv.compressMinSize()
+	if final && size < minSize {
+		return ""
+	}
+	if cl, err := strconv.ParseInt(r.headers.Get("Content-Length"), 10, 64); err == nil && cl < int64(minSize) {
+		return ""
+	}
+	return negotiateEncoding(r.req.Header)
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+
+func (r *responseBodyWriter) writeHeader(conn io.Writer, proto string, headers http.Header, statusCode int) error {
+	if !r.req.ProtoAtLeast(1, 0) {
+		// An HTTP/0.9 response is nothing but the body, which ends when
+		// the connection closes.
+		r.req.Close = true
+		return nil
+	}
+
+	_, clSet := r.headers["Content-Length"]
+	_, teSet := r.headers["Transfer-Encoding"]
+	switch {
+	case !bodyAllowedForStatus(statusCode):
+		// There is no body to frame. These responses must not carry
+		// Transfer-Encoding, and a 304 keeps any Content-Length since it
+		// describes the cached representation.
+		r.headers.Del("Transfer-Encoding")
+		if statusCode != http.StatusNotModified {
+			r.headers.Del("Content-Length")
+		}
+	case r.req.Method == http.MethodHead:
+		// A HEAD response ends with the headers, whatever they say about
+		// the body, so it needs no framing.
+	case !clSet && !teSet:
+		if r.req.ProtoAtLeast(1, 1) {
+			r.chunkedEncoding = true
+			r.headers.Set("Transfer-Encoding", "chunked")
+		} else {
+			// HTTP/1.0 clients don't know about chunked encoding, so the
+			// end of the body is signaled by closing the connection.
+			r.req.Close = true
+		}
+	}
+
+	if r.srv.shuttingDown() {
+		// Tell the client not to reuse a connection we're about to close.
+		r.req.Close = true
+	}
+	if r.req.Close {
+		r.headers.Set("Connection", "close")
+	} else {
+		r.headers.Set("Connection", "keep-alive")
+	}
+
+	if _, err := io.WriteString(conn, proto); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{' '}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, strconv.FormatInt(int64(statusCode), 10)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{' '}); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, http.StatusText(statusCode)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(nlcf); err != nil {
+		return err
+	}
+	for k, vals := range headers {
+		for _, val := range vals {
+			if _, err := io.WriteString(conn, k); err != nil {
+				return err
+			}
+			if _, err := conn.Write([]byte{':', ' '}); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(conn, val); err != nil {
+				return err
+			}
+			if _, err := conn.Write(nlcf); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := conn.Write(nlcf); err != nil {
+		return err
+	}
+	return nil
+}
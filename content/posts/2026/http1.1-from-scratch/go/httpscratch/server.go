@@ -0,0 +1,373 @@
+// Package httpscratch is the HTTP server built over the course of the "HTTP
+// from scratch" series. A single Server speaks HTTP/0.9, HTTP/1.0 and
+// HTTP/1.1, picking the version from each request line.
+package httpscratch
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxHeaderBytes is the default for Server.MaxHeaderBytes.
+	DefaultMaxHeaderBytes = 1 << 20
+	// DefaultMaxHeaderFieldBytes is the default for
+	// Server.MaxHeaderFieldBytes.
+	DefaultMaxHeaderFieldBytes = 8 << 10
+)
+
+// shutdownPollInterval is how often Shutdown checks for connections that
+// have gone idle and can be closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Server is a simple HTTP server. HTTP/0.9 simple requests get a bare body,
+// HTTP/1.0 responses are delimited by Content-Length or by closing the
+// connection, and HTTP/1.1 connections are kept alive with chunked bodies
+// when the length isn't known up front.
+type Server struct {
+	Addr    string
+	Handler http.Handler
+
+	// ReadHeaderTimeout is the amount of time allowed to read the request
+	// line and headers. Zero means no timeout.
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout is the maximum amount of time to wait for the next request
+	// on a keep-alive connection. If zero, ReadHeaderTimeout is used.
+	IdleTimeout time.Duration
+	// WriteTimeout is the maximum duration before timing out writes of the
+	// response. It is reset for every request. Zero means no timeout.
+	WriteTimeout time.Duration
+	// Compress enables transparent compression. Response bodies are gzip or
+	// deflate encoded based on the request's Accept-Encoding, and gzip or
+	// deflate encoded request bodies are decoded before the handler sees them.
+	Compress bool
+	// CompressMinSize is the smallest response body worth compressing. Zero
+	// means 1024 bytes.
+	CompressMinSize int
+
+	// MaxHeaderBytes limits the size of the request line and header fields
+	// together. Larger requests get 414 or 431. Zero means
+	// DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// MaxHeaderFieldBytes limits the size of a single header field line.
+	// Larger fields get 431. Zero means DefaultMaxHeaderFieldBytes.
+	MaxHeaderFieldBytes int
+
+	// H2C, if set, takes over connections that ask to switch to cleartext
+	// HTTP/2 with "Upgrade: h2c". The server reads the request body and
+	// sends 101 Switching Protocols before calling it. upgrade is the
+	// request that asked for the switch, which HTTP/2 answers as stream 1,
+	// and settings is the decoded HTTP2-Settings header. The connection is
+	// closed when H2C returns, and until then Shutdown waits for it like a
+	// request in flight. With golang.org/x/net/http2 this is a call to
+	// (*http2.Server).ServeConn.
+	H2C func(conn net.Conn, upgrade *http.Request, settings []byte)
+
+	// TLSConfig optionally provides the TLS configuration used by ServeTLS
+	// and ListenAndServeTLS.
+	TLSConfig *tls.Config
+	// MaxConns limits the number of simultaneously open connections. Once
+	// the limit is reached, new connections wait in the kernel's accept
+	// backlog. Zero means no limit.
+	MaxConns int
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]bool // value is true when the connection is idle
+	doneChan   chan struct{}
+	inShutdown atomic.Bool
+}
+
+// ListenAndServe starts the server.
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return http.ErrServerClosed
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and handles each one in a new goroutine.
+// It always returns a non-nil error. After Shutdown, the error is
+// http.ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return http.ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	defer l.Close()
+
+	var sem chan struct{}
+	if s.MaxConns > 0 {
+		sem = make(chan struct{}, s.MaxConns)
+	}
+
+	for {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-s.getDoneChan():
+				return http.ErrServerClosed
+			}
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+
+		// Track the connection before its goroutine starts, so a Shutdown
+		// that runs in between still waits for it or closes it.
+		s.setConnState(conn, true)
+		go func() {
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			if err := s.handleConnection(conn); err != nil {
+				slog.Error(fmt.Sprintf("http error: %s", err))
+			}
+		}()
+	}
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners, then
+// closes idle connections and waits for active ones to finish their current
+// request. If ctx expires first, Shutdown returns the context's error and
+// any remaining connections are left to finish on their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	s.closeDoneChanLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+func (s *Server) handler() http.Handler {
+	if s.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return s.Handler
+}
+
+func (s *Server) maxHeaderBytes() int {
+	if s.MaxHeaderBytes > 0 {
+		return s.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+func (s *Server) maxHeaderFieldBytes() int {
+	if s.MaxHeaderFieldBytes > 0 {
+		return s.MaxHeaderFieldBytes
+	}
+	return DefaultMaxHeaderFieldBytes
+}
+
+func (s *Server) compressMinSize() int {
+	if s.CompressMinSize > 0 {
+		return s.CompressMinSize
+	}
+	return defaultCompressMinSize
+}
+
+func (s *Server) getDoneChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.doneChan == nil {
+		s.doneChan = make(chan struct{})
+	}
+	return s.doneChan
+}
+
+func (s *Server) closeDoneChanLocked() {
+	if s.doneChan == nil {
+		s.doneChan = make(chan struct{})
+	}
+	select {
+	case <-s.doneChan:
+	default:
+		close(s.doneChan)
+	}
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+// setConnState records whether conn is idle (waiting for a request) or
+// active (reading or serving one).
+func (s *Server) setConnState(conn net.Conn, idle bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.conns[conn] = idle
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeIdleConns closes all idle connections and reports whether there are
+// no connections left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) handleConnection(conn net.Conn) (err error) {
+	defer func() {
+		s.forgetConn(conn)
+		// A hijacked connection belongs to the handler now.
+		if errors.Is(err, http.ErrHijacked) {
+			err = nil
+			return
+		}
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	// For TLS connections, finish the handshake before reading anything so
+	// the negotiated state is available to every request.
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := setReadDeadline(conn, s.ReadHeaderTimeout); err != nil {
+			return err
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake error: %w", err)
+		}
+		state := tlsConn.ConnectionState()
+		tlsState = &state
+	}
+
+	for first := true; ; first = false {
+		s.setConnState(conn, true)
+		if s.shuttingDown() {
+			return nil
+		}
+
+		// Wait for the first byte of the next request. The first request
+		// on a connection gets ReadHeaderTimeout, later ones get IdleTimeout.
+		waitTimeout := s.ReadHeaderTimeout
+		if !first && s.IdleTimeout > 0 {
+			waitTimeout = s.IdleTimeout
+		}
+		if err := setReadDeadline(conn, waitTimeout); err != nil {
+			return err
+		}
+		if _, err := reader.Peek(1); err != nil {
+			if errors.Is(err, io.EOF) || (!first && isTimeout(err)) {
+				return nil
+			}
+			return fmt.Errorf("read request line error: %w", err)
+		}
+		s.setConnState(conn, false)
+
+		if err := setReadDeadline(conn, s.ReadHeaderTimeout); err != nil {
+			return err
+		}
+		shouldClose, err := s.handleRequest(conn, tlsState, reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			var reqErr *requestError
+			if errors.As(err, &reqErr) {
+				writeRequestError(conn, reqErr)
+				closeWriteAndDrain(conn)
+			}
+			return err
+		}
+		if shouldClose {
+			return nil
+		}
+	}
+}
+
+// closeWriteAndDrain shuts down the write side of conn and reads whatever
+// the client already sent. Closing a socket with unread data makes the
+// kernel send a RST, which can destroy the error response we just wrote
+// before the client gets to read it.
+func closeWriteAndDrain(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	io.Copy(io.Discard, io.LimitReader(conn, 256<<10))
+}
+
+func setReadDeadline(conn net.Conn, d time.Duration) error {
+	if d <= 0 {
+		return conn.SetReadDeadline(time.Time{})
+	}
+	return conn.SetReadDeadline(time.Now().Add(d))
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
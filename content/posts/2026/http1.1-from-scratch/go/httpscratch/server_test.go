@@ -0,0 +1,325 @@
+package httpscratch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startServer runs s on a random local port and returns its address. The
+// server is shut down when the test finishes.
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(l) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Serve returned %v, want %v", err, http.ErrServerClosed)
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ReadHeaderTimeout: 100 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A slowloris client: send part of the headers and then stall.
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected server to close the connection, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler:     http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		IdleTimeout: 100 * time.Millisecond,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// The connection is now idle and should be closed once IdleTimeout passes.
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected server to close the idle connection, got %v", err)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler:  http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		MaxConns: 1,
+	})
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// Make sure the first connection has been accepted before dialing again.
+	if _, err := io.WriteString(first, "GET / HTTP/1.1\r\nHost: example\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	firstReader := bufio.NewReader(first)
+	if _, err := http.ReadResponse(firstReader, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, err := io.WriteString(second, "GET / HTTP/1.1\r\nHost: example\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := second.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("expected second connection to wait, got %v", err)
+	}
+
+	// Closing the first connection frees up the slot.
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := http.ReadResponse(bufio.NewReader(second), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownWaitsForActiveRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			io.WriteString(w, "done")
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("Serve returned %v, want %v", err, http.ErrServerClosed)
+	}
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned before the active request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Close {
+		t.Error("expected the response to a request in flight during shutdown to close the connection")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "done" {
+		t.Errorf("got body %q, want %q", body, "done")
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestShutdownClosesNewConnections(t *testing.T) {
+	// A connection that was just accepted counts as idle, so Shutdown
+	// closes it instead of returning while it's still about to be served.
+	s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// It's a reset rather than EOF if Shutdown closed the listener before
+	// the connection was accepted.
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("expected Shutdown to close the connection, got %v", err)
+	}
+}
+
+func TestVersionDispatch(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}),
+	})
+
+	testCases := []struct {
+		name    string
+		request string
+		// wantProto is empty for a bare HTTP/0.9 response.
+		wantProto            string
+		wantTransferEncoding []string
+	}{
+		{
+			name:    "HTTP/0.9",
+			request: "GET /\r\n",
+		},
+		{
+			name:      "HTTP/1.0",
+			request:   "GET / HTTP/1.0\r\n\r\n",
+			wantProto: "HTTP/1.0",
+		},
+		{
+			name:                 "HTTP/1.1",
+			request:              "GET / HTTP/1.1\r\nHost: example\r\nConnection: close\r\n\r\n",
+			wantProto:            "HTTP/1.1",
+			wantTransferEncoding: []string{"chunked"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			if _, err := io.WriteString(conn, tc.request); err != nil {
+				t.Fatal(err)
+			}
+			// Every case ends with the server closing the connection.
+			raw, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.wantProto == "" {
+				if string(raw) != tc.name {
+					t.Errorf("got response %q, want a bare body of %q", raw, tc.name)
+				}
+				return
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Proto != tc.wantProto {
+				t.Errorf("got status line version %q, want %q", resp.Proto, tc.wantProto)
+			}
+			if string(body) != tc.name {
+				t.Errorf("handler saw %q, want %q", body, tc.name)
+			}
+			if !slices.Equal(resp.TransferEncoding, tc.wantTransferEncoding) {
+				t.Errorf("got Transfer-Encoding %q, want %q", resp.TransferEncoding, tc.wantTransferEncoding)
+			}
+			if !resp.Close {
+				t.Error("expected the connection to be closed")
+			}
+		})
+	}
+}
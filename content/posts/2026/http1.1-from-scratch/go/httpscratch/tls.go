@@ -0,0 +1,47 @@
+package httpscratch
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// ListenAndServeTLS listens on s.Addr and serves HTTPS using the given
+// certificate and key files. See ServeTLS.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if s.shuttingDown() {
+		return http.ErrServerClosed
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS wraps l in TLS and serves connections on it. The certificate
+// comes from certFile and keyFile, which can be left empty if
+// s.TLSConfig already has Certificates or GetCertificate set. The server
+// advertises "http/1.1" using ALPN so clients don't try to speak HTTP/2.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := s.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if !slices.Contains(config.NextProtos, "http/1.1") {
+		config.NextProtos = append(config.NextProtos, "http/1.1")
+	}
+
+	hasCert := len(config.Certificates) > 0 || config.GetCertificate != nil
+	if !hasCert || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return s.Serve(tls.NewListener(l, config))
+}
@@ -0,0 +1,128 @@
+package httpscratch
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 in
+// memory, so the tests don't need any files.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"kmcd.dev test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+
+	gotTLS := make(chan *tls.ConnectionState, 1)
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotTLS <- r.TLS
+			io.WriteString(w, "hello over TLS")
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.ServeTLS(l, "", "") }()
+	defer func() {
+		s.Shutdown(context.Background())
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("ServeTLS returned %v, want %v", err, http.ErrServerClosed)
+		}
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			// Offer h2 as well to check that ALPN settles on http/1.1.
+			TLSClientConfig:   &tls.Config{RootCAs: pool, NextProtos: []string{"h2", "http/1.1"}},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("https://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ProtoMajor != 1 || resp.ProtoMinor != 1 {
+		t.Errorf("got protocol %s, want HTTP/1.1", resp.Proto)
+	}
+	if string(body) != "hello over TLS" {
+		t.Errorf("got body %q", body)
+	}
+	if resp.TLS == nil || resp.TLS.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("client didn't negotiate http/1.1: %+v", resp.TLS)
+	}
+
+	state := <-gotTLS
+	if state == nil {
+		t.Fatal("r.TLS was not populated")
+	}
+	if !state.HandshakeComplete {
+		t.Error("r.TLS.HandshakeComplete is false")
+	}
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("got negotiated protocol %q, want http/1.1", state.NegotiatedProtocol)
+	}
+}
+
+func TestServeTLSRequiresCertificate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Handler: http.NotFoundHandler()}
+	if err := s.ServeTLS(l, "", ""); err == nil {
+		t.Fatal("expected an error without a certificate")
+	}
+}
@@ -0,0 +1,113 @@
+package httpscratch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Hijack lets the handler take over the connection, as http.Hijacker. The
+// returned bufio.Reader may already hold bytes the client sent after the
+// request. The server stops tracking the connection, so Shutdown neither
+// waits for it nor closes it.
+func (r *responseBodyWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	if r.bodyBuffer != nil {
+		// Send whatever the handler has written so far before it starts
+		// writing to the connection itself.
+		if err := r.startBody(false); err != nil {
+			return nil, nil, err
+		}
+	}
+	r.hijacked = true
+	r.srv.forgetConn(r.conn)
+	if err := r.conn.SetDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	return r.conn, bufio.NewReadWriter(r.reader, bufio.NewWriter(r.conn)), nil
+}
+
+// isUpgrade reports whether the request asks to switch to protocol with an
+// Upgrade header (RFC 9110 section 7.8). Only HTTP/1.1 has Upgrade.
+func isUpgrade(req *http.Request, protocol string) bool {
+	if !req.ProtoAtLeast(1, 1) || !headerHasToken(req.Header, "Connection", "upgrade") {
+		return false
+	}
+	for _, v := range req.Header["Upgrade"] {
+		for _, p := range strings.Split(v, ",") {
+			// Protocols may carry a version, like "websocket/13".
+			name, _, _ := strings.Cut(strings.TrimSpace(p), "/")
+			if strings.EqualFold(name, protocol) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isH2CUpgrade reports whether the request asks to switch to cleartext
+// HTTP/2 (RFC 7540 section 3.2), which also needs an HTTP2-Settings header
+// listed in Connection.
+func isH2CUpgrade(req *http.Request) bool {
+	return isUpgrade(req, "h2c") && headerHasToken(req.Header, "Connection", "HTTP2-Settings")
+}
+
+// maxH2CUpgradeBodyBytes limits the body of a request that asks to switch
+// to h2c. It's held in memory until HTTP/2 hands it to the handler.
+const maxH2CUpgradeBodyBytes = 1 << 20
+
+// serveH2C switches the connection to HTTP/2 and hands it to s.H2C. The
+// connection stays tracked as active until H2C returns, so Shutdown waits
+// for it like any request in flight.
+func (s *Server) serveH2C(conn net.Conn, reader *bufio.Reader, req *http.Request) error {
+	values := req.Header["Http2-Settings"]
+	if len(values) != 1 {
+		return badRequest("h2c upgrade needs exactly one HTTP2-Settings header")
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil {
+		return badRequest("invalid HTTP2-Settings header")
+	}
+
+	// The whole request has to arrive over HTTP/1.1 before the switch, so
+	// read the body now. HTTP/2 gets it from memory.
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxH2CUpgradeBodyBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxH2CUpgradeBodyBytes {
+		return &requestError{StatusCode: http.StatusRequestEntityTooLarge, Reason: "h2c upgrade request body too large"}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err != nil {
+		return err
+	}
+
+	// The client sends its connection preface right after the request, so
+	// some of it may already be sitting in our buffer.
+	s.H2C(&bufferedConn{Conn: conn, reader: reader}, req, settings)
+	return nil
+}
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader, so that
+// nothing already buffered is lost when a connection changes hands.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
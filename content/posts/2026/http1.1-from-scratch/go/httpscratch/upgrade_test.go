@@ -0,0 +1,290 @@
+package httpscratch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestHijack(t *testing.T) {
+	hijacked := make(chan struct{})
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, rw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			close(hijacked)
+			// Speak a made-up line protocol that echoes lines back until
+			// the client says bye. The first line was sent along with the
+			// request, so it has to come out of rw's buffer.
+			defer conn.Close()
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil || line == "bye\n" {
+					return
+				}
+				rw.WriteString("echo: " + line)
+				rw.Flush()
+			}
+		}),
+	}
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\n\r\nfirst\n"); err != nil {
+		t.Fatal(err)
+	}
+	<-hijacked
+
+	// Shutdown must not wait for a connection the server no longer owns.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	io.WriteString(conn, "second\nbye\n")
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo: first\necho: second\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Proto+" "+string(body))
+	})
+	h2s := &http2.Server{}
+	addr := startServer(t, &Server{
+		Handler: handler,
+		H2C: func(conn net.Conn, upgrade *http.Request, settings []byte) {
+			h2s.ServeConn(conn, &http2.ServeConnOpts{
+				Handler:        handler,
+				UpgradeRequest: upgrade,
+				Settings:       settings,
+			})
+		},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// An empty HTTP2-Settings means the client uses the defaults. The
+	// client preface is sent straight after the request, without waiting
+	// for the 101.
+	var out bytes.Buffer
+	out.WriteString("POST / HTTP/1.1\r\nHost: example\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\nContent-Length: 5\r\n\r\nhello")
+	out.WriteString(http2.ClientPreface)
+	if err := http2.NewFramer(&out, nil).WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(out.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("got %s with Upgrade %q, want 101 to h2c", resp.Status, resp.Header.Get("Upgrade"))
+	}
+
+	// The upgraded request is answered on stream 1, as it arrived.
+	framer := http2.NewFramer(conn, br)
+	decoder := hpack.NewDecoder(4096, nil)
+	if status, body := readH2Response(t, framer, decoder, 1); status != "200" || body != "HTTP/1.1 hello" {
+		t.Errorf("stream 1: got :status %q and body %q", status, body)
+	}
+
+	// After that it's an ordinary HTTP/2 connection.
+	var block bytes.Buffer
+	enc := hpack.NewEncoder(&block)
+	for _, f := range []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "example"},
+		{Name: ":path", Value: "/"},
+	} {
+		enc.WriteField(f)
+	}
+	err = framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: block.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := readH2Response(t, framer, decoder, 3); status != "200" || body != "HTTP/2.0 " {
+		t.Errorf("stream 3: got :status %q and body %q", status, body)
+	}
+}
+
+// readH2Response reads frames until the response on streamID is complete
+// and returns its status and body. decoder holds the connection's HPACK
+// state, so it has to be shared by every call on the same connection.
+func readH2Response(t *testing.T, framer *http2.Framer, decoder *hpack.Decoder, streamID uint32) (string, string) {
+	t.Helper()
+	var status string
+	var body []byte
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if settings, ok := frame.(*http2.SettingsFrame); ok && !settings.IsAck() {
+			framer.WriteSettingsAck()
+		}
+		if frame.Header().StreamID != streamID {
+			continue
+		}
+		switch f := frame.(type) {
+		case *http2.HeadersFrame:
+			fields, err := decoder.DecodeFull(f.HeaderBlockFragment())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range fields {
+				if field.Name == ":status" {
+					status = field.Value
+				}
+			}
+			if f.StreamEnded() {
+				return status, string(body)
+			}
+		case *http2.DataFrame:
+			body = append(body, f.Data()...)
+			if f.StreamEnded() {
+				return status, string(body)
+			}
+		}
+	}
+}
+
+func TestH2CUpgradeBodyTooLarge(t *testing.T) {
+	var called atomic.Bool
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		H2C:     func(conn net.Conn, upgrade *http.Request, settings []byte) { called.Store(true) },
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// The body would have to be held in memory for HTTP/2, so a large one
+	// is refused before the switch.
+	size := maxH2CUpgradeBodyBytes + 1
+	go io.WriteString(conn, fmt.Sprintf("POST / HTTP/1.1\r\nHost: example\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\nContent-Length: %d\r\n\r\n%s", size, strings.Repeat("a", size)))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %s, want 413", resp.Status)
+	}
+	if called.Load() {
+		t.Error("H2C was called")
+	}
+}
+
+func TestShutdownWaitsForH2C(t *testing.T) {
+	done := make(chan struct{})
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		H2C: func(conn net.Conn, upgrade *http.Request, settings []byte) {
+			defer close(done)
+			io.Copy(io.Discard, conn)
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s, want 101", resp.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v while the h2c connection was open, want %v", err, context.DeadlineExceeded)
+	}
+
+	conn.Close()
+	<-done
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown after the h2c connection closed: %v", err)
+	}
+}
+
+func TestH2CUpgradeIgnoredWithoutHook(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}),
+	})
+
+	// Without H2C the upgrade is optional and the request is served over
+	// HTTP/1.1 as usual.
+	resp, body := roundTrip(t, addr, "GET / HTTP/1.1\r\nHost: example\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	if resp.StatusCode != http.StatusOK || string(body) != "HTTP/1.1" {
+		t.Errorf("got %s with body %q", resp.Status, body)
+	}
+}
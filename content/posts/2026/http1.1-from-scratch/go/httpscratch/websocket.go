@@ -0,0 +1,268 @@
+package httpscratch
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"unicode/utf8"
+)
+
+// websocketGUID is appended to the client's key to compute
+// Sec-WebSocket-Accept (RFC 6455 section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketMessage limits the size of a message once its fragments are
+// put back together.
+const maxWebSocketMessage = 16 << 20
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	OpContinuation byte = 0x0
+	OpText         byte = 0x1
+	OpBinary       byte = 0x2
+	OpClose        byte = 0x8
+	OpPing         byte = 0x9
+	OpPong         byte = 0xa
+)
+
+// WebSocket close codes used by the server (RFC 6455 section 7.4.1).
+const (
+	CloseNormal          = 1000
+	CloseProtocolError   = 1002
+	CloseInvalidPayload  = 1007
+	CloseMessageTooLarge = 1009
+)
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// WebSocket.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+var errNotUpgrade = errors.New("httpscratch: not a WebSocket upgrade request")
+
+// WebSocket is the server side of a WebSocket connection. It's a minimal
+// implementation: no extensions and no subprotocols. One goroutine may read
+// while others write.
+type WebSocket struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// AcceptWebSocket performs the server side of the opening handshake (RFC 6455
+// section 4.2) and takes over the connection. If the request isn't a valid
+// WebSocket handshake, it answers with an error status and returns an error.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	if r.Method != http.MethodGet || !isUpgrade(r, "websocket") {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errNotUpgrade
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("httpscratch: unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("httpscratch: invalid Sec-WebSocket-Key")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		websocketAccept(key))
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocket{conn: conn, reader: rw.Reader}, nil
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for a client key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ReadMessage returns the next text or binary message, reassembled from its
+// fragments. Pings are answered along the way. When the client closes the
+// connection, the close is echoed and a *CloseError is returned.
+func (ws *WebSocket) ReadMessage() (opcode byte, payload []byte, err error) {
+	for {
+		fin, op, data, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := ws.WriteMessage(OpPong, data); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			return 0, nil, ws.handleClose(data)
+		case OpContinuation:
+			if opcode == 0 {
+				return 0, nil, ws.fail(CloseProtocolError, "continuation without a message to continue")
+			}
+		case OpText, OpBinary:
+			if opcode != 0 {
+				return 0, nil, ws.fail(CloseProtocolError, "new message before the last one finished")
+			}
+			opcode = op
+		default:
+			return 0, nil, ws.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %#x", op))
+		}
+
+		if len(payload)+len(data) > maxWebSocketMessage {
+			return 0, nil, ws.fail(CloseMessageTooLarge, "message too large")
+		}
+		payload = append(payload, data...)
+		if !fin {
+			continue
+		}
+		if opcode == OpText && !utf8.Valid(payload) {
+			return 0, nil, ws.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+		}
+		return opcode, payload, nil
+	}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (ws *WebSocket) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, ws.fail(CloseProtocolError, "reserved bits set without an extension")
+	}
+	// Clients must mask every frame (RFC 6455 section 5.1).
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, ws.fail(CloseProtocolError, "unmasked client frame")
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= OpClose && (!fin || length > 125) {
+		return false, 0, nil, ws.fail(CloseProtocolError, "invalid control frame")
+	}
+	if length > maxWebSocketMessage {
+		return false, 0, nil, ws.fail(CloseMessageTooLarge, "frame too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends payload as a single unfragmented frame. Server frames
+// are never masked.
+func (ws *WebSocket) WriteMessage(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == OpClose {
+		ws.closeSent = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// handleClose answers the client's close frame with the same status code.
+func (ws *WebSocket) handleClose(data []byte) error {
+	closeErr := &CloseError{Code: 1005} // no status code was present
+	var reply []byte
+	if len(data) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(data))
+		closeErr.Reason = string(data[2:])
+		reply = data[:2]
+	}
+	ws.WriteMessage(OpClose, reply)
+	ws.conn.Close()
+	return closeErr
+}
+
+// fail closes the connection with the given status after a protocol error.
+func (ws *WebSocket) fail(code int, reason string) error {
+	ws.closeWithStatus(code, reason)
+	ws.conn.Close()
+	return fmt.Errorf("httpscratch: websocket: %s", reason)
+}
+
+func (ws *WebSocket) closeWithStatus(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	return ws.WriteMessage(OpClose, payload)
+}
+
+// Close sends a normal close frame and closes the connection.
+func (ws *WebSocket) Close() error {
+	ws.closeWithStatus(CloseNormal, "")
+	return ws.conn.Close()
+}
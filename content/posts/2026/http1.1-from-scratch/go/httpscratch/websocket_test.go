@@ -0,0 +1,258 @@
+package httpscratch
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// The example from RFC 6455 section 1.3.
+	if got, want := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// writeClientFrame writes a masked frame the way a browser would.
+func writeClientFrame(t *testing.T, w io.Writer, fin bool, opcode byte, payload []byte) {
+	t.Helper()
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrame reads an unmasked, unfragmented frame.
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		t.Fatalf("expected a final, unmasked frame, got header %x", head)
+	}
+	length := int(head[1] & 0x7f)
+	if length == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	closed := make(chan error, 1)
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := AcceptWebSocket(w, r)
+			if err != nil {
+				return
+			}
+			for {
+				opcode, msg, err := ws.ReadMessage()
+				if err != nil {
+					closed <- err
+					return
+				}
+				ws.WriteMessage(opcode, msg)
+			}
+		}),
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = io.WriteString(conn, "GET /chat HTTP/1.1\r\nHost: example\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got Sec-WebSocket-Accept %q", got)
+	}
+
+	// A text message in two fragments with a ping in the middle.
+	writeClientFrame(t, conn, false, OpText, []byte("hello, "))
+	writeClientFrame(t, conn, true, OpPing, []byte("are you there?"))
+	writeClientFrame(t, conn, true, OpContinuation, []byte("world"))
+	if op, payload := readServerFrame(t, br); op != OpPong || string(payload) != "are you there?" {
+		t.Errorf("got opcode %#x with %q, want a pong", op, payload)
+	}
+	if op, payload := readServerFrame(t, br); op != OpText || string(payload) != "hello, world" {
+		t.Errorf("got opcode %#x with %q, want the text message", op, payload)
+	}
+
+	// A binary message big enough for the 16-bit length.
+	big := make([]byte, 1000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	writeClientFrame(t, conn, true, OpBinary, big)
+	if op, payload := readServerFrame(t, br); op != OpBinary || string(payload) != string(big) {
+		t.Errorf("got opcode %#x with %d bytes, want the binary message", op, len(payload))
+	}
+
+	writeClientFrame(t, conn, true, OpClose, binary.BigEndian.AppendUint16(nil, CloseNormal))
+	op, payload := readServerFrame(t, br)
+	if op != OpClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != CloseNormal {
+		t.Errorf("got opcode %#x with %x, want a normal close", op, payload)
+	}
+	var closeErr *CloseError
+	if err := <-closed; !errors.As(err, &closeErr) || closeErr.Code != CloseNormal {
+		t.Errorf("ReadMessage returned %v, want a CloseError with code %d", err, CloseNormal)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := AcceptWebSocket(w, r)
+			if err != nil {
+				return
+			}
+			ws.ReadMessage()
+		}),
+	})
+
+	testCases := []struct {
+		name     string
+		send     func(t *testing.T, w io.Writer)
+		wantCode uint16
+	}{
+		{
+			name: "unmasked frame",
+			send: func(t *testing.T, w io.Writer) {
+				w.Write([]byte{0x81, 0x02, 'h', 'i'})
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "continuation without a message",
+			send: func(t *testing.T, w io.Writer) {
+				writeClientFrame(t, w, true, OpContinuation, []byte("hi"))
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "fragmented ping",
+			send: func(t *testing.T, w io.Writer) {
+				writeClientFrame(t, w, false, OpPing, nil)
+			},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name: "invalid UTF-8",
+			send: func(t *testing.T, w io.Writer) {
+				writeClientFrame(t, w, true, OpText, []byte{0xff, 0xfe})
+			},
+			wantCode: CloseInvalidPayload,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			br := bufio.NewReader(conn)
+			if _, err := http.ReadResponse(br, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.send(t, conn)
+			op, payload := readServerFrame(t, br)
+			if op != OpClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != tc.wantCode {
+				t.Errorf("got opcode %#x with %x, want close code %d", op, payload, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestWebSocketBadHandshake(t *testing.T) {
+	addr := startServer(t, &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			AcceptWebSocket(w, r)
+		}),
+	})
+
+	testCases := []struct {
+		name       string
+		request    string
+		wantStatus int
+	}{
+		{
+			name:       "not an upgrade",
+			request:    "GET / HTTP/1.1\r\nHost: example\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "missing key",
+			request: "GET / HTTP/1.1\r\nHost: example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Version: 13\r\n\r\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "old version",
+			request: "GET / HTTP/1.1\r\nHost: example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n\r\n",
+			wantStatus: http.StatusUpgradeRequired,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, _ := roundTrip(t, addr, tc.request)
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// h2dump is a small offline Wireshark for HTTP/2. It reads the raw bytes of
+// a connection, either from capture files or by sitting in between a client
+// and a cleartext (h2c) server, and prints every frame with the same
+// FramePrinter the client uses for tracing.
+//
+// Print the frames in capture files:
+//
+//	go run ./cmd/h2dump conn-1-client.bin conn-1-server.bin
+//
+// Proxy h2c connections to a server, saving what each side sends:
+//
+//	go run ./cmd/h2dump -proxy 127.0.0.1:9001 -upstream 127.0.0.1:9000 -save conn
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sudorandom/kmcd.dev/http2-from-scratch/http2scratch"
+)
+
+func main() {
+	proxy := flag.String("proxy", "", "listen on this address and print the frames of every h2c connection passed on to -upstream")
+	upstream := flag.String("upstream", "127.0.0.1:9000", "h2c server for -proxy")
+	save := flag.String("save", "", "with -proxy, also save each direction of every connection to files starting with this")
+	flag.Parse()
+
+	if *proxy != "" {
+		log.Fatal(runProxy(*proxy, *upstream, *save))
+	}
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: h2dump capture-file... | h2dump -proxy addr [-upstream addr] [-save prefix]")
+		os.Exit(2)
+	}
+	if err := runDump(flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runDump prints the frames in capture files. Each file holds what one
+// side of a connection sent. A file starting with the connection preface
+// is the client's, anything else the server's. The files share one
+// printer, so pass the client's and the server's half of the same
+// connection together to get the window accounting for both directions.
+func runDump(paths []string) error {
+	printer := http2scratch.NewFramePrinter(os.Stdout)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		br := bufio.NewReader(f)
+		from := http2scratch.PeerServer
+		if preface, _ := br.Peek(len(http2scratch.Preface)); bytes.Equal(preface, []byte(http2scratch.Preface)) {
+			from = http2scratch.PeerClient
+		}
+		printer.Printf("# %s, sent by the %s", path, from)
+		err = http2scratch.DumpStream(br, from, printer)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// runProxy listens on addr and forwards every connection to upstream,
+// printing the frames going each way. If save is set, the bytes are also
+// written to save-N-client.bin and save-N-server.bin for the Nth
+// connection, which h2dump can read back later.
+func runProxy(addr, upstream, save string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Printf("h2dump: proxying h2c from %s to %s", l.Addr(), upstream)
+
+	var n atomic.Int32
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go proxyConn(conn, upstream, save, int(n.Add(1)))
+	}
+}
+
+func proxyConn(client net.Conn, upstream, save string, n int) {
+	defer client.Close()
+	server, err := net.Dial("tcp", upstream)
+	if err != nil {
+		log.Printf("h2dump: connection %d: %v", n, err)
+		return
+	}
+	defer server.Close()
+
+	printer := http2scratch.NewFramePrinter(os.Stdout)
+	printer.Prefix = fmt.Sprintf("#%d ", n)
+	printer.Printf("connection from %s", client.RemoteAddr())
+
+	var wg sync.WaitGroup
+	forward := func(dst, src net.Conn, from http2scratch.Peer) {
+		defer wg.Done()
+		pr, pw := io.Pipe()
+		var w io.Writer = pw
+		if save != "" {
+			f, err := os.Create(fmt.Sprintf("%s-%d-%s.bin", save, n, from))
+			if err != nil {
+				log.Printf("h2dump: connection %d: %v", n, err)
+			} else {
+				defer f.Close()
+				w = io.MultiWriter(pw, f)
+			}
+		}
+		go func() {
+			if err := http2scratch.DumpStream(pr, from, printer); err != nil {
+				printer.Printf("%s → %s  can't decode any further: %v", from, from.Other(), err)
+			}
+			// Keep draining, or the proxy would stall.
+			io.Copy(io.Discard, pr)
+		}()
+		io.Copy(dst, io.TeeReader(src, w))
+		pw.Close()
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}
+	wg.Add(2)
+	go forward(server, client, http2scratch.PeerClient)
+	go forward(client, server, http2scratch.PeerServer)
+	wg.Wait()
+}
@@ -0,0 +1,149 @@
+package http2scratch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errBodyClosed = errors.New("read on closed response body")
+
+// writeRequestBody streams the request body as DATA frames, then ends the
+// stream with an empty DATA frame or, if the request has trailers, with a
+// HEADERS frame carrying them. It runs in its own goroutine so that the
+// response can start before the body is done, which is what makes
+// bidirectional streaming (gRPC, for one) possible.
+func (cc *clientConn) writeRequestBody(s *stream, req *http.Request) {
+	defer req.Body.Close()
+	buf := make([]byte, 16<<10)
+	for {
+		n, err := req.Body.Read(buf)
+		if n > 0 {
+			if werr := cc.writeData(s, buf[:n], false); werr != nil {
+				cc.abortRequestBody(s, werr)
+				return
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cc.abortRequestBody(s, fmt.Errorf("failed to read request body: %w", err))
+			return
+		}
+	}
+
+	cc.mu.Lock()
+	if s.sentEnd || s.ended || s.err != nil {
+		// The stream was finished or given up on while we were reading.
+		cc.mu.Unlock()
+		return
+	}
+	s.sentEnd = true
+	cc.mu.Unlock()
+
+	var err error
+	if len(req.Trailer) == 0 {
+		err = cc.writeFrame(FrameData, FlagEndStream, s.id, nil)
+	} else {
+		cc.writeMu.Lock()
+		err = cc.writeHeadersLocked(s.id, trailerHeaders(req.Trailer), true)
+		cc.writeMu.Unlock()
+	}
+	if err != nil {
+		cc.abortRequestBody(s, err)
+	}
+}
+
+// abortRequestBody fails s because its request body couldn't be sent. If
+// the server might still be waiting for the rest, it's told with
+// RST_STREAM that none is coming.
+func (cc *clientConn) abortRequestBody(s *stream, err error) {
+	cc.mu.Lock()
+	alreadySent := s.sentEnd
+	s.sentEnd = true
+	if !s.ended && s.err == nil {
+		cc.endStreamLocked(s, err)
+	}
+	cc.mu.Unlock()
+
+	if !alreadySent {
+		cc.writeFrame(FrameRstStream, 0, s.id, binary.BigEndian.AppendUint32(nil, ErrCodeCancel))
+	}
+}
+
+// trailerHeaders turns request trailers into a header list. Like all
+// HTTP/2 field names, theirs must be lowercase.
+func trailerHeaders(trailer http.Header) []HeaderField {
+	var headers []HeaderField
+	for name, values := range trailer {
+		for _, value := range values {
+			headers = append(headers, HeaderField{Name: strings.ToLower(name), Value: value})
+		}
+	}
+	return headers
+}
+
+// responseBody streams a response body as its DATA frames arrive. Reading
+// is what opens the receive windows back up, so a slow reader slows the
+// server down instead of piling up data in memory.
+type responseBody struct {
+	cc *clientConn
+	s  *stream
+	// trailer is the response's Trailer map. It's filled in once the body
+	// has been read to the end, as net/http does.
+	trailer http.Header
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	cc, s := b.cc, b.s
+	cc.mu.Lock()
+	for s.body.Len() == 0 && !s.ended && s.err == nil {
+		cc.cond.Wait()
+	}
+	if s.body.Len() == 0 {
+		err := s.err
+		if err == nil {
+			err = io.EOF
+			b.setTrailersLocked()
+		}
+		cc.mu.Unlock()
+		return 0, err
+	}
+	n, _ := s.body.Read(p)
+	if !s.pushed {
+		cc.recvCredit += int64(n)
+	}
+	s.recvCredit += int64(n)
+	connUpdate := cc.takeConnCreditLocked()
+	streamUpdate := cc.takeStreamCreditLocked(s)
+	cc.mu.Unlock()
+
+	cc.sendWindowUpdates(connUpdate, s, streamUpdate)
+	return n, nil
+}
+
+// setTrailersLocked copies the trailers the server sent into the response.
+func (b *responseBody) setTrailersLocked() {
+	if b.trailer == nil || b.s.trailers == nil {
+		return
+	}
+	for _, h := range b.s.trailers {
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+		b.trailer.Add(http.CanonicalHeaderKey(h.Name), h.Value)
+	}
+	// Only once, however many times Read hits the end.
+	b.s.trailers = nil
+}
+
+// Close stops the stream if the server is still sending. The connection
+// stays open for other requests.
+func (b *responseBody) Close() error {
+	b.cc.cancelStream(b.s, errBodyClosed)
+	return nil
+}
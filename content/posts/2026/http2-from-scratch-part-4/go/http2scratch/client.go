@@ -0,0 +1,346 @@
+package http2scratch
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Protocol constants
+	Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	// Frame Types (RFC 9113 Section 6)
+	FrameData         uint8 = 0x0
+	FrameHeaders      uint8 = 0x1
+	FramePriority     uint8 = 0x2
+	FrameRstStream    uint8 = 0x3
+	FrameSettings     uint8 = 0x4
+	FramePushPromise  uint8 = 0x5
+	FramePing         uint8 = 0x6
+	FrameGoAway       uint8 = 0x7
+	FrameWindowUpdate uint8 = 0x8
+	FrameContinuation uint8 = 0x9
+
+	// Common Flags
+	FlagAck        uint8 = 0x01 // For SETTINGS/PING
+	FlagEndStream  uint8 = 0x01 // For DATA/HEADERS
+	FlagEndHeaders uint8 = 0x04 // For HEADERS/PUSH_PROMISE/CONTINUATION
+	FlagPadded     uint8 = 0x08 // For DATA/HEADERS/PUSH_PROMISE
+	FlagPriority   uint8 = 0x20 // For HEADERS
+
+	// Settings (RFC 9113 Section 6.5.2)
+	SettingsHeaderTableSize      uint16 = 0x1
+	SettingsEnablePush           uint16 = 0x2
+	SettingsMaxConcurrentStreams uint16 = 0x3
+	SettingsInitialWindowSize    uint16 = 0x4
+	SettingsMaxFrameSize         uint16 = 0x5
+	SettingsMaxHeaderListSize    uint16 = 0x6
+
+	// Extended CONNECT setting (RFC 8441 Section 3)
+	SettingsEnableConnectProtocol uint16 = 0x8
+
+	// Error Codes (RFC 9113 Section 7)
+	ErrCodeNo                 uint32 = 0x0
+	ErrCodeProtocol           uint32 = 0x1
+	ErrCodeInternal           uint32 = 0x2
+	ErrCodeFlowControl        uint32 = 0x3
+	ErrCodeSettingsTimeout    uint32 = 0x4
+	ErrCodeStreamClosed       uint32 = 0x5
+	ErrCodeFrameSize          uint32 = 0x6
+	ErrCodeRefusedStream      uint32 = 0x7
+	ErrCodeCancel             uint32 = 0x8
+	ErrCodeCompression        uint32 = 0x9
+	ErrCodeConnect            uint32 = 0xa
+	ErrCodeEnhanceYourCalm    uint32 = 0xb
+	ErrCodeInadequateSecurity uint32 = 0xc
+	ErrCodeHTTP11Required     uint32 = 0xd
+)
+
+// maxRetries is how many times Do sends a request again after the server
+// turned it away unprocessed.
+const maxRetries = 3
+
+// Client sends requests over HTTP/2, keeping one connection per host and
+// multiplexing concurrent requests over it as separate streams.
+type Client struct {
+	// Timeout limits how long setting up a connection may take: the TCP
+	// dial, the TLS handshake and the SETTINGS exchange. Zero means no
+	// limit.
+	Timeout time.Duration
+	// TLSConfig is used when dialing. NextProtos is always set to h2.
+	TLSConfig *tls.Config
+	// ReadIdleTimeout, if set, is how long a connection may go without
+	// receiving a frame before the client sends a PING to check on it.
+	ReadIdleTimeout time.Duration
+	// PingTimeout is how long to wait for the answer to that PING before
+	// closing the connection. Zero means 15 seconds.
+	PingTimeout time.Duration
+	// Tracer, if set, is told about every frame the client's connections
+	// send and receive. NewFramePrinter makes one that prints them.
+	Tracer Tracer
+	// EnablePush lets servers push responses (RFC 9113 Section 8.4). A
+	// pushed response is kept on its connection until a GET for the same
+	// URL claims it. With push disabled, the default, a PUSH_PROMISE is a
+	// connection error.
+	EnablePush bool
+	// OnPush, if set, is called with the request of every push a server
+	// promises. It runs on the connection's read loop, so it must not
+	// block; fetch the pushed response from another goroutine.
+	OnPush func(promised *http.Request)
+
+	mu    sync.Mutex
+	conns map[string]*clientConn
+	dials map[string]*dialCall // dials in flight, by address
+}
+
+// dialCall is a connection being set up. Requests for the same address
+// wait on done instead of dialing their own.
+type dialCall struct {
+	done chan struct{}
+	cc   *clientConn
+	err  error
+}
+
+func NewClient() *Client {
+	return &Client{
+		Timeout: 30 * time.Second,
+	}
+}
+
+// Do sends the request on the host's connection, dialing one if needed.
+// It's safe to call from multiple goroutines. A GET the server has already
+// pushed a response for is answered with that push. A request the server refused
+// or dropped with GOAWAY before processing it is sent again on a new
+// connection, as long as its body can be replayed with GetBody.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	port := "443"
+	if req.URL.Port() != "" {
+		port = req.URL.Port()
+	}
+	addr := net.JoinHostPort(req.URL.Hostname(), port)
+
+	for attempt := 0; ; attempt++ {
+		cc, err := c.getConn(addr)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := cc.roundTrip(req)
+		if err == nil || attempt == maxRetries || !canRetry(err) {
+			return resp, err
+		}
+		retry, rerr := rewindRequest(req)
+		if rerr != nil {
+			return nil, err
+		}
+		req = retry
+	}
+}
+
+// canRetry reports whether err means the server never processed the
+// request (RFC 9113 Section 8.7), so sending it again is safe even if it
+// isn't idempotent.
+func canRetry(err error) bool {
+	var goAway GoAwayError
+	var streamErr StreamError
+	switch {
+	case errors.Is(err, errConnGoingAway), errors.As(err, &goAway):
+		return true
+	case errors.As(err, &streamErr):
+		return streamErr.Code == ErrCodeRefusedStream
+	}
+	return false
+}
+
+// rewindRequest returns req with a fresh copy of its body, ready to be sent
+// again.
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("cannot retry request: body can't be replayed")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	retry := *req
+	retry.Body = body
+	return &retry, nil
+}
+
+// getConn returns the connection for addr. A connection that has failed,
+// been sent GOAWAY or run out of stream IDs is replaced with a new one.
+// Dialing happens outside c.mu, so a slow server only holds up the
+// requests waiting for it.
+func (c *Client) getConn(addr string) (*clientConn, error) {
+	c.mu.Lock()
+	if cc, ok := c.conns[addr]; ok && cc.canTakeNewRequest() {
+		c.mu.Unlock()
+		return cc, nil
+	}
+	if call, ok := c.dials[addr]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.cc, call.err
+	}
+	call := &dialCall{done: make(chan struct{})}
+	if c.dials == nil {
+		c.dials = make(map[string]*dialCall)
+	}
+	c.dials[addr] = call
+	c.mu.Unlock()
+
+	call.cc, call.err = c.dial(addr)
+
+	c.mu.Lock()
+	delete(c.dials, addr)
+	if call.err == nil {
+		if c.conns == nil {
+			c.conns = make(map[string]*clientConn)
+		}
+		c.conns[addr] = call.cc
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return call.cc, call.err
+}
+
+// dial opens a new HTTP/2 connection to addr.
+func (c *Client) dial(addr string) (*clientConn, error) {
+	config := &tls.Config{}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
+	}
+	config.NextProtos = []string{"h2"}
+
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "h2" {
+		conn.Close() // Close connection if h2 is not negotiated
+		return nil, fmt.Errorf("server did not negotiate HTTP/2: %s", state.NegotiatedProtocol)
+	}
+
+	cc, err := newClientConn(c, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Close closes every connection. Requests still in flight fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, cc := range c.conns {
+		cc.close()
+		delete(c.conns, addr)
+	}
+	return nil
+}
+
+// requestHeaders builds the header list for req: pseudo-headers first, then
+// the regular headers in lowercase as HTTP/2 requires.
+func requestHeaders(req *http.Request) []HeaderField {
+	authority := req.URL.Host
+	if authority == "" {
+		authority = req.Host // Fallback if URL.Host is empty
+	}
+	scheme := "https"
+	if req.URL.Scheme != "" {
+		scheme = req.URL.Scheme
+	}
+	headers := []HeaderField{{Name: ":method", Value: req.Method}}
+	protocol := req.Header.Get(":protocol")
+	if req.Method == http.MethodConnect && protocol == "" {
+		// A plain CONNECT only names the host and port to tunnel to (RFC
+		// 9113 Section 8.5).
+		headers = append(headers, HeaderField{Name: ":authority", Value: authority})
+	} else {
+		if protocol != "" {
+			headers = append(headers, HeaderField{Name: ":protocol", Value: protocol})
+		}
+		headers = append(headers,
+			HeaderField{Name: ":scheme", Value: scheme},
+			HeaderField{Name: ":authority", Value: authority},
+			HeaderField{Name: ":path", Value: req.URL.RequestURI()},
+		)
+	}
+	for name, values := range req.Header {
+		if strings.HasPrefix(name, ":") {
+			// Pseudo-headers like :protocol were dealt with above.
+			continue
+		}
+		name = strings.ToLower(name)
+		switch name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade", "host":
+			// Connection-specific headers are not allowed in HTTP/2.
+			continue
+		}
+		for _, value := range values {
+			headers = append(headers, HeaderField{Name: name, Value: value})
+		}
+	}
+	if req.ContentLength > 0 && req.Header.Get("Content-Length") == "" {
+		headers = append(headers, HeaderField{Name: "content-length", Value: strconv.FormatInt(req.ContentLength, 10)})
+	}
+	if len(req.Trailer) > 0 {
+		// Announce the trailers, which are sent after the body.
+		names := make([]string, 0, len(req.Trailer))
+		for name := range req.Trailer {
+			names = append(names, strings.ToLower(name))
+		}
+		headers = append(headers, HeaderField{Name: "trailer", Value: strings.Join(names, ", ")})
+	}
+	return headers
+}
+
+// buildResponse turns the decoded response headers into an http.Response.
+// Trailer has an entry for every trailer the server announced; the values
+// arrive once the body has been read to the end.
+func buildResponse(req *http.Request, respHeaders []HeaderField, body io.ReadCloser) *http.Response {
+	httpResp := &http.Response{
+		StatusCode:    200,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		ProtoMinor:    0,
+		Header:        make(http.Header),
+		Trailer:       make(http.Header),
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}
+
+	for _, h := range respHeaders {
+		httpResp.Header.Add(h.Name, h.Value)
+		switch h.Name {
+		case ":status":
+			fmt.Sscanf(h.Value, "%d", &httpResp.StatusCode)
+		case "content-length":
+			if n, err := strconv.ParseInt(h.Value, 10, 64); err == nil && n >= 0 {
+				httpResp.ContentLength = n
+			}
+		case "trailer":
+			for _, name := range strings.Split(h.Value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					httpResp.Trailer[http.CanonicalHeaderKey(name)] = nil
+				}
+			}
+		}
+	}
+	httpResp.Status = fmt.Sprintf("%d %s", httpResp.StatusCode, http.StatusText(httpResp.StatusCode))
+	return httpResp
+}
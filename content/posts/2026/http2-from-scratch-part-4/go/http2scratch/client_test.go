@@ -0,0 +1,980 @@
+package http2scratch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer starts an HTTP/2 server and a client that trusts it.
+func newTestServer(t *testing.T, handler http.Handler, maxStreams uint32) (*httptest.Server, *Client, *atomic.Int32) {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(handler)
+	ts.EnableHTTP2 = true
+	if maxStreams > 0 {
+		ts.Config.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: int(maxStreams)}
+	}
+	var conns atomic.Int32
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	client := NewClient()
+	client.TLSConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+	t.Cleanup(func() { client.Close() })
+	return ts, client, &conns
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	// Every handler waits until all of them are running, which only happens
+	// if the requests really are in flight at the same time.
+	const n = 5
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	ts, client, conns := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		fmt.Fprintf(w, "hello from %s", r.URL.RequestURI())
+	}), 0)
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/%d?q=x", i)
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+			req.Header.Set("X-Request", "test")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if want := "hello from " + path; resp.StatusCode != http.StatusOK || string(body) != want {
+				t.Errorf("got %s with body %q, want %q", resp.Status, body, want)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := conns.Load(); got != 1 {
+		t.Errorf("used %d connections, want 1", got)
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cur := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			prev := maxInFlight.Load()
+			if cur <= prev || maxInFlight.CompareAndSwap(prev, cur) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(w, "ok")
+	}), 2)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if got := maxInFlight.Load(); got > 2 {
+		t.Errorf("server saw %d concurrent requests, but allowed only 2", got)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	release := make(chan struct{})
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		io.WriteString(w, "ok")
+	}), 1)
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/slow", nil)
+	if _, err := client.Do(req); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The cancelled stream gave its slot back, so the connection is still
+	// usable even though it only allows one stream at a time.
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/fast", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestLargeDownload(t *testing.T) {
+	// Far more than the 65,535 byte initial windows, so the download only
+	// finishes if the client keeps sending WINDOW_UPDATE.
+	const size = 1 << 20
+	var written atomic.Int64
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 1024)
+		for written.Load() < size {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			written.Add(int64(len(chunk)))
+		}
+	}), 0)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// While nobody reads the body, the windows stay shut and the server
+	// can't get much further than the initial window.
+	time.Sleep(200 * time.Millisecond)
+	if got := written.Load(); got > 2*initialWindowSize {
+		t.Errorf("server wrote %d bytes before the body was read", got)
+	}
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Errorf("read %d bytes, want %d", n, size)
+	}
+}
+
+func TestCloseBodyEarly(t *testing.T) {
+	ts, client, conns := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/small" {
+			io.WriteString(w, "ok")
+			return
+		}
+		chunk := make([]byte, 1024)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}), 0)
+
+	// Abandon a few endless bodies. Each time, the unread data has to be
+	// returned to the connection window or it eventually shuts for good.
+	for range 5 {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/endless", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.CopyN(io.Discard, resp.Body, 10000)
+		resp.Body.Close()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/small", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "ok" {
+		t.Errorf("got body %q and error %v", body, err)
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("used %d connections, want 1", got)
+	}
+}
+
+func TestLargeUpload(t *testing.T) {
+	// Bigger than the initial windows, so the upload stalls unless the
+	// client waits for WINDOW_UPDATE before sending more.
+	const size = 1 << 20
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d %d", r.ContentLength, n)
+	}), 0)
+
+	tests := []struct {
+		name string
+		body io.Reader
+		want string
+	}{
+		{"known length", bytes.NewReader(make([]byte, size)), fmt.Sprintf("%d %d", size, size)},
+		{"unknown length", io.MultiReader(bytes.NewReader(make([]byte, size))), fmt.Sprintf("-1 %d", size)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, ts.URL, tt.body)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write(body)
+		w.Header().Set("X-Checksum", r.Trailer.Get("X-Checksum"))
+	}), 0)
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("hello"))
+	req.Trailer = http.Header{"X-Checksum": {"abc123"}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if _, ok := resp.Trailer["X-Checksum"]; !ok {
+		t.Errorf("announced trailer missing from %v", resp.Trailer)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("got body %q and error %v", body, err)
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Errorf("got trailer %q, want %q", got, "abc123")
+	}
+}
+
+func TestBidirectionalStream(t *testing.T) {
+	// The handler echoes each line as it arrives, so every exchange needs
+	// the request body and the response body open at the same time.
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			fmt.Fprintf(w, "echo: %s\n", scanner.Text())
+			w.(http.Flusher).Flush()
+		}
+	}), 0)
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, pr)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewReader(resp.Body)
+	for _, msg := range []string{"one", "two", "three"} {
+		fmt.Fprintln(pw, msg)
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "echo: " + msg + "\n"; line != want {
+			t.Errorf("got %q, want %q", line, want)
+		}
+	}
+	pw.Close()
+	if rest, err := io.ReadAll(lines); err != nil || len(rest) != 0 {
+		t.Errorf("got %q and error %v after the request ended", rest, err)
+	}
+}
+
+func TestCancelWhileQueued(t *testing.T) {
+	release := make(chan struct{})
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}), 1)
+	defer close(release)
+
+	// The first request takes the only stream slot, so the second one
+	// never gets to send its headers. Its context must still end the wait.
+	first := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if _, err := client.Do(req); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	release <- struct{}{}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelWhileReadingBody(t *testing.T) {
+	handlerDone := make(chan error, 1)
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		handlerDone <- r.Context().Err()
+	}), 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.ReadFull(resp.Body, make([]byte, len("partial"))); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := io.ReadAll(resp.Body); err != context.Canceled {
+		t.Errorf("got error %v reading the body, want %v", err, context.Canceled)
+	}
+	// The server only notices if the client sent RST_STREAM.
+	select {
+	case <-handlerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server never saw the stream being reset")
+	}
+}
+
+func TestStreamResetError(t *testing.T) {
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// net/http resets the stream with INTERNAL_ERROR.
+		panic(http.ErrAbortHandler)
+	}), 0)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, err := client.Do(req)
+	var streamErr StreamError
+	if !errors.As(err, &streamErr) || streamErr.Code != ErrCodeInternal {
+		t.Fatalf("got error %v, want a stream error with INTERNAL_ERROR", err)
+	}
+}
+
+// fakeServer accepts TLS connections that negotiate h2, reads the
+// connection preface, sends an empty SETTINGS frame and hands the rest of
+// the connection to serve.
+func fakeServer(t *testing.T, serve func(c *rawConn)) (string, *Client) {
+	t.Helper()
+	return fakeServerWithSettings(t, nil, serve)
+}
+
+// fakeServerWithSettings is fakeServer with settings in the server's
+// SETTINGS frame.
+func fakeServerWithSettings(t *testing.T, settings []Setting, serve func(c *rawConn)) (string, *Client) {
+	t.Helper()
+	var payload []byte
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, s.ID)
+		payload = binary.BigEndian.AppendUint32(payload, s.Value)
+	}
+	cert, pool := newTestCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadFull(conn, make([]byte, len(Preface))); err != nil {
+					return
+				}
+				c := &rawConn{t: t, conn: conn, fr: NewFrameReader(conn), enc: NewHPACKEncoder(4096), dec: NewHPACKDecoder(4096)}
+				c.write(FrameSettings, 0, 0, payload)
+				serve(c)
+			}()
+		}
+	}()
+
+	client := NewClient()
+	client.TLSConfig = &tls.Config{RootCAs: pool}
+	t.Cleanup(func() { client.Close() })
+	return "https://" + l.Addr().String(), client
+}
+
+// respond sends a 200 response with body on the stream.
+func (c *rawConn) respond(streamID uint32, body string) {
+	c.write(FrameHeaders, FlagEndHeaders, streamID, c.enc.Encode([]HeaderField{{Name: ":status", Value: "200"}}))
+	c.write(FrameData, FlagEndStream, streamID, []byte(body))
+}
+
+func TestGoAwayRetry(t *testing.T) {
+	// The first connection takes two requests, then sends GOAWAY saying
+	// it only processed the first. The second connection answers anything.
+	var accepted atomic.Int32
+	url, client := fakeServer(t, func(c *rawConn) {
+		first := accepted.Add(1) == 1
+		var streams []uint32
+		for {
+			f, err := c.fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			h, ok := f.(*HeadersFrame)
+			if !ok {
+				continue
+			}
+			c.dec.Decode(h.HeaderBlock)
+			if !first {
+				c.respond(h.StreamID, "retried")
+				continue
+			}
+			streams = append(streams, h.StreamID)
+			if len(streams) == 2 {
+				payload := binary.BigEndian.AppendUint32(nil, streams[0])
+				payload = binary.BigEndian.AppendUint32(payload, ErrCodeNo)
+				c.write(FrameGoAway, 0, 0, append(payload, "restarting"...))
+				c.respond(streams[0], "processed")
+			}
+		}
+	})
+
+	var mu sync.Mutex
+	var bodies []string
+	var wg sync.WaitGroup
+	for _, body := range []io.Reader{nil, strings.NewReader("replayable")} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, url, body)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			bodies = append(bodies, string(b))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(bodies)
+	if want := []string{"processed", "retried"}; !slices.Equal(bodies, want) {
+		t.Errorf("got responses %q, want %q", bodies, want)
+	}
+	if got := accepted.Load(); got != 2 {
+		t.Errorf("used %d connections, want 2", got)
+	}
+}
+
+func TestGoAwayNoReplay(t *testing.T) {
+	// A body that can't be read twice can't be retried, so the caller gets
+	// the GOAWAY instead.
+	url, client := fakeServer(t, func(c *rawConn) {
+		c.readUntil(FrameHeaders)
+		payload := binary.BigEndian.AppendUint32(nil, 0)
+		payload = binary.BigEndian.AppendUint32(payload, ErrCodeNo)
+		c.write(FrameGoAway, 0, 0, payload)
+		for {
+			if _, err := c.fr.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, url, io.NopCloser(strings.NewReader("once")))
+	_, err := client.Do(req)
+	var goAway GoAwayError
+	if !errors.As(err, &goAway) || goAway.LastStreamID != 0 {
+		t.Fatalf("got error %v, want GOAWAY with last stream 0", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	// The server holds back the response until it has answered three
+	// keepalive PINGs.
+	url, client := fakeServer(t, func(c *rawConn) {
+		var pings int
+		var stream uint32
+		for {
+			f, err := c.fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *HeadersFrame:
+				c.dec.Decode(f.HeaderBlock)
+				stream = f.StreamID
+			case *PingFrame:
+				if f.Has(FlagAck) {
+					continue
+				}
+				c.write(FramePing, FlagAck, 0, f.Data[:])
+				if pings++; pings == 3 {
+					c.respond(stream, "still here")
+				}
+			}
+		}
+	})
+	client.ReadIdleTimeout = 20 * time.Millisecond
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "still here" {
+		t.Errorf("got body %q and error %v", body, err)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	url, client := fakeServer(t, func(c *rawConn) {
+		// Read everything, answer nothing.
+		for {
+			if _, err := c.fr.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+	client.ReadIdleTimeout = 50 * time.Millisecond
+	client.PingTimeout = 50 * time.Millisecond
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	_, err := client.Do(req)
+	if err == nil || !strings.Contains(err.Error(), "health check failed") {
+		t.Fatalf("got error %v, want the health check to fail", err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	// The server finishes the TLS handshake but never sends its SETTINGS.
+	cert, pool := newTestCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	client := NewClient()
+	client.TLSConfig = &tls.Config{RootCAs: pool}
+	client.Timeout = 100 * time.Millisecond
+	t.Cleanup(func() { client.Close() })
+
+	errc := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+l.Addr().String(), nil)
+		_, err := client.Do(req)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("got error %v, want a timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Do still waiting for the server's SETTINGS")
+	}
+}
+
+func TestSlowDialDoesNotBlockOtherHosts(t *testing.T) {
+	url, client := fakeServer(t, func(c *rawConn) {
+		c.respond(c.readHeaders().StreamID, "ok")
+	})
+	client.Timeout = 5 * time.Second
+
+	// This server accepts the TCP connection and then says nothing, so the
+	// TLS handshake hangs until Timeout.
+	stall, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stall.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := stall.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	stalled := make(chan struct{})
+	go func() {
+		defer close(stalled)
+		req, _ := http.NewRequest(http.MethodGet, "https://"+stall.Addr().String(), nil)
+		client.Do(req)
+	}()
+	conn := <-accepted
+	defer func() {
+		conn.Close()
+		<-stalled
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request to one host waited for another host's dial")
+	}
+}
+
+// readSettings reads the client's SETTINGS frame and returns its values by
+// ID.
+func (c *rawConn) readSettings() map[uint16]uint32 {
+	c.t.Helper()
+	f, ok := c.readUntil(FrameSettings).(*SettingsFrame)
+	if !ok {
+		c.t.Fatal("expected SETTINGS")
+	}
+	values := make(map[uint16]uint32)
+	for _, s := range f.Settings {
+		values[s.ID] = s.Value
+	}
+	return values
+}
+
+// decodedHeaders is a HEADERS frame along with its decoded header block.
+type decodedHeaders struct {
+	*HeadersFrame
+	headers []HeaderField
+}
+
+// readHeaders reads frames until a HEADERS frame arrives and decodes it.
+func (c *rawConn) readHeaders() decodedHeaders {
+	c.t.Helper()
+	for {
+		f, err := c.fr.ReadFrame()
+		if err != nil {
+			c.t.Fatalf("waiting for HEADERS: %v", err)
+		}
+		if h, ok := f.(*HeadersFrame); ok {
+			headers, err := c.dec.Decode(h.HeaderBlock)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			return decodedHeaders{h, headers}
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	// The server answers the page and pushes its stylesheet. The request
+	// for the stylesheet must not reach the server.
+	url, client := fakeServer(t, func(c *rawConn) {
+		if v, ok := c.readSettings()[SettingsEnablePush]; !ok || v != 1 {
+			t.Errorf("client sent SETTINGS_ENABLE_PUSH %d, want 1", v)
+		}
+		h := c.readHeaders()
+		promise := binary.BigEndian.AppendUint32(nil, 2)
+		promise = append(promise, c.enc.Encode([]HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":authority", Value: headerValue(h.headers, ":authority")},
+			{Name: ":path", Value: "/style.css"},
+		})...)
+		c.write(FramePushPromise, FlagEndHeaders, h.StreamID, promise)
+		c.respond(h.StreamID, "<html>")
+		c.respond(2, "body {}")
+		for {
+			f, err := c.fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if _, ok := f.(*HeadersFrame); ok {
+				t.Errorf("client requested stream %d instead of using the push", f.Header().StreamID)
+			}
+		}
+	})
+	client.EnablePush = true
+	promised := make(chan string, 1)
+	client.OnPush = func(req *http.Request) { promised <- req.URL.String() }
+
+	get := func(path string) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url+path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	if got := get("/"); got != "<html>" {
+		t.Errorf("got page %q", got)
+	}
+	if got, want := <-promised, url+"/style.css"; got != want {
+		t.Errorf("got promise for %s, want %s", got, want)
+	}
+	if got := get("/style.css"); got != "body {}" {
+		t.Errorf("got pushed body %q", got)
+	}
+}
+
+func TestUnclaimedPushLeavesConnectionWindow(t *testing.T) {
+	// The server pushes a response that fills a whole stream window and
+	// nobody ever asks for it. The connection window must not stay used up
+	// by it, or the page and the next request could never be answered.
+	url, client := fakeServer(t, func(c *rawConn) {
+		h := c.readHeaders()
+		promise := binary.BigEndian.AppendUint32(nil, 2)
+		promise = append(promise, c.enc.Encode([]HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":authority", Value: headerValue(h.headers, ":authority")},
+			{Name: ":path", Value: "/video.mp4"},
+		})...)
+		c.write(FramePushPromise, FlagEndHeaders, h.StreamID, promise)
+		c.write(FrameHeaders, FlagEndHeaders, 2, c.enc.Encode([]HeaderField{{Name: ":status", Value: "200"}}))
+		chunk := make([]byte, 16384)
+		for left := initialWindowSize; left > 0; left -= len(chunk) {
+			chunk = chunk[:min(left, len(chunk))]
+			c.write(FrameData, 0, 2, chunk)
+		}
+		c.respond(h.StreamID, "<html>")
+		h = c.readHeaders()
+		c.respond(h.StreamID, "ok")
+		for {
+			if _, err := c.fr.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+	client.EnablePush = true
+
+	for _, path := range []string{"/", "/other"} {
+		req, _ := http.NewRequest(http.MethodGet, url+path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+}
+
+func TestPushDisabled(t *testing.T) {
+	goAway := make(chan uint32, 1)
+	url, client := fakeServer(t, func(c *rawConn) {
+		if v, ok := c.readSettings()[SettingsEnablePush]; !ok || v != 0 {
+			t.Errorf("client sent SETTINGS_ENABLE_PUSH %d, want 0", v)
+		}
+		h := c.readHeaders()
+		promise := binary.BigEndian.AppendUint32(nil, 2)
+		promise = append(promise, c.enc.Encode([]HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":authority", Value: headerValue(h.headers, ":authority")},
+			{Name: ":path", Value: "/style.css"},
+		})...)
+		c.write(FramePushPromise, FlagEndHeaders, h.StreamID, promise)
+		f := c.readUntil(FrameGoAway).(*GoAwayFrame)
+		goAway <- f.ErrCode
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	_, err := client.Do(req)
+	var connErr ConnectionError
+	if !errors.As(err, &connErr) || connErr.Code != ErrCodeProtocol {
+		t.Fatalf("got error %v, want a PROTOCOL_ERROR connection error", err)
+	}
+	if code := <-goAway; code != ErrCodeProtocol {
+		t.Errorf("client sent GOAWAY %s, want PROTOCOL_ERROR", ErrCodeName(code))
+	}
+}
+
+func TestPushUnsafeMethod(t *testing.T) {
+	// A push for a POST is refused on its own stream; the page still loads.
+	reset := make(chan *RSTStreamFrame, 1)
+	url, client := fakeServer(t, func(c *rawConn) {
+		h := c.readHeaders()
+		promise := binary.BigEndian.AppendUint32(nil, 2)
+		promise = append(promise, c.enc.Encode([]HeaderField{
+			{Name: ":method", Value: "POST"},
+			{Name: ":scheme", Value: "https"},
+			{Name: ":authority", Value: headerValue(h.headers, ":authority")},
+			{Name: ":path", Value: "/form"},
+		})...)
+		c.write(FramePushPromise, FlagEndHeaders, h.StreamID, promise)
+		reset <- c.readUntil(FrameRstStream).(*RSTStreamFrame)
+		c.respond(h.StreamID, "<html>")
+		for {
+			if _, err := c.fr.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+	client.EnablePush = true
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "<html>" {
+		t.Errorf("got body %q and error %v", body, err)
+	}
+	if f := <-reset; f.StreamID != 2 || f.ErrCode != ErrCodeProtocol {
+		t.Errorf("got RST_STREAM %s on stream %d, want PROTOCOL_ERROR on stream 2", ErrCodeName(f.ErrCode), f.StreamID)
+	}
+}
+
+func TestExtendedConnect(t *testing.T) {
+	// The server accepts a WebSocket over HTTP/2 and echoes whatever
+	// arrives on the stream in upper case.
+	settings := []Setting{{ID: SettingsEnableConnectProtocol, Value: 1}}
+	url, client := fakeServerWithSettings(t, settings, func(c *rawConn) {
+		h := c.readHeaders()
+		want := []HeaderField{
+			{Name: ":method", Value: "CONNECT"},
+			{Name: ":protocol", Value: "websocket"},
+			{Name: ":scheme", Value: "https"},
+		}
+		if !slices.Equal(h.headers[:3], want) || headerValue(h.headers, ":path") != "/chat" {
+			t.Errorf("got request headers %v", h.headers)
+		}
+		c.write(FrameHeaders, FlagEndHeaders, h.StreamID, c.enc.Encode([]HeaderField{{Name: ":status", Value: "200"}}))
+		for {
+			f, err := c.fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if d, ok := f.(*DataFrame); ok {
+				c.write(FrameData, d.Flags&FlagEndStream, h.StreamID, bytes.ToUpper(d.Data))
+			}
+		}
+	})
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodConnect, url+"/chat", pr)
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %s, want 200", resp.Status)
+	}
+	r := bufio.NewReader(resp.Body)
+	for _, msg := range []string{"hello\n", "again\n"} {
+		io.WriteString(pw, msg)
+		line, err := r.ReadString('\n')
+		if err != nil || line != strings.ToUpper(msg) {
+			t.Fatalf("got %q and error %v, want %q", line, err, strings.ToUpper(msg))
+		}
+	}
+	pw.Close()
+	if rest, err := io.ReadAll(r); err != nil || len(rest) != 0 {
+		t.Errorf("got %q and error %v after closing", rest, err)
+	}
+}
+
+func TestExtendedConnectNotSupported(t *testing.T) {
+	url, client := fakeServer(t, func(c *rawConn) {
+		for {
+			if _, err := c.fr.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+
+	req, _ := http.NewRequest(http.MethodConnect, url+"/chat", nil)
+	req.Header.Set(":protocol", "websocket")
+	if _, err := client.Do(req); err != errExtendedConnectNotSupported {
+		t.Fatalf("got error %v, want %v", err, errExtendedConnectNotSupported)
+	}
+}
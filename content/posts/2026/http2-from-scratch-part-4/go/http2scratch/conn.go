@@ -0,0 +1,664 @@
+package http2scratch
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxStreamID is the largest stream ID a client can use. Once it's used up,
+// the connection can't start any more streams.
+const maxStreamID = 1<<31 - 1
+
+// headerTableSize is the default HPACK dynamic table size (RFC 9113 Section
+// 6.5.2). Our decoder uses it, and our encoder never uses more, even if the
+// server allows it.
+const headerTableSize = 4096
+
+var (
+	errConnClosed    = errors.New("connection closed")
+	errConnGoingAway = errors.New("connection is going away")
+)
+
+// clientConn is a single HTTP/2 connection shared by many requests. One
+// goroutine reads frames and hands them to the stream they belong to;
+// requests write their own frames.
+type clientConn struct {
+	conn net.Conn
+
+	// writeMu serializes frames. The HPACK encoder lives under it too, since
+	// header blocks must reach the server in the order they were encoded.
+	writeMu  sync.Mutex
+	hpackEnc *HPACKEncoder
+
+	// fr and hpackDec are only used by the read loop.
+	fr       *FrameReader
+	hpackDec *HPACKDecoder
+
+	mu sync.Mutex
+	// cond is broadcast whenever the state of the connection or one of its
+	// streams changes: a stream ends, data arrives, a window opens up or the
+	// connection fails. Everyone waiting on anything checks again.
+	cond                 *sync.Cond
+	streams              map[uint32]*stream
+	activeStreams        uint32 // includes streams still waiting for an ID
+	nextStreamID         uint32
+	maxConcurrentStreams uint32
+	maxFrameSize         uint32
+	goAway               bool
+	err                  error // set once the connection is unusable
+
+	// Connection-level flow control, see flow.go.
+	sendWindow        int64 // bytes we may send
+	recvWindow        int64 // bytes the server may send
+	recvCredit        int64 // bytes read but not yet given back to the server
+	peerInitialWindow int64 // the server's SETTINGS_INITIAL_WINDOW_SIZE
+
+	tracer Tracer // nil unless Client.Tracer is set
+
+	// Keepalive, see ping.go.
+	readIdleTimeout time.Duration
+	pingTimeout     time.Duration
+	pings           map[[8]byte]chan struct{} // PINGs waiting for their ACK
+
+	// Server push, see push.go.
+	enablePush     bool
+	onPush         func(*http.Request)
+	lastPromisedID uint32
+	pushes         map[string]*stream // promised responses nobody has asked for yet
+
+	// extendedConnect is set once the server allows CONNECT with a
+	// :protocol, see connect.go.
+	extendedConnect bool
+}
+
+// stream is a single request and its response. Everything but id and
+// headersDone is guarded by clientConn.mu.
+type stream struct {
+	id uint32
+	// headersDone is closed once the response headers arrive or the stream
+	// fails before they do.
+	headersDone chan struct{}
+	headers     []HeaderField
+	trailers    []HeaderField
+	body        bytes.Buffer // DATA received but not read yet
+	ended       bool         // the server sent END_STREAM
+	pushed      bool         // the server opened it with PUSH_PROMISE
+	sentEnd     bool         // we sent END_STREAM or RST_STREAM
+	err         error        // why the stream failed, if it did
+	// stopCancel stops watching the request's context once the stream is
+	// over.
+	stopCancel func() bool
+
+	// Stream-level flow control, see flow.go.
+	sendWindow int64
+	recvWindow int64
+	recvCredit int64
+}
+
+// newClientConn performs the connection preface and SETTINGS exchange and
+// starts the read loop. The keepalive, tracing and push options come from c.
+func newClientConn(c *Client, conn net.Conn) (*clientConn, error) {
+	pingTimeout := c.PingTimeout
+	if pingTimeout == 0 {
+		pingTimeout = defaultPingTimeout
+	}
+	cc := &clientConn{
+		conn:                 conn,
+		fr:                   NewFrameReader(conn),
+		hpackEnc:             NewHPACKEncoder(headerTableSize),
+		hpackDec:             NewHPACKDecoder(headerTableSize),
+		streams:              make(map[uint32]*stream),
+		nextStreamID:         1,
+		maxConcurrentStreams: math.MaxUint32, // unlimited until the server says otherwise
+		maxFrameSize:         defaultMaxFrameSize,
+		sendWindow:           initialWindowSize,
+		recvWindow:           initialWindowSize,
+		peerInitialWindow:    initialWindowSize,
+		tracer:               c.Tracer,
+		readIdleTimeout:      c.ReadIdleTimeout,
+		pingTimeout:          pingTimeout,
+		enablePush:           c.EnablePush,
+		onPush:               c.OnPush,
+		pushes:               make(map[string]*stream),
+	}
+	cc.cond = sync.NewCond(&cc.mu)
+
+	// A server that never sends its SETTINGS mustn't hang the dial.
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	// Send Connection Preface
+	if _, err := conn.Write([]byte(Preface)); err != nil {
+		return nil, fmt.Errorf("failed to send preface: %w", err)
+	}
+
+	// Send our settings. Push is on unless a client says otherwise (RFC 9113
+	// Section 6.5.2), so it's always sent.
+	var enablePush uint32
+	if c.EnablePush {
+		enablePush = 1
+	}
+	settings := binary.BigEndian.AppendUint16(nil, SettingsEnablePush)
+	settings = binary.BigEndian.AppendUint32(settings, enablePush)
+	if err := cc.writeFrame(FrameSettings, 0, 0, settings); err != nil {
+		return nil, fmt.Errorf("failed to send settings: %w", err)
+	}
+
+	// The server's preface is a SETTINGS frame. Wait for it, so the first
+	// requests already respect its limits.
+	frame, err := cc.fr.ReadFrame()
+	if err != nil {
+		return nil, fmt.Errorf("handshake read error: %w", err)
+	}
+	cc.traceFrame(PeerServer, frame)
+	serverSettings, ok := frame.(*SettingsFrame)
+	if !ok || serverSettings.Has(FlagAck) {
+		return nil, fmt.Errorf("expected SETTINGS from the server, got frame type %d", frame.Header().Type)
+	}
+	if err := cc.handleSettings(serverSettings); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go cc.readLoop()
+	return cc, nil
+}
+
+// canTakeNewRequest reports whether the connection can start another
+// stream, now or once one of the current ones finishes.
+func (cc *clientConn) canTakeNewRequest() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err == nil && !cc.goAway && cc.nextStreamID <= maxStreamID
+}
+
+// roundTrip sends req on a new stream and waits for the response headers.
+// The request body is sent in the background, so the response can start
+// before it's done, and the response body streams in as the caller reads it.
+// Cancelling the request's context resets the stream at any point, even
+// while the response body is being read.
+func (cc *clientConn) roundTrip(req *http.Request) (*http.Response, error) {
+	if s := cc.claimPush(req); s != nil {
+		cc.watchContext(req.Context(), s)
+		return cc.awaitResponse(req, s)
+	}
+	ctx := req.Context()
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if err := cc.checkExtendedConnect(req); err != nil {
+		if hasBody {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	s, err := cc.newStream(ctx)
+	if err != nil {
+		if hasBody {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	if err := cc.startStream(s, requestHeaders(req), !hasBody); err != nil {
+		if hasBody {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	cc.watchContext(ctx, s)
+	if hasBody {
+		go cc.writeRequestBody(s, req)
+	}
+	return cc.awaitResponse(req, s)
+}
+
+// watchContext resets s if ctx is cancelled before the stream is over.
+func (cc *clientConn) watchContext(ctx context.Context, s *stream) {
+	stop := context.AfterFunc(ctx, func() { cc.cancelStream(s, ctx.Err()) })
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.streams[s.id] != s {
+		// It's already over, e.g. a push the server finished before it
+		// was claimed. Whatever it buffered can still be read.
+		stop()
+		return
+	}
+	s.stopCancel = stop
+}
+
+// awaitResponse waits for the response headers on s. If the request's
+// context is cancelled first, cancelStream ends the wait with the context's
+// error.
+func (cc *clientConn) awaitResponse(req *http.Request, s *stream) (*http.Response, error) {
+	<-s.headersDone
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if s.headers == nil {
+		return nil, s.err
+	}
+	body := &responseBody{cc: cc, s: s}
+	resp := buildResponse(req, s.headers, body)
+	body.trailer = resp.Trailer
+	return resp, nil
+}
+
+// newStream waits for a free stream slot and takes it, giving up if ctx is
+// cancelled first. The stream gets its ID when its headers are written.
+func (cc *clientConn) newStream(ctx context.Context) (*stream, error) {
+	stop := context.AfterFunc(ctx, func() {
+		cc.mu.Lock()
+		cc.cond.Broadcast()
+		cc.mu.Unlock()
+	})
+	defer stop()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for ctx.Err() == nil && cc.err == nil && !cc.goAway && cc.activeStreams >= cc.maxConcurrentStreams {
+		cc.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := cc.checkUsableLocked(); err != nil {
+		return nil, err
+	}
+	cc.activeStreams++
+	return &stream{
+		headersDone: make(chan struct{}),
+		recvWindow:  initialWindowSize,
+	}, nil
+}
+
+// checkUsableLocked returns why no new stream can be started, if so.
+func (cc *clientConn) checkUsableLocked() error {
+	switch {
+	case cc.err != nil:
+		return cc.err
+	case cc.goAway:
+		return errConnGoingAway
+	case cc.nextStreamID > maxStreamID:
+		return errors.New("connection ran out of stream IDs")
+	}
+	return nil
+}
+
+// startStream assigns s its ID and sends the request headers. The ID is
+// assigned under the write lock because the server must see new streams in
+// increasing order.
+func (cc *clientConn) startStream(s *stream, headers []HeaderField, endStream bool) error {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+
+	cc.mu.Lock()
+	if err := cc.checkUsableLocked(); err != nil {
+		cc.activeStreams--
+		cc.closeIfIdleLocked()
+		cc.cond.Broadcast()
+		cc.mu.Unlock()
+		return err
+	}
+	s.id = cc.nextStreamID
+	cc.nextStreamID += 2
+	cc.streams[s.id] = s
+	s.sendWindow = cc.peerInitialWindow
+	s.sentEnd = endStream
+	cc.mu.Unlock()
+
+	return cc.writeHeadersLocked(s.id, headers, endStream)
+}
+
+// writeHeadersLocked encodes headers and sends them as a HEADERS frame,
+// followed by CONTINUATION frames if the block doesn't fit in one frame.
+func (cc *clientConn) writeHeadersLocked(streamID uint32, headers []HeaderField, endStream bool) error {
+	cc.mu.Lock()
+	maxFrameSize := int(cc.maxFrameSize)
+	cc.mu.Unlock()
+
+	block := cc.hpackEnc.Encode(headers)
+	if err := writeHeaderBlock(cc.conn, streamID, block, endStream, maxFrameSize); err != nil {
+		// The HPACK state is out of sync with the server now, so the
+		// connection is done for.
+		cc.conn.Close()
+		return err
+	}
+	if cc.tracer != nil {
+		// Traced as one frame, the way the server's FrameReader sees it.
+		flags := FlagEndHeaders
+		if endStream {
+			flags |= FlagEndStream
+		}
+		cc.traceWrite(FrameHeaders, flags, streamID, block)
+		cc.tracer.Headers(PeerClient, streamID, headers, cc.hpackEnc.dynamicTable)
+	}
+	return nil
+}
+
+func (cc *clientConn) writeFrame(frameType, flags uint8, streamID uint32, payload []byte) error {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	return cc.writeFrameLocked(frameType, flags, streamID, payload)
+}
+
+func (cc *clientConn) writeFrameLocked(frameType, flags uint8, streamID uint32, payload []byte) error {
+	if err := WriteFrame(cc.conn, frameType, flags, streamID, payload); err != nil {
+		return err
+	}
+	cc.traceWrite(frameType, flags, streamID, payload)
+	return nil
+}
+
+// traceWrite hands a frame we sent to the tracer, parsed like the server
+// would parse it.
+func (cc *clientConn) traceWrite(frameType, flags uint8, streamID uint32, payload []byte) {
+	if cc.tracer == nil {
+		return
+	}
+	h := FrameHeader{Length: uint32(len(payload)), Type: frameType, Flags: flags, StreamID: streamID}
+	if f, err := ParseFrame(Frame{Header: h, Payload: payload}); err == nil {
+		cc.tracer.Frame(PeerClient, f)
+	}
+}
+
+func (cc *clientConn) traceFrame(from Peer, f TypedFrame) {
+	if cc.tracer != nil {
+		cc.tracer.Frame(from, f)
+	}
+}
+
+// readLoop reads frames until the connection fails and dispatches them to
+// their streams by ID. A stream error only resets that stream; anything
+// else ends the connection, with GOAWAY if it's the server's fault.
+func (cc *clientConn) readLoop() {
+	var idle *time.Timer
+	if cc.readIdleTimeout > 0 {
+		idle = time.AfterFunc(cc.readIdleTimeout, cc.healthCheck)
+		defer idle.Stop()
+	}
+	for {
+		frame, err := cc.fr.ReadFrame()
+		if idle != nil {
+			idle.Reset(cc.readIdleTimeout)
+		}
+		if err == nil {
+			cc.traceFrame(PeerServer, frame)
+			err = cc.handleFrame(frame)
+		}
+		var streamErr StreamError
+		if errors.As(err, &streamErr) {
+			cc.handleStreamError(streamErr)
+			continue
+		}
+		if err != nil {
+			var connErr ConnectionError
+			if errors.As(err, &connErr) {
+				cc.writeFrame(FrameGoAway, 0, 0, binary.BigEndian.AppendUint32(make([]byte, 4), connErr.Code))
+			}
+			cc.fail(err)
+			return
+		}
+	}
+}
+
+// handleStreamError resets the stream the error is about.
+func (cc *clientConn) handleStreamError(err StreamError) {
+	cc.mu.Lock()
+	s := cc.streams[err.StreamID]
+	cc.mu.Unlock()
+	if s != nil {
+		cc.resetStream(s, err.Code, err)
+		return
+	}
+	cc.writeFrame(FrameRstStream, 0, err.StreamID, binary.BigEndian.AppendUint32(nil, err.Code))
+}
+
+func (cc *clientConn) handleFrame(frame TypedFrame) error {
+	switch f := frame.(type) {
+	case *SettingsFrame:
+		if f.Has(FlagAck) {
+			return nil
+		}
+		return cc.handleSettings(f)
+	case *PingFrame:
+		if f.Has(FlagAck) {
+			cc.handlePingAck(f.Data)
+			return nil
+		}
+		return cc.writeFrame(FramePing, FlagAck, 0, f.Data[:])
+	case *HeadersFrame:
+		return cc.handleHeaders(f)
+	case *DataFrame:
+		return cc.handleData(f)
+	case *RSTStreamFrame:
+		cc.mu.Lock()
+		if s := cc.streams[f.StreamID]; s != nil {
+			cc.endStreamLocked(s, StreamError{StreamID: s.id, Code: f.ErrCode, Reason: "reset by server"})
+		}
+		cc.mu.Unlock()
+	case *GoAwayFrame:
+		cc.handleGoAway(f)
+	case *WindowUpdateFrame:
+		return cc.handleWindowUpdate(f)
+	case *PushPromiseFrame:
+		return cc.handlePushPromise(f)
+	}
+	return nil
+}
+
+// handleSettings applies the server's settings and acknowledges them. The
+// parser already rejected values out of range.
+func (cc *clientConn) handleSettings(f *SettingsFrame) error {
+	tableSize := int64(-1)
+	cc.mu.Lock()
+	for _, setting := range f.Settings {
+		switch setting.ID {
+		case SettingsHeaderTableSize:
+			tableSize = int64(min(setting.Value, headerTableSize))
+		case SettingsMaxConcurrentStreams:
+			cc.maxConcurrentStreams = setting.Value
+		case SettingsInitialWindowSize:
+			if err := cc.setInitialWindowSizeLocked(setting.Value); err != nil {
+				cc.mu.Unlock()
+				return err
+			}
+		case SettingsMaxFrameSize:
+			cc.maxFrameSize = setting.Value
+		case SettingsEnableConnectProtocol:
+			cc.extendedConnect = setting.Value == 1
+		}
+	}
+	// A higher limit may let waiting requests through.
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	cc.writeMu.Lock()
+	if tableSize >= 0 && uint32(tableSize) != cc.hpackEnc.dynamicTable.maxSize {
+		// The server has less room for our header fields than we've been
+		// assuming. The next header block tells it we've shrunk the table.
+		cc.hpackEnc.SetMaxDynamicTableSize(uint32(tableSize))
+	}
+	err := cc.writeFrameLocked(FrameSettings, FlagAck, 0, nil)
+	cc.writeMu.Unlock()
+	return err
+}
+
+// handleHeaders decodes a header block. Blocks for streams we've given up
+// on still have to be decoded to keep the HPACK state in sync.
+func (cc *clientConn) handleHeaders(f *HeadersFrame) error {
+	headers, err := cc.hpackDec.Decode(f.HeaderBlock)
+	if err != nil {
+		return connError(ErrCodeCompression, "hpack: %v", err)
+	}
+	if cc.tracer != nil {
+		cc.tracer.Headers(PeerServer, f.StreamID, headers, cc.hpackDec.dynamicTable)
+	}
+
+	cc.mu.Lock()
+	s := cc.streams[f.StreamID]
+	if s == nil {
+		cc.mu.Unlock()
+		return nil
+	}
+	endStream := f.Has(FlagEndStream)
+	switch {
+	case s.headers == nil:
+		if status := headerValue(headers, ":status"); len(status) == 3 && status[0] == '1' {
+			// An interim response like 103 Early Hints. The real one
+			// is still to come.
+			cc.mu.Unlock()
+			return nil
+		}
+		s.headers = headers
+		close(s.headersDone)
+	case !endStream:
+		// Anything after the response headers is trailers, and those
+		// have to end the stream (RFC 9113 Section 8.1).
+		cc.mu.Unlock()
+		cc.resetStream(s, ErrCodeProtocol, fmt.Errorf("stream %d: trailers without END_STREAM", s.id))
+		return nil
+	default:
+		s.trailers = headers
+	}
+	reset := endStream && cc.finishStreamLocked(s)
+	cc.mu.Unlock()
+
+	if reset {
+		cc.writeFrame(FrameRstStream, 0, s.id, binary.BigEndian.AppendUint32(nil, ErrCodeCancel))
+	}
+	return nil
+}
+
+func headerValue(headers []HeaderField, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// handleGoAway stops new streams on the connection. Streams the server
+// already accepted are allowed to finish. The rest were never processed, so
+// they fail with a GoAwayError and Client.Do sends them again on a new
+// connection. Once the last stream is done, the connection is closed.
+func (cc *clientConn) handleGoAway(f *GoAwayFrame) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.goAway = true
+	err := GoAwayError{LastStreamID: f.LastStreamID, Code: f.ErrCode, DebugData: string(f.DebugData)}
+	for id, s := range cc.streams {
+		// LastStreamID only covers the streams we opened.
+		if !s.pushed && id > f.LastStreamID {
+			cc.endStreamLocked(s, err)
+		}
+	}
+	cc.closeIfIdleLocked()
+	cc.cond.Broadcast()
+}
+
+// closeIfIdleLocked closes a connection that has been sent GOAWAY once it
+// has no streams left. The read loop notices and cleans up the rest.
+func (cc *clientConn) closeIfIdleLocked() {
+	if cc.goAway && cc.activeStreams == 0 {
+		cc.conn.Close()
+	}
+}
+
+// endStreamLocked takes s out of the stream table, freeing its slot. A nil
+// err means the server finished the response; buffered data can still be
+// read.
+func (cc *clientConn) endStreamLocked(s *stream, err error) {
+	if err == nil {
+		s.ended = true
+		if s.headers == nil {
+			err = fmt.Errorf("stream %d ended without a response", s.id)
+		}
+	}
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	select {
+	case <-s.headersDone:
+	default:
+		close(s.headersDone)
+	}
+	if s.stopCancel != nil {
+		s.stopCancel()
+	}
+	if cc.streams[s.id] == s {
+		delete(cc.streams, s.id)
+		if !s.pushed {
+			// Pushes don't count against the server's stream limit.
+			cc.activeStreams--
+			cc.closeIfIdleLocked()
+		}
+	}
+	cc.cond.Broadcast()
+}
+
+// finishStreamLocked ends s after the server sent END_STREAM. If we're still
+// sending the request body, it has to be cut short: the response is
+// complete, so the server has no use for the rest. In that case it reports
+// that the caller must send RST_STREAM once it has released the lock.
+func (cc *clientConn) finishStreamLocked(s *stream) (reset bool) {
+	cc.endStreamLocked(s, nil)
+	if s.sentEnd {
+		return false
+	}
+	s.sentEnd = true
+	return true
+}
+
+// cancelStream gives up on s. If the server might still be sending, it's
+// told to stop with RST_STREAM.
+func (cc *clientConn) cancelStream(s *stream, err error) {
+	cc.mu.Lock()
+	open := cc.streams[s.id] == s
+	s.sentEnd = true
+	cc.endStreamLocked(s, err)
+	// Whatever wasn't read will never be, so the server can have that
+	// part of the connection window back. Pushes gave theirs back already.
+	if !s.pushed {
+		cc.recvCredit += int64(s.body.Len())
+	}
+	s.body.Reset()
+	update := cc.takeConnCreditLocked()
+	cc.mu.Unlock()
+
+	if open {
+		cc.writeFrame(FrameRstStream, 0, s.id, binary.BigEndian.AppendUint32(nil, ErrCodeCancel))
+	}
+	cc.sendWindowUpdates(update, nil, 0)
+}
+
+// fail marks the connection as unusable and fails every open stream.
+func (cc *clientConn) fail(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.err == nil {
+		cc.err = fmt.Errorf("connection closed: %w", err)
+	}
+	// Only close it once the error is recorded, or the read loop could
+	// report the closed socket instead of the reason.
+	cc.conn.Close()
+	for _, s := range cc.streams {
+		cc.endStreamLocked(s, cc.err)
+	}
+	for data, ack := range cc.pings {
+		close(ack)
+		delete(cc.pings, data)
+	}
+	cc.cond.Broadcast()
+}
+
+func (cc *clientConn) close() {
+	cc.fail(errConnClosed)
+}
@@ -0,0 +1,40 @@
+package http2scratch
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Extended CONNECT (RFC 8441) is how WebSockets run over HTTP/2. Instead of
+// upgrading the connection as HTTP/1.1 does, the client opens a stream with
+// a CONNECT request that names the protocol in a :protocol pseudo-header,
+// and after a 200 response the stream's DATA frames carry the WebSocket
+// frames both ways. To send one, set the pseudo-header on the request:
+//
+//	pr, pw := io.Pipe()
+//	req, _ := http.NewRequest(http.MethodConnect, "https://example.com/chat", pr)
+//	req.Header.Set(":protocol", "websocket")
+//	req.Header.Set("Sec-WebSocket-Version", "13")
+//
+// Writes to pw go to the server and the response body reads what it sends.
+
+var errExtendedConnectNotSupported = errors.New("server does not support extended CONNECT")
+
+// checkExtendedConnect makes sure a request with a :protocol is a CONNECT
+// and that the server said it accepts those with
+// SETTINGS_ENABLE_CONNECT_PROTOCOL. We've had its first SETTINGS frame since
+// the handshake, so there's nothing to wait for.
+func (cc *clientConn) checkExtendedConnect(req *http.Request) error {
+	if req.Header.Get(":protocol") == "" {
+		return nil
+	}
+	if req.Method != http.MethodConnect {
+		return errors.New(":protocol is only allowed on CONNECT requests")
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.extendedConnect {
+		return errExtendedConnectNotSupported
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package http2scratch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DumpStream decodes what from sent on a connection until r runs out,
+// handing every frame and header block to t. The client's side has to
+// start with the connection preface. It's the core of the h2dump command,
+// which feeds it capture files or the traffic of a proxied connection.
+func DumpStream(r io.Reader, from Peer, t *FramePrinter) error {
+	if from == PeerClient {
+		preface := make([]byte, len(Preface))
+		if _, err := io.ReadFull(r, preface); err != nil {
+			return fmt.Errorf("reading preface: %w", err)
+		}
+		if !bytes.Equal(preface, []byte(Preface)) {
+			return fmt.Errorf("not an HTTP/2 connection preface: %q", preface)
+		}
+		t.Printf("client → server  connection preface")
+	}
+
+	fr := NewFrameReader(r)
+	// We don't know what the receiver advertised, so take anything legal.
+	fr.MaxFrameSize = maxFrameSizeLimit
+	dec := NewHPACKDecoder(headerTableSize)
+	for {
+		frame, err := fr.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var streamErr StreamError
+		if errors.As(err, &streamErr) {
+			// The frame is bad, but the framing isn't, so keep going.
+			t.Printf("%s → %s  %s", from, from.Other(), streamErr)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		t.Frame(from, frame)
+
+		var streamID uint32
+		var block []byte
+		switch f := frame.(type) {
+		case *HeadersFrame:
+			streamID, block = f.StreamID, f.HeaderBlock
+		case *PushPromiseFrame:
+			streamID, block = f.PromisedStreamID, f.HeaderBlock
+		default:
+			continue
+		}
+		fields, err := dec.Decode(block)
+		if err != nil {
+			// Every block after this one depends on the state this one
+			// left behind, so there's no point going on.
+			return fmt.Errorf("stream %d: hpack: %w", streamID, err)
+		}
+		t.Headers(from, streamID, fields, dec.dynamicTable)
+	}
+}
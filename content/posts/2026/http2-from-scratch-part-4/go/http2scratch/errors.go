@@ -0,0 +1,76 @@
+package http2scratch
+
+import "fmt"
+
+// RFC 9113 Section 5.4 sorts errors into two kinds. A connection error
+// breaks the whole connection: we send GOAWAY and close it. A stream error
+// only affects one stream, which is reset with RST_STREAM while the rest
+// carry on. Either way the error code tells the peer what went wrong.
+
+var errCodeNames = map[uint32]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+// ErrCodeName returns the name RFC 9113 gives an error code. Unknown codes
+// must be treated like INTERNAL_ERROR, but they're shown as they are.
+func ErrCodeName(code uint32) string {
+	if name, ok := errCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", code)
+}
+
+// ConnectionError is an error that ends the whole connection.
+type ConnectionError struct {
+	Code   uint32
+	Reason string
+}
+
+func (e ConnectionError) Error() string {
+	return fmt.Sprintf("connection error %s: %s", ErrCodeName(e.Code), e.Reason)
+}
+
+// StreamError is an error that only ends one stream.
+type StreamError struct {
+	StreamID uint32
+	Code     uint32
+	Reason   string
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream %d error %s: %s", e.StreamID, ErrCodeName(e.Code), e.Reason)
+}
+
+func connError(code uint32, format string, args ...any) error {
+	return ConnectionError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// GoAwayError is returned for a request the server never processed because
+// it sent GOAWAY with a lower last stream ID. Such a request can safely be
+// sent again, and Client.Do does that on a new connection.
+type GoAwayError struct {
+	LastStreamID uint32
+	Code         uint32
+	DebugData    string
+}
+
+func (e GoAwayError) Error() string {
+	msg := fmt.Sprintf("server sent GOAWAY %s with last stream %d", ErrCodeName(e.Code), e.LastStreamID)
+	if e.DebugData != "" {
+		msg += ": " + e.DebugData
+	}
+	return msg
+}
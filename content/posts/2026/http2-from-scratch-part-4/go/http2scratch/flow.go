@@ -0,0 +1,220 @@
+package http2scratch
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Flow control (RFC 9113 Section 5.2) limits how much DATA a sender may have
+// in flight. Each side keeps a window per stream and one for the connection,
+// and a DATA frame uses up both. The receiver hands the bytes back with
+// WINDOW_UPDATE once it has dealt with them.
+
+// initialWindowSize is the window the connection and every stream start
+// with (RFC 9113 Section 6.9.2). We never advertise anything else.
+const initialWindowSize = 65535
+
+// maxWindowSize is the largest a flow-control window may grow.
+const maxWindowSize = 1<<31 - 1
+
+// handleData buffers a DATA frame for its stream. The whole frame, padding
+// included, counts against the receive windows.
+func (cc *clientConn) handleData(f *DataFrame) error {
+	payload := f.Data
+	length := int64(f.Length)
+
+	cc.mu.Lock()
+	if length > cc.recvWindow {
+		cc.mu.Unlock()
+		return connError(ErrCodeFlowControl, "server overran the connection flow-control window")
+	}
+	cc.recvWindow -= length
+
+	s := cc.streams[f.StreamID]
+	if s == nil || length > s.recvWindow {
+		// Nobody is going to read this, so the connection window can be
+		// given back right away.
+		cc.recvCredit += length
+		update := cc.takeConnCreditLocked()
+		cc.mu.Unlock()
+		cc.sendWindowUpdates(update, nil, 0)
+		if s != nil {
+			cc.resetStream(s, ErrCodeFlowControl, fmt.Errorf("server overran the flow-control window of stream %d", s.id))
+		}
+		return nil
+	}
+
+	s.recvWindow -= length
+	s.body.Write(payload)
+	// Padding is never read, so it's given back immediately.
+	padding := length - int64(len(payload))
+	cc.recvCredit += padding
+	s.recvCredit += padding
+	if s.pushed {
+		// A push may sit unread until a request claims it, so only its
+		// stream window holds it back. Otherwise a few unclaimed pushes
+		// could stall the whole connection.
+		cc.recvCredit += int64(len(payload))
+	}
+	reset := false
+	if f.Has(FlagEndStream) {
+		reset = cc.finishStreamLocked(s)
+	} else {
+		cc.cond.Broadcast()
+	}
+	connUpdate := cc.takeConnCreditLocked()
+	streamUpdate := cc.takeStreamCreditLocked(s)
+	cc.mu.Unlock()
+
+	cc.sendWindowUpdates(connUpdate, s, streamUpdate)
+	if reset {
+		cc.writeFrame(FrameRstStream, 0, s.id, binary.BigEndian.AppendUint32(nil, ErrCodeCancel))
+	}
+	return nil
+}
+
+// takeConnCreditLocked returns how many bytes of the connection window to
+// give back to the server. Rather than a WINDOW_UPDATE for every read, the
+// bytes are saved up until they're half the window.
+func (cc *clientConn) takeConnCreditLocked() int64 {
+	if cc.recvCredit < initialWindowSize/2 {
+		return 0
+	}
+	n := cc.recvCredit
+	cc.recvCredit = 0
+	cc.recvWindow += n
+	return n
+}
+
+// takeStreamCreditLocked is takeConnCreditLocked for a stream's window.
+func (cc *clientConn) takeStreamCreditLocked(s *stream) int64 {
+	if s.ended || s.err != nil {
+		// The server won't send any more, so there's no point.
+		return 0
+	}
+	if s.recvCredit < initialWindowSize/2 {
+		return 0
+	}
+	n := s.recvCredit
+	s.recvCredit = 0
+	s.recvWindow += n
+	return n
+}
+
+// sendWindowUpdates sends WINDOW_UPDATE frames for the connection and for
+// s. Zero increments are skipped.
+func (cc *clientConn) sendWindowUpdates(connIncrement int64, s *stream, streamIncrement int64) {
+	if connIncrement > 0 {
+		cc.writeFrame(FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, uint32(connIncrement)))
+	}
+	if streamIncrement > 0 {
+		cc.writeFrame(FrameWindowUpdate, 0, s.id, binary.BigEndian.AppendUint32(nil, uint32(streamIncrement)))
+	}
+}
+
+// handleWindowUpdate grows one of our send windows. The parser already
+// rejected zero increments.
+func (cc *clientConn) handleWindowUpdate(f *WindowUpdateFrame) error {
+	increment := int64(f.Increment)
+
+	cc.mu.Lock()
+	if f.StreamID == 0 {
+		defer cc.mu.Unlock()
+		if cc.sendWindow+increment > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection flow-control window overflow")
+		}
+		cc.sendWindow += increment
+		cc.cond.Broadcast()
+		return nil
+	}
+
+	s := cc.streams[f.StreamID]
+	if s == nil {
+		cc.mu.Unlock()
+		return nil
+	}
+	if s.sendWindow+increment > maxWindowSize {
+		cc.mu.Unlock()
+		return StreamError{StreamID: s.id, Code: ErrCodeFlowControl, Reason: "flow-control window overflow"}
+	}
+	s.sendWindow += increment
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+	return nil
+}
+
+// setInitialWindowSizeLocked applies a new SETTINGS_INITIAL_WINDOW_SIZE. The
+// change applies to the streams already open too, which can leave a window
+// negative until the server sends WINDOW_UPDATE (RFC 9113 Section 6.9.2).
+func (cc *clientConn) setInitialWindowSizeLocked(size uint32) error {
+	delta := int64(size) - cc.peerInitialWindow
+	cc.peerInitialWindow = int64(size)
+	for _, s := range cc.streams {
+		if s.sendWindow+delta > maxWindowSize {
+			return connError(ErrCodeFlowControl, "flow-control window overflow on stream %d", s.id)
+		}
+		s.sendWindow += delta
+	}
+	return nil
+}
+
+// resetStream fails s and tells the server with RST_STREAM.
+func (cc *clientConn) resetStream(s *stream, errCode uint32, err error) {
+	cc.mu.Lock()
+	s.sentEnd = true
+	cc.endStreamLocked(s, err)
+	cc.mu.Unlock()
+	cc.writeFrame(FrameRstStream, 0, s.id, binary.BigEndian.AppendUint32(nil, errCode))
+}
+
+// takeSendWindow waits until s may send DATA and reserves up to max bytes
+// of the connection's and the stream's send windows. A single frame never
+// exceeds the server's SETTINGS_MAX_FRAME_SIZE.
+func (cc *clientConn) takeSendWindow(s *stream, max int) (int, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for {
+		switch {
+		case cc.err != nil:
+			return 0, cc.err
+		case s.err != nil:
+			return 0, s.err
+		case s.ended:
+			return 0, fmt.Errorf("stream %d closed by server", s.id)
+		}
+		n := min(int64(max), cc.sendWindow, s.sendWindow, int64(cc.maxFrameSize))
+		if n > 0 {
+			cc.sendWindow -= n
+			s.sendWindow -= n
+			return int(n), nil
+		}
+		cc.cond.Wait()
+	}
+}
+
+// writeData sends data on s, splitting it into as many DATA frames as flow
+// control and the maximum frame size call for.
+func (cc *clientConn) writeData(s *stream, data []byte, endStream bool) error {
+	for len(data) > 0 {
+		n, err := cc.takeSendWindow(s, len(data))
+		if err != nil {
+			return err
+		}
+		var flags uint8
+		if endStream && n == len(data) {
+			flags = FlagEndStream
+		}
+		if err := cc.writeFrame(FrameData, flags, s.id, data[:n]); err != nil {
+			return err
+		}
+		if flags != 0 {
+			return nil
+		}
+		data = data[n:]
+	}
+	if endStream {
+		// Nothing left to send, but the stream still has to be ended.
+		return cc.writeFrame(FrameData, FlagEndStream, s.id, nil)
+	}
+	return nil
+}
@@ -1,12 +1,12 @@
-package main
+package http2scratch
 
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-
-	"golang.org/x/net/http2/hpack"
+	"math"
 )
 
 // RFC 7541: HPACK: Header Compression for HTTP/2
@@ -35,6 +35,12 @@ type HeaderField struct {
 	Name, Value string
 }
 
+// Size is how much room the field takes up in a dynamic table: its name and
+// value plus 32 bytes of overhead (RFC 7541 Section 4.1).
+func (hf HeaderField) Size() uint32 {
+	return uint32(len(hf.Name) + len(hf.Value) + 32)
+}
+
 // StaticTable is the predefined, unchangeable table of header fields, as defined in RFC 7541 Appendix A.
 var StaticTable = []HeaderField{
 	{Name: ":authority", Value: ""},
@@ -88,6 +94,7 @@ var StaticTable = []HeaderField{
 	{Name: "proxy-authorization", Value: ""},
 	{Name: "range", Value: ""},
 	{Name: "referer", Value: ""},
+	{Name: "refresh", Value: ""},
 	{Name: "retry-after", Value: ""},
 	{Name: "server", Value: ""},
 	{Name: "set-cookie", Value: ""},
@@ -125,6 +132,21 @@ func NewDynamicTable(maxSize uint32) *DynamicTable {
 	}
 }
 
+// Len returns the number of entries in the table.
+func (d *DynamicTable) Len() int {
+	return len(d.headers)
+}
+
+// Size returns the size of the table as RFC 7541 Section 4.1 counts it.
+func (d *DynamicTable) Size() uint32 {
+	return d.size
+}
+
+// MaxSize returns the most the table may hold.
+func (d *DynamicTable) MaxSize() uint32 {
+	return d.maxSize
+}
+
 func (d *DynamicTable) At(i int) (HeaderField, bool) {
 	if i < 0 || i >= len(d.headers) {
 		return HeaderField{}, false
@@ -132,36 +154,73 @@ func (d *DynamicTable) At(i int) (HeaderField, bool) {
 	return d.headers[i], true
 }
 
+// Add inserts h at the front of the table, evicting the oldest entries to
+// make room. An entry bigger than the whole table just empties it (RFC 7541
+// Section 4.4).
 func (d *DynamicTable) Add(h HeaderField) {
-	size := uint32(len(h.Name) + len(h.Value) + 32)
-	for d.size+size > d.maxSize && len(d.headers) > 0 {
-		last := d.headers[len(d.headers)-1]
-		d.size -= uint32(len(last.Name) + len(last.Value) + 32)
-		d.headers = d.headers[:len(d.headers)-1]
+	size := h.Size()
+	if size > d.maxSize {
+		d.evict(0)
+		return
 	}
+	d.evict(d.maxSize - size)
 	d.headers = append([]HeaderField{h}, d.headers...)
 	d.size += size
 }
 
 func (d *DynamicTable) SetMaxSize(size uint32) {
 	d.maxSize = size
-	for d.size > d.maxSize && len(d.headers) > 0 {
+	d.evict(size)
+}
+
+// evict drops the oldest entries until the table takes up at most size.
+func (d *DynamicTable) evict(size uint32) {
+	for d.size > size && len(d.headers) > 0 {
 		last := d.headers[len(d.headers)-1]
-		d.size -= uint32(len(last.Name) + len(last.Value) + 32)
+		d.size -= last.Size()
 		d.headers = d.headers[:len(d.headers)-1]
 	}
 }
 
+// search looks for h in the table. It returns the position of an exact match
+// if there is one, and otherwise of the first entry with the same name.
+func (d *DynamicTable) search(h HeaderField) (i int, nameOnly bool) {
+	nameMatch := -1
+	for i, hf := range d.headers {
+		if hf == h {
+			return i, false
+		}
+		if nameMatch < 0 && hf.Name == h.Name {
+			nameMatch = i
+		}
+	}
+	return nameMatch, true
+}
+
+// errIntegerOverflow is returned for an integer that doesn't fit in 32
+// bits. Nothing HPACK encodes gets that big, so it can only be an attack.
+var errIntegerOverflow = errors.New("integer overflow")
+
 type HPACKDecoder struct {
 	dynamicTable *DynamicTable
+	// allowedMaxSize is the SETTINGS_HEADER_TABLE_SIZE we advertised. The
+	// encoder may shrink the table and grow it back, but never past this.
+	allowedMaxSize uint32
 }
 
 func NewHPACKDecoder(maxSize uint32) *HPACKDecoder {
 	return &HPACKDecoder{
-		dynamicTable: NewDynamicTable(maxSize),
+		dynamicTable:   NewDynamicTable(maxSize),
+		allowedMaxSize: maxSize,
 	}
 }
 
+// SetAllowedMaxDynamicTableSize changes the largest table the encoder may
+// ask for, e.g. after advertising a new SETTINGS_HEADER_TABLE_SIZE.
+func (h *HPACKDecoder) SetAllowedMaxDynamicTableSize(size uint32) {
+	h.allowedMaxSize = size
+}
+
 func (h *HPACKDecoder) Header(i int) (HeaderField, bool) {
 	if i <= 0 {
 		return HeaderField{}, false
@@ -172,48 +231,56 @@ func (h *HPACKDecoder) Header(i int) (HeaderField, bool) {
 	return h.dynamicTable.At(i - len(StaticTable) - 1)
 }
 
+// Decode decodes a complete header block, updating the dynamic table as it
+// goes. An error leaves the table in an unknown state, so the connection
+// has to be closed with COMPRESSION_ERROR.
 func (h *HPACKDecoder) Decode(payload []byte) ([]HeaderField, error) {
 	var headers []HeaderField
 	r := bytes.NewReader(payload)
 	for r.Len() > 0 {
 		b, _ := r.ReadByte()
 		if b&maskIndexed == patternIndexed { // Indexed Header Field
-			index, n := decodeInt(b, r, 7)
-			if n < 0 {
-				return nil, fmt.Errorf("failed to decode integer")
+			index, err := decodeInt(b, r, 7)
+			if err != nil {
+				return nil, err
 			}
 			header, ok := h.Header(index)
 			if !ok {
 				return nil, fmt.Errorf("invalid header index: %d", index)
 			}
 			headers = append(headers, header)
-			fmt.Printf("  [Header] %s: %s\n", header.Name, header.Value)
 		} else if b&maskLiteralIncremental == patternLiteralIncremental { // Literal Header Field with Incremental Indexing
-			index, n := decodeInt(b, r, 6)
-			if n < 0 {
-				return nil, fmt.Errorf("failed to decode integer")
+			index, err := decodeInt(b, r, 6)
+			if err != nil {
+				return nil, err
 			}
 			header, err := h.decodeLiteralHeader(r, index, true)
 			if err != nil {
 				return nil, err
 			}
 			headers = append(headers, header)
-			fmt.Printf("  [Header] %s: %s\n", header.Name, header.Value)
 		} else if b&maskLiteral == patternLiteral || b&maskLiteral == patternLiteralNever { // Literal Header Field without or never indexed
-			index, n := decodeInt(b, r, 4)
-			if n < 0 {
-				return nil, fmt.Errorf("failed to decode integer")
+			index, err := decodeInt(b, r, 4)
+			if err != nil {
+				return nil, err
 			}
 			header, err := h.decodeLiteralHeader(r, index, false)
 			if err != nil {
 				return nil, err
 			}
 			headers = append(headers, header)
-			fmt.Printf("  [Header] %s: %s\n", header.Name, header.Value)
 		} else if b&maskDynamicTableSize == patternDynamicTableSize { // Dynamic Table Size Update
-			size, n := decodeInt(b, r, 5)
-			if n < 0 {
-				return nil, fmt.Errorf("failed to decode integer")
+			// Size updates come first in a block (RFC 7541 Section 4.2)
+			// and can't go past what we allowed (Section 6.3).
+			if len(headers) > 0 {
+				return nil, errors.New("dynamic table size update after a header field")
+			}
+			size, err := decodeInt(b, r, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > int(h.allowedMaxSize) {
+				return nil, fmt.Errorf("dynamic table size update to %d, more than the allowed %d", size, h.allowedMaxSize)
 			}
 			h.dynamicTable.SetMaxSize(uint32(size))
 		} else {
@@ -250,11 +317,14 @@ func (h *HPACKDecoder) decodeLiteralHeader(r *bytes.Reader, index int, addToDyna
 }
 
 func (h *HPACKDecoder) decodeString(r *bytes.Reader) (string, error) {
-	b, _ := r.ReadByte()
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
 	huffman := b&HuffmanFlagMask == HuffmanFlagMask
-	length, n := decodeInt(b, r, 7)
-	if n < 0 {
-		return "", fmt.Errorf("failed to decode integer")
+	length, err := decodeInt(b, r, 7)
+	if err != nil {
+		return "", err
 	}
 	if r.Len() < length {
 		return "", io.ErrUnexpectedEOF
@@ -262,72 +332,138 @@ func (h *HPACKDecoder) decodeString(r *bytes.Reader) (string, error) {
 	data := make([]byte, length)
 	r.Read(data)
 	if huffman {
-		return hpack.HuffmanDecodeToString(data)
+		return HuffmanDecode(data)
 	}
 	return string(data), nil
 }
 
-func decodeInt(b byte, r *bytes.Reader, n int) (int, int) {
-	mask := (1 << n) - 1
-	i := int(b) & mask
+// decodeInt decodes an integer with an n-bit prefix (RFC 7541 Section
+// 5.1). b is the byte holding the prefix, and any continuation bytes are
+// read from r. Values that don't fit in 32 bits are rejected, however many
+// continuation bytes they're spread over.
+func decodeInt(b byte, r *bytes.Reader, n int) (int, error) {
+	mask := uint64(1)<<n - 1
+	i := uint64(b) & mask
 	if i < mask {
-		return i, 1
+		return int(i), nil
 	}
 
-	var m uint = 0
-	bytesRead := 1
-	var val uint64
+	var m uint
 	for {
 		b, err := r.ReadByte()
 		if err != nil {
-			return 0, -bytesRead
+			return 0, io.ErrUnexpectedEOF
+		}
+		// Five continuation bytes are enough for 32 bits. Checking first
+		// keeps the shift below from overflowing too.
+		if m >= 35 {
+			return 0, errIntegerOverflow
+		}
+		i += uint64(b&127) << m
+		if i > math.MaxUint32 {
+			return 0, errIntegerOverflow
 		}
-		bytesRead++
-		val |= uint64(b&127) << m
 		m += 7
 		if b&IntegerContinuationMask == 0 {
-			break
+			return int(i), nil
 		}
 	}
-	return i + int(val), bytesRead
+}
+
+// SensitiveHeader is the default NeverIndex policy. Credentials are never
+// added to the dynamic table, where an attacker who can make us send headers
+// could work them out by watching how well their guesses compress (RFC 7541
+// Section 7.1). The never-indexed flag also tells proxies to do the same.
+func SensitiveHeader(hf HeaderField) bool {
+	switch hf.Name {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie":
+		return true
+	}
+	return false
 }
 
 type HPACKEncoder struct {
 	dynamicTable *DynamicTable
+	// NeverIndex decides which fields are sent as never-indexed literals.
+	// nil indexes everything.
+	NeverIndex func(HeaderField) bool
+	// sizeUpdate is set when the table size changed since the last header
+	// block, which the decoder has to be told about.
+	sizeUpdate bool
 }
 
 func NewHPACKEncoder(maxSize uint32) *HPACKEncoder {
 	return &HPACKEncoder{
 		dynamicTable: NewDynamicTable(maxSize),
+		NeverIndex:   SensitiveHeader,
 	}
 }
 
+// SetMaxDynamicTableSize changes the size of the dynamic table. It must not
+// exceed the SETTINGS_HEADER_TABLE_SIZE the peer advertised. The change is
+// signalled at the start of the next header block.
+func (e *HPACKEncoder) SetMaxDynamicTableSize(size uint32) {
+	e.dynamicTable.SetMaxSize(size)
+	e.sizeUpdate = true
+}
+
+// Encode encodes a header block. Each field is sent the cheapest way
+// available: as an index if the exact field is in the static or dynamic
+// table, and otherwise as a literal, with the name as an index if possible.
+// Literals are added to the dynamic table so that the next block can refer
+// to them, unless they're sensitive or too big to fit.
 func (e *HPACKEncoder) Encode(headers []HeaderField) []byte {
 	var buf bytes.Buffer
+	if e.sizeUpdate {
+		encodeInt(&buf, int(e.dynamicTable.maxSize), 5, patternDynamicTableSize)
+		e.sizeUpdate = false
+	}
 	for _, hf := range headers {
-		// Find a match in static table
-		if index, ok := staticTableMap[hf]; ok {
+		index, nameOnly := e.search(hf)
+		switch {
+		case e.NeverIndex != nil && e.NeverIndex(hf):
+			e.encodeLiteral(&buf, hf, index, 4, patternLiteralNever)
+		case index > 0 && !nameOnly:
 			encodeInt(&buf, index, 7, patternIndexed)
-			continue
-		}
-
-		// Find a name match in static table
-		if index, ok := staticTableNameMap[hf.Name]; ok {
-			encodeInt(&buf, index, 6, patternLiteralIncremental)
-			encodeString(&buf, hf.Value)
+		case hf.Size() > e.dynamicTable.maxSize:
+			e.encodeLiteral(&buf, hf, index, 4, patternLiteral)
+		default:
+			e.encodeLiteral(&buf, hf, index, 6, patternLiteralIncremental)
 			e.dynamicTable.Add(hf)
-			continue
 		}
-
-		// Literal with literal name
-		encodeInt(&buf, 0, 6, patternLiteralIncremental)
-		encodeString(&buf, hf.Name)
-		encodeString(&buf, hf.Value)
-		e.dynamicTable.Add(hf)
 	}
 	return buf.Bytes()
 }
 
+// search finds the best index for hf across both tables. nameOnly reports
+// whether only the name matched; an index of 0 means not even that.
+func (e *HPACKEncoder) search(hf HeaderField) (index int, nameOnly bool) {
+	if index, ok := staticTableMap[hf]; ok {
+		return index, false
+	}
+	i, nameOnly := e.dynamicTable.search(hf)
+	if i >= 0 && !nameOnly {
+		return len(StaticTable) + 1 + i, false
+	}
+	if index, ok := staticTableNameMap[hf.Name]; ok {
+		return index, true
+	}
+	if i >= 0 {
+		return len(StaticTable) + 1 + i, true
+	}
+	return 0, true
+}
+
+// encodeLiteral writes a literal field of the given kind, referring to the
+// name by nameIndex unless it's 0.
+func (e *HPACKEncoder) encodeLiteral(buf *bytes.Buffer, hf HeaderField, nameIndex, n int, pattern byte) {
+	encodeInt(buf, nameIndex, n, pattern)
+	if nameIndex == 0 {
+		encodeString(buf, hf.Name)
+	}
+	encodeString(buf, hf.Value)
+}
+
 func encodeInt(buf *bytes.Buffer, i int, n int, pattern byte) {
 	mask := (1 << n) - 1
 	if i < mask {
@@ -341,8 +477,13 @@ func encodeInt(buf *bytes.Buffer, i int, n int, pattern byte) {
 	}
 }
 
+// encodeString writes a string literal, Huffman encoded if that's shorter.
 func encodeString(buf *bytes.Buffer, s string) {
-	// no huffman for now
+	if n := HuffmanEncodedLen(s); n < len(s) {
+		encodeInt(buf, n, 7, HuffmanFlagMask)
+		buf.Write(AppendHuffman(buf.AvailableBuffer(), s))
+		return
+	}
 	encodeInt(buf, len(s), 7, 0x00) // This is patternLiteral. We are encoding a raw string.
 	buf.WriteString(s)
 }
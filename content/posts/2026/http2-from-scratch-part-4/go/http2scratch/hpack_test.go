@@ -0,0 +1,439 @@
+package http2scratch
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// decodeWithXNet decodes a header block with golang.org/x/net's decoder,
+// which serves as the reference implementation.
+func decodeWithXNet(t testing.TB, dec *hpack.Decoder, block []byte) []hpack.HeaderField {
+	t.Helper()
+	fields, err := dec.DecodeFull(block)
+	if err != nil {
+		t.Fatalf("x/net failed to decode %x: %v", block, err)
+	}
+	return fields
+}
+
+func TestHuffmanRFCExamples(t *testing.T) {
+	// RFC 7541 Appendix C.4
+	tests := []struct{ s, encoded string }{
+		{"www.example.com", "f1e3c2e5f23a6ba0ab90f4ff"},
+		{"no-cache", "a8eb10649cbf"},
+		{"custom-key", "25a849e95ba97d7f"},
+		{"custom-value", "25a849e95bb8e8b4bf"},
+	}
+	for _, tt := range tests {
+		if got := hex.EncodeToString(AppendHuffman(nil, tt.s)); got != tt.encoded {
+			t.Errorf("AppendHuffman(%q) = %s, want %s", tt.s, got, tt.encoded)
+		}
+		if got := HuffmanEncodedLen(tt.s); got != len(tt.encoded)/2 {
+			t.Errorf("HuffmanEncodedLen(%q) = %d, want %d", tt.s, got, len(tt.encoded)/2)
+		}
+		data, _ := hex.DecodeString(tt.encoded)
+		if got, err := HuffmanDecode(data); err != nil || got != tt.s {
+			t.Errorf("HuffmanDecode(%s) = %q, %v, want %q", tt.encoded, got, err, tt.s)
+		}
+	}
+}
+
+func TestHuffmanDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"EOS symbol", []byte{0xff, 0xff, 0xff, 0xfc}},
+		{"padding over 7 bits", []byte{0x1f, 0xff}}, // 'a' followed by 11 one bits
+		{"padding with a zero bit", []byte{0x1e}},   // 'a' followed by 110
+	}
+	for _, tt := range tests {
+		if got, err := HuffmanDecode(tt.data); err == nil {
+			t.Errorf("%s: decoded %q, want an error", tt.name, got)
+		}
+	}
+}
+
+func TestEncoderIndexing(t *testing.T) {
+	enc := NewHPACKEncoder(4096)
+	dec := hpack.NewDecoder(4096, nil)
+	headers := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/posts/"},
+		{Name: "user-agent", Value: "http2-from-scratch"},
+		{Name: "x-custom", Value: "value"},
+	}
+
+	first := enc.Encode(headers)
+	second := enc.Encode(headers)
+	// Everything is in a table now, so each field is a single index byte.
+	if len(second) != len(headers) {
+		t.Errorf("second block is %d bytes, want %d: %x", len(second), len(headers), second)
+	}
+	for _, block := range [][]byte{first, second} {
+		fields := decodeWithXNet(t, dec, block)
+		if len(fields) != len(headers) {
+			t.Fatalf("decoded %d fields, want %d", len(fields), len(headers))
+		}
+		for i, f := range fields {
+			if f.Name != headers[i].Name || f.Value != headers[i].Value {
+				t.Errorf("field %d: got %s: %s, want %s: %s", i, f.Name, f.Value, headers[i].Name, headers[i].Value)
+			}
+		}
+	}
+
+	// A new value for a known name only sends the value.
+	third := enc.Encode([]HeaderField{{Name: "x-custom", Value: "other"}})
+	if want := 1 + 1 + len("other"); len(third) > want {
+		t.Errorf("name-only match took %d bytes, want at most %d", len(third), want)
+	}
+	decodeWithXNet(t, dec, third)
+}
+
+func TestEncoderNeverIndex(t *testing.T) {
+	enc := NewHPACKEncoder(4096)
+	dec := hpack.NewDecoder(4096, nil)
+	secret := HeaderField{Name: "authorization", Value: "Bearer secret-token"}
+
+	for range 2 {
+		fields := decodeWithXNet(t, dec, enc.Encode([]HeaderField{secret}))
+		if len(fields) != 1 || !fields[0].Sensitive || fields[0].Value != secret.Value {
+			t.Errorf("got %v, want a sensitive %s", fields, secret.Name)
+		}
+	}
+	if len(enc.dynamicTable.headers) != 0 {
+		t.Errorf("sensitive field ended up in the dynamic table: %v", enc.dynamicTable.headers)
+	}
+
+	// The policy is pluggable.
+	enc.NeverIndex = func(hf HeaderField) bool { return hf.Name == "x-api-key" }
+	fields := decodeWithXNet(t, dec, enc.Encode([]HeaderField{{Name: "x-api-key", Value: "k"}, secret}))
+	if !fields[0].Sensitive || fields[1].Sensitive {
+		t.Errorf("got %v, want only x-api-key to be sensitive", fields)
+	}
+}
+
+func TestEncoderTableSizeUpdate(t *testing.T) {
+	enc := NewHPACKEncoder(4096)
+	dec := hpack.NewDecoder(4096, nil)
+	decodeWithXNet(t, dec, enc.Encode([]HeaderField{{Name: "x-a", Value: "1"}}))
+
+	enc.SetMaxDynamicTableSize(0)
+	block := enc.Encode([]HeaderField{{Name: "x-a", Value: "1"}})
+	fields := decodeWithXNet(t, dec, block)
+	if len(fields) != 1 || fields[0].Value != "1" {
+		t.Errorf("got %v", fields)
+	}
+	// An entry too big for the table is sent without indexing.
+	enc.SetMaxDynamicTableSize(64)
+	big := HeaderField{Name: "x-big", Value: strings.Repeat("v", 100)}
+	decodeWithXNet(t, dec, enc.Encode([]HeaderField{big, big}))
+	if len(enc.dynamicTable.headers) != 0 {
+		t.Errorf("oversized field ended up in the dynamic table")
+	}
+}
+
+func FuzzHuffman(f *testing.F) {
+	f.Add([]byte("www.example.com"))
+	f.Add([]byte{0, 0xff, '\n', 0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := string(data)
+		encoded := AppendHuffman(nil, s)
+		if len(encoded) != HuffmanEncodedLen(s) {
+			t.Fatalf("encoded %d bytes, HuffmanEncodedLen said %d", len(encoded), HuffmanEncodedLen(s))
+		}
+		if got, err := hpack.HuffmanDecodeToString(encoded); err != nil || got != s {
+			t.Fatalf("x/net decoded %q, %v, want %q", got, err, s)
+		}
+		if got, err := HuffmanDecode(encoded); err != nil || got != s {
+			t.Fatalf("decoded %q, %v, want %q", got, err, s)
+		}
+
+		// On arbitrary input, both decoders agree.
+		got, err := HuffmanDecode(data)
+		want, wantErr := hpack.HuffmanDecodeToString(data)
+		if (err != nil) != (wantErr != nil) || got != want {
+			t.Fatalf("decoded %x to %q, %v; x/net gives %q, %v", data, got, err, want, wantErr)
+		}
+	})
+}
+
+// FuzzEncoder encodes the fuzzer's header fields over several blocks, so
+// the dynamic table gets exercised, and checks x/net decodes them back.
+func FuzzEncoder(f *testing.F) {
+	f.Add("content-type\x00text/html\x00x-custom\x00a\x00content-type\x00text/html", uint16(4096))
+	f.Add("authorization\x00secret\x00cookie\x00a=b", uint16(100))
+	f.Fuzz(func(t *testing.T, input string, tableSize uint16) {
+		parts := strings.Split(input, "\x00")
+		var headers []HeaderField
+		for i := 0; i+1 < len(parts); i += 2 {
+			headers = append(headers, HeaderField{Name: strings.ToLower(parts[i]), Value: parts[i+1]})
+		}
+
+		enc := NewHPACKEncoder(4096)
+		dec := hpack.NewDecoder(4096, nil)
+		if tableSize < 4096 {
+			enc.SetMaxDynamicTableSize(uint32(tableSize))
+		}
+		for start := 0; start < len(headers); start += 3 {
+			block := headers[start:min(start+3, len(headers))]
+			fields := decodeWithXNet(t, dec, enc.Encode(block))
+			if len(fields) != len(block) {
+				t.Fatalf("decoded %d fields, want %d", len(fields), len(block))
+			}
+			for i, f := range fields {
+				if f.Name != block[i].Name || f.Value != block[i].Value {
+					t.Fatalf("field %d: got %q: %q, want %q: %q", i, f.Name, f.Value, block[i].Name, block[i].Value)
+				}
+			}
+		}
+		if enc.dynamicTable.size > enc.dynamicTable.maxSize {
+			t.Fatalf("dynamic table holds %d bytes, more than its maximum of %d", enc.dynamicTable.size, enc.dynamicTable.maxSize)
+		}
+	})
+}
+
+// story is a file in the format of the hpack-test-case corpus, see
+// testdata/hpack-stories/README.md.
+type story struct {
+	Description string      `json:"description"`
+	Cases       []storyCase `json:"cases"`
+}
+
+type storyCase struct {
+	Seqno           int                 `json:"seqno"`
+	HeaderTableSize *uint32             `json:"header_table_size"`
+	Wire            string              `json:"wire"`
+	Headers         []map[string]string `json:"headers"`
+}
+
+func (c storyCase) fields() []HeaderField {
+	var fields []HeaderField
+	for _, h := range c.Headers {
+		for name, value := range h {
+			fields = append(fields, HeaderField{Name: name, Value: value})
+		}
+	}
+	return fields
+}
+
+// loadStories reads our own stories and the stories checked in from the
+// upstream corpus under testdata/hpack-test-case.
+func loadStories(t *testing.T) map[string]story {
+	t.Helper()
+	paths, err := filepath.Glob("testdata/hpack-stories/*/story_*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no stories in testdata/hpack-stories")
+	}
+	upstream, err := filepath.Glob("testdata/hpack-test-case/*/story_*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths = append(paths, upstream...)
+	stories := make(map[string]story)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s story
+		if err := json.Unmarshal(data, &s); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		stories[strings.TrimPrefix(path, "testdata/")] = s
+	}
+	return stories
+}
+
+// checkTable fails if the dynamic table holds more than it may.
+func checkTable(t testing.TB, dec *HPACKDecoder) {
+	t.Helper()
+	table := dec.dynamicTable
+	if table.size > table.maxSize || table.maxSize > dec.allowedMaxSize {
+		t.Fatalf("dynamic table holds %d bytes with a maximum of %d, allowed %d", table.size, table.maxSize, dec.allowedMaxSize)
+	}
+}
+
+func equalFields(got, want []HeaderField) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHPACKTestCaseDecode(t *testing.T) {
+	for name, s := range loadStories(t) {
+		t.Run(name, func(t *testing.T) {
+			dec := NewHPACKDecoder(headerTableSize)
+			for _, c := range s.Cases {
+				if c.Wire == "" {
+					t.Skip("no wire encoding")
+				}
+				if size := c.HeaderTableSize; size != nil {
+					// The first case sets the size the table starts
+					// with. Later ones can only shrink it, the encoder
+					// has to grow it back itself.
+					dec.SetAllowedMaxDynamicTableSize(*size)
+					if c.Seqno == 0 || dec.dynamicTable.maxSize > *size {
+						dec.dynamicTable.SetMaxSize(*size)
+					}
+				}
+				wire, err := hex.DecodeString(c.Wire)
+				if err != nil {
+					t.Fatalf("case %d: %v", c.Seqno, err)
+				}
+				got, err := dec.Decode(wire)
+				if err != nil {
+					t.Fatalf("case %d: %v", c.Seqno, err)
+				}
+				if want := c.fields(); !equalFields(got, want) {
+					t.Fatalf("case %d: got %v, want %v", c.Seqno, got, want)
+				}
+				checkTable(t, dec)
+			}
+		})
+	}
+}
+
+func TestHPACKTestCaseRoundTrip(t *testing.T) {
+	// Every story, whoever encoded it, is encoded again by our encoder and
+	// decoded by both our decoder and x/net's.
+	for name, s := range loadStories(t) {
+		t.Run(name, func(t *testing.T) {
+			enc := NewHPACKEncoder(headerTableSize)
+			dec := NewHPACKDecoder(headerTableSize)
+			ref := hpack.NewDecoder(headerTableSize, nil)
+			for _, c := range s.Cases {
+				if c.HeaderTableSize != nil {
+					enc.SetMaxDynamicTableSize(min(*c.HeaderTableSize, headerTableSize))
+				}
+				want := c.fields()
+				block := enc.Encode(want)
+				got, err := dec.Decode(block)
+				if err != nil {
+					t.Fatalf("case %d: %v", c.Seqno, err)
+				}
+				if !equalFields(got, want) {
+					t.Fatalf("case %d: got %v, want %v", c.Seqno, got, want)
+				}
+				refFields := decodeWithXNet(t, ref, block)
+				for i, f := range refFields {
+					if f.Name != want[i].Name || f.Value != want[i].Value {
+						t.Fatalf("case %d: x/net decoded field %d as %q: %q, want %q: %q", c.Seqno, i, f.Name, f.Value, want[i].Name, want[i].Value)
+					}
+				}
+				checkTable(t, dec)
+			}
+		})
+	}
+}
+
+func TestDecodeInt(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte // the first byte holds the prefix
+		prefix  int
+		want    int
+		wantErr error
+	}{
+		// RFC 7541 Appendix C.1
+		{"fits in the prefix", []byte{0x0a}, 5, 10, nil},
+		{"continuation bytes", []byte{0x1f, 0x9a, 0x0a}, 5, 1337, nil},
+		{"8-bit prefix", []byte{0x2a}, 8, 42, nil},
+
+		{"largest value", []byte{0x1f, 0xe0, 0xff, 0xff, 0xff, 0x0f}, 5, math.MaxUint32, nil},
+		{"truncated", []byte{0x1f, 0x9a}, 5, 0, io.ErrUnexpectedEOF},
+		{"too big", []byte{0x1f, 0xe1, 0xff, 0xff, 0xff, 0x0f}, 5, 0, errIntegerOverflow},
+		{"too many bytes", append([]byte{0x1f}, bytes.Repeat([]byte{0x80}, 10)...), 5, 0, errIntegerOverflow},
+	}
+	for _, tt := range tests {
+		got, err := decodeInt(tt.data[0], bytes.NewReader(tt.data[1:]), tt.prefix)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+	}{
+		{"index 0", "80"},
+		{"index past the tables", "be"},
+		{"size update over the allowed size", "3fe21f"}, // 4097
+		{"size update after a field", "8220"},
+		{"truncated string", "400161"},
+		{"string longer than the block", "4001610a"},
+		{"string length overflow", "407fffffffff0f"},
+		{"bad Huffman code", "4081ff00"},
+	}
+	for _, tt := range tests {
+		block, _ := hex.DecodeString(tt.block)
+		dec := NewHPACKDecoder(headerTableSize)
+		if fields, err := dec.Decode(block); err == nil {
+			t.Errorf("%s: decoded %v, want an error", tt.name, fields)
+		}
+	}
+}
+
+// FuzzDecoder decodes the fuzzer's input twice, as two header blocks on
+// the same connection, and checks that the decoder doesn't panic and that
+// the dynamic table stays within its limits. Whatever both decoders accept
+// has to decode the same as with x/net. They don't always reject the same
+// blocks: x/net allows a size update after a field while the table is
+// empty, and refuses the second of two size updates that RFC 7541 Section
+// 4.2 allows at the start of a block.
+func FuzzDecoder(f *testing.F) {
+	for _, s := range []string{
+		"828684410f7777772e6578616d706c652e636f6d",
+		"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+		"4803333032580770726976617465611d4d6f6e2c203231204f637420323031332032303a31333a323120474d546e1768747470733a2f2f7777772e6578616d706c652e636f6d",
+		"3fe10140026b310176",
+		"1f9a0a",
+	} {
+		block, _ := hex.DecodeString(s)
+		f.Add(block, uint16(4096))
+		f.Add(block, uint16(256))
+	}
+	f.Fuzz(func(t *testing.T, block []byte, tableSize uint16) {
+		dec := NewHPACKDecoder(uint32(tableSize))
+		ref := hpack.NewDecoder(uint32(tableSize), nil)
+		for range 2 {
+			got, err := dec.Decode(block)
+			if err != nil {
+				return
+			}
+			checkTable(t, dec)
+			want, err := ref.DecodeFull(block)
+			if err != nil {
+				return
+			}
+			if len(got) != len(want) {
+				t.Fatalf("decoding %x: got %v, x/net got %v", block, got, want)
+			}
+			for i := range got {
+				if got[i].Name != want[i].Name || got[i].Value != want[i].Value {
+					t.Fatalf("decoding %x: got %v, x/net got %v", block, got, want)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,491 @@
+package http2scratch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// defaultMaxFrameSize is the largest frame payload a peer accepts until it
+// says otherwise (RFC 9113 Section 6.5.2).
+const defaultMaxFrameSize = 16384
+
+// maxFrameSizeLimit is the largest SETTINGS_MAX_FRAME_SIZE allowed.
+const maxFrameSizeLimit = 1<<24 - 1
+
+// FrameHeader represents the 9-byte fixed header of every HTTP/2 frame.
+type FrameHeader struct {
+	Length   uint32
+	Type     uint8
+	Flags    uint8
+	StreamID uint32
+}
+
+// Frame represents a complete HTTP/2 frame including its payload.
+type Frame struct {
+	Header  FrameHeader
+	Payload []byte
+}
+
+// ReadFrame reads a header and then the corresponding payload from the
+// connection. It accepts any length the header can express; FrameReader is
+// the one that enforces SETTINGS_MAX_FRAME_SIZE.
+func ReadFrame(r io.Reader) (Frame, error) {
+	header, err := readFrameHeader(r)
+	if err != nil {
+		return Frame{}, err
+	}
+	return readFramePayload(r, header)
+}
+
+// readFrameHeader reads the 9-byte header of the next frame.
+func readFrameHeader(r io.Reader) (FrameHeader, error) {
+	headerBuf := make([]byte, 9)
+	_, err := io.ReadFull(r, headerBuf)
+	if err != nil {
+		return FrameHeader{}, fmt.Errorf("reading header: %w", err)
+	}
+
+	// Parse the header fields using bit-shifting
+	header := FrameHeader{
+		Length:   uint32(headerBuf[0])<<16 | uint32(headerBuf[1])<<8 | uint32(headerBuf[2]),
+		Type:     headerBuf[3],
+		Flags:    headerBuf[4],
+		StreamID: binary.BigEndian.Uint32(headerBuf[5:9]) & 0x7FFFFFFF,
+	}
+	return header, nil
+}
+
+// readFramePayload reads the payload that follows header.
+func readFramePayload(r io.Reader, header FrameHeader) (Frame, error) {
+	// Read the payload based on the Length field
+	payload := make([]byte, header.Length)
+	if header.Length > 0 {
+		_, err := io.ReadFull(r, payload)
+		if err != nil {
+			return Frame{}, fmt.Errorf("reading payload: %w", err)
+		}
+	}
+
+	return Frame{Header: header, Payload: payload}, nil
+}
+
+// WriteFrame writes a single frame: the 9-byte header followed by the
+// payload, in one Write so concurrent writers can't interleave.
+func WriteFrame(w io.Writer, frameType, flags uint8, streamID uint32, payload []byte) error {
+	frame := make([]byte, 9, 9+len(payload))
+	frame[0] = byte(len(payload) >> 16)
+	frame[1] = byte(len(payload) >> 8)
+	frame[2] = byte(len(payload))
+	frame[3] = frameType
+	frame[4] = flags
+	binary.BigEndian.PutUint32(frame[5:9], streamID)
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+// writeHeaderBlock sends an encoded header block as a HEADERS frame,
+// followed by CONTINUATION frames if it doesn't fit in one frame.
+func writeHeaderBlock(w io.Writer, streamID uint32, block []byte, endStream bool, maxFrameSize int) error {
+	frameType := FrameHeaders
+	var flags uint8
+	if endStream {
+		flags = FlagEndStream
+	}
+	for {
+		chunk := block
+		if len(chunk) > maxFrameSize {
+			chunk = chunk[:maxFrameSize]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		if err := WriteFrame(w, frameType, flags, streamID, chunk); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		frameType, flags = FrameContinuation, 0
+	}
+}
+
+// Has reports whether flag is set on the frame.
+func (h FrameHeader) Has(flag uint8) bool {
+	return h.Flags&flag != 0
+}
+
+// Header returns the frame header. Every typed frame embeds FrameHeader, so
+// they all get this method.
+func (h FrameHeader) Header() FrameHeader {
+	return h
+}
+
+// TypedFrame is a parsed frame: one of *DataFrame, *HeadersFrame,
+// *PriorityFrame, *RSTStreamFrame, *SettingsFrame, *PushPromiseFrame,
+// *PingFrame, *GoAwayFrame, *WindowUpdateFrame or *UnknownFrame.
+type TypedFrame interface {
+	Header() FrameHeader
+}
+
+// DataFrame carries request or response body bytes (RFC 9113 Section 6.1).
+// Data has the padding removed, but flow control counts the whole frame, so
+// use Length for that.
+type DataFrame struct {
+	FrameHeader
+	Data []byte
+}
+
+// HeadersFrame opens a stream or carries trailers (RFC 9113 Section 6.2).
+// HeaderBlock is the complete block, already put back together from any
+// CONTINUATION frames, with the padding and priority fields removed.
+type HeadersFrame struct {
+	FrameHeader
+	Priority    *PriorityParam // nil unless the PRIORITY flag was set
+	HeaderBlock []byte
+}
+
+// PriorityParam is the deprecated priority scheme of RFC 7540. We parse it
+// so it can be skipped, but it's otherwise ignored (RFC 9113 Section 5.3.2).
+type PriorityParam struct {
+	StreamDep uint32
+	Exclusive bool
+	Weight    uint8
+}
+
+// PriorityFrame is a PRIORITY frame (RFC 9113 Section 6.3).
+type PriorityFrame struct {
+	FrameHeader
+	PriorityParam
+}
+
+// RSTStreamFrame ends a stream immediately (RFC 9113 Section 6.4).
+type RSTStreamFrame struct {
+	FrameHeader
+	ErrCode uint32
+}
+
+// Setting is one parameter of a SETTINGS frame.
+type Setting struct {
+	ID    uint16
+	Value uint32
+}
+
+// SettingsFrame carries the sender's settings, or acknowledges ours if the
+// ACK flag is set (RFC 9113 Section 6.5).
+type SettingsFrame struct {
+	FrameHeader
+	Settings []Setting
+}
+
+// PushPromiseFrame announces a stream the server is about to push (RFC 9113
+// Section 6.6). Like HeadersFrame, HeaderBlock is the complete block.
+type PushPromiseFrame struct {
+	FrameHeader
+	PromisedStreamID uint32
+	HeaderBlock      []byte
+}
+
+// PingFrame measures round trips and checks that the connection is alive
+// (RFC 9113 Section 6.7).
+type PingFrame struct {
+	FrameHeader
+	Data [8]byte
+}
+
+// GoAwayFrame starts shutting the connection down (RFC 9113 Section 6.8).
+type GoAwayFrame struct {
+	FrameHeader
+	LastStreamID uint32
+	ErrCode      uint32
+	DebugData    []byte
+}
+
+// WindowUpdateFrame grows a flow-control window (RFC 9113 Section 6.9).
+type WindowUpdateFrame struct {
+	FrameHeader
+	Increment uint32
+}
+
+// UnknownFrame is a frame of a type we don't know. Those must be ignored
+// (RFC 9113 Section 4.1).
+type UnknownFrame struct {
+	FrameHeader
+	Payload []byte
+}
+
+// defaultMaxHeaderBlockSize bounds a header block spread over CONTINUATION
+// frames. Without a limit a peer could keep sending them forever.
+const defaultMaxHeaderBlockSize = 1 << 20
+
+// FrameReader reads frames from a connection and parses them. It takes care
+// of the parts of the framing layer that span frames: header blocks split
+// over CONTINUATION frames come back as a single HeadersFrame or
+// PushPromiseFrame.
+type FrameReader struct {
+	r io.Reader
+	// MaxFrameSize is the largest payload we accept. It's the
+	// SETTINGS_MAX_FRAME_SIZE we advertised, so anything bigger is a
+	// FRAME_SIZE_ERROR.
+	MaxFrameSize uint32
+	// MaxHeaderBlockSize bounds a header block including its CONTINUATION
+	// frames.
+	MaxHeaderBlockSize int
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		r:                  r,
+		MaxFrameSize:       defaultMaxFrameSize,
+		MaxHeaderBlockSize: defaultMaxHeaderBlockSize,
+	}
+}
+
+// ReadFrame reads and parses the next frame. A protocol violation comes back
+// as a ConnectionError or StreamError carrying the matching error code. After
+// a StreamError the connection is still fine and reading can go on.
+func (fr *FrameReader) ReadFrame() (TypedFrame, error) {
+	frame, err := fr.readRaw()
+	if err != nil {
+		return nil, err
+	}
+	if frame.Header.Type == FrameContinuation {
+		return nil, connError(ErrCodeProtocol, "CONTINUATION frame without a header block to continue")
+	}
+	f, err := ParseFrame(frame)
+	if err != nil {
+		return nil, err
+	}
+	switch f := f.(type) {
+	case *HeadersFrame:
+		f.HeaderBlock, err = fr.readContinuations(f.FrameHeader, f.HeaderBlock)
+		f.Flags |= FlagEndHeaders
+	case *PushPromiseFrame:
+		f.HeaderBlock, err = fr.readContinuations(f.FrameHeader, f.HeaderBlock)
+		f.Flags |= FlagEndHeaders
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readRaw reads one frame. The length is checked against MaxFrameSize
+// before anything is allocated for the payload, so an oversized frame
+// can't make us buffer up to 16 MB first.
+func (fr *FrameReader) readRaw() (Frame, error) {
+	header, err := readFrameHeader(fr.r)
+	if err != nil {
+		return Frame{}, err
+	}
+	if header.Length > fr.MaxFrameSize {
+		return Frame{}, connError(ErrCodeFrameSize, "%d byte frame exceeds the maximum frame size of %d", header.Length, fr.MaxFrameSize)
+	}
+	return readFramePayload(fr.r, header)
+}
+
+// readContinuations appends CONTINUATION frames to block until the header
+// block is complete. Nothing else may come in between, not even frames for
+// other streams (RFC 9113 Section 6.10).
+func (fr *FrameReader) readContinuations(first FrameHeader, block []byte) ([]byte, error) {
+	if first.Has(FlagEndHeaders) {
+		return block, nil
+	}
+	block = append([]byte(nil), block...)
+	for {
+		next, err := fr.readRaw()
+		if err != nil {
+			return nil, err
+		}
+		if next.Header.Type != FrameContinuation || next.Header.StreamID != first.StreamID {
+			return nil, connError(ErrCodeProtocol, "expected CONTINUATION for stream %d, got frame type %d on stream %d", first.StreamID, next.Header.Type, next.Header.StreamID)
+		}
+		if len(block)+len(next.Payload) > fr.MaxHeaderBlockSize {
+			return nil, connError(ErrCodeEnhanceYourCalm, "header block on stream %d exceeds %d bytes", first.StreamID, fr.MaxHeaderBlockSize)
+		}
+		block = append(block, next.Payload...)
+		if next.Header.Has(FlagEndHeaders) {
+			return block, nil
+		}
+	}
+}
+
+// ParseFrame parses a single raw frame, checking the rules RFC 9113 Section
+// 6 sets for its type. A HEADERS or PUSH_PROMISE frame without END_HEADERS
+// only holds the first fragment of its header block; FrameReader takes care
+// of the rest. CONTINUATION frames come back as UnknownFrame, since they only
+// make sense as part of a block.
+func ParseFrame(frame Frame) (TypedFrame, error) {
+	h, p := frame.Header, frame.Payload
+	switch h.Type {
+	case FrameData:
+		if h.StreamID == 0 {
+			return nil, connError(ErrCodeProtocol, "DATA frame on stream 0")
+		}
+		data, err := stripPadding(h, p)
+		if err != nil {
+			return nil, err
+		}
+		return &DataFrame{FrameHeader: h, Data: data}, nil
+
+	case FrameHeaders:
+		if h.StreamID == 0 {
+			return nil, connError(ErrCodeProtocol, "HEADERS frame on stream 0")
+		}
+		block, err := stripPadding(h, p)
+		if err != nil {
+			return nil, err
+		}
+		f := &HeadersFrame{FrameHeader: h}
+		if h.Has(FlagPriority) {
+			if len(block) < 5 {
+				return nil, connError(ErrCodeFrameSize, "HEADERS frame too short for its priority fields")
+			}
+			param := parsePriority(block)
+			f.Priority = &param
+			block = block[5:]
+		}
+		f.HeaderBlock = block
+		return f, nil
+
+	case FramePriority:
+		if h.StreamID == 0 {
+			return nil, connError(ErrCodeProtocol, "PRIORITY frame on stream 0")
+		}
+		if len(p) != 5 {
+			return nil, StreamError{StreamID: h.StreamID, Code: ErrCodeFrameSize, Reason: "PRIORITY frame must be 5 bytes"}
+		}
+		return &PriorityFrame{FrameHeader: h, PriorityParam: parsePriority(p)}, nil
+
+	case FrameRstStream:
+		if h.StreamID == 0 {
+			return nil, connError(ErrCodeProtocol, "RST_STREAM frame on stream 0")
+		}
+		if len(p) != 4 {
+			return nil, connError(ErrCodeFrameSize, "RST_STREAM frame must be 4 bytes")
+		}
+		return &RSTStreamFrame{FrameHeader: h, ErrCode: binary.BigEndian.Uint32(p)}, nil
+
+	case FrameSettings:
+		return parseSettings(h, p)
+
+	case FramePushPromise:
+		if h.StreamID == 0 {
+			return nil, connError(ErrCodeProtocol, "PUSH_PROMISE frame on stream 0")
+		}
+		block, err := stripPadding(h, p)
+		if err != nil {
+			return nil, err
+		}
+		if len(block) < 4 {
+			return nil, connError(ErrCodeFrameSize, "PUSH_PROMISE frame too short")
+		}
+		return &PushPromiseFrame{
+			FrameHeader:      h,
+			PromisedStreamID: binary.BigEndian.Uint32(block) & 0x7FFFFFFF,
+			HeaderBlock:      block[4:],
+		}, nil
+
+	case FramePing:
+		if h.StreamID != 0 {
+			return nil, connError(ErrCodeProtocol, "PING frame on stream %d", h.StreamID)
+		}
+		if len(p) != 8 {
+			return nil, connError(ErrCodeFrameSize, "PING frame must be 8 bytes")
+		}
+		f := &PingFrame{FrameHeader: h}
+		copy(f.Data[:], p)
+		return f, nil
+
+	case FrameGoAway:
+		if h.StreamID != 0 {
+			return nil, connError(ErrCodeProtocol, "GOAWAY frame on stream %d", h.StreamID)
+		}
+		if len(p) < 8 {
+			return nil, connError(ErrCodeFrameSize, "GOAWAY frame too short")
+		}
+		return &GoAwayFrame{
+			FrameHeader:  h,
+			LastStreamID: binary.BigEndian.Uint32(p[0:4]) & 0x7FFFFFFF,
+			ErrCode:      binary.BigEndian.Uint32(p[4:8]),
+			DebugData:    p[8:],
+		}, nil
+
+	case FrameWindowUpdate:
+		if len(p) != 4 {
+			return nil, connError(ErrCodeFrameSize, "WINDOW_UPDATE frame must be 4 bytes")
+		}
+		increment := binary.BigEndian.Uint32(p) & 0x7FFFFFFF
+		if increment == 0 {
+			if h.StreamID == 0 {
+				return nil, connError(ErrCodeProtocol, "WINDOW_UPDATE with a zero increment")
+			}
+			return nil, StreamError{StreamID: h.StreamID, Code: ErrCodeProtocol, Reason: "WINDOW_UPDATE with a zero increment"}
+		}
+		return &WindowUpdateFrame{FrameHeader: h, Increment: increment}, nil
+	}
+	return &UnknownFrame{FrameHeader: h, Payload: p}, nil
+}
+
+// stripPadding returns the payload of a DATA, HEADERS or PUSH_PROMISE frame
+// without its padding.
+func stripPadding(h FrameHeader, payload []byte) ([]byte, error) {
+	if !h.Has(FlagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, connError(ErrCodeProtocol, "padding on stream %d longer than the frame", h.StreamID)
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+func parsePriority(p []byte) PriorityParam {
+	dep := binary.BigEndian.Uint32(p[0:4])
+	return PriorityParam{
+		StreamDep: dep & 0x7FFFFFFF,
+		Exclusive: dep&0x80000000 != 0,
+		Weight:    p[4],
+	}
+}
+
+// parseSettings parses a SETTINGS frame and checks the values whose range
+// RFC 9113 Section 6.5.2 restricts.
+func parseSettings(h FrameHeader, p []byte) (*SettingsFrame, error) {
+	if h.StreamID != 0 {
+		return nil, connError(ErrCodeProtocol, "SETTINGS frame on stream %d", h.StreamID)
+	}
+	if h.Has(FlagAck) {
+		if len(p) != 0 {
+			return nil, connError(ErrCodeFrameSize, "SETTINGS ACK with a payload")
+		}
+		return &SettingsFrame{FrameHeader: h}, nil
+	}
+	if len(p)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS frame length %d isn't a multiple of 6", len(p))
+	}
+	f := &SettingsFrame{FrameHeader: h}
+	for ; len(p) > 0; p = p[6:] {
+		s := Setting{ID: binary.BigEndian.Uint16(p[0:2]), Value: binary.BigEndian.Uint32(p[2:6])}
+		switch s.ID {
+		case SettingsEnablePush:
+			if s.Value > 1 {
+				return nil, connError(ErrCodeProtocol, "SETTINGS_ENABLE_PUSH must be 0 or 1, got %d", s.Value)
+			}
+		case SettingsEnableConnectProtocol:
+			if s.Value > 1 {
+				return nil, connError(ErrCodeProtocol, "SETTINGS_ENABLE_CONNECT_PROTOCOL must be 0 or 1, got %d", s.Value)
+			}
+		case SettingsInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return nil, connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE %d above the maximum window size", s.Value)
+			}
+		case SettingsMaxFrameSize:
+			if s.Value < defaultMaxFrameSize || s.Value > maxFrameSizeLimit {
+				return nil, connError(ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE %d out of range", s.Value)
+			}
+		}
+		f.Settings = append(f.Settings, s)
+	}
+	return f, nil
+}
@@ -0,0 +1,164 @@
+package http2scratch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// rawFrame encodes a frame the way it appears on the wire.
+func rawFrame(frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	b := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), frameType, flags}
+	b = binary.BigEndian.AppendUint32(b, streamID)
+	return append(b, payload...)
+}
+
+func TestReadFramePaddingAndPriority(t *testing.T) {
+	var wire []byte
+	// DATA with 3 bytes of padding.
+	wire = append(wire, rawFrame(FrameData, FlagPadded|FlagEndStream, 1, []byte("\x03hello\x00\x00\x00"))...)
+	// HEADERS with padding and priority fields, split over two
+	// CONTINUATION frames.
+	headers := append([]byte{2}, 0x80, 0, 0, 3, 15)
+	headers = append(headers, "abc"...)
+	headers = append(headers, 0, 0)
+	wire = append(wire, rawFrame(FrameHeaders, FlagPadded|FlagPriority|FlagEndStream, 3, headers)...)
+	wire = append(wire, rawFrame(FrameContinuation, 0, 3, []byte("def"))...)
+	wire = append(wire, rawFrame(FrameContinuation, FlagEndHeaders, 3, []byte("ghi"))...)
+
+	fr := NewFrameReader(bytes.NewReader(wire))
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := f.(*DataFrame)
+	if !ok || string(data.Data) != "hello" || data.Length != 9 || !data.Has(FlagEndStream) {
+		t.Fatalf("got %#v, want DATA with %q", f, "hello")
+	}
+
+	f, err = fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := f.(*HeadersFrame)
+	if !ok {
+		t.Fatalf("got %T, want *HeadersFrame", f)
+	}
+	if string(h.HeaderBlock) != "abcdefghi" {
+		t.Errorf("got header block %q, want %q", h.HeaderBlock, "abcdefghi")
+	}
+	if want := (PriorityParam{StreamDep: 3, Exclusive: true, Weight: 15}); h.Priority == nil || *h.Priority != want {
+		t.Errorf("got priority %+v, want %+v", h.Priority, want)
+	}
+	if !h.Has(FlagEndHeaders) || !h.Has(FlagEndStream) {
+		t.Errorf("got flags %#x, want END_HEADERS and END_STREAM", h.Flags)
+	}
+
+	if _, err := fr.ReadFrame(); !errors.Is(err, io.EOF) {
+		t.Errorf("got error %v at the end, want EOF", err)
+	}
+}
+
+func TestReadFrameSettings(t *testing.T) {
+	payload := binary.BigEndian.AppendUint16(nil, SettingsMaxConcurrentStreams)
+	payload = binary.BigEndian.AppendUint32(payload, 100)
+	payload = binary.BigEndian.AppendUint16(payload, SettingsMaxFrameSize)
+	payload = binary.BigEndian.AppendUint32(payload, 1<<20)
+
+	f, err := NewFrameReader(bytes.NewReader(rawFrame(FrameSettings, 0, 0, payload))).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, ok := f.(*SettingsFrame)
+	if !ok {
+		t.Fatalf("got %T, want *SettingsFrame", f)
+	}
+	want := []Setting{{SettingsMaxConcurrentStreams, 100}, {SettingsMaxFrameSize, 1 << 20}}
+	if len(settings.Settings) != len(want) || settings.Settings[0] != want[0] || settings.Settings[1] != want[1] {
+		t.Errorf("got %v, want %v", settings.Settings, want)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	setting := func(id uint16, value uint32) []byte {
+		return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint16(nil, id), value)
+	}
+	tests := []struct {
+		name   string
+		wire   []byte
+		code   uint32
+		stream bool // a stream error rather than a connection error
+	}{
+		{"DATA on stream 0", rawFrame(FrameData, 0, 0, []byte("x")), ErrCodeProtocol, false},
+		{"padding too long", rawFrame(FrameData, FlagPadded, 1, []byte{5, 'x'}), ErrCodeProtocol, false},
+		{"empty padded frame", rawFrame(FrameHeaders, FlagPadded|FlagEndHeaders, 1, nil), ErrCodeProtocol, false},
+		{"short priority", rawFrame(FrameHeaders, FlagPriority|FlagEndHeaders, 1, []byte{0, 0}), ErrCodeFrameSize, false},
+		{"oversized frame", rawFrame(FrameData, 0, 1, make([]byte, defaultMaxFrameSize+1)), ErrCodeFrameSize, false},
+		// Only the header arrives: the length must be refused before any
+		// payload is read.
+		{"oversized frame header", []byte{0xff, 0xff, 0xff, FrameData, 0, 0, 0, 0, 1}, ErrCodeFrameSize, false},
+		{"lone CONTINUATION", rawFrame(FrameContinuation, FlagEndHeaders, 1, nil), ErrCodeProtocol, false},
+		{"interleaved frame", append(rawFrame(FrameHeaders, 0, 1, nil), rawFrame(FrameData, 0, 1, nil)...), ErrCodeProtocol, false},
+		{"CONTINUATION on another stream", append(rawFrame(FrameHeaders, 0, 1, nil), rawFrame(FrameContinuation, FlagEndHeaders, 3, nil)...), ErrCodeProtocol, false},
+		{"PRIORITY wrong size", rawFrame(FramePriority, 0, 1, []byte{1}), ErrCodeFrameSize, true},
+		{"RST_STREAM wrong size", rawFrame(FrameRstStream, 0, 1, []byte{1}), ErrCodeFrameSize, false},
+		{"SETTINGS on a stream", rawFrame(FrameSettings, 0, 1, nil), ErrCodeProtocol, false},
+		{"SETTINGS ACK with payload", rawFrame(FrameSettings, FlagAck, 0, setting(1, 1)), ErrCodeFrameSize, false},
+		{"SETTINGS wrong size", rawFrame(FrameSettings, 0, 0, []byte{1, 2, 3}), ErrCodeFrameSize, false},
+		{"ENABLE_PUSH out of range", rawFrame(FrameSettings, 0, 0, setting(SettingsEnablePush, 2)), ErrCodeProtocol, false},
+		{"INITIAL_WINDOW_SIZE too big", rawFrame(FrameSettings, 0, 0, setting(SettingsInitialWindowSize, 1<<31)), ErrCodeFlowControl, false},
+		{"MAX_FRAME_SIZE too small", rawFrame(FrameSettings, 0, 0, setting(SettingsMaxFrameSize, 100)), ErrCodeProtocol, false},
+		{"PING on a stream", rawFrame(FramePing, 0, 1, make([]byte, 8)), ErrCodeProtocol, false},
+		{"PING wrong size", rawFrame(FramePing, 0, 0, make([]byte, 4)), ErrCodeFrameSize, false},
+		{"GOAWAY too short", rawFrame(FrameGoAway, 0, 0, make([]byte, 4)), ErrCodeFrameSize, false},
+		{"WINDOW_UPDATE wrong size", rawFrame(FrameWindowUpdate, 0, 0, make([]byte, 3)), ErrCodeFrameSize, false},
+		{"zero connection increment", rawFrame(FrameWindowUpdate, 0, 0, make([]byte, 4)), ErrCodeProtocol, false},
+		{"zero stream increment", rawFrame(FrameWindowUpdate, 0, 1, make([]byte, 4)), ErrCodeProtocol, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFrameReader(bytes.NewReader(tt.wire)).ReadFrame()
+			var connErr ConnectionError
+			var streamErr StreamError
+			switch {
+			case tt.stream && errors.As(err, &streamErr):
+				if streamErr.Code != tt.code {
+					t.Errorf("got %v, want code %s", err, ErrCodeName(tt.code))
+				}
+			case !tt.stream && errors.As(err, &connErr):
+				if connErr.Code != tt.code {
+					t.Errorf("got %v, want code %s", err, ErrCodeName(tt.code))
+				}
+			default:
+				t.Errorf("got error %v, want %s (stream error: %t)", err, ErrCodeName(tt.code), tt.stream)
+			}
+		})
+	}
+}
+
+func TestReadFrameHeaderBlockLimit(t *testing.T) {
+	var wire []byte
+	wire = append(wire, rawFrame(FrameHeaders, 0, 1, nil)...)
+	for range 100 {
+		wire = append(wire, rawFrame(FrameContinuation, 0, 1, []byte(strings.Repeat("x", 1000)))...)
+	}
+	fr := NewFrameReader(bytes.NewReader(wire))
+	fr.MaxHeaderBlockSize = 10000
+	var connErr ConnectionError
+	if _, err := fr.ReadFrame(); !errors.As(err, &connErr) || connErr.Code != ErrCodeEnhanceYourCalm {
+		t.Errorf("got error %v, want ENHANCE_YOUR_CALM", err)
+	}
+}
+
+func TestReadFrameUnknownType(t *testing.T) {
+	f, err := NewFrameReader(bytes.NewReader(rawFrame(0xfa, 0, 0, []byte("ext")))).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := f.(*UnknownFrame); !ok || string(u.Payload) != "ext" {
+		t.Errorf("got %#v, want an UnknownFrame", f)
+	}
+}
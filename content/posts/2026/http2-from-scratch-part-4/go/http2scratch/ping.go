@@ -0,0 +1,72 @@
+package http2scratch
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// defaultPingTimeout is how long a keepalive PING may go unanswered when
+// Client.PingTimeout isn't set.
+const defaultPingTimeout = 15 * time.Second
+
+// ping sends a PING with a random payload and waits for the server to
+// echo it back with the ACK flag.
+func (cc *clientConn) ping(ctx context.Context) error {
+	var data [8]byte
+	rand.Read(data[:])
+	ack := make(chan struct{})
+
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return cc.err
+	}
+	if cc.pings == nil {
+		cc.pings = make(map[[8]byte]chan struct{})
+	}
+	cc.pings[data] = ack
+	cc.mu.Unlock()
+	defer func() {
+		cc.mu.Lock()
+		delete(cc.pings, data)
+		cc.mu.Unlock()
+	}()
+
+	if err := cc.writeFrame(FramePing, 0, 0, data[:]); err != nil {
+		return err
+	}
+	select {
+	case <-ack:
+		// fail closes the channel too, so check that it was really the ACK.
+		cc.mu.Lock()
+		defer cc.mu.Unlock()
+		return cc.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handlePingAck wakes up whoever sent the PING the server is acknowledging.
+// An ACK for a PING we didn't send is ignored.
+func (cc *clientConn) handlePingAck(data [8]byte) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if ack, ok := cc.pings[data]; ok {
+		close(ack)
+		delete(cc.pings, data)
+	}
+}
+
+// healthCheck runs when nothing has been read for readIdleTimeout. If the
+// server doesn't answer a PING either, the connection is taken to be dead
+// and closed, failing its streams, rather than left to hang until TCP gives
+// up on it.
+func (cc *clientConn) healthCheck() {
+	ctx, cancel := context.WithTimeout(context.Background(), cc.pingTimeout)
+	defer cancel()
+	if err := cc.ping(ctx); err != nil {
+		cc.fail(fmt.Errorf("health check failed: %w", err))
+	}
+}
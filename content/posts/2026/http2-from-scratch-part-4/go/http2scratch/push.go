@@ -0,0 +1,146 @@
+package http2scratch
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Server push (RFC 9113 Section 8.4) lets a server answer a request it
+// expects the client to make, like the stylesheet of the page it's serving.
+// A PUSH_PROMISE on one of our streams carries the promised request and
+// reserves a stream of the server's for the response. We keep the response
+// on that stream until a GET for the same URL comes along and claims it.
+
+// maxPushedStreams bounds how many promised responses a connection keeps
+// around before anyone has asked for them. Past it, pushes are refused.
+const maxPushedStreams = 100
+
+// handlePushPromise reserves the promised stream and files it under its
+// request for a later GET to claim. The header block is decoded first, even
+// if the push ends up refused, to keep the HPACK state in sync.
+func (cc *clientConn) handlePushPromise(f *PushPromiseFrame) error {
+	if !cc.enablePush {
+		return connError(ErrCodeProtocol, "server sent PUSH_PROMISE with push disabled")
+	}
+	headers, err := cc.hpackDec.Decode(f.HeaderBlock)
+	if err != nil {
+		return connError(ErrCodeCompression, "hpack: %v", err)
+	}
+	if cc.tracer != nil {
+		cc.tracer.Headers(PeerServer, f.PromisedStreamID, headers, cc.hpackDec.dynamicTable)
+	}
+
+	cc.mu.Lock()
+	if f.PromisedStreamID%2 != 0 || f.PromisedStreamID <= cc.lastPromisedID {
+		cc.mu.Unlock()
+		return connError(ErrCodeProtocol, "PUSH_PROMISE for stream %d, which isn't a new server stream", f.PromisedStreamID)
+	}
+	cc.lastPromisedID = f.PromisedStreamID
+	if f.StreamID%2 == 0 || f.StreamID >= cc.nextStreamID {
+		cc.mu.Unlock()
+		return connError(ErrCodeProtocol, "PUSH_PROMISE on stream %d, which we didn't open", f.StreamID)
+	}
+	refuse := func(code uint32, reason string) error {
+		cc.mu.Unlock()
+		return StreamError{StreamID: f.PromisedStreamID, Code: code, Reason: reason}
+	}
+	if cc.streams[f.StreamID] == nil {
+		// We gave up on the request the push belongs to.
+		return refuse(ErrCodeCancel, "push for a closed stream")
+	}
+	req, err := promisedRequest(headers)
+	if err != nil {
+		// RFC 9113 Section 8.4.1 makes this a stream error on the
+		// promised stream.
+		return refuse(ErrCodeProtocol, err.Error())
+	}
+	key := pushKey(headers)
+	if _, dup := cc.pushes[key]; dup || len(cc.pushes) >= maxPushedStreams {
+		return refuse(ErrCodeRefusedStream, "push not wanted")
+	}
+	s := &stream{
+		id:          f.PromisedStreamID,
+		pushed:      true,
+		headersDone: make(chan struct{}),
+		sentEnd:     true, // we never send on a pushed stream
+		recvWindow:  initialWindowSize,
+	}
+	cc.streams[s.id] = s
+	cc.pushes[key] = s
+	onPush := cc.onPush
+	cc.mu.Unlock()
+
+	if onPush != nil {
+		onPush(req)
+	}
+	return nil
+}
+
+// promisedRequest checks the request of a PUSH_PROMISE and turns it into an
+// http.Request. Only safe, cacheable requests may be pushed, and those never
+// have a body.
+func promisedRequest(headers []HeaderField) (*http.Request, error) {
+	method := headerValue(headers, ":method")
+	scheme := headerValue(headers, ":scheme")
+	authority := headerValue(headers, ":authority")
+	path := headerValue(headers, ":path")
+	if method != http.MethodGet && method != http.MethodHead {
+		return nil, errors.New("pushed request isn't a GET or HEAD")
+	}
+	if scheme == "" || authority == "" || path == "" {
+		return nil, errors.New("pushed request is missing a pseudo-header")
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme, u.Host = scheme, authority
+	req := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+		Host:       authority,
+		Body:       http.NoBody,
+	}
+	for _, h := range headers {
+		if !strings.HasPrefix(h.Name, ":") {
+			req.Header.Add(http.CanonicalHeaderKey(h.Name), h.Value)
+		}
+	}
+	return req, nil
+}
+
+// pushKey is what a pushed response is filed under: the method and URL of
+// its request. Our connections are per host, so a server can't answer for
+// another host's URLs this way; a push for one is simply never claimed.
+func pushKey(headers []HeaderField) string {
+	return headerValue(headers, ":method") + " " + headerValue(headers, ":scheme") + "://" +
+		headerValue(headers, ":authority") + headerValue(headers, ":path")
+}
+
+// claimPush returns the pushed stream that answers req, if there is one.
+// Pushes the server reset are dropped, so the request goes out as usual.
+func (cc *clientConn) claimPush(req *http.Request) *stream {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return nil
+	}
+	key := pushKey(requestHeaders(req))
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	s := cc.pushes[key]
+	if s == nil {
+		return nil
+	}
+	delete(cc.pushes, key)
+	if s.err != nil {
+		return nil
+	}
+	return s
+}
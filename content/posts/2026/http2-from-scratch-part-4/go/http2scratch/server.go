@@ -0,0 +1,292 @@
+package http2scratch
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxConcurrentStreams is how many streams a client may have open at
+// once unless Server.MaxConcurrentStreams says otherwise.
+const defaultMaxConcurrentStreams = 100
+
+// defaultHandshakeTimeout is how long a new connection has to finish its
+// handshake unless Server.HandshakeTimeout says otherwise.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// shutdownPollInterval is how often Shutdown checks whether every
+// connection has finished.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Server serves HTTP/2, built on the same frame parser and HPACK codec as
+// the client. It speaks HTTP/2 over TLS, negotiated with ALPN, and
+// cleartext HTTP/2 with prior knowledge, where the client sends the
+// connection preface straight away. Each stream becomes a call to Handler.
+type Server struct {
+	Addr    string
+	Handler http.Handler
+
+	// TLSConfig optionally provides the TLS configuration used by ServeTLS
+	// and ListenAndServeTLS.
+	TLSConfig *tls.Config
+	// MaxConcurrentStreams limits the streams a client may have open on one
+	// connection. Zero means defaultMaxConcurrentStreams.
+	MaxConcurrentStreams uint32
+	// HandshakeTimeout limits how long a new connection may take to finish
+	// the TLS handshake and send its preface and first SETTINGS frame.
+	// Zero means defaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// IdleTimeout, if set, is how long a connection may have no open
+	// streams before the server sends GOAWAY and closes it.
+	IdleTimeout time.Duration
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	inShutdown atomic.Bool
+}
+
+// ListenAndServe listens on s.Addr and serves cleartext HTTP/2 with prior
+// knowledge, e.g. curl --http2-prior-knowledge.
+func (s *Server) ListenAndServe() error {
+	if s.inShutdown.Load() {
+		return http.ErrServerClosed
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS listens on s.Addr and serves HTTP/2 over TLS using the
+// given certificate and key files. See ServeTLS.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if s.inShutdown.Load() {
+		return http.ErrServerClosed
+	}
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS wraps l in TLS and serves connections on it. The certificate
+// comes from certFile and keyFile, which can be left empty if s.TLSConfig
+// already has Certificates or GetCertificate set. The server advertises
+// "h2" using ALPN, and clients that don't pick it are turned away.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := s.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if !slices.Contains(config.NextProtos, "h2") {
+		config.NextProtos = append([]string{"h2"}, config.NextProtos...)
+	}
+
+	hasCert := len(config.Certificates) > 0 || config.GetCertificate != nil
+	if !hasCert || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return s.Serve(tls.NewListener(l, config))
+}
+
+// Serve accepts connections on l and serves each one in a new goroutine. It
+// always returns a non-nil error. After Shutdown or Close, the error is
+// http.ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return http.ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.inShutdown.Load() {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves HTTP/2 on a single connection and closes it when done.
+// A TLS connection must negotiate "h2" with ALPN; anything else is expected
+// to start with the HTTP/2 connection preface.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.serveConn(conn, nil, nil)
+}
+
+// ServeH2C takes over a connection that was upgraded from HTTP/1.1 with
+// "Upgrade: h2c" (RFC 7540 Section 3.2). upgrade is the request that asked
+// for the switch, with its body already read, and it's answered on stream
+// 1. settings is the decoded HTTP2-Settings header. The signature matches
+// the H2C hook of the HTTP/1.1 server from the earlier posts.
+func (s *Server) ServeH2C(conn net.Conn, upgrade *http.Request, settings []byte) {
+	s.serveConn(conn, upgrade, settings)
+}
+
+func (s *Server) serveConn(conn net.Conn, upgrade *http.Request, settings []byte) {
+	defer conn.Close()
+	// Track the connection straight away, so Close and Shutdown can reach
+	// one that is still in its handshake.
+	sc := newServerConn(s, conn)
+	if !s.trackConn(sc, true) {
+		return
+	}
+	defer s.trackConn(sc, false)
+
+	// serve clears the deadline once the client's SETTINGS arrive.
+	conn.SetDeadline(time.Now().Add(s.handshakeTimeout()))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			slog.Error(fmt.Sprintf("http2: TLS handshake error from %s: %s", conn.RemoteAddr(), err))
+			return
+		}
+		if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+			slog.Error(fmt.Sprintf("http2: client %s did not negotiate h2 (got %q)", conn.RemoteAddr(), proto))
+			return
+		}
+	}
+
+	err := sc.serve(upgrade, settings)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		slog.Error(fmt.Sprintf("http2: connection from %s: %s", conn.RemoteAddr(), err))
+	}
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners and
+// sends every connection GOAWAY, so clients stop opening streams, then
+// waits for the streams already open to finish. Connections still in their
+// handshake are closed. If ctx expires first, Shutdown returns the
+// context's error and the remaining connections are left to finish on
+// their own.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	err := s.closeListeners()
+
+	s.mu.Lock()
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+	for _, sc := range conns {
+		sc.startShutdown()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		done := len(s.conns) == 0
+		s.mu.Unlock()
+		if done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes all listeners and connections immediately. Requests still
+// in flight fail.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+	err := s.closeListeners()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sc := range s.conns {
+		sc.conn.Close()
+	}
+	return err
+}
+
+func (s *Server) handler() http.Handler {
+	if s.Handler == nil {
+		return http.DefaultServeMux
+	}
+	return s.Handler
+}
+
+func (s *Server) maxConcurrentStreams() uint32 {
+	if s.MaxConcurrentStreams > 0 {
+		return s.MaxConcurrentStreams
+	}
+	return defaultMaxConcurrentStreams
+}
+
+func (s *Server) handshakeTimeout() time.Duration {
+	if s.HandshakeTimeout > 0 {
+		return s.HandshakeTimeout
+	}
+	return defaultHandshakeTimeout
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.inShutdown.Load() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(sc *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	if add {
+		if s.inShutdown.Load() {
+			return false
+		}
+		s.conns[sc] = struct{}{}
+	} else {
+		delete(s.conns, sc)
+	}
+	return true
+}
@@ -0,0 +1,615 @@
+package http2scratch
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1 in
+// memory, so the tests don't need any files.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"kmcd.dev test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// startServer runs s over TLS on a random port and returns its URL and a
+// client that trusts it.
+func startServer(t *testing.T, s *Server) (string, *Client) {
+	t.Helper()
+	cert, pool := newTestCertificate(t)
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTLS(l, "", "")
+	t.Cleanup(func() { s.Close() })
+
+	client := NewClient()
+	client.TLSConfig = &tls.Config{RootCAs: pool}
+	t.Cleanup(func() { client.Close() })
+	return "https://" + l.Addr().String(), client
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Trailer", "X-Request-Trailer")
+	w.Header().Set("X-Method", r.Method)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "%s %s %s", r.Proto, r.URL.RequestURI(), body)
+	w.Header().Set("X-Request-Trailer", r.Trailer.Get("X-Checksum"))
+}
+
+func TestServerWithOurClient(t *testing.T) {
+	url, client := startServer(t, &Server{Handler: http.HandlerFunc(echoHandler)})
+
+	req, _ := http.NewRequest(http.MethodPost, url+"/echo?x=1", strings.NewReader("hello"))
+	req.Trailer = http.Header{"X-Checksum": {"abc"}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "HTTP/2.0 /echo?x=1 hello"; string(body) != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+	if got := resp.Header.Get("X-Method"); got != http.MethodPost {
+		t.Errorf("got X-Method %q, want POST", got)
+	}
+	if got := resp.Trailer.Get("X-Request-Trailer"); got != "abc" {
+		t.Errorf("got trailer %q, want %q", got, "abc")
+	}
+}
+
+func TestServerConcurrentStreams(t *testing.T) {
+	// Every handler waits for all of them, so this only finishes if the
+	// server really runs the streams of one connection concurrently.
+	const n = 10
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	url, client := startServer(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		io.WriteString(w, r.URL.Path)
+	})})
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/%d", i)
+			req, _ := http.NewRequest(http.MethodGet, url+path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != path {
+				t.Errorf("got %q, want %q", body, path)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerLargeBodies(t *testing.T) {
+	// Both directions are far beyond the initial flow-control windows.
+	const size = 1 << 20
+	url, client := startServer(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})})
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("got %d bytes back, want the %d sent", len(body), len(payload))
+	}
+}
+
+func TestServerWithNetHTTP(t *testing.T) {
+	cert, pool := newTestCertificate(t)
+	s := &Server{
+		Handler:   http.HandlerFunc(echoHandler),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	tlsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeTLS(tlsListener, "", "")
+	plainListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(plainListener)
+	defer s.Close()
+
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+	tests := []struct {
+		name      string
+		url       string
+		transport *http.Transport
+	}{
+		{"TLS", "https://" + tlsListener.Addr().String(), &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		}},
+		{"h2c prior knowledge", "http://" + plainListener.Addr().String(), &http.Transport{Protocols: &h2c}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.transport.CloseIdleConnections()
+			client := &http.Client{Transport: tt.transport}
+			resp, err := client.Post(tt.url+"/upload", "text/plain", strings.NewReader("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0 /upload data" {
+				t.Errorf("got %s with body %q", resp.Proto, body)
+			}
+			if _, ok := resp.Trailer["X-Request-Trailer"]; !ok {
+				t.Errorf("got trailers %v, want X-Request-Trailer", resp.Trailer)
+			}
+		})
+	}
+}
+
+func TestServerResponses(t *testing.T) {
+	url, client := startServer(t, &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/html":
+			io.WriteString(w, "<html><body>hi</body></html>")
+		case "/streamed":
+			io.WriteString(w, "part one,")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "part two")
+		case "/panic":
+			panic(http.ErrAbortHandler)
+		}
+	})})
+
+	tests := []struct {
+		path, method  string
+		status        int
+		contentType   string
+		contentLength int64
+		body          string
+	}{
+		{"/no-content", http.MethodGet, http.StatusNoContent, "", -1, ""},
+		{"/html", http.MethodGet, http.StatusOK, "text/html; charset=utf-8", 28, "<html><body>hi</body></html>"},
+		{"/html", http.MethodHead, http.StatusOK, "", -1, ""},
+		{"/streamed", http.MethodGet, http.StatusOK, "text/plain; charset=utf-8", -1, "part one,part two"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, url+tt.path, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || string(body) != tt.body {
+				t.Errorf("got %s with body %q, want %d with %q", resp.Status, body, tt.status, tt.body)
+			}
+			if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.contentType)
+			}
+			if resp.ContentLength != tt.contentLength {
+				t.Errorf("got Content-Length %d, want %d", resp.ContentLength, tt.contentLength)
+			}
+		})
+	}
+
+	// A panicking handler only resets its own stream.
+	req, _ := http.NewRequest(http.MethodGet, url+"/panic", nil)
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+		t.Error("request to a panicking handler succeeded")
+	}
+	req, _ = http.NewRequest(http.MethodGet, url+"/html", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("connection unusable after a panic: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "done")
+	})}
+	url, client := startServer(t, s)
+
+	result := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, url+"/slow", nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			var body []byte
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && string(body) != "done" {
+				err = fmt.Errorf("got body %q", body)
+			}
+		}
+		result <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// The GOAWAY stops the client from opening new streams on the
+	// connection, so it dials again, and the listener is gone.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, _ := http.NewRequest(http.MethodGet, url+"/fast", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepts requests after Shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v while a request was in flight", err)
+	default:
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe,
+// writes are buffered, so either side can write without the other reading.
+func tcpPipe(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+// rawConn speaks HTTP/2 frame by frame, for tests that need to send what a
+// well-behaved client wouldn't.
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+	fr   *FrameReader
+	enc  *HPACKEncoder
+	dec  *HPACKDecoder
+}
+
+func newRawConn(t *testing.T, conn net.Conn) *rawConn {
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &rawConn{t: t, conn: conn, fr: NewFrameReader(conn), enc: NewHPACKEncoder(4096), dec: NewHPACKDecoder(4096)}
+}
+
+func (c *rawConn) write(frameType, flags uint8, streamID uint32, payload []byte) {
+	if err := WriteFrame(c.conn, frameType, flags, streamID, payload); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// readUntil reads frames until one of type frameType arrives.
+func (c *rawConn) readUntil(frameType uint8) TypedFrame {
+	c.t.Helper()
+	for {
+		f, err := c.fr.ReadFrame()
+		if err != nil {
+			c.t.Fatalf("waiting for frame type %d: %v", frameType, err)
+		}
+		if h, ok := f.(*HeadersFrame); ok {
+			if _, err := c.dec.Decode(h.HeaderBlock); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		if f.Header().Type == frameType {
+			return f
+		}
+	}
+}
+
+func TestServerProtocolErrors(t *testing.T) {
+	request := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/"},
+	}
+	tests := []struct {
+		name string
+		send func(c *rawConn)
+		// Either a connection error, answered with GOAWAY, or a stream
+		// error, answered with RST_STREAM on stream 1.
+		goAway bool
+		code   uint32
+	}{
+		{"even stream ID", func(c *rawConn) {
+			c.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 2, c.enc.Encode(request))
+		}, true, ErrCodeProtocol},
+		{"DATA on an idle stream", func(c *rawConn) {
+			c.write(FrameData, 0, 5, []byte("x"))
+		}, true, ErrCodeProtocol},
+		{"garbage header block", func(c *rawConn) {
+			c.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		}, true, ErrCodeCompression},
+		{"missing :path", func(c *rawConn) {
+			c.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, c.enc.Encode(request[:3]))
+		}, false, ErrCodeProtocol},
+		{"connection-specific header", func(c *rawConn) {
+			fields := append(request, HeaderField{Name: "connection", Value: "keep-alive"})
+			c.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, c.enc.Encode(fields))
+		}, false, ErrCodeProtocol},
+		{"uppercase header name", func(c *rawConn) {
+			fields := append(request, HeaderField{Name: "X-Upper", Value: "1"})
+			c.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, c.enc.Encode(fields))
+		}, false, ErrCodeProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := tcpPipe(t)
+			s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+			go s.ServeConn(server)
+			c := newRawConn(t, client)
+			io.WriteString(client, Preface)
+			c.readUntil(FrameSettings)
+			c.write(FrameSettings, 0, 0, nil)
+			tt.send(c)
+
+			if tt.goAway {
+				f := c.readUntil(FrameGoAway).(*GoAwayFrame)
+				if f.ErrCode != tt.code {
+					t.Errorf("got GOAWAY %s, want %s", ErrCodeName(f.ErrCode), ErrCodeName(tt.code))
+				}
+				return
+			}
+			f := c.readUntil(FrameRstStream).(*RSTStreamFrame)
+			if f.StreamID != 1 || f.ErrCode != tt.code {
+				t.Errorf("got RST_STREAM %s on stream %d, want %s on stream 1", ErrCodeName(f.ErrCode), f.StreamID, ErrCodeName(tt.code))
+			}
+		})
+	}
+}
+
+func TestServeH2C(t *testing.T) {
+	client, server := tcpPipe(t)
+	s := &Server{Handler: http.HandlerFunc(echoHandler)}
+	upgrade, _ := http.NewRequest(http.MethodPost, "/upgraded", strings.NewReader("from HTTP/1.1"))
+	upgrade.Header.Set("Upgrade", "h2c")
+	upgrade.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	settings := binary.BigEndian.AppendUint16(nil, SettingsInitialWindowSize)
+	settings = binary.BigEndian.AppendUint32(settings, 1<<20)
+	go s.ServeH2C(server, upgrade, settings)
+
+	c := newRawConn(t, client)
+	io.WriteString(client, Preface)
+	c.write(FrameSettings, 0, 0, nil)
+
+	// The upgrade request is answered on stream 1 without the client
+	// having to send anything more.
+	var status string
+	var body []byte
+	for {
+		f, err := c.fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Header().StreamID != 1 {
+			continue
+		}
+		switch f := f.(type) {
+		case *HeadersFrame:
+			headers, err := c.dec.Decode(f.HeaderBlock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status == "" {
+				status = headerValue(headers, ":status")
+			}
+		case *DataFrame:
+			body = append(body, f.Data...)
+		}
+		if f.Header().Has(FlagEndStream) {
+			break
+		}
+	}
+	if want := "HTTP/2.0 /upgraded from HTTP/1.1"; status != "200" || string(body) != want {
+		t.Errorf("got status %s with body %q, want 200 with %q", status, body, want)
+	}
+}
+
+func TestShutdownIdleServer(t *testing.T) {
+	s := &Server{}
+	startServer(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(nil); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Serve after Shutdown returned %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+// expectClosed reads from conn until the server closes it, failing the test
+// if that takes more than two seconds.
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("server didn't close the connection")
+	}
+}
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	t.Run("TLS", func(t *testing.T) {
+		// Connect, then never start the TLS handshake.
+		url, _ := startServer(t, &Server{HandshakeTimeout: 100 * time.Millisecond})
+		conn, err := net.Dial("tcp", strings.TrimPrefix(url, "https://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		expectClosed(t, conn)
+	})
+	t.Run("preface", func(t *testing.T) {
+		// Send the preface but no SETTINGS.
+		client, server := tcpPipe(t)
+		s := &Server{HandshakeTimeout: 100 * time.Millisecond}
+		go s.ServeConn(server)
+		defer client.Close()
+		io.WriteString(client, Preface)
+		expectClosed(t, client)
+	})
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	client, server := tcpPipe(t)
+	s := &Server{
+		Handler:     http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	go s.ServeConn(server)
+	c := newRawConn(t, client)
+	io.WriteString(client, Preface)
+	c.readUntil(FrameSettings)
+	c.write(FrameSettings, 0, 0, nil)
+	c.write(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, c.enc.Encode([]HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/"},
+	}))
+
+	// Once the only stream is done, the connection is idle.
+	f := c.readUntil(FrameGoAway).(*GoAwayFrame)
+	if f.LastStreamID != 1 || f.ErrCode != ErrCodeNo {
+		t.Errorf("got GOAWAY %s with last stream %d, want NO_ERROR with last stream 1", ErrCodeName(f.ErrCode), f.LastStreamID)
+	}
+	expectClosed(t, client)
+}
+
+func TestShutdownClosesHandshakingConn(t *testing.T) {
+	s := &Server{}
+	url, _ := startServer(t, s)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Wait for the server to pick up the connection.
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn)
+}
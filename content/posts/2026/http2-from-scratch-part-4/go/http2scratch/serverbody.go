@@ -0,0 +1,264 @@
+package http2scratch
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responseBufferSize is how much of a response body is held back before
+// it's sent as DATA. If the whole body fits, the response also gets a
+// Content-Length.
+const responseBufferSize = 16 << 10
+
+var errReadOnClosedBody = errors.New("http2: read on closed request body")
+
+// requestBody streams a request body to the handler as its DATA frames
+// arrive, handing the flow-control windows back as it's read.
+type requestBody struct {
+	sc *serverConn
+	st *serverStream
+	// trailer is the request's Trailer map, filled in once the body has
+	// been read to the end.
+	trailer http.Header
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	sc, st := b.sc, b.st
+	sc.mu.Lock()
+	for st.body.Len() == 0 && !st.ended && st.err == nil && !st.bodyClosed {
+		sc.cond.Wait()
+	}
+	if st.bodyClosed {
+		sc.mu.Unlock()
+		return 0, errReadOnClosedBody
+	}
+	if st.body.Len() == 0 {
+		err := st.err
+		if err == nil {
+			err = io.EOF
+			b.setTrailersLocked()
+		}
+		sc.mu.Unlock()
+		return 0, err
+	}
+	n, _ := st.body.Read(p)
+	sc.recvCredit += int64(n)
+	st.recvCredit += int64(n)
+	connUpdate := sc.takeConnCreditLocked()
+	streamUpdate := sc.takeStreamCreditLocked(st)
+	sc.mu.Unlock()
+
+	sc.sendWindowUpdates(connUpdate, st, streamUpdate)
+	return n, nil
+}
+
+func (b *requestBody) setTrailersLocked() {
+	if b.trailer == nil || b.st.trailers == nil {
+		return
+	}
+	for _, h := range b.st.trailers {
+		if !strings.HasPrefix(h.Name, ":") {
+			b.trailer.Add(http.CanonicalHeaderKey(h.Name), h.Value)
+		}
+	}
+	b.st.trailers = nil
+}
+
+// Close discards the rest of the body. Anything still buffered or yet to
+// arrive goes straight back into the flow-control windows, so the client
+// isn't left stuck.
+func (b *requestBody) Close() error {
+	sc, st := b.sc, b.st
+	sc.mu.Lock()
+	if st.bodyClosed {
+		sc.mu.Unlock()
+		return nil
+	}
+	st.bodyClosed = true
+	n := int64(st.body.Len())
+	st.body.Reset()
+	sc.recvCredit += n
+	st.recvCredit += n
+	connUpdate := sc.takeConnCreditLocked()
+	streamUpdate := sc.takeStreamCreditLocked(st)
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	sc.sendWindowUpdates(connUpdate, st, streamUpdate)
+	return nil
+}
+
+// responseWriter is the http.ResponseWriter for one stream. The first
+// responseBufferSize bytes of the body are buffered, and the HEADERS frame
+// goes out when the buffer fills up, the handler flushes, or it returns.
+type responseWriter struct {
+	sc  *serverConn
+	st  *serverStream
+	req *http.Request
+
+	header      http.Header
+	status      int  // set by WriteHeader
+	sentHeaders bool // the HEADERS frame was sent
+	buf         []byte
+	err         error // a failed write, returned from every write after it
+}
+
+func newResponseWriter(sc *serverConn, st *serverStream, req *http.Request) *responseWriter {
+	return &responseWriter{sc: sc, st: st, req: req, header: make(http.Header)}
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader sets the response status. Informational responses (1xx) are
+// sent right away, and the handler can still send the final one after.
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		headers := append([]HeaderField{{Name: ":status", Value: strconv.Itoa(code)}}, w.headerFields(false)...)
+		w.fail(w.sc.writeHeaders(w.st, headers, false))
+		return
+	}
+	w.status = code
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.bodyAllowed() {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if w.req.Method == http.MethodHead {
+		// The handler doesn't have to care, the body just isn't sent.
+		return len(p), nil
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= responseBufferSize {
+		w.Flush()
+	}
+	return len(p), w.err
+}
+
+// Flush sends the response headers, if they haven't gone out yet, and
+// everything buffered.
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		return
+	}
+	if !w.sentHeaders {
+		w.fail(w.sendHeaders(false, -1))
+	}
+	if len(w.buf) > 0 && w.err == nil {
+		w.fail(w.sc.writeData(w.st, w.buf, false))
+		w.buf = w.buf[:0]
+	}
+}
+
+// finish ends the stream once the handler has returned: with the last of
+// the body, or with the trailers if there are any.
+func (w *responseWriter) finish() error {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	trailers := w.headerFields(true)
+	endWithData := len(trailers) == 0
+	if !w.sentHeaders {
+		// The handler is done, so if the body is still in the buffer,
+		// its length is known.
+		contentLength := int64(-1)
+		if w.bodyAllowed() && w.req.Method != http.MethodHead {
+			contentLength = int64(len(w.buf))
+		}
+		endWithHeaders := endWithData && len(w.buf) == 0
+		if err := w.sendHeaders(endWithHeaders, contentLength); err != nil {
+			return err
+		}
+		if endWithHeaders {
+			w.sc.markSentEnd(w.st)
+			return nil
+		}
+	}
+	if len(w.buf) > 0 || endWithData {
+		if err := w.sc.writeData(w.st, w.buf, endWithData); err != nil {
+			return err
+		}
+	}
+	if !endWithData {
+		if err := w.sc.writeHeaders(w.st, trailers, true); err != nil {
+			return err
+		}
+	}
+	w.sc.markSentEnd(w.st)
+	return nil
+}
+
+func (w *responseWriter) fail(err error) {
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// bodyAllowed reports whether the status allows a response body (RFC 9110
+// Section 6.4.1).
+func (w *responseWriter) bodyAllowed() bool {
+	return w.status != http.StatusNoContent && w.status != http.StatusNotModified
+}
+
+// sendHeaders sends the response headers. contentLength is added as
+// Content-Length if it's known and the handler didn't set one.
+func (w *responseWriter) sendHeaders(endStream bool, contentLength int64) error {
+	if _, ok := w.header["Content-Type"]; !ok && len(w.buf) > 0 {
+		w.header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if _, ok := w.header["Content-Length"]; !ok && contentLength >= 0 {
+		w.header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	headers := append([]HeaderField{{Name: ":status", Value: strconv.Itoa(w.status)}}, w.headerFields(false)...)
+	w.sentHeaders = true
+	return w.sc.writeHeaders(w.st, headers, endStream)
+}
+
+// headerFields converts the header map to lowercase fields, leaving out
+// what HTTP/2 doesn't allow. With trailers set it returns the trailers
+// instead: the values of the names announced in the Trailer header, plus
+// anything set with http.TrailerPrefix.
+func (w *responseWriter) headerFields(trailers bool) []HeaderField {
+	announced := make(map[string]bool)
+	for _, value := range w.header.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			announced[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	var fields []HeaderField
+	for name, values := range w.header {
+		isTrailer := announced[name] || strings.HasPrefix(name, http.TrailerPrefix)
+		if isTrailer != trailers {
+			continue
+		}
+		name = strings.ToLower(strings.TrimPrefix(name, http.TrailerPrefix))
+		switch name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			continue
+		}
+		for _, value := range values {
+			fields = append(fields, HeaderField{Name: name, Value: value})
+		}
+	}
+	return fields
+}
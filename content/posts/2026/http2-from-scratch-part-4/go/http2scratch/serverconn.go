@@ -0,0 +1,820 @@
+package http2scratch
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shutdownPing is the payload of the PING sent with the first GOAWAY of a
+// graceful shutdown. Its ACK means the client has seen the GOAWAY.
+var shutdownPing = [8]byte{'s', 'h', 'u', 't', 'd', 'o', 'w', 'n'}
+
+// serverConn is a single HTTP/2 connection accepted by Server. As with
+// clientConn, one goroutine reads frames and hands them to the stream they
+// belong to. Every stream's handler runs in its own goroutine and writes
+// its own frames.
+type serverConn struct {
+	srv  *Server
+	conn net.Conn
+	// ctx is the parent of every request's context. It's cancelled when
+	// the connection closes.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// fr and hpackDec are only used by the read loop.
+	fr       *FrameReader
+	hpackDec *HPACKDecoder
+
+	// writeMu serializes frames and guards the HPACK encoder.
+	writeMu  sync.Mutex
+	hpackEnc *HPACKEncoder
+
+	mu sync.Mutex
+	// cond is broadcast whenever the state of the connection or one of its
+	// streams changes, just like clientConn.cond.
+	cond         *sync.Cond
+	streams      map[uint32]*serverStream
+	lastStreamID uint32 // the highest stream ID the client has opened
+	maxFrameSize uint32 // the client's SETTINGS_MAX_FRAME_SIZE
+	started      bool   // serve is running; the TLS handshake is done
+	shuttingDown bool   // the first GOAWAY of a graceful shutdown was sent
+	goAway       bool   // the final GOAWAY was sent; no more new streams
+	err          error  // set once the connection is unusable
+
+	// Connection-level flow control, as in clientConn.
+	sendWindow        int64
+	recvWindow        int64
+	recvCredit        int64
+	peerInitialWindow int64
+
+	// idleTimer closes the connection once it has had no streams for
+	// Server.IdleTimeout. It's nil if there is no IdleTimeout.
+	idleTimer *time.Timer
+}
+
+// serverStream is a single request and its response. Everything but id,
+// ctx and cancel is guarded by serverConn.mu.
+type serverStream struct {
+	id     uint32
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	body       bytes.Buffer // DATA received but not read yet
+	bodyClosed bool         // the handler closed the request body
+	trailers   []HeaderField
+	ended      bool  // the client sent END_STREAM
+	sentEnd    bool  // we sent END_STREAM or RST_STREAM
+	err        error // why the stream was reset, if it was
+
+	sendWindow int64
+	recvWindow int64
+	recvCredit int64
+}
+
+func newServerConn(srv *Server, conn net.Conn) *serverConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	sc := &serverConn{
+		srv:               srv,
+		conn:              conn,
+		ctx:               ctx,
+		cancel:            cancel,
+		fr:                NewFrameReader(conn),
+		hpackDec:          NewHPACKDecoder(headerTableSize),
+		hpackEnc:          NewHPACKEncoder(headerTableSize),
+		streams:           make(map[uint32]*serverStream),
+		maxFrameSize:      defaultMaxFrameSize,
+		sendWindow:        initialWindowSize,
+		recvWindow:        initialWindowSize,
+		peerInitialWindow: initialWindowSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+// serve runs the connection until it fails or shuts down. For an h2c
+// upgrade, upgrade and settings come from the HTTP/1.1 request.
+func (sc *serverConn) serve(upgrade *http.Request, settings []byte) error {
+	defer sc.fail(errConnClosed)
+	sc.mu.Lock()
+	sc.started = true
+	if idle := sc.srv.IdleTimeout; idle > 0 {
+		sc.idleTimer = time.AfterFunc(idle, sc.closeIdle)
+	}
+	sc.mu.Unlock()
+
+	// The server's connection preface is a SETTINGS frame, and it may send
+	// it before the client's preface arrives.
+	var payload []byte
+	payload = binary.BigEndian.AppendUint16(payload, SettingsMaxConcurrentStreams)
+	payload = binary.BigEndian.AppendUint32(payload, sc.srv.maxConcurrentStreams())
+	if err := sc.writeFrame(FrameSettings, 0, 0, payload); err != nil {
+		return err
+	}
+
+	if upgrade != nil {
+		f, err := parseSettings(FrameHeader{Type: FrameSettings}, settings)
+		if err != nil {
+			return err
+		}
+		// These settings count as acknowledged by the 101 response.
+		if err := sc.applySettings(f); err != nil {
+			return err
+		}
+		sc.startUpgradeStream(upgrade)
+	}
+
+	preface := make([]byte, len(Preface))
+	if _, err := io.ReadFull(sc.conn, preface); err != nil {
+		return fmt.Errorf("reading preface: %w", err)
+	}
+	if string(preface) != Preface {
+		return connError(ErrCodeProtocol, "invalid connection preface")
+	}
+	frame, err := sc.fr.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if f, ok := frame.(*SettingsFrame); !ok || f.Has(FlagAck) {
+		return connError(ErrCodeProtocol, "expected SETTINGS after the preface, got frame type %d", frame.Header().Type)
+	}
+	if err := sc.handleFrame(frame); err != nil {
+		return err
+	}
+	sc.conn.SetDeadline(time.Time{})
+	return sc.readLoop()
+}
+
+// readLoop reads frames until the connection fails, handling errors the
+// same way as clientConn.readLoop.
+func (sc *serverConn) readLoop() error {
+	for {
+		frame, err := sc.fr.ReadFrame()
+		if err == nil {
+			err = sc.handleFrame(frame)
+		}
+		var streamErr StreamError
+		if errors.As(err, &streamErr) {
+			sc.resetStreamID(streamErr.StreamID, streamErr.Code, streamErr)
+			continue
+		}
+		if err != nil {
+			var connErr ConnectionError
+			if errors.As(err, &connErr) {
+				sc.mu.Lock()
+				last := sc.lastStreamID
+				sc.mu.Unlock()
+				payload := binary.BigEndian.AppendUint32(nil, last)
+				sc.writeFrame(FrameGoAway, 0, 0, binary.BigEndian.AppendUint32(payload, connErr.Code))
+			}
+			return err
+		}
+	}
+}
+
+func (sc *serverConn) handleFrame(frame TypedFrame) error {
+	switch f := frame.(type) {
+	case *SettingsFrame:
+		if f.Has(FlagAck) {
+			return nil
+		}
+		if err := sc.applySettings(f); err != nil {
+			return err
+		}
+		return sc.writeFrame(FrameSettings, FlagAck, 0, nil)
+	case *PingFrame:
+		if !f.Has(FlagAck) {
+			return sc.writeFrame(FramePing, FlagAck, 0, f.Data[:])
+		}
+		if f.Data == shutdownPing {
+			sc.finishShutdown()
+		}
+	case *HeadersFrame:
+		return sc.handleHeaders(f)
+	case *DataFrame:
+		return sc.handleData(f)
+	case *RSTStreamFrame:
+		sc.mu.Lock()
+		if st := sc.streams[f.StreamID]; st != nil {
+			st.sentEnd = true // nothing more may be sent on it
+			sc.endStreamLocked(st, fmt.Errorf("stream %d reset by client: %s", st.id, ErrCodeName(f.ErrCode)))
+		} else if f.StreamID > sc.lastStreamID {
+			sc.mu.Unlock()
+			return connError(ErrCodeProtocol, "RST_STREAM for idle stream %d", f.StreamID)
+		}
+		sc.mu.Unlock()
+	case *WindowUpdateFrame:
+		return sc.handleWindowUpdate(f)
+	case *GoAwayFrame:
+		// The client won't open any more streams. The ones it has can
+		// finish, and the connection closes when it's done with them.
+	case *PushPromiseFrame:
+		return connError(ErrCodeProtocol, "client sent PUSH_PROMISE")
+	}
+	return nil
+}
+
+// applySettings applies the client's settings. The parser already rejected
+// values out of range.
+func (sc *serverConn) applySettings(f *SettingsFrame) error {
+	tableSize := int64(-1)
+	sc.mu.Lock()
+	for _, setting := range f.Settings {
+		switch setting.ID {
+		case SettingsHeaderTableSize:
+			tableSize = int64(min(setting.Value, headerTableSize))
+		case SettingsInitialWindowSize:
+			delta := int64(setting.Value) - sc.peerInitialWindow
+			sc.peerInitialWindow = int64(setting.Value)
+			for _, st := range sc.streams {
+				if st.sendWindow+delta > maxWindowSize {
+					sc.mu.Unlock()
+					return connError(ErrCodeFlowControl, "flow-control window overflow on stream %d", st.id)
+				}
+				st.sendWindow += delta
+			}
+		case SettingsMaxFrameSize:
+			sc.maxFrameSize = setting.Value
+		}
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	if tableSize >= 0 {
+		sc.writeMu.Lock()
+		if uint32(tableSize) != sc.hpackEnc.dynamicTable.maxSize {
+			sc.hpackEnc.SetMaxDynamicTableSize(uint32(tableSize))
+		}
+		sc.writeMu.Unlock()
+	}
+	return nil
+}
+
+// handleHeaders opens a new stream and starts its handler, or takes the
+// trailers of one that's already open.
+func (sc *serverConn) handleHeaders(f *HeadersFrame) error {
+	// Even a block we're going to ignore has to be decoded, to keep the
+	// HPACK state in sync.
+	headers, err := sc.hpackDec.Decode(f.HeaderBlock)
+	if err != nil {
+		return connError(ErrCodeCompression, "hpack: %v", err)
+	}
+	endStream := f.Has(FlagEndStream)
+
+	sc.mu.Lock()
+	if st := sc.streams[f.StreamID]; st != nil {
+		defer sc.mu.Unlock()
+		switch {
+		case st.ended:
+			return StreamError{StreamID: f.StreamID, Code: ErrCodeStreamClosed, Reason: "HEADERS after END_STREAM"}
+		case !endStream:
+			return StreamError{StreamID: f.StreamID, Code: ErrCodeProtocol, Reason: "trailers without END_STREAM"}
+		}
+		st.trailers = headers
+		st.ended = true
+		sc.closeStreamIfDoneLocked(st)
+		sc.cond.Broadcast()
+		return nil
+	}
+	if f.StreamID%2 == 0 || f.StreamID <= sc.lastStreamID {
+		sc.mu.Unlock()
+		return connError(ErrCodeProtocol, "HEADERS opening stream %d, which isn't a new client stream", f.StreamID)
+	}
+	sc.lastStreamID = f.StreamID
+	if sc.goAway {
+		// Sent after our final GOAWAY, so the client knows it wasn't
+		// processed and can retry it elsewhere.
+		sc.mu.Unlock()
+		return nil
+	}
+	if uint32(len(sc.streams)) >= sc.srv.maxConcurrentStreams() {
+		sc.mu.Unlock()
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeRefusedStream, Reason: "too many concurrent streams"}
+	}
+	st := sc.newStreamLocked(f.StreamID)
+	st.ended = endStream
+	sc.mu.Unlock()
+
+	req, err := sc.newRequest(st, headers)
+	if err != nil {
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeProtocol, Reason: err.Error()}
+	}
+	go sc.runHandler(st, req)
+	return nil
+}
+
+func (sc *serverConn) newStreamLocked(id uint32) *serverStream {
+	ctx, cancel := context.WithCancel(sc.ctx)
+	st := &serverStream{
+		id:         id,
+		ctx:        ctx,
+		cancel:     cancel,
+		sendWindow: sc.peerInitialWindow,
+		recvWindow: initialWindowSize,
+	}
+	sc.streams[id] = st
+	if sc.idleTimer != nil {
+		sc.idleTimer.Stop()
+	}
+	return st
+}
+
+// startUpgradeStream answers the HTTP/1.1 request of an h2c upgrade as
+// stream 1, which starts out half-closed: the whole request has already
+// arrived (RFC 7540 Section 3.2).
+func (sc *serverConn) startUpgradeStream(upgrade *http.Request) {
+	sc.mu.Lock()
+	st := sc.newStreamLocked(1)
+	st.ended = true
+	sc.lastStreamID = 1
+	sc.mu.Unlock()
+
+	req := upgrade.Clone(st.ctx)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Header.Del("Upgrade")
+	req.Header.Del("Http2-Settings")
+	req.Header.Del("Connection")
+	go sc.runHandler(st, req)
+}
+
+// newRequest checks a request's header block (RFC 9113 Section 8.3.1) and
+// turns it into an http.Request whose body reads from st.
+func (sc *serverConn) newRequest(st *serverStream, headers []HeaderField) (*http.Request, error) {
+	pseudo := make(map[string]string)
+	header := make(http.Header)
+	var cookies []string
+	for _, hf := range headers {
+		if strings.HasPrefix(hf.Name, ":") {
+			if len(header) > 0 || len(cookies) > 0 {
+				return nil, fmt.Errorf("pseudo-header %s after regular headers", hf.Name)
+			}
+			switch hf.Name {
+			case ":method", ":scheme", ":authority", ":path":
+			default:
+				return nil, fmt.Errorf("invalid pseudo-header %s", hf.Name)
+			}
+			if _, dup := pseudo[hf.Name]; dup {
+				return nil, fmt.Errorf("duplicate pseudo-header %s", hf.Name)
+			}
+			pseudo[hf.Name] = hf.Value
+			continue
+		}
+		if hf.Name != strings.ToLower(hf.Name) {
+			return nil, fmt.Errorf("uppercase header name %q", hf.Name)
+		}
+		switch hf.Name {
+		case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+			return nil, fmt.Errorf("connection-specific header %s", hf.Name)
+		case "te":
+			if hf.Value != "trailers" {
+				return nil, errors.New(`TE header other than "trailers"`)
+			}
+		case "cookie":
+			// Cookies may be split into separate fields for better
+			// compression, and are joined back up here (RFC 9113 Section
+			// 8.2.3).
+			cookies = append(cookies, hf.Value)
+			continue
+		}
+		header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+	}
+	if len(cookies) > 0 {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+
+	method := pseudo[":method"]
+	path := pseudo[":path"]
+	authority := pseudo[":authority"]
+	if authority == "" {
+		authority = header.Get("Host")
+	}
+	var u *url.URL
+	var err error
+	if method == http.MethodConnect {
+		if authority == "" || pseudo[":scheme"] != "" || path != "" {
+			return nil, errors.New("malformed CONNECT request")
+		}
+		u = &url.URL{Host: authority}
+		path = authority
+	} else {
+		if method == "" || pseudo[":scheme"] == "" || path == "" {
+			return nil, errors.New("missing required pseudo-header")
+		}
+		if u, err = url.ParseRequestURI(path); err != nil {
+			return nil, fmt.Errorf("invalid :path %q", path)
+		}
+	}
+
+	req := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		ProtoMinor:    0,
+		Header:        header,
+		Host:          authority,
+		RequestURI:    path,
+		RemoteAddr:    sc.conn.RemoteAddr().String(),
+		ContentLength: -1,
+		Body:          http.NoBody,
+	}
+	if tlsConn, ok := sc.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+	if cl := header.Get("Content-Length"); cl != "" {
+		if req.ContentLength, err = strconv.ParseInt(cl, 10, 64); err != nil || req.ContentLength < 0 {
+			return nil, fmt.Errorf("invalid Content-Length %q", cl)
+		}
+	}
+	if st.ended {
+		req.ContentLength = 0
+	} else {
+		body := &requestBody{sc: sc, st: st}
+		if names := header.Values("Trailer"); len(names) > 0 {
+			req.Trailer = make(http.Header)
+			for _, value := range names {
+				for _, name := range strings.Split(value, ",") {
+					if name = strings.TrimSpace(name); name != "" {
+						req.Trailer[http.CanonicalHeaderKey(name)] = nil
+					}
+				}
+			}
+			body.trailer = req.Trailer
+		}
+		req.Body = body
+	}
+	return req.WithContext(st.ctx), nil
+}
+
+// runHandler serves one request and ends its stream once the handler
+// returns.
+func (sc *serverConn) runHandler(st *serverStream, req *http.Request) {
+	w := newResponseWriter(sc, st, req)
+	defer st.cancel()
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				slog.Error(fmt.Sprintf("http2: panic serving %s: %v", sc.conn.RemoteAddr(), p))
+			}
+			sc.resetStream(st, ErrCodeInternal, errors.New("handler panicked"))
+			return
+		}
+		if err := w.finish(); err != nil {
+			sc.resetStream(st, ErrCodeInternal, err)
+			return
+		}
+		sc.mu.Lock()
+		reset := !st.ended && st.err == nil
+		sc.mu.Unlock()
+		if reset {
+			// The response is complete, so the rest of the request body
+			// isn't needed (RFC 9113 Section 8.1).
+			sc.resetStream(st, ErrCodeNo, nil)
+		}
+	}()
+	sc.srv.handler().ServeHTTP(w, req)
+}
+
+// handleData buffers a DATA frame for its stream, with the same flow
+// control as clientConn.handleData.
+func (sc *serverConn) handleData(f *DataFrame) error {
+	length := int64(f.Length)
+	sc.mu.Lock()
+	if length > sc.recvWindow {
+		sc.mu.Unlock()
+		return connError(ErrCodeFlowControl, "client overran the connection flow-control window")
+	}
+	sc.recvWindow -= length
+
+	st := sc.streams[f.StreamID]
+	if st == nil || st.ended || length > st.recvWindow {
+		sc.recvCredit += length
+		update := sc.takeConnCreditLocked()
+		idle := st == nil && f.StreamID > sc.lastStreamID
+		sc.mu.Unlock()
+		sc.sendWindowUpdates(update, nil, 0)
+		switch {
+		case idle:
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", f.StreamID)
+		case st != nil && !st.ended:
+			return StreamError{StreamID: f.StreamID, Code: ErrCodeFlowControl, Reason: "client overran the stream flow-control window"}
+		}
+		return StreamError{StreamID: f.StreamID, Code: ErrCodeStreamClosed, Reason: "DATA on a closed stream"}
+	}
+
+	st.recvWindow -= length
+	if st.bodyClosed {
+		// Nobody is reading, so it all goes straight back.
+		sc.recvCredit += length
+		st.recvCredit += length
+	} else {
+		st.body.Write(f.Data)
+		padding := length - int64(len(f.Data))
+		sc.recvCredit += padding
+		st.recvCredit += padding
+	}
+	if f.Has(FlagEndStream) {
+		st.ended = true
+		sc.closeStreamIfDoneLocked(st)
+	}
+	sc.cond.Broadcast()
+	connUpdate := sc.takeConnCreditLocked()
+	streamUpdate := sc.takeStreamCreditLocked(st)
+	sc.mu.Unlock()
+
+	sc.sendWindowUpdates(connUpdate, st, streamUpdate)
+	return nil
+}
+
+func (sc *serverConn) takeConnCreditLocked() int64 {
+	if sc.recvCredit < initialWindowSize/2 {
+		return 0
+	}
+	n := sc.recvCredit
+	sc.recvCredit = 0
+	sc.recvWindow += n
+	return n
+}
+
+func (sc *serverConn) takeStreamCreditLocked(st *serverStream) int64 {
+	if st.ended || st.err != nil || st.recvCredit < initialWindowSize/2 {
+		return 0
+	}
+	n := st.recvCredit
+	st.recvCredit = 0
+	st.recvWindow += n
+	return n
+}
+
+func (sc *serverConn) sendWindowUpdates(connIncrement int64, st *serverStream, streamIncrement int64) {
+	if connIncrement > 0 {
+		sc.writeFrame(FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, uint32(connIncrement)))
+	}
+	if streamIncrement > 0 {
+		sc.writeFrame(FrameWindowUpdate, 0, st.id, binary.BigEndian.AppendUint32(nil, uint32(streamIncrement)))
+	}
+}
+
+func (sc *serverConn) handleWindowUpdate(f *WindowUpdateFrame) error {
+	increment := int64(f.Increment)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.StreamID == 0 {
+		if sc.sendWindow+increment > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection flow-control window overflow")
+		}
+		sc.sendWindow += increment
+		sc.cond.Broadcast()
+		return nil
+	}
+	st := sc.streams[f.StreamID]
+	if st == nil {
+		if f.StreamID > sc.lastStreamID {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE for idle stream %d", f.StreamID)
+		}
+		return nil
+	}
+	if st.sendWindow+increment > maxWindowSize {
+		return StreamError{StreamID: st.id, Code: ErrCodeFlowControl, Reason: "flow-control window overflow"}
+	}
+	st.sendWindow += increment
+	sc.cond.Broadcast()
+	return nil
+}
+
+// writeData sends data on st as DATA frames, waiting for flow control.
+func (sc *serverConn) writeData(st *serverStream, data []byte, endStream bool) error {
+	for len(data) > 0 {
+		sc.mu.Lock()
+		for sc.err == nil && st.err == nil && min(sc.sendWindow, st.sendWindow) <= 0 {
+			sc.cond.Wait()
+		}
+		if err := firstErr(sc.err, st.err); err != nil {
+			sc.mu.Unlock()
+			return err
+		}
+		n := min(int64(len(data)), sc.sendWindow, st.sendWindow, int64(sc.maxFrameSize))
+		sc.sendWindow -= n
+		st.sendWindow -= n
+		sc.mu.Unlock()
+
+		var flags uint8
+		if endStream && int(n) == len(data) {
+			flags = FlagEndStream
+		}
+		if err := sc.writeFrame(FrameData, flags, st.id, data[:n]); err != nil {
+			return err
+		}
+		if flags != 0 {
+			return nil
+		}
+		data = data[n:]
+	}
+	if endStream {
+		return sc.writeFrame(FrameData, FlagEndStream, st.id, nil)
+	}
+	return nil
+}
+
+// firstErr returns the first non-nil error.
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeaders encodes headers and sends them on st.
+func (sc *serverConn) writeHeaders(st *serverStream, headers []HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	if err := firstErr(sc.err, st.err); err != nil {
+		sc.mu.Unlock()
+		return err
+	}
+	maxFrameSize := int(sc.maxFrameSize)
+	sc.mu.Unlock()
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	block := sc.hpackEnc.Encode(headers)
+	if err := writeHeaderBlock(sc.conn, st.id, block, endStream, maxFrameSize); err != nil {
+		// The HPACK state is out of sync with the client now.
+		sc.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (sc *serverConn) writeFrame(frameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return WriteFrame(sc.conn, frameType, flags, streamID, payload)
+}
+
+// markSentEnd records that we've finished our side of st.
+func (sc *serverConn) markSentEnd(st *serverStream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.sentEnd = true
+	sc.closeStreamIfDoneLocked(st)
+}
+
+// closeStreamIfDoneLocked forgets st once both sides are done with it, and
+// closes the connection if it was the last stream after the final GOAWAY.
+func (sc *serverConn) closeStreamIfDoneLocked(st *serverStream) {
+	if !st.sentEnd || (!st.ended && st.err == nil) {
+		return
+	}
+	if sc.streams[st.id] == st {
+		delete(sc.streams, st.id)
+	}
+	if len(sc.streams) > 0 {
+		return
+	}
+	if sc.goAway {
+		sc.conn.Close()
+	} else if sc.idleTimer != nil {
+		sc.idleTimer.Reset(sc.srv.IdleTimeout)
+	}
+}
+
+// endStreamLocked fails st, which wakes up its handler if it's waiting for
+// the request body or flow control.
+func (sc *serverConn) endStreamLocked(st *serverStream, err error) {
+	if st.err == nil {
+		st.err = err
+	}
+	st.cancel()
+	sc.closeStreamIfDoneLocked(st)
+	sc.cond.Broadcast()
+}
+
+// resetStream ends st with RST_STREAM. A nil err means the response was
+// complete and only the rest of the request is being turned down.
+func (sc *serverConn) resetStream(st *serverStream, code uint32, err error) {
+	sc.mu.Lock()
+	alreadySent := st.sentEnd
+	st.sentEnd = true
+	if err == nil {
+		err = fmt.Errorf("stream %d reset: %s", st.id, ErrCodeName(code))
+		st.ended = true
+	}
+	sc.endStreamLocked(st, err)
+	sc.mu.Unlock()
+	if !alreadySent || code == ErrCodeNo {
+		sc.writeFrame(FrameRstStream, 0, st.id, binary.BigEndian.AppendUint32(nil, code))
+	}
+}
+
+// resetStreamID resets a stream by ID, whether or not we still track it.
+func (sc *serverConn) resetStreamID(id uint32, code uint32, err error) {
+	sc.mu.Lock()
+	st := sc.streams[id]
+	sc.mu.Unlock()
+	if st != nil {
+		sc.resetStream(st, code, err)
+		return
+	}
+	sc.writeFrame(FrameRstStream, 0, id, binary.BigEndian.AppendUint32(nil, code))
+}
+
+// startShutdown begins a graceful shutdown (RFC 9113 Section 6.8). The
+// first GOAWAY has the highest possible stream ID, since streams the client
+// is opening right now may still be on their way. The PING after it comes
+// back once the client has seen the GOAWAY, and then finishShutdown sends
+// the real last stream ID.
+func (sc *serverConn) startShutdown() {
+	sc.mu.Lock()
+	if !sc.started {
+		// Nothing has been served yet, and a GOAWAY can't be sent before
+		// the TLS handshake is done.
+		sc.mu.Unlock()
+		sc.conn.Close()
+		return
+	}
+	if sc.shuttingDown {
+		sc.mu.Unlock()
+		return
+	}
+	sc.shuttingDown = true
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, maxStreamID)
+	sc.writeFrame(FrameGoAway, 0, 0, binary.BigEndian.AppendUint32(payload, ErrCodeNo))
+	sc.writeFrame(FramePing, 0, 0, shutdownPing[:])
+}
+
+// finishShutdown sends the final GOAWAY. Streams up to lastStreamID are
+// served, anything newer is ignored, and the connection closes once the
+// last stream is done.
+func (sc *serverConn) finishShutdown() {
+	sc.mu.Lock()
+	if !sc.shuttingDown || sc.goAway {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goAway = true
+	last := sc.lastStreamID
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, last)
+	sc.writeFrame(FrameGoAway, 0, 0, binary.BigEndian.AppendUint32(payload, ErrCodeNo))
+
+	sc.mu.Lock()
+	if len(sc.streams) == 0 {
+		sc.conn.Close()
+	}
+	sc.mu.Unlock()
+}
+
+// closeIdle runs once the connection has had no streams for IdleTimeout.
+// It sends GOAWAY with the last stream ID, so the client knows nothing it
+// sent was dropped, and closes the connection.
+func (sc *serverConn) closeIdle() {
+	sc.mu.Lock()
+	if len(sc.streams) > 0 || sc.goAway || sc.err != nil {
+		// A stream started as the timer fired.
+		sc.mu.Unlock()
+		return
+	}
+	sc.goAway = true
+	last := sc.lastStreamID
+	sc.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, last)
+	sc.writeFrame(FrameGoAway, 0, 0, binary.BigEndian.AppendUint32(payload, ErrCodeNo))
+	sc.conn.Close()
+}
+
+// fail marks the connection as unusable and fails every open stream.
+func (sc *serverConn) fail(err error) {
+	sc.conn.Close()
+	sc.cancel()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.idleTimer != nil {
+		sc.idleTimer.Stop()
+	}
+	if sc.err == nil {
+		sc.err = fmt.Errorf("connection closed: %w", err)
+	}
+	for _, st := range sc.streams {
+		sc.endStreamLocked(st, sc.err)
+	}
+	sc.cond.Broadcast()
+}
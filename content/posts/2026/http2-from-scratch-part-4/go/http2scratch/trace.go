@@ -0,0 +1,290 @@
+package http2scratch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Peer is one side of a connection.
+type Peer int
+
+const (
+	PeerClient Peer = iota
+	PeerServer
+)
+
+func (p Peer) String() string {
+	if p == PeerClient {
+		return "client"
+	}
+	return "server"
+}
+
+// Other returns the peer at the other end of the connection.
+func (p Peer) Other() Peer {
+	return 1 - p
+}
+
+// Tracer watches a connection frame by frame. The client calls it for
+// every frame it sends or receives, and h2dump for every frame in a
+// capture. Each peer's frames arrive in order, but the two directions can
+// be reported at the same time, so a Tracer must be safe for concurrent
+// use.
+type Tracer interface {
+	// Frame is called for each frame. CONTINUATION frames are already
+	// merged into the HEADERS or PUSH_PROMISE frame before them.
+	Frame(from Peer, f TypedFrame)
+	// Headers is called once the header block of a HEADERS or
+	// PUSH_PROMISE frame has been decoded. table is the sender's HPACK
+	// dynamic table after the block, which the receiver's mirrors. It's
+	// only valid during the call.
+	Headers(from Peer, streamID uint32, fields []HeaderField, table *DynamicTable)
+}
+
+var frameTypeNames = map[uint8]string{
+	FrameData:         "DATA",
+	FrameHeaders:      "HEADERS",
+	FramePriority:     "PRIORITY",
+	FrameRstStream:    "RST_STREAM",
+	FrameSettings:     "SETTINGS",
+	FramePushPromise:  "PUSH_PROMISE",
+	FramePing:         "PING",
+	FrameGoAway:       "GOAWAY",
+	FrameWindowUpdate: "WINDOW_UPDATE",
+	FrameContinuation: "CONTINUATION",
+}
+
+// FrameTypeName returns the name RFC 9113 gives a frame type.
+func FrameTypeName(t uint8) string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(0x%x)", t)
+}
+
+var settingNames = map[uint16]string{
+	SettingsHeaderTableSize:       "HEADER_TABLE_SIZE",
+	SettingsEnablePush:            "ENABLE_PUSH",
+	SettingsMaxConcurrentStreams:  "MAX_CONCURRENT_STREAMS",
+	SettingsInitialWindowSize:     "INITIAL_WINDOW_SIZE",
+	SettingsMaxFrameSize:          "MAX_FRAME_SIZE",
+	SettingsMaxHeaderListSize:     "MAX_HEADER_LIST_SIZE",
+	SettingsEnableConnectProtocol: "ENABLE_CONNECT_PROTOCOL",
+}
+
+// SettingName returns the name RFC 9113 gives a setting.
+func SettingName(id uint16) string {
+	if name, ok := settingNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(0x%x)", id)
+}
+
+// flagNames returns the names of the flags set on a frame. The same bit
+// means different things depending on the frame type.
+func flagNames(h FrameHeader) string {
+	type flag struct {
+		bit  uint8
+		name string
+	}
+	var flags []flag
+	switch h.Type {
+	case FrameSettings, FramePing:
+		flags = []flag{{FlagAck, "ACK"}}
+	case FrameData:
+		flags = []flag{{FlagEndStream, "END_STREAM"}, {FlagPadded, "PADDED"}}
+	case FrameHeaders:
+		flags = []flag{{FlagEndStream, "END_STREAM"}, {FlagEndHeaders, "END_HEADERS"}, {FlagPadded, "PADDED"}, {FlagPriority, "PRIORITY"}}
+	case FramePushPromise:
+		flags = []flag{{FlagEndHeaders, "END_HEADERS"}, {FlagPadded, "PADDED"}}
+	case FrameContinuation:
+		flags = []flag{{FlagEndHeaders, "END_HEADERS"}}
+	}
+	var names []string
+	for _, f := range flags {
+		if h.Has(f.bit) {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, "|")
+}
+
+// FramePrinter is a Tracer that writes every frame out in a readable form:
+// names instead of numbers, decoded SETTINGS and header blocks, the HPACK
+// dynamic table after each block and the flow-control windows after every
+// DATA and WINDOW_UPDATE frame. It keeps the window accounting itself, from
+// the frames it sees, so it needs to see all of them.
+type FramePrinter struct {
+	// Prefix starts every line, e.g. to tell connections apart.
+	Prefix string
+
+	mu sync.Mutex
+	w  io.Writer
+	// initialWindow is the window each peer's streams start with, which is
+	// the INITIAL_WINDOW_SIZE the other peer sent.
+	initialWindow [2]int64
+	connWindow    [2]int64 // what each peer may still send on the connection
+	streams       map[uint32]*tracedStream
+}
+
+// tracedStream is the flow-control state of an open stream, indexed by
+// the peer sending.
+type tracedStream struct {
+	window [2]int64
+	ended  [2]bool
+}
+
+func NewFramePrinter(w io.Writer) *FramePrinter {
+	return &FramePrinter{
+		w:             w,
+		initialWindow: [2]int64{initialWindowSize, initialWindowSize},
+		connWindow:    [2]int64{initialWindowSize, initialWindowSize},
+		streams:       make(map[uint32]*tracedStream),
+	}
+}
+
+// Frame prints f, followed by its details on indented lines.
+func (p *FramePrinter) Frame(from Peer, f TypedFrame) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var b bytes.Buffer
+	h := f.Header()
+	fmt.Fprintf(&b, "%s%s → %s  %s stream=%d len=%d flags=%s\n",
+		p.Prefix, from, from.Other(), FrameTypeName(h.Type), h.StreamID, h.Length, flagNames(h))
+
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, "%s    "+format+"\n", append([]any{p.Prefix}, args...)...)
+	}
+	switch f := f.(type) {
+	case *DataFrame:
+		p.consume(from, h.StreamID, int64(h.Length))
+		line("%d bytes of data", len(f.Data))
+		line("%s send window: connection %d, stream %d", from, p.connWindow[from], p.streamWindow(from, h.StreamID))
+	case *HeadersFrame:
+		if f.Priority != nil {
+			line("priority: depends on %d, weight %d, exclusive %t", f.Priority.StreamDep, int(f.Priority.Weight)+1, f.Priority.Exclusive)
+		}
+		line("%d byte header block", len(f.HeaderBlock))
+	case *PriorityFrame:
+		line("depends on %d, weight %d, exclusive %t", f.StreamDep, int(f.Weight)+1, f.Exclusive)
+	case *RSTStreamFrame:
+		line("error: %s", ErrCodeName(f.ErrCode))
+		delete(p.streams, h.StreamID)
+	case *SettingsFrame:
+		for _, s := range f.Settings {
+			line("%s = %d", SettingName(s.ID), s.Value)
+			if s.ID == SettingsInitialWindowSize {
+				p.setInitialWindow(from.Other(), int64(s.Value))
+			}
+		}
+	case *PushPromiseFrame:
+		line("promised stream %d, %d byte header block", f.PromisedStreamID, len(f.HeaderBlock))
+	case *PingFrame:
+		line("data: %x", f.Data)
+	case *GoAwayFrame:
+		line("last stream %d, error: %s", f.LastStreamID, ErrCodeName(f.ErrCode))
+		if len(f.DebugData) > 0 {
+			line("debug data: %q", f.DebugData)
+		}
+	case *WindowUpdateFrame:
+		// The update is for the windows of the peer on the other end.
+		to := from.Other()
+		if h.StreamID == 0 {
+			p.connWindow[to] += int64(f.Increment)
+			line("+%d, %s send window: connection %d", f.Increment, to, p.connWindow[to])
+		} else {
+			if s := p.streams[h.StreamID]; s != nil {
+				s.window[to] += int64(f.Increment)
+			}
+			line("+%d, %s send window: stream %d", f.Increment, to, p.streamWindow(to, h.StreamID))
+		}
+	case *UnknownFrame:
+		line("%d byte payload", len(f.Payload))
+	}
+
+	if h.Type == FrameHeaders || h.Type == FrameData {
+		p.trackStream(from, h)
+	}
+	p.w.Write(b.Bytes())
+}
+
+// Headers prints the decoded header block and the dynamic table after it.
+func (p *FramePrinter) Headers(from Peer, streamID uint32, fields []HeaderField, table *DynamicTable) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var b bytes.Buffer
+	for _, f := range fields {
+		fmt.Fprintf(&b, "%s    %s: %s\n", p.Prefix, f.Name, f.Value)
+	}
+	fmt.Fprintf(&b, "%s    %s dynamic table: %d entries, %d/%d bytes\n", p.Prefix, from, table.Len(), table.Size(), table.MaxSize())
+	for i := range table.Len() {
+		f, _ := table.At(i)
+		fmt.Fprintf(&b, "%s      [%d] %s: %s\n", p.Prefix, len(StaticTable)+1+i, f.Name, f.Value)
+	}
+	p.w.Write(b.Bytes())
+}
+
+// Printf writes a line that isn't about a frame, such as a note on where
+// a capture came from.
+func (p *FramePrinter) Printf(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.w, "%s"+format+"\n", append([]any{p.Prefix}, args...)...)
+}
+
+// consume takes n bytes of DATA sent by from out of its windows.
+func (p *FramePrinter) consume(from Peer, streamID uint32, n int64) {
+	p.connWindow[from] -= n
+	if s := p.stream(streamID); s != nil {
+		s.window[from] -= n
+	}
+}
+
+// trackStream notes END_STREAM, and forgets the stream once both sides
+// have ended it.
+func (p *FramePrinter) trackStream(from Peer, h FrameHeader) {
+	s := p.stream(h.StreamID)
+	if s == nil || !h.Has(FlagEndStream) {
+		return
+	}
+	s.ended[from] = true
+	if s.ended[PeerClient] && s.ended[PeerServer] {
+		delete(p.streams, h.StreamID)
+	}
+}
+
+// stream returns the state of a stream, starting to track it if it's new.
+func (p *FramePrinter) stream(id uint32) *tracedStream {
+	if id == 0 {
+		return nil
+	}
+	s, ok := p.streams[id]
+	if !ok {
+		s = &tracedStream{window: p.initialWindow}
+		p.streams[id] = s
+	}
+	return s
+}
+
+func (p *FramePrinter) streamWindow(from Peer, id uint32) int64 {
+	if s := p.streams[id]; s != nil {
+		return s.window[from]
+	}
+	return p.initialWindow[from]
+}
+
+// setInitialWindow applies a new INITIAL_WINDOW_SIZE to the streams of
+// peer, including the ones already open (RFC 9113 Section 6.9.2).
+func (p *FramePrinter) setInitialWindow(peer Peer, size int64) {
+	delta := size - p.initialWindow[peer]
+	p.initialWindow[peer] = size
+	for _, s := range p.streams {
+		s.window[peer] += delta
+	}
+}
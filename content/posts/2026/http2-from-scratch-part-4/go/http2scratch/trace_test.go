@@ -0,0 +1,109 @@
+package http2scratch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDumpStream(t *testing.T) {
+	// What a client sends for a small POST, with a SETTINGS frame that
+	// changes the server's window and a header block split in two.
+	var capture bytes.Buffer
+	capture.WriteString(Preface)
+	WriteFrame(&capture, FrameSettings, 0, 0, []byte{0, 4, 0, 1, 0, 0})
+	enc := NewHPACKEncoder(headerTableSize)
+	block := enc.Encode([]HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/upload"},
+	})
+	WriteFrame(&capture, FrameHeaders, 0, 1, block[:5])
+	WriteFrame(&capture, FrameContinuation, FlagEndHeaders, 1, block[5:])
+	WriteFrame(&capture, FrameData, FlagEndStream, 1, []byte("hello"))
+	WriteFrame(&capture, FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, 1000))
+
+	var out bytes.Buffer
+	if err := DumpStream(&capture, PeerClient, NewFramePrinter(&out)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"client → server  connection preface",
+		"client → server  SETTINGS stream=0 len=6 flags=-",
+		"    INITIAL_WINDOW_SIZE = 65536",
+		"client → server  HEADERS stream=1 len=5 flags=END_HEADERS",
+		"    " + strconv.Itoa(len(block)) + " byte header block",
+		"    :authority: example.com",
+		"    client dynamic table: 2 entries, 97/4096 bytes",
+		"      [62] :path: /upload",
+		"      [63] :authority: example.com",
+		"client → server  DATA stream=1 len=5 flags=END_STREAM",
+		"    client send window: connection 65530, stream 65530",
+		"    +1000, server send window: connection 66535",
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("output is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// recordingTracer keeps what it's told.
+type recordingTracer struct {
+	mu      sync.Mutex
+	frames  map[Peer][]uint8
+	headers map[Peer][]HeaderField
+}
+
+func (r *recordingTracer) Frame(from Peer, f TypedFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames[from] = append(r.frames[from], f.Header().Type)
+}
+
+func (r *recordingTracer) Headers(from Peer, streamID uint32, fields []HeaderField, table *DynamicTable) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.headers[from] = append(r.headers[from], fields...)
+}
+
+func TestClientTracer(t *testing.T) {
+	ts, client, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}), 0)
+	tracer := &recordingTracer{frames: make(map[Peer][]uint8), headers: make(map[Peer][]HeaderField)}
+	client.Tracer = tracer
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/echo", strings.NewReader("hello"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if got := tracer.frames[PeerClient]; len(got) == 0 || got[0] != FrameSettings {
+		t.Errorf("client frames %v don't start with SETTINGS", got)
+	}
+	for _, want := range []uint8{FrameHeaders, FrameData} {
+		if !bytes.Contains(tracer.frames[PeerClient], []byte{want}) {
+			t.Errorf("client frames %v are missing %s", tracer.frames[PeerClient], FrameTypeName(want))
+		}
+		if !bytes.Contains(tracer.frames[PeerServer], []byte{want}) {
+			t.Errorf("server frames %v are missing %s", tracer.frames[PeerServer], FrameTypeName(want))
+		}
+	}
+	if h := tracer.headers[PeerClient]; len(h) == 0 || h[0] != (HeaderField{Name: ":method", Value: "POST"}) {
+		t.Errorf("client headers %v don't start with :method POST", h)
+	}
+	if h := tracer.headers[PeerServer]; len(h) == 0 || h[0] != (HeaderField{Name: ":status", Value: "200"}) {
+		t.Errorf("server headers %v don't start with :status 200", h)
+	}
+}
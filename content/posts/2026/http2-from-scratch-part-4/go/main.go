@@ -1,32 +1,79 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"sync"
+
+	"github.com/sudorandom/kmcd.dev/http2-from-scratch/http2scratch"
 )
 
 func main() {
-	client := NewClient()
+	serve := flag.String("serve", "", "run the HTTP/2 server on this address instead of the client, e.g. 127.0.0.1:9000")
+	certFile := flag.String("cert", "", "TLS certificate for -serve; without one the server speaks h2c")
+	keyFile := flag.String("key", "", "TLS key for -serve")
+	trace := flag.Bool("trace", true, "print every frame the client sends and receives")
+	flag.Parse()
 
-	req, err := http.NewRequest("GET", "https://kmcd.dev/", nil)
-	if err != nil {
-		log.Fatalf("Failed to create request: %v", err)
+	if *serve != "" {
+		runServer(*serve, *certFile, *keyFile)
+		return
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("Failed to execute request: %v", err)
+	client := http2scratch.NewClient()
+	defer client.Close()
+	if *trace {
+		client.Tracer = http2scratch.NewFramePrinter(os.Stdout)
 	}
-	defer resp.Body.Close()
 
-	fmt.Printf("Protocol: %s\n", resp.Proto)
+	// These all share one connection, each on its own stream.
+	paths := []string{"/", "/posts/", "/about/"}
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "https://kmcd.dev"+path, nil)
+			if err != nil {
+				log.Fatalf("Failed to create request: %v", err)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				log.Fatalf("Failed to read body: %v", err)
+			}
+			fmt.Printf("%s: %s %s, %d bytes\n", path, resp.Proto, resp.Status, len(body))
+		}()
+	}
+	wg.Wait()
+}
 
-	fmt.Println("Response Status:", resp.Status)
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("Failed to read body: %v", err)
+// runServer serves a small echo handler, e.g. for
+// curl --http2-prior-knowledge http://127.0.0.1:9000/hello
+func runServer(addr, certFile, keyFile string) {
+	s := &http2scratch.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+			for name, values := range r.Header {
+				fmt.Fprintf(w, "%s: %v\n", name, values)
+			}
+		}),
+	}
+	if certFile != "" || keyFile != "" {
+		log.Printf("Starting HTTP/2 server: https://%s", addr)
+		log.Fatal(s.ListenAndServeTLS(certFile, keyFile))
 	}
-	fmt.Printf("Response Body: %s\n", string(body))
+	log.Printf("Starting HTTP/2 server (h2c): http://%s", addr)
+	log.Fatal(s.ListenAndServe())
 }